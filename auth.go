@@ -0,0 +1,213 @@
+package contman
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DockerHubRegistry is the registry of images named without a registry host
+const DockerHubRegistry = "docker.io"
+
+// dockerHubServer is the address docker CLI keeps Docker Hub credentials
+// under
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// AuthConfig holds credentials for a registry, all fields are empty for
+// anonymous access
+type AuthConfig struct {
+	Username string
+	Password string
+	// IdentityToken is an OAuth refresh token used instead of Password
+	IdentityToken string
+	// RegistryToken is a bearer token sent to the registry as is
+	RegistryToken string
+}
+
+// AuthProvider looks up credentials for a registry host, e.g.
+// "registry.example.com:5000" or DockerHubRegistry. Registries without
+// credentials get empty AuthConfig and no error.
+type AuthProvider interface {
+	GetAuth(ctx context.Context, registry string) (AuthConfig, error)
+}
+
+// AuthProviderFunc is a function implementing AuthProvider
+type AuthProviderFunc func(ctx context.Context, registry string) (AuthConfig, error)
+
+func (f AuthProviderFunc) GetAuth(ctx context.Context, registry string) (AuthConfig, error) {
+	return f(ctx, registry)
+}
+
+// StaticAuth maps registries to credentials set programmatically, keys are
+// normalized as by NormalizeRegistry
+type StaticAuth map[string]AuthConfig
+
+func (a StaticAuth) GetAuth(ctx context.Context, registry string) (AuthConfig, error) {
+	registry = NormalizeRegistry(registry)
+	for key, auth := range a {
+		if NormalizeRegistry(key) == registry {
+			return auth, nil
+		}
+	}
+	return AuthConfig{}, nil
+}
+
+// AuthChain returns credentials of the first provider having them
+type AuthChain []AuthProvider
+
+func (c AuthChain) GetAuth(ctx context.Context, registry string) (AuthConfig, error) {
+	for _, provider := range c {
+		auth, err := provider.GetAuth(ctx, registry)
+		if err != nil || auth != (AuthConfig{}) {
+			return auth, err
+		}
+	}
+	return AuthConfig{}, nil
+}
+
+// NormalizeRegistry turns server addresses used in docker config into
+// registry hosts, aliases of Docker Hub become DockerHubRegistry
+func NormalizeRegistry(server string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	if i := strings.IndexRune(host, '/'); i >= 0 {
+		host = host[:i]
+	}
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return DockerHubRegistry
+	}
+	return host
+}
+
+// DockerConfigAuth reads credentials the way docker CLI does. Credential
+// helpers of credHelpers and credsStore of config.json are run as
+// docker-credential-<name> binaries, credentials of auths are used for
+// registries the helpers know nothing about.
+type DockerConfigAuth struct {
+	// Dir is directory of config.json, DOCKER_CONFIG or ~/.docker when empty
+	Dir string
+}
+
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+func (a DockerConfigAuth) GetAuth(ctx context.Context, registry string) (AuthConfig, error) {
+	dir := a.Dir
+	if dir == "" {
+		dir = os.Getenv("DOCKER_CONFIG")
+	}
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".docker")
+	}
+
+	var config dockerConfig
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return AuthConfig{}, nil
+	}
+	if err != nil {
+		return AuthConfig{}, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return AuthConfig{}, fmt.Errorf("docker config %s: %w", dir, err)
+	}
+
+	registry = NormalizeRegistry(registry)
+	helper := config.CredsStore
+	for server, name := range config.CredHelpers {
+		if NormalizeRegistry(server) == registry {
+			helper = name
+		}
+	}
+	if helper != "" {
+		server := registry
+		if registry == DockerHubRegistry {
+			server = dockerHubServer
+		}
+		auth, err := runCredentialHelper(ctx, helper, server)
+		if err != nil || auth != (AuthConfig{}) {
+			return auth, err
+		}
+	}
+
+	for server, entry := range config.Auths {
+		if NormalizeRegistry(server) == registry {
+			return entry.authConfig()
+		}
+	}
+	return AuthConfig{}, nil
+}
+
+func (e dockerAuth) authConfig() (AuthConfig, error) {
+	auth := AuthConfig{
+		Username:      e.Username,
+		Password:      e.Password,
+		IdentityToken: e.IdentityToken,
+		RegistryToken: e.RegistryToken,
+	}
+	if e.Auth == "" {
+		return auth, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(e.Auth)
+	if err != nil {
+		return AuthConfig{}, fmt.Errorf("invalid auth of docker config: %w", err)
+	}
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return AuthConfig{}, fmt.Errorf("invalid auth of docker config")
+	}
+	auth.Username, auth.Password = parts[0], parts[1]
+	return auth, nil
+}
+
+// credentialsNotFound is printed by credential helpers for servers they
+// have no credentials for
+const credentialsNotFound = "credentials not found in native keychain"
+
+// runCredentialHelper gets credentials for server from
+// docker-credential-<helper>, username "<token>" means the secret is an
+// identity token
+func runCredentialHelper(ctx context.Context, helper, server string) (AuthConfig, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.TrimSpace(stdout.String()) == credentialsNotFound {
+			return AuthConfig{}, nil
+		}
+		return AuthConfig{}, fmt.Errorf("credential helper %s: %w: %s", helper, err, strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return AuthConfig{}, fmt.Errorf("credential helper %s: %w", helper, err)
+	}
+	if creds.Username == "<token>" {
+		return AuthConfig{IdentityToken: creds.Secret}, nil
+	}
+	return AuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+}
@@ -0,0 +1,113 @@
+package contman_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elemir/contman"
+)
+
+// TestMain turns the test binary into a fake credential helper when it is
+// run as docker-credential-<name>, credentials of helpers are taken from
+// CONTMAN_FAKE_CREDENTIALS
+func TestMain(m *testing.M) {
+	if name := filepath.Base(os.Args[0]); strings.HasPrefix(name, "docker-credential-") {
+		os.Exit(fakeCredentialHelper(strings.TrimPrefix(name, "docker-credential-"), os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+type fakeCredentials struct {
+	Username string
+	Secret   string
+}
+
+func fakeCredentialHelper(helper string, args []string) int {
+	if len(args) != 1 || args[0] != "get" {
+		return 2
+	}
+	server, _ := ioutil.ReadAll(os.Stdin)
+	var helpers map[string]map[string]fakeCredentials
+	json.Unmarshal([]byte(os.Getenv("CONTMAN_FAKE_CREDENTIALS")), &helpers)
+	creds, ok := helpers[helper][string(server)]
+	if !ok {
+		fmt.Println("credentials not found in native keychain")
+		return 1
+	}
+	json.NewEncoder(os.Stdout).Encode(map[string]string{"ServerURL": string(server), "Username": creds.Username, "Secret": creds.Secret})
+	return 0
+}
+
+func TestDockerConfigAuth(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, helper := range []string{"desktop", "ecr"} {
+		if err := os.Symlink(self, filepath.Join(dir, "docker-credential-"+helper)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	creds, _ := json.Marshal(map[string]map[string]fakeCredentials{
+		"desktop": {"https://index.docker.io/v1/": {"hub", "hub-password"}},
+		"ecr":     {"123.dkr.ecr.example.com": {"<token>", "refresh-token"}},
+	})
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	defer os.Setenv("CONTMAN_FAKE_CREDENTIALS", os.Getenv("CONTMAN_FAKE_CREDENTIALS"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.Setenv("CONTMAN_FAKE_CREDENTIALS", string(creds))
+
+	config := `{
+  "credsStore": "desktop",
+  "credHelpers": {"123.dkr.ecr.example.com": "ecr", "broken.example.com": "missing"},
+  "auths": {
+    "https://registry.example.com/v2/": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("ci:secret")) + `"},
+    "tokens.example.com": {"identitytoken": "token"}
+  }
+}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	provider := contman.DockerConfigAuth{Dir: dir}
+	for registry, expected := range map[string]contman.AuthConfig{
+		"docker.io":               {Username: "hub", Password: "hub-password"},
+		"index.docker.io":         {Username: "hub", Password: "hub-password"},
+		"123.dkr.ecr.example.com": {IdentityToken: "refresh-token"},
+		"registry.example.com":    {Username: "ci", Password: "secret"},
+		"tokens.example.com":      {IdentityToken: "token"},
+		"unknown.example.com":     {},
+	} {
+		auth, err := provider.GetAuth(ctx, registry)
+		if err != nil || auth != expected {
+			t.Errorf("Unexpected credentials for %s: %+v, %v", registry, auth, err)
+		}
+	}
+	if _, err := provider.GetAuth(ctx, "broken.example.com"); err == nil {
+		t.Error("Missing credential helper is ignored")
+	}
+
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	os.Setenv("DOCKER_CONFIG", dir)
+	chain := contman.AuthChain{
+		contman.StaticAuth{"https://registry.example.com": {Username: "deploy", Password: "deploy-password"}},
+		contman.DockerConfigAuth{},
+	}
+	if auth, _ := chain.GetAuth(ctx, "registry.example.com"); auth.Username != "deploy" {
+		t.Errorf("Static credentials are not used: %+v", auth)
+	}
+	if auth, _ := chain.GetAuth(ctx, "docker.io"); auth.Username != "hub" {
+		t.Errorf("Docker config is not used: %+v", auth)
+	}
+}
@@ -0,0 +1,41 @@
+package contman
+
+import "context"
+
+// BuildSpec describes image built from a Dockerfile
+type BuildSpec struct {
+	// Context is host directory sent to the builder, relative one is
+	// resolved against HostDir of receipt
+	Context string `receipt:"context"`
+	// Dockerfile is path relative to Context, Dockerfile when empty
+	Dockerfile string            `receipt:"dockerfile"`
+	Args       map[string]string `receipt:"args"`
+	// Target is stage of multi-stage Dockerfile to build, the last one when
+	// empty
+	Target string   `receipt:"target"`
+	Tags   []string `receipt:"tags"`
+	// Ignore is path of dockerignore file relative to Context, .dockerignore
+	// is used when empty. Dockerfile and the ignore file are always sent.
+	Ignore string `receipt:"ignore"`
+	// Events, if set, receives build output, which is logged at debug level
+	// otherwise
+	Events func(BuildEvent)
+}
+
+// BuildEvent is a message streamed by the builder
+type BuildEvent struct {
+	// Stream is output of the build, e.g. of a RUN instruction
+	Stream string
+	// Status is progress of pulling base image layer ID
+	Status string
+	ID     string
+	// ImageID is set once the image is built
+	ImageID string
+}
+
+// ImageBuilder is implemented by managers able to build images
+type ImageBuilder interface {
+	// BuildImage builds image and returns its ID, failed build is reported
+	// as error with the message of the builder
+	BuildImage(ctx context.Context, spec BuildSpec) (string, error)
+}
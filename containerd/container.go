@@ -0,0 +1,384 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	eventsapi "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/continuity/fs"
+	"github.com/containerd/typeurl/v2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/archive"
+	"github.com/elemir/contman/internal/cgroups"
+	"github.com/elemir/contman/internal/stream"
+)
+
+const (
+	// killedExitCode is exit code of processes killed by SIGKILL
+	killedExitCode = 128 + 9
+	// oomEventTimeout limits waiting for TaskOOM event of a killed process,
+	// it is delivered independently of the exit status
+	oomEventTimeout = 500 * time.Millisecond
+)
+
+type ContainerdContainer struct {
+	manager   *ContainerdManager
+	container containerd.Container
+	hostDir   string
+	// secretsDir keeps secret files mounted into the container
+	secretsDir string
+
+	task     containerd.Task
+	exitCh   <-chan containerd.ExitStatus
+	stdout   *stream.DeferredWriter
+	stderr   *stream.DeferredWriter
+	execs    int
+	execsMtx sync.Mutex
+	// oom is notified by TaskOOM events until stopWatch is called
+	oom       *cgroups.OOMNotifier
+	stopWatch context.CancelFunc
+}
+
+func (cc *ContainerdContainer) ID() string {
+	return cc.container.ID()
+}
+
+func (cc *ContainerdContainer) ImageDigest(ctx context.Context) (string, error) {
+	image, err := cc.container.Image(ctx)
+	if err != nil {
+		return "", err
+	}
+	return image.Target().Digest.String(), nil
+}
+
+func (cc *ContainerdContainer) Start(ctx context.Context) error {
+	task, err := cc.container.NewTask(ctx, cio.NewCreator(cio.WithStreams(nil, cc.stdout, cc.stderr)))
+	if err != nil {
+		cc.GetLogger().WithError(err).Error("Error creating task")
+		return err
+	}
+
+	// Exit status is only delivered to waiters subscribed before start
+	exitCh, err := task.Wait(context.Background())
+	if err != nil {
+		cc.GetLogger().WithError(err).Error("Error waiting task")
+		_, _ = task.Delete(ctx)
+		return err
+	}
+
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	cc.oom = cgroups.NewOOMNotifier()
+	go cc.watchOOM(watchCtx)
+
+	if err := task.Start(ctx); err != nil {
+		cc.GetLogger().WithError(err).Error("Error starting container")
+		stopWatch()
+		_, _ = task.Delete(ctx)
+		return err
+	}
+
+	cc.task = task
+	cc.stopWatch = stopWatch
+	cc.exitCh = exitCh
+	return nil
+}
+
+// watchOOM notifies cc.oom about TaskOOM events of the container
+func (cc *ContainerdContainer) watchOOM(ctx context.Context) {
+	filter := fmt.Sprintf(`topic=="/tasks/oom",namespace==%q`, cc.manager.namespace)
+	events, errs := cc.manager.client.Subscribe(ctx, filter)
+	for {
+		select {
+		case envelope := <-events:
+			event, err := typeurl.UnmarshalAny(envelope.Event)
+			if err != nil {
+				cc.GetLogger().WithError(err).Debug("Cannot decode event")
+				continue
+			}
+			if oom, ok := event.(*eventsapi.TaskOOM); ok && oom.ContainerID == cc.ID() {
+				cc.oom.Notify()
+			}
+		case err := <-errs:
+			if err != nil && ctx.Err() == nil {
+				cc.GetLogger().WithError(err).Warn("Cannot watch OOM events")
+			}
+			return
+		}
+	}
+}
+
+// exitError returns *contman.ExitError for processes killed by OOM killer
+func (cc *ContainerdContainer) exitError(code int) (int, error) {
+	if code == killedExitCode && cc.oom != nil && cc.oom.Killed(oomEventTimeout) {
+		return code, &contman.ExitError{ContainerID: cc.ID(), Code: code, OOMKilled: true}
+	}
+	return code, nil
+}
+
+func (cc *ContainerdContainer) Stop(ctx context.Context, timeout time.Duration) error {
+	if cc.task == nil {
+		return nil
+	}
+
+	if err := cc.task.Kill(ctx, syscall.SIGTERM); err != nil && !errdefs.IsNotFound(err) {
+		cc.GetLogger().WithError(err).Error("Error stopping container")
+		return err
+	}
+
+	select {
+	case <-cc.exitCh:
+		return nil
+	case <-time.After(timeout):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return cc.Kill(ctx)
+}
+
+func (cc *ContainerdContainer) Kill(ctx context.Context) error {
+	if cc.task == nil {
+		return nil
+	}
+
+	err := cc.task.Kill(ctx, syscall.SIGKILL)
+	if err != nil && !errdefs.IsNotFound(err) {
+		cc.GetLogger().WithError(err).Error("Error killing container")
+		return err
+	}
+	return nil
+}
+
+func (cc *ContainerdContainer) Remove(ctx context.Context) error {
+	if cc.stopWatch != nil {
+		cc.stopWatch()
+	}
+	if cc.task != nil {
+		if _, err := cc.task.Delete(ctx); err != nil && !errdefs.IsNotFound(err) {
+			cc.GetLogger().WithError(err).Error("Error deleting task")
+			return err
+		}
+		cc.task = nil
+	}
+
+	err := cc.container.Delete(ctx, containerd.WithSnapshotCleanup)
+	if err != nil {
+		cc.GetLogger().WithError(err).Errorf("Error removing container")
+		return err
+	}
+	return os.RemoveAll(cc.secretsDir)
+}
+
+func (cc *ContainerdContainer) IsRunning(ctx context.Context) (bool, error) {
+	if cc.task == nil {
+		return false, nil
+	}
+
+	status, err := cc.task.Status(ctx)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		cc.GetLogger().WithError(err).Errorf("Error checking container running status")
+		return false, err
+	}
+	return status.Status == containerd.Running, nil
+}
+
+func (cc *ContainerdContainer) Wait(ctx context.Context, stdout, stderr io.Writer) (int, error) {
+	if cc.task == nil {
+		return 0, fmt.Errorf("container %s is not started", cc.ID())
+	}
+
+	cc.stdout.Attach(stdout)
+	cc.stderr.Attach(stderr)
+
+	select {
+	case status := <-cc.exitCh:
+		code, _, err := status.Result()
+		if err != nil {
+			cc.GetLogger().WithError(err).Error("Error waiting container")
+			return 0, err
+		}
+		// Drain task output before returning
+		cc.task.IO().Wait()
+		if _, err := cc.task.Delete(ctx); err == nil {
+			cc.task = nil
+		}
+		return cc.exitError(int(code))
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (cc *ContainerdContainer) Exec(ctx context.Context, config contman.ExecConfig) (int, error) {
+	l := cc.GetLogger().WithField("cmd", config.Cmd)
+	if cc.task == nil {
+		return 0, fmt.Errorf("container %s is not started", cc.ID())
+	}
+
+	spec, err := cc.container.Spec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	pspec := *spec.Process
+	pspec.Args = []string{"sh", "-c", config.Cmd}
+	pspec.Env = append(append([]string(nil), pspec.Env...), formatEnv(config.Env)...)
+	if config.WorkingDir != "" {
+		pspec.Cwd = config.WorkingDir
+	}
+
+	cc.execsMtx.Lock()
+	cc.execs++
+	execID := fmt.Sprintf("exec-%d", cc.execs)
+	cc.execsMtx.Unlock()
+
+	process, err := cc.task.Exec(ctx, execID, &pspec, cio.NewCreator(cio.WithStreams(nil, orDiscard(config.Stdout), orDiscard(config.Stderr))))
+	if err != nil {
+		l.WithError(err).Error("Error creating exec")
+		return 0, err
+	}
+	defer func() { _, _ = process.Delete(context.Background()) }()
+
+	exitCh, err := process.Wait(ctx)
+	if err != nil {
+		l.WithError(err).Error("Error waiting exec")
+		return 0, err
+	}
+	if err := process.Start(ctx); err != nil {
+		l.WithError(err).Error("Error starting exec")
+		return 0, err
+	}
+
+	select {
+	case status := <-exitCh:
+		code, _, err := status.Result()
+		if err != nil {
+			return 0, err
+		}
+		// Wait for copying of exec output to finish
+		process.IO().Wait()
+		return cc.exitError(int(code))
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// withRootfs calls f with root of the container. Snapshot of a running task
+// is mounted by its shim already, mounting it once more while the task writes
+// into it may corrupt it, so root of the task process is used instead. The
+// snapshot is mounted only once the task has exited.
+func (cc *ContainerdContainer) withRootfs(ctx context.Context, f func(root string) error) error {
+	if cc.task != nil {
+		status, err := cc.task.Status(ctx)
+		if err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+		switch status.Status {
+		case containerd.Running, containerd.Paused, containerd.Pausing:
+			return f(fmt.Sprintf("/proc/%d/root", cc.task.Pid()))
+		}
+	}
+
+	info, err := cc.container.Info(ctx)
+	if err != nil {
+		return err
+	}
+
+	mounts, err := cc.manager.client.SnapshotService(info.Snapshotter).Mounts(ctx, info.SnapshotKey)
+	if err != nil {
+		return err
+	}
+
+	return mount.WithTempMount(ctx, mounts, f)
+}
+
+func (cc *ContainerdContainer) CopyFrom(ctx context.Context, src, dest string) error {
+	l := cc.GetLogger().WithFields(log.Fields{
+		"src":  src,
+		"dest": dest,
+	})
+
+	err := cc.withRootfs(ctx, func(root string) error {
+		target, err := fs.RootPath(root, src)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			return fmt.Errorf("%s: %w", src, contman.ErrNotFound)
+		}
+
+		reader, writer := io.Pipe()
+		go func() {
+			_ = writer.CloseWithError(archive.CreateTarToWriter(target, path.Base(src), writer))
+		}()
+		defer reader.Close()
+
+		return archive.ExtractTarFromReader(reader, cc.hostPath(dest))
+	})
+	if err != nil {
+		l.WithError(err).Error("Error copying from container")
+	}
+	return err
+}
+
+func (cc *ContainerdContainer) CopyTo(ctx context.Context, src, dest string) error {
+	l := cc.GetLogger().WithFields(log.Fields{
+		"src":  src,
+		"dest": dest,
+	})
+
+	err := cc.withRootfs(ctx, func(root string) error {
+		target, err := fs.RootPath(root, dest)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+
+		reader, writer := io.Pipe()
+		go func() {
+			_ = writer.CloseWithError(archive.CreateTarToWriter(cc.hostPath(src), src, writer))
+		}()
+		defer reader.Close()
+
+		return archive.ExtractTarFromReader(reader, target)
+	})
+	if err != nil {
+		l.WithError(err).Error("Error copying to container")
+	}
+	return err
+}
+
+func (cc *ContainerdContainer) GetLogger() *log.Entry {
+	return log.WithField("containerID", cc.ID())
+}
+
+func (cc *ContainerdContainer) hostPath(path string) string {
+	if cc.hostDir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(cc.hostDir, path)
+}
+
+func orDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return ioutil.Discard
+	}
+	return w
+}
@@ -0,0 +1,168 @@
+package containerd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/elemir/contman"
+)
+
+var alpineReceipt = contman.Receipt{
+	Image: "alpine:latest",
+	Cmd:   "echo Hello World!",
+}
+
+func TestNormalizeImage(t *testing.T) {
+	for image, expected := range map[string]string{
+		"alpine":                     "docker.io/library/alpine:latest",
+		"alpine:3.8":                 "docker.io/library/alpine:3.8",
+		"quay.io/coreos/etcd:v3.3.9": "quay.io/coreos/etcd:v3.3.9",
+	} {
+		if ref, err := normalizeImage(image); err != nil || ref != expected {
+			t.Errorf("Unexpected reference for %s: %s, %v", image, ref, err)
+		}
+	}
+}
+
+// skipWithoutContainerd skips tests needing a live containerd socket
+func skipWithoutContainerd(t *testing.T) {
+	address := os.Getenv("CONTAINERD_ADDRESS")
+	if address == "" {
+		address = DefaultAddress
+	}
+	conn, err := net.Dial("unix", address)
+	if err != nil {
+		t.Skip("Containerd is not reachable: ", err)
+	}
+	_ = conn.Close()
+}
+
+func TestRun(t *testing.T) {
+	skipWithoutContainerd(t)
+
+	cm, err := NewContainerdManager()
+	if err != nil {
+		t.Fatal("Cannot create containerd manager: ", err)
+	}
+	defer cm.Close()
+
+	result, err := contman.RunReceipt(cm, alpineReceipt)
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if string(result.Stdout) != "Hello World!\n" {
+		t.Errorf("Unexpected output: %q", result.Stdout)
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	skipWithoutContainerd(t)
+
+	dir, err := ioutil.TempDir("", "contman-containerd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm, err := NewContainerdManager(WithRoot(dir), WithNamespace("contman-test"))
+	if err != nil {
+		t.Fatal("Cannot create containerd manager: ", err)
+	}
+	defer cm.Close()
+	ctx := context.Background()
+
+	receipt := alpineReceipt
+	receipt.Cmd = "touch /cache/done"
+	receipt.Caches = map[string]string{"go-mod": "/cache"}
+	if _, err := contman.RunReceipt(cm, receipt); err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "volumes", "contman-test", "go-mod", "data", "done")); err != nil {
+		t.Error("Cache is not kept in volume: ", err)
+	}
+
+	cacheLabels := map[string]string{contman.CacheLabel: "true"}
+	if _, err := cm.VolumeCreate(ctx, "npm", cacheLabels); err != nil {
+		t.Fatal("Cannot create volume: ", err)
+	}
+	cntr, err := cm.ContainerCreate(ctx, contman.Config{
+		Image:  "alpine:latest",
+		Cmd:    "true",
+		Mounts: []contman.Mount{{Type: contman.MountVolume, Source: "go-mod", Target: "/go/pkg/mod"}},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+
+	if volumes, err := cm.VolumeList(ctx, cacheLabels); err != nil || len(volumes) != 2 {
+		t.Errorf("Unexpected volumes: %+v, %v", volumes, err)
+	}
+	if pruned, err := cm.VolumePrune(ctx, cacheLabels); err != nil || !reflect.DeepEqual(pruned, []string{"npm"}) {
+		t.Errorf("Used volume is pruned: %v, %v", pruned, err)
+	}
+	cntr.Remove(ctx)
+	if pruned, err := cm.VolumePrune(ctx, cacheLabels); err != nil || !reflect.DeepEqual(pruned, []string{"go-mod"}) {
+		t.Errorf("Unused volume is not pruned: %v, %v", pruned, err)
+	}
+}
+
+func TestCopyRunning(t *testing.T) {
+	skipWithoutContainerd(t)
+
+	dir, err := ioutil.TempDir("", "contman-containerd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.txt"), []byte("input"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := NewContainerdManager(WithRoot(dir))
+	if err != nil {
+		t.Fatal("Cannot create containerd manager: ", err)
+	}
+	defer cm.Close()
+	ctx := context.Background()
+	if err := cm.PullImage(ctx, "alpine:latest"); err != nil {
+		t.Fatal("Cannot pull image: ", err)
+	}
+
+	cntr, err := cm.ContainerCreate(ctx, contman.Config{
+		Image:   "alpine:latest",
+		Cmd:     "sleep 60",
+		HostDir: dir,
+		Mounts:  []contman.Mount{{Type: contman.MountTmpfs, Target: "/scratch"}},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	defer cntr.Remove(ctx)
+	if err := cntr.Start(ctx); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+	defer cntr.Kill(ctx)
+
+	// Running task sees copies right away, mounts of the container included
+	for _, dest := range []string{"/work", "/scratch"} {
+		if err := cntr.CopyTo(ctx, "input.txt", dest); err != nil {
+			t.Fatal("Cannot copy to running container: ", err)
+		}
+		var stdout bytes.Buffer
+		if code, err := cntr.Exec(ctx, contman.ExecConfig{Cmd: "cat " + dest + "/input.txt", Stdout: &stdout}); err != nil || code != 0 || stdout.String() != "input" {
+			t.Errorf("Copy to %s is not visible: %q, %d, %v", dest, stdout.String(), code, err)
+		}
+	}
+	if err := cntr.CopyFrom(ctx, "/scratch/input.txt", "out"); err != nil {
+		t.Error("Cannot copy from running container: ", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "out", "input.txt")); err != nil || string(data) != "input" {
+		t.Errorf("Unexpected copied file: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,309 @@
+// Package containerd implements contman.Manager directly on containerd gRPC
+// API, without dockerd.
+package containerd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	"github.com/containerd/containerd/reference/docker"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/runtimespec"
+	"github.com/elemir/contman/internal/secrets"
+	"github.com/elemir/contman/internal/stream"
+)
+
+const (
+	DefaultAddress   = "/run/containerd/containerd.sock"
+	DefaultNamespace = "contman"
+)
+
+type ContainerdManager struct {
+	client      *containerd.Client
+	address     string
+	namespace   string
+	snapshotter string
+	root        string
+}
+
+type Option func(*ContainerdManager)
+
+// WithAddress sets containerd socket, CONTAINERD_ADDRESS or DefaultAddress
+// is used by default
+func WithAddress(address string) Option {
+	return func(cm *ContainerdManager) {
+		cm.address = address
+	}
+}
+
+// WithNamespace sets containerd namespace for images and containers,
+// CONTAINERD_NAMESPACE or DefaultNamespace is used by default
+func WithNamespace(namespace string) Option {
+	return func(cm *ContainerdManager) {
+		cm.namespace = namespace
+	}
+}
+
+// WithSnapshotter sets snapshotter used to unpack images and create
+// container root filesystems
+func WithSnapshotter(snapshotter string) Option {
+	return func(cm *ContainerdManager) {
+		cm.snapshotter = snapshotter
+	}
+}
+
+// WithRoot sets directory keeping volumes, which containerd has no store
+// for, a directory of the current user under os.TempDir is used by default
+func WithRoot(root string) Option {
+	return func(cm *ContainerdManager) {
+		cm.root = root
+	}
+}
+
+// NewContainerdManagerWithContext connects to containerd, deadline of ctx
+// limits the dial and ctx is used to check that containerd is serving
+func NewContainerdManagerWithContext(ctx context.Context, opts ...Option) (*ContainerdManager, error) {
+	cm := &ContainerdManager{
+		address:     os.Getenv("CONTAINERD_ADDRESS"),
+		namespace:   os.Getenv(namespaces.NamespaceEnvVar),
+		snapshotter: containerd.DefaultSnapshotter,
+	}
+	if cm.address == "" {
+		cm.address = DefaultAddress
+	}
+	if cm.namespace == "" {
+		cm.namespace = DefaultNamespace
+	}
+	for _, opt := range opts {
+		opt(cm)
+	}
+	if cm.root == "" {
+		cm.root = filepath.Join(os.TempDir(), fmt.Sprintf("contman-containerd-%d", os.Geteuid()))
+	}
+	if err := os.MkdirAll(cm.root, 0700); err != nil {
+		log.WithError(err).WithField("root", cm.root).Error("Cannot create manager root")
+		return nil, err
+	}
+
+	clientOpts := []containerd.ClientOpt{containerd.WithDefaultNamespace(cm.namespace)}
+	if deadline, ok := ctx.Deadline(); ok {
+		clientOpts = append(clientOpts, containerd.WithTimeout(time.Until(deadline)))
+	}
+	cli, err := containerd.New(cm.address, clientOpts...)
+	if err != nil {
+		log.WithError(err).WithField("address", cm.address).Error("Cannot connect to containerd")
+		return nil, err
+	}
+	if _, err := cli.IsServing(ctx); err != nil {
+		_ = cli.Close()
+		log.WithError(err).WithField("address", cm.address).Error("Containerd is not serving")
+		return nil, err
+	}
+	cm.client = cli
+
+	return cm, nil
+}
+
+func NewContainerdManager(opts ...Option) (*ContainerdManager, error) {
+	return NewContainerdManagerWithContext(context.Background(), opts...)
+}
+
+func (cm *ContainerdManager) Close() error {
+	return cm.client.Close()
+}
+
+// normalizeImage turns short docker names like "alpine" into fully qualified
+// references containerd stores images under
+func normalizeImage(image string) (string, error) {
+	named, err := docker.ParseDockerRef(image)
+	if err != nil {
+		return "", err
+	}
+	return named.String(), nil
+}
+
+func (cm *ContainerdManager) PullImage(ctx context.Context, image string) error {
+	ref, err := normalizeImage(image)
+	if err != nil {
+		log.WithError(err).Error("Cannot parse image name")
+		return err
+	}
+
+	_, err = cm.client.Pull(ctx, ref, containerd.WithPullUnpack, containerd.WithPullSnapshotter(cm.snapshotter))
+	if err != nil {
+		log.WithError(err).Error("Error pulling image")
+		return err
+	}
+	return nil
+}
+
+func (cm *ContainerdManager) HasImage(ctx context.Context, image string) (bool, error) {
+	if image == "" {
+		return false, nil
+	}
+	ref, err := normalizeImage(image)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = cm.client.GetImage(ctx, ref)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		log.WithError(err).Error("Unable to get image")
+		return false, err
+	}
+	return true, nil
+}
+
+func (cm *ContainerdManager) ContainerCreate(ctx context.Context, config contman.Config) (contman.Container, error) {
+	ref, err := normalizeImage(config.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := cm.client.GetImage(ctx, ref)
+	if errdefs.IsNotFound(err) {
+		return nil, fmt.Errorf("image %s: %w", config.Image, contman.ErrNotFound)
+	}
+	if err != nil {
+		log.WithError(err).Error("Error getting image")
+		return nil, err
+	}
+
+	secretsDir, secretMounts, err := secrets.Mounts(config.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	created := false
+	defer func() {
+		if !created {
+			os.RemoveAll(secretsDir)
+		}
+	}()
+	config.Mounts = append(append([]contman.Mount(nil), config.Mounts...), secretMounts...)
+
+	mounts := make([]specs.Mount, len(config.Mounts))
+	for i, m := range config.Mounts {
+		options := []string{"rbind", "rw"}
+		if m.ReadOnly {
+			options = []string{"rbind", "ro"}
+		}
+		mounts[i] = specs.Mount{
+			Source:      m.Source,
+			Destination: m.Target,
+			Type:        "bind",
+			Options:     options,
+		}
+		switch m.Type {
+		case "", contman.MountBind:
+		case contman.MountTmpfs:
+			mounts[i].Type, mounts[i].Source = "tmpfs", "tmpfs"
+			mounts[i].Options = []string{"nosuid", "nodev", options[1]}
+		case contman.MountVolume:
+			if mounts[i].Source, err = cm.volumes().Path(m.Source); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown type %s of mount %s", m.Type, m.Target)
+		}
+	}
+
+	// Without entrypoint args replace CMD of the image, without both the
+	// image config is run as it is
+	specOpts := []oci.SpecOpts{oci.WithImageConfig(image)}
+	entrypoint, args := config.Process()
+	switch {
+	case entrypoint != nil:
+		specOpts = append(specOpts, oci.WithProcessArgs(append(entrypoint, args...)...))
+	case args != nil:
+		specOpts = append(specOpts, oci.WithImageConfigArgs(image, args))
+	}
+	specOpts = append(specOpts,
+		oci.WithEnv(formatEnv(config.Env)),
+		oci.WithMounts(mounts),
+	)
+	if user := config.ProcessUser(); user != "" {
+		specOpts = append(specOpts, oci.WithUser(user))
+	}
+	if config.Hostname != "" {
+		specOpts = append(specOpts, oci.WithHostname(config.Hostname))
+	}
+	switch config.Network {
+	case contman.NetworkHost:
+		specOpts = append(specOpts, oci.WithHostNamespace(specs.NetworkNamespace), oci.WithHostHostsFile, oci.WithHostResolvconf)
+	case "", contman.NetworkNone:
+		// Own network namespace of default spec has loopback only
+	default:
+		return nil, fmt.Errorf("network %s is not supported without CNI", config.Network)
+	}
+	if config.WorkingDir != "" {
+		specOpts = append(specOpts, oci.WithProcessCwd(config.WorkingDir))
+	}
+	specOpts = append(specOpts, func(_ context.Context, _ oci.Client, _ *containers.Container, s *specs.Spec) error {
+		runtimespec.SetResources(s, config.Resources)
+		return runtimespec.SetSecurity(s, config.Security)
+	})
+
+	id := newID()
+	cntr, err := cm.client.NewContainer(ctx, id,
+		containerd.WithImage(image),
+		containerd.WithSnapshotter(cm.snapshotter),
+		containerd.WithNewSnapshot(id, image),
+		containerd.WithNewSpec(specOpts...),
+		containerd.WithContainerLabels(config.Labels),
+	)
+	if err != nil {
+		log.WithError(err).Error("Error creating container")
+		return nil, err
+	}
+	created = true
+
+	return &ContainerdContainer{
+		manager:    cm,
+		container:  cntr,
+		hostDir:    config.HostDir,
+		secretsDir: secretsDir,
+		stdout:     &stream.DeferredWriter{},
+		stderr:     &stream.DeferredWriter{},
+	}, nil
+}
+
+func (cm *ContainerdManager) GetSystemMounts() []contman.Mount {
+	return []contman.Mount{
+		{
+			Source: cm.address,
+			Target: DefaultAddress,
+		},
+	}
+}
+
+func newID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func formatEnv(vars map[string]string) []string {
+	env := make([]string, 0, len(vars))
+	for key, value := range vars {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	return env
+}
@@ -0,0 +1,58 @@
+package containerd
+
+import (
+	"context"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/volumes"
+)
+
+// volumes keeps volumes of the namespace as directories under the manager
+// root, they are bind mounted into containers
+func (cm *ContainerdManager) volumes() volumes.Store {
+	return volumes.Store{Dir: filepath.Join(cm.root, "volumes", cm.namespace)}
+}
+
+func (cm *ContainerdManager) VolumeCreate(ctx context.Context, name string, labels map[string]string) (contman.Volume, error) {
+	v, err := cm.volumes().Create(name, labels)
+	if err != nil {
+		log.WithError(err).WithField("volume", name).Error("Error creating volume")
+	}
+	return v, err
+}
+
+func (cm *ContainerdManager) VolumeList(ctx context.Context, labels map[string]string) ([]contman.Volume, error) {
+	list, err := cm.volumes().List(labels)
+	if err != nil {
+		log.WithError(err).Error("Error listing volumes")
+	}
+	return list, err
+}
+
+// VolumePrune keeps volumes mounted by existing containers of the namespace
+func (cm *ContainerdManager) VolumePrune(ctx context.Context, labels map[string]string) ([]string, error) {
+	containers, err := cm.client.Containers(ctx)
+	if err != nil {
+		log.WithError(err).Error("Error listing containers")
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, c := range containers {
+		spec, err := c.Spec(ctx)
+		if err != nil {
+			continue
+		}
+		for _, m := range spec.Mounts {
+			used[m.Source] = true
+		}
+	}
+
+	removed, err := cm.volumes().Prune(labels, used)
+	if err != nil {
+		log.WithError(err).Error("Error pruning volumes")
+	}
+	return removed, err
+}
@@ -0,0 +1,297 @@
+package contmantest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+)
+
+type State int
+
+const (
+	Created State = iota
+	Running
+	Exited
+	Removed
+)
+
+func (s State) String() string {
+	switch s {
+	case Created:
+		return "created"
+	case Running:
+		return "running"
+	case Exited:
+		return "exited"
+	case Removed:
+		return "removed"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Exit codes of fake processes terminated by Stop and Kill
+const (
+	StoppedExitCode = 143
+	KilledExitCode  = 137
+)
+
+type Container struct {
+	mu sync.Mutex
+
+	id       string
+	manager  *Manager
+	digest   string
+	state    State
+	exitCode int
+	files    map[string][]byte
+	execs    []contman.ExecConfig
+	stopped  chan struct{}
+
+	Config contman.Config
+}
+
+func (c *Container) ID() string {
+	return c.id
+}
+
+func (c *Container) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *Container) ExitCode() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.exitCode
+}
+
+// Execs returns configs of all commands executed in the container
+func (c *Container) Execs() []contman.ExecConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]contman.ExecConfig(nil), c.execs...)
+}
+
+func (c *Container) WriteFile(name string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[path.Clean(name)] = data
+}
+
+func (c *Container) ReadFile(name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.files[path.Clean(name)]
+	return data, ok
+}
+
+// Files returns sorted paths of all files in the container
+func (c *Container) Files() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.files))
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Container) ImageDigest(ctx context.Context) (string, error) {
+	return c.digest, nil
+}
+
+func (c *Container) Start(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != Created {
+		return fmt.Errorf("container %s is %v", c.id, c.state)
+	}
+	c.state = Running
+	return nil
+}
+
+func (c *Container) Stop(ctx context.Context, timeout time.Duration) error {
+	return c.terminate(StoppedExitCode)
+}
+
+func (c *Container) Kill(ctx context.Context) error {
+	return c.terminate(KilledExitCode)
+}
+
+func (c *Container) terminate(exitCode int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != Running {
+		return fmt.Errorf("container %s is %v", c.id, c.state)
+	}
+	c.state = Exited
+	c.exitCode = exitCode
+	close(c.stopped)
+	return nil
+}
+
+func (c *Container) Remove(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == Running {
+		return fmt.Errorf("container %s is running", c.id)
+	}
+	c.state = Removed
+	return nil
+}
+
+func (c *Container) IsRunning(ctx context.Context) (bool, error) {
+	return c.State() == Running, nil
+}
+
+func (c *Container) Wait(ctx context.Context, stdout, stderr io.Writer) (int, error) {
+	switch c.State() {
+	case Created, Removed:
+		return 0, fmt.Errorf("container %s is not started", c.id)
+	case Exited:
+		return c.ExitCode(), nil
+	}
+
+	b := c.manager.cmdBehavior(c.Config.Cmd)
+	exitCode, err := c.run(ctx, b, stdout, stderr)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != Running {
+		return c.exitCode, nil
+	}
+	c.state = Exited
+	c.exitCode = exitCode
+	if b.OOMKilled {
+		c.exitCode = KilledExitCode
+		return c.exitCode, &contman.ExitError{ContainerID: c.id, Code: c.exitCode, OOMKilled: true}
+	}
+	return c.exitCode, nil
+}
+
+func (c *Container) Exec(ctx context.Context, config contman.ExecConfig) (int, error) {
+	c.mu.Lock()
+	if c.state != Running {
+		c.mu.Unlock()
+		return 0, fmt.Errorf("container %s is not running", c.id)
+	}
+	c.execs = append(c.execs, config)
+	c.mu.Unlock()
+
+	b := c.manager.execBehavior(config.Cmd)
+	exitCode, err := c.run(ctx, b, config.Stdout, config.Stderr)
+	if err == nil && b.OOMKilled {
+		return KilledExitCode, &contman.ExitError{ContainerID: c.id, Code: KilledExitCode, OOMKilled: true}
+	}
+	return exitCode, err
+}
+
+func (c *Container) run(ctx context.Context, b Behavior, stdout, stderr io.Writer) (int, error) {
+	var timer <-chan time.Time
+	if b.Duration > 0 {
+		timer = time.After(b.Duration)
+	}
+	if b.Duration != 0 {
+		select {
+		case <-timer:
+		case <-c.stopped:
+			return c.ExitCode(), nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	for name, data := range b.Files {
+		c.WriteFile(name, []byte(data))
+	}
+	if stdout != nil {
+		io.WriteString(stdout, b.Stdout)
+	}
+	if stderr != nil {
+		io.WriteString(stderr, b.Stderr)
+	}
+	if b.Run != nil {
+		return b.Run(c), nil
+	}
+	return b.ExitCode, nil
+}
+
+// CopyTo stores host files into container filesystem naming them the same
+// way as the docker backend does.
+func (c *Container) CopyTo(ctx context.Context, src, dest string) error {
+	root := c.hostPath(src)
+	return filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(src + strings.TrimPrefix(file, root))
+		c.WriteFile(path.Join(dest, name), data)
+		return nil
+	})
+}
+
+func (c *Container) CopyFrom(ctx context.Context, src, dest string) error {
+	src = path.Clean(src)
+
+	c.mu.Lock()
+	files := map[string][]byte{}
+	for name, data := range c.files {
+		if name == src || strings.HasPrefix(name, strings.TrimSuffix(src, "/")+"/") {
+			files[name] = data
+		}
+	}
+	c.mu.Unlock()
+
+	if len(files) == 0 {
+		return fmt.Errorf("%s: %w", src, contman.ErrNotFound)
+	}
+
+	base := path.Dir(src)
+	for name, data := range files {
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, base), "/")
+		target := filepath.Join(c.hostPath(dest), filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(target, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Container) GetLogger() *log.Entry {
+	return log.WithField("containerID", c.id)
+}
+
+func (c *Container) hostPath(p string) string {
+	if c.Config.HostDir == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(c.Config.HostDir, p)
+}
@@ -0,0 +1,143 @@
+package contmantest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/elemir/contman"
+)
+
+// PushImage makes image available for pulling and records it in Pushes
+func (m *Manager) PushImage(ctx context.Context, image string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	digest, ok := m.images[image]
+	if !ok {
+		return fmt.Errorf("image %s: %w", image, contman.ErrNotFound)
+	}
+	m.registry[image] = digest
+	m.Pushes = append(m.Pushes, image)
+	return nil
+}
+
+func (m *Manager) TagImage(ctx context.Context, source, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	digest, ok := m.images[source]
+	if !ok {
+		return fmt.Errorf("image %s: %w", source, contman.ErrNotFound)
+	}
+	delete(m.images, digest)
+	m.images[target] = digest
+	return nil
+}
+
+func (m *Manager) RemoveImage(ctx context.Context, image string, force bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	digest, ok := m.images[image]
+	if !ok {
+		return fmt.Errorf("image %s: %w", image, contman.ErrNotFound)
+	}
+	if len(m.imageRefs()[digest]) > 1 {
+		delete(m.images, image)
+		return nil
+	}
+	if m.usedImages()[digest] && !force {
+		return fmt.Errorf("image %s is used by a container", image)
+	}
+	delete(m.images, image)
+	return nil
+}
+
+// ListImages reports digests of images as their IDs, images built without
+// tags are dangling
+func (m *Manager) ListImages(ctx context.Context, filter contman.ImageFilter) ([]contman.Image, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.matchImages(filter), nil
+}
+
+// PruneImages removes images not used by containers existing in any state
+// but Removed
+func (m *Manager) PruneImages(ctx context.Context, filter contman.ImageFilter) ([]string, error) {
+	if filter.Reference != "" {
+		return nil, errors.New("images cannot be pruned by reference")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	used := m.usedImages()
+	var pruned []string
+	for _, image := range m.matchImages(filter) {
+		if used[image.ID] {
+			continue
+		}
+		for ref, digest := range m.images {
+			if digest == image.ID {
+				delete(m.images, ref)
+			}
+		}
+		pruned = append(pruned, image.ID)
+	}
+	return pruned, nil
+}
+
+// imageRefs returns tags of images by their IDs, it must be called with m.mu
+// held
+func (m *Manager) imageRefs() map[string][]string {
+	refs := map[string][]string{}
+	for ref, digest := range m.images {
+		if ref != digest {
+			refs[digest] = append(refs[digest], ref)
+		} else if _, ok := refs[digest]; !ok {
+			refs[digest] = nil
+		}
+	}
+	return refs
+}
+
+// matchImages returns images selected by filter sorted by ID, it must be
+// called with m.mu held. Images of the fake manager have no labels.
+func (m *Manager) matchImages(filter contman.ImageFilter) []contman.Image {
+	var images []contman.Image
+	for digest, tags := range m.imageRefs() {
+		if len(filter.Labels) > 0 || filter.Dangling && len(tags) > 0 {
+			continue
+		}
+		matches := filter.Reference == ""
+		for _, tag := range tags {
+			if ok, _ := path.Match(filter.Reference, tag); ok {
+				matches = true
+			}
+		}
+		if matches {
+			sort.Strings(tags)
+			images = append(images, contman.Image{ID: digest, Tags: tags})
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images
+}
+
+// usedImages returns IDs of images of containers existing in any state but
+// Removed, it must be called with m.mu held
+func (m *Manager) usedImages() map[string]bool {
+	used := map[string]bool{}
+	for _, c := range m.containers {
+		if c.State() != Removed {
+			used[c.digest] = true
+		}
+	}
+	return used
+}
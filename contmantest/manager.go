@@ -0,0 +1,326 @@
+// Package contmantest provides an in-memory contman.Manager for testing
+// code built on receipts without a container runtime.
+package contmantest
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elemir/contman"
+)
+
+// Behavior describes what a fake process does when it is run
+type Behavior struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	// Files are written into container filesystem before the process exits
+	Files map[string]string
+	// Duration delays exit of the process, a negative value makes it run
+	// until the container is stopped
+	Duration time.Duration
+	// Run, if set, is called with the container before the process exits
+	// and its result overrides ExitCode
+	Run func(c *Container) int
+	// OOMKilled makes Wait and Exec report the process killed by OOM killer
+	// with KilledExitCode
+	OOMKilled bool
+}
+
+type Manager struct {
+	mu sync.Mutex
+
+	images     map[string]string
+	registry   map[string]string
+	pullErrors map[string]error
+	buildError error
+	cmds       map[string]Behavior
+	execs      map[string]Behavior
+	containers []*Container
+	volumes    map[string]contman.Volume
+	pulls      []string
+
+	SystemMounts []contman.Mount
+	// Builds records every spec passed to BuildImage
+	Builds []contman.BuildSpec
+	// Pushes records every image pushed by PushImage
+	Pushes []string
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		images:     map[string]string{},
+		registry:   map[string]string{},
+		pullErrors: map[string]error{},
+		cmds:       map[string]Behavior{},
+		execs:      map[string]Behavior{},
+		volumes:    map[string]contman.Volume{},
+	}
+}
+
+// AddImage puts image into local image store
+func (m *Manager) AddImage(image, digest string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.images[image] = digest
+}
+
+// AddRemoteImage makes image available for pulling
+func (m *Manager) AddRemoteImage(image, digest string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.registry[image] = digest
+}
+
+// FailPull makes pulling image fail with err
+func (m *Manager) FailPull(image string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pullErrors[image] = err
+}
+
+// FailBuild makes building images fail with err
+func (m *Manager) FailBuild(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buildError = err
+}
+
+// OnCmd sets behavior of containers created with cmd, behavior for empty
+// cmd is used for commands without their own behavior
+func (m *Manager) OnCmd(cmd string, b Behavior) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cmds[cmd] = b
+}
+
+// OnExec sets behavior of cmd executed in a running container, behavior for
+// empty cmd is used for commands without their own behavior
+func (m *Manager) OnExec(cmd string, b Behavior) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.execs[cmd] = b
+}
+
+func (m *Manager) Containers() []*Container {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Container(nil), m.containers...)
+}
+
+// Pulls returns every image passed to PullImage
+func (m *Manager) Pulls() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.pulls...)
+}
+
+func (m *Manager) PullImage(ctx context.Context, image string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pulls = append(m.pulls, image)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err, ok := m.pullErrors[image]; ok {
+		return err
+	}
+	digest, ok := m.registry[image]
+	if !ok {
+		return fmt.Errorf("pull %s: %w", image, contman.ErrNotFound)
+	}
+	m.images[image] = digest
+	return nil
+}
+
+// HasImage finds image by its reference or, for "name@digest" references,
+// by digest of a tag of name
+func (m *Manager) HasImage(ctx context.Context, image string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.images[image]; ok {
+		return true, nil
+	}
+	i := strings.LastIndex(image, "@")
+	if i < 0 {
+		return false, nil
+	}
+	for ref, digest := range m.images {
+		if digest == image[i+1:] && strings.HasPrefix(ref, image[:i]+":") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LocalDigest returns digest image was added or pulled with
+func (m *Manager) LocalDigest(ctx context.Context, image string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.images[image], nil
+}
+
+// RemoteDigest returns digest image was added to the registry with
+func (m *Manager) RemoteDigest(ctx context.Context, image string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	digest, ok := m.registry[image]
+	if !ok {
+		return "", fmt.Errorf("image %s: %w", image, contman.ErrNotFound)
+	}
+	return digest, nil
+}
+
+// BuildImage stores image with an ID derived from the number of builds under
+// its ID and tags, output of the build is a single event
+func (m *Manager) BuildImage(ctx context.Context, spec contman.BuildSpec) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Builds = append(m.Builds, spec)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if m.buildError != nil {
+		return "", m.buildError
+	}
+	id := fmt.Sprintf("sha256:%064x", len(m.Builds))
+	for _, ref := range append([]string{id}, spec.Tags...) {
+		m.images[ref] = id
+	}
+	if spec.Events != nil {
+		spec.Events(contman.BuildEvent{Stream: "Successfully built " + id[7:19] + "\n"})
+		spec.Events(contman.BuildEvent{ImageID: id})
+	}
+	return id, nil
+}
+
+func (m *Manager) ContainerCreate(ctx context.Context, config contman.Config) (contman.Container, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	digest, ok := m.images[config.Image]
+	if !ok {
+		return nil, fmt.Errorf("image %s: %w", config.Image, contman.ErrNotFound)
+	}
+
+	for _, mount := range config.Mounts {
+		if _, ok := m.volumes[mount.Source]; mount.Type == contman.MountVolume && !ok {
+			m.volumes[mount.Source] = contman.Volume{Name: mount.Source}
+		}
+	}
+
+	c := &Container{
+		id:      fmt.Sprintf("fake%04d", len(m.containers)+1),
+		manager: m,
+		digest:  digest,
+		Config:  config,
+		files:   map[string][]byte{},
+		stopped: make(chan struct{}),
+	}
+	for name, value := range config.Secrets {
+		c.files[path.Join(contman.SecretsDir, name)] = value
+	}
+	m.containers = append(m.containers, c)
+
+	return c, nil
+}
+
+func (m *Manager) VolumeCreate(ctx context.Context, name string, labels map[string]string) (contman.Volume, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.volumes[name]; ok {
+		return v, nil
+	}
+	v := contman.Volume{Name: name, Labels: labels}
+	m.volumes[name] = v
+	return v, nil
+}
+
+func (m *Manager) VolumeList(ctx context.Context, labels map[string]string) ([]contman.Volume, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var volumes []contman.Volume
+	for _, name := range m.volumeNames(labels) {
+		volumes = append(volumes, m.volumes[name])
+	}
+	return volumes, nil
+}
+
+// VolumePrune removes volumes which are not mounted by containers existing
+// in any state but Removed
+func (m *Manager) VolumePrune(ctx context.Context, labels map[string]string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	used := map[string]bool{}
+	for _, c := range m.containers {
+		if c.State() == Removed {
+			continue
+		}
+		for _, mount := range c.Config.Mounts {
+			if mount.Type == contman.MountVolume {
+				used[mount.Source] = true
+			}
+		}
+	}
+
+	var pruned []string
+	for _, name := range m.volumeNames(labels) {
+		if !used[name] {
+			delete(m.volumes, name)
+			pruned = append(pruned, name)
+		}
+	}
+	return pruned, nil
+}
+
+// volumeNames returns sorted names of volumes having all of labels, it must
+// be called with m.mu held
+func (m *Manager) volumeNames(labels map[string]string) []string {
+	var names []string
+	for name, v := range m.volumes {
+		matches := true
+		for key, value := range labels {
+			if v.Labels[key] != value {
+				matches = false
+			}
+		}
+		if matches {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *Manager) GetSystemMounts() []contman.Mount {
+	return m.SystemMounts
+}
+
+func (m *Manager) cmdBehavior(cmd string) Behavior {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, ok := m.cmds[cmd]; ok {
+		return b
+	}
+	return m.cmds[""]
+}
+
+func (m *Manager) execBehavior(cmd string) Behavior {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, ok := m.execs[cmd]; ok {
+		return b
+	}
+	return m.execs[""]
+}
@@ -0,0 +1,223 @@
+package contman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is wrapped by managers into errors about missing paths
+var ErrNotFound = errors.New("not found")
+
+type CopyPolicy int
+
+const (
+	// CopyRequired fails the receipt when the source is missing
+	CopyRequired CopyPolicy = iota
+	// CopyOptional skips a missing source
+	CopyOptional
+	// CopyGlob treats the source as a pattern which may match nothing,
+	// for output copies only the last path element may contain a pattern
+	CopyGlob
+)
+
+func (p CopyPolicy) String() string {
+	switch p {
+	case CopyRequired:
+		return "required"
+	case CopyOptional:
+		return "optional"
+	case CopyGlob:
+		return "glob"
+	}
+	return fmt.Sprintf("CopyPolicy(%d)", int(p))
+}
+
+func (p CopyPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *CopyPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "required":
+		*p = CopyRequired
+	case "optional":
+		*p = CopyOptional
+	case "glob":
+		*p = CopyGlob
+	default:
+		return fmt.Errorf("unknown copy policy %q", text)
+	}
+	return nil
+}
+
+type CopyStatus struct {
+	Src  string
+	Dest string
+	// Skipped is set when an optional source is missing or a glob pattern
+	// matches nothing
+	Skipped bool
+	Err     error
+}
+
+// CopyErrors lists every path which failed to be copied
+type CopyErrors []CopyStatus
+
+func (es CopyErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = fmt.Sprintf("%s -> %s: %v", e.Src, e.Dest, e.Err)
+	}
+	return "failed to copy " + strings.Join(msgs, "; ")
+}
+
+func failedCopies(statuses []CopyStatus) error {
+	var errs CopyErrors
+	for _, status := range statuses {
+		if status.Err != nil {
+			errs = append(errs, status)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func copyInputs(ctx context.Context, cntr Container, hostDir string, copies map[string]string, policies map[string]CopyPolicy) []CopyStatus {
+	var statuses []CopyStatus
+
+	for _, src := range sortedKeys(copies) {
+		dest := copies[src]
+
+		switch policies[src] {
+		case CopyGlob:
+			matches, err := filepath.Glob(hostPath(hostDir, src))
+			if err != nil {
+				statuses = append(statuses, CopyStatus{Src: src, Dest: dest, Err: err})
+				continue
+			}
+			if len(matches) == 0 {
+				statuses = append(statuses, CopyStatus{Src: src, Dest: dest, Skipped: true})
+				continue
+			}
+			for _, match := range matches {
+				if !filepath.IsAbs(src) {
+					match, _ = filepath.Rel(hostDir, match)
+				}
+				statuses = append(statuses, CopyStatus{
+					Src:  match,
+					Dest: dest,
+					Err:  cntr.CopyTo(ctx, match, dest),
+				})
+			}
+		case CopyOptional:
+			status := CopyStatus{Src: src, Dest: dest}
+			if _, err := os.Stat(hostPath(hostDir, src)); os.IsNotExist(err) {
+				status.Skipped = true
+			} else {
+				status.Err = cntr.CopyTo(ctx, src, dest)
+			}
+			statuses = append(statuses, status)
+		default:
+			status := CopyStatus{Src: src, Dest: dest}
+			if _, err := os.Stat(hostPath(hostDir, src)); err != nil {
+				status.Err = err
+			} else {
+				status.Err = cntr.CopyTo(ctx, src, dest)
+			}
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+func copyOutputs(ctx context.Context, cntr Container, hostDir string, copies map[string]string, policies map[string]CopyPolicy) []CopyStatus {
+	var statuses []CopyStatus
+
+	for _, src := range sortedKeys(copies) {
+		dest := copies[src]
+
+		switch policies[src] {
+		case CopyGlob:
+			statuses = append(statuses, copyOutputGlob(ctx, cntr, hostDir, src, dest)...)
+		case CopyOptional:
+			status := CopyStatus{Src: src, Dest: dest}
+			err := cntr.CopyFrom(ctx, src, dest)
+			if errors.Is(err, ErrNotFound) {
+				status.Skipped = true
+			} else {
+				status.Err = err
+			}
+			statuses = append(statuses, status)
+		default:
+			statuses = append(statuses, CopyStatus{
+				Src:  src,
+				Dest: dest,
+				Err:  cntr.CopyFrom(ctx, src, dest),
+			})
+		}
+	}
+
+	return statuses
+}
+
+// copyOutputGlob copies parent directory of the pattern into a temporary
+// directory next to dest and moves matching entries from it into dest.
+func copyOutputGlob(ctx context.Context, cntr Container, hostDir, pattern, dest string) []CopyStatus {
+	dir, base := filepath.Dir(pattern), filepath.Base(pattern)
+	destDir := hostPath(hostDir, dest)
+	fail := func(err error) []CopyStatus {
+		return []CopyStatus{{Src: pattern, Dest: dest, Err: err}}
+	}
+
+	if _, err := filepath.Match(base, ""); err != nil {
+		return fail(err)
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fail(err)
+	}
+	tmp, err := ioutil.TempDir(destDir, ".contman-")
+	if err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	err = cntr.CopyFrom(ctx, dir, tmp)
+	if errors.Is(err, ErrNotFound) {
+		return []CopyStatus{{Src: pattern, Dest: dest, Skipped: true}}
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(tmp, filepath.Base(dir), base))
+	if err != nil {
+		return fail(err)
+	}
+	if len(matches) == 0 {
+		return []CopyStatus{{Src: pattern, Dest: dest, Skipped: true}}
+	}
+
+	var statuses []CopyStatus
+	for _, match := range matches {
+		name := filepath.Base(match)
+		target := filepath.Join(destDir, name)
+		if err := os.RemoveAll(target); err != nil {
+			statuses = append(statuses, CopyStatus{Src: filepath.Join(dir, name), Dest: dest, Err: err})
+			continue
+		}
+		statuses = append(statuses, CopyStatus{
+			Src:  filepath.Join(dir, name),
+			Dest: dest,
+			Err:  os.Rename(match, target),
+		})
+	}
+
+	return statuses
+}
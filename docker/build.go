@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/docker/docker/api/types"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/buildcontext"
+	"github.com/elemir/contman/internal/jsonstream"
+)
+
+func (dm *DockerManager) BuildImage(ctx context.Context, spec contman.BuildSpec) (string, error) {
+	if spec.Dockerfile == "" {
+		spec.Dockerfile = "Dockerfile"
+	}
+	if spec.Ignore == "" {
+		spec.Ignore = ".dockerignore"
+	}
+	args := make(map[string]*string, len(spec.Args))
+	for key := range spec.Args {
+		value := spec.Args[key]
+		args[key] = &value
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(buildcontext.Create(spec.Context, spec.Dockerfile, spec.Ignore, writer))
+	}()
+	defer reader.Close()
+
+	resp, err := dm.client.ImageBuild(ctx, reader, types.ImageBuildOptions{
+		Dockerfile: spec.Dockerfile,
+		Tags:       spec.Tags,
+		BuildArgs:  args,
+		Target:     spec.Target,
+		Remove:     true,
+	})
+	if err != nil {
+		log.WithError(err).Error("Error building image")
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	id := ""
+	err = jsonstream.Decode(resp.Body, func(msg jsonstream.Message) {
+		event := contman.BuildEvent{Stream: msg.Stream, Status: msg.Status, ID: msg.ID}
+		var result types.BuildResult
+		if len(msg.Aux) > 0 && json.Unmarshal(msg.Aux, &result) == nil && result.ID != "" {
+			id = result.ID
+			event.ImageID = id
+		}
+		if spec.Events != nil {
+			spec.Events(event)
+		} else if line := strings.TrimSpace(msg.Stream); line != "" {
+			log.WithField("context", spec.Context).Debug(line)
+		}
+	})
+	if err != nil {
+		log.WithError(err).Error("Error building image")
+		return "", err
+	}
+	if id == "" {
+		return "", errors.New("builder reported no image ID")
+	}
+	return id, nil
+}
@@ -0,0 +1,98 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/elemir/contman"
+)
+
+func writeBuildContext(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "contman-build-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestBuildImage(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	dir := writeBuildContext(t, map[string]string{
+		"build/app.Dockerfile": "FROM alpine:latest AS base\nRUN apk add git\n\nFROM base AS runtime\nCOPY app /app\n",
+		".dockerignore":        "*.log\n",
+		"app":                  "#!/bin/sh\n",
+		"debug.log":            "log\n",
+	})
+	defer os.RemoveAll(dir)
+
+	var events []contman.BuildEvent
+	result, err := contman.RunReceipt(dm, contman.Receipt{
+		Image: "app",
+		Cmd:   "/app",
+		Build: &contman.BuildSpec{
+			Dockerfile: "build/app.Dockerfile",
+			Args:       map[string]string{"VERSION": "1.0"},
+			Target:     "runtime",
+			Events:     func(e contman.BuildEvent) { events = append(events, e) },
+		},
+		HostDir: dir,
+	})
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if !srv.HasImage("app:latest") || srv.Container(result.ContainerID).ImageID != result.ImageID {
+		t.Errorf("Built image is not run: %+v", result)
+	}
+	if len(events) != 6 || events[0].Stream != "Step 1/4 : FROM alpine:latest AS base\n" || events[4].ImageID != result.ImageID {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+
+	req := srv.RequestsTo("image-build")[0]
+	var args map[string]string
+	if err := json.Unmarshal([]byte(req.Query.Get("buildargs")), &args); err != nil || args["VERSION"] != "1.0" || req.Query.Get("target") != "runtime" {
+		t.Errorf("Unexpected build query: %v", req.Query)
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(req.Body))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{".dockerignore", "app", "build/", "build/app.Dockerfile"}) {
+		t.Errorf("Unexpected build context: %v", names)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM alpine\nRUNN true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = dm.BuildImage(context.Background(), contman.BuildSpec{Context: dir})
+	if err == nil || err.Error() != "Dockerfile parse error: unknown instruction: RUNN" {
+		t.Error("Unexpected build error: ", err)
+	}
+}
@@ -1,14 +1,14 @@
 package docker
 
 import (
+	"context"
 	"errors"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/docker/docker/api/types"
-
-	dockercli "github.com/docker/cli/cli/command"
-	"github.com/docker/cli/cli/command/container"
-	cliflags "github.com/docker/cli/cli/flags"
+	"github.com/docker/docker/pkg/term"
 )
 
 func (d *DockerManager) RunCommand(containerName string, command []string) error {
@@ -39,17 +39,16 @@ func (d *DockerManager) RunCommand(containerName string, command []string) error
 
 	errCh := make(chan error, 1)
 
-	dockerCli := dockercli.NewDockerCli(os.Stdin, os.Stdout, os.Stderr)
-	dockerCli.Initialize(cliflags.NewClientOptions())
+	t, isTerminal := newTerminal(os.Stdin, os.Stdout)
 
 	go func() {
 		defer close(errCh)
 		errCh <- func() error {
 			streamer := hijackedIOStreamer{
-				streams:      dockerCli,
-				inputStream:  dockerCli.In(),
-				outputStream: dockerCli.Out(),
-				errorStream:  dockerCli.Out(),
+				terminal:     t,
+				inputStream:  os.Stdin,
+				outputStream: os.Stdout,
+				errorStream:  os.Stdout,
 				resp:         respAttach,
 				tty:          true,
 			}
@@ -58,10 +57,9 @@ func (d *DockerManager) RunCommand(containerName string, command []string) error
 		}()
 	}()
 
-	if dockerCli.In().IsTerminal() {
-		if err := container.MonitorTtySize(d.context, dockerCli, execID, true); err != nil {
-			return err
-		}
+	if isTerminal {
+		stop := d.monitorTtySize(d.context, execID, t)
+		defer stop()
 	}
 
 	if err := <-errCh; err != nil {
@@ -80,3 +78,32 @@ func (d *DockerManager) RunCommand(containerName string, command []string) error
 
 	return nil
 }
+
+// monitorTtySize resizes tty of exec to the size of the terminal and keeps
+// it in sync until returned stop is called
+func (d *DockerManager) monitorTtySize(ctx context.Context, execID string, t *terminal) (stop func()) {
+	resize := func() {
+		ws, err := term.GetWinsize(t.out)
+		if err != nil || ws.Height == 0 || ws.Width == 0 {
+			return
+		}
+		d.client.ContainerExecResize(ctx, execID, types.ResizeOptions{Height: uint(ws.Height), Width: uint(ws.Width)})
+	}
+	resize()
+
+	sigchan := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigchan, syscall.SIGWINCH)
+	go func() {
+		defer signal.Stop(sigchan)
+		for {
+			select {
+			case <-sigchan:
+				resize()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
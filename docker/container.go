@@ -1,25 +1,66 @@
 package docker
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/archive"
+	"github.com/elemir/contman/internal/cgroups"
+	"github.com/elemir/contman/internal/references"
 )
 
+// killedExitCode is exit code of processes killed by SIGKILL
+const killedExitCode = 128 + 9
+
 type DockerContainer struct {
 	id      string
 	manager *DockerManager
+	hostDir string
+	// tty containers have raw output, not multiplexed by stdcopy
+	tty bool
+	// secretsDir keeps secret files mounted into the container
+	secretsDir string
+}
+
+func (dc *DockerContainer) ID() string {
+	return dc.id
+}
+
+func (dc *DockerContainer) ImageDigest(ctx context.Context) (string, error) {
+	descr, err := dc.manager.client.ContainerInspect(ctx, dc.id)
+	if err != nil {
+		return "", err
+	}
+
+	image, _, err := dc.manager.client.ImageInspectWithRaw(ctx, descr.Image)
+	if err != nil {
+		return "", err
+	}
+	// Image may have digests of other repositories it was pulled from
+	if named, err := reference.ParseNormalizedNamed(descr.Config.Image); err == nil {
+		if canonical := references.RepoDigest(image.RepoDigests, named); canonical != nil {
+			return reference.FamiliarString(canonical), nil
+		}
+	}
+	return image.ID, nil
 }
 
-func (dc *DockerContainer) Start() error {
-	ctx := dc.getContext()
+func (dc *DockerContainer) Start(ctx context.Context) error {
 	err := dc.manager.client.ContainerStart(ctx, dc.id, types.ContainerStartOptions{})
 	if err != nil {
 		dc.GetLogger().WithError(err).Error("Error starting container")
@@ -27,8 +68,7 @@ func (dc *DockerContainer) Start() error {
 	return err
 }
 
-func (dc *DockerContainer) Stop(timeout time.Duration) error {
-	ctx := dc.getContext()
+func (dc *DockerContainer) Stop(ctx context.Context, timeout time.Duration) error {
 	err := dc.manager.client.ContainerStop(ctx, dc.id, &timeout)
 	if err != nil {
 		dc.GetLogger().WithError(err).Error("Error stopping container")
@@ -36,17 +76,27 @@ func (dc *DockerContainer) Stop(timeout time.Duration) error {
 	return err
 }
 
-func (dc *DockerContainer) Remove() error {
-	ctx := dc.getContext()
+func (dc *DockerContainer) Kill(ctx context.Context) error {
+	err := dc.manager.client.ContainerKill(ctx, dc.id, "KILL")
+	if err != nil {
+		dc.GetLogger().WithError(err).Error("Error killing container")
+	}
+	return err
+}
+
+func (dc *DockerContainer) Remove(ctx context.Context) error {
 	err := dc.manager.client.ContainerRemove(ctx, dc.id, types.ContainerRemoveOptions{})
 	if err != nil {
 		dc.GetLogger().WithError(err).Errorf("Error removing container")
+		return err
+	}
+	if dc.secretsDir != "" {
+		err = os.RemoveAll(dc.secretsDir)
 	}
 	return err
 }
 
-func (dc *DockerContainer) IsRunning() (bool, error) {
-	ctx := dc.getContext()
+func (dc *DockerContainer) IsRunning(ctx context.Context) (bool, error) {
 	descr, err := dc.manager.client.ContainerInspect(ctx, dc.id)
 	if err != nil {
 		dc.GetLogger().WithError(err).Errorf("Error checking container running status")
@@ -55,18 +105,26 @@ func (dc *DockerContainer) IsRunning() (bool, error) {
 	return run, err
 }
 
-func (dc *DockerContainer) Wait(dumpLog bool) (int, error) {
-	ctx := dc.getContext()
+func (dc *DockerContainer) Wait(ctx context.Context, stdout, stderr io.Writer) (int, error) {
 	var exitCode int
 
-	if dumpLog {
+	var logsDone chan struct{}
+	if stdout != nil || stderr != nil {
 		out, err := dc.manager.client.ContainerLogs(ctx, dc.id, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
 		if err != nil {
 			dc.GetLogger().WithError(err).Error("Error getting container logs")
 			return 0, err
 		}
 		defer func() { _ = out.Close() }()
-		go func() { _, _ = stdcopy.StdCopy(os.Stdout, os.Stderr, out) }()
+		logsDone = make(chan struct{})
+		go func() {
+			defer close(logsDone)
+			if dc.tty {
+				_, _ = io.Copy(orDiscard(stdout), out)
+				return
+			}
+			_, _ = stdcopy.StdCopy(orDiscard(stdout), orDiscard(stderr), out)
+		}()
 	}
 
 	statusCh, errCh := dc.manager.client.ContainerWait(ctx, dc.id, container.WaitConditionNotRunning)
@@ -80,16 +138,119 @@ func (dc *DockerContainer) Wait(dumpLog bool) (int, error) {
 		exitCode = int(status.StatusCode)
 	}
 
+	// Log stream ends together with container, wait for its tail
+	if logsDone != nil {
+		select {
+		case <-logsDone:
+		case <-ctx.Done():
+		}
+	}
+
+	if exitCode != 0 {
+		return dc.checkOOM(ctx, exitCode)
+	}
+	return exitCode, nil
+}
+
+// checkOOM returns *contman.ExitError when the daemon has seen OOM killer in
+// the exited container
+func (dc *DockerContainer) checkOOM(ctx context.Context, exitCode int) (int, error) {
+	descr, err := dc.manager.client.ContainerInspect(ctx, dc.id)
+	if err != nil {
+		dc.GetLogger().WithError(err).Warn("Cannot check whether container was killed by OOM killer")
+	} else if descr.State.OOMKilled {
+		return exitCode, &contman.ExitError{ContainerID: dc.id, Code: exitCode, OOMKilled: true}
+	}
+	return exitCode, nil
+}
+
+// Exec tells an OOM kill of the command apart by OOM kill counter of the
+// container cgroup read before and after it, as the daemon keeps the
+// container marked since the first kill
+func (dc *DockerContainer) Exec(ctx context.Context, config contman.ExecConfig) (int, error) {
+	before, err := dc.oomKills(ctx)
+	if err != nil {
+		dc.GetLogger().WithError(err).Warn("Cannot read OOM events")
+	}
+	exitCode, execErr := dc.exec(ctx, config)
+	if execErr != nil || exitCode != killedExitCode || err != nil {
+		return exitCode, execErr
+	}
+	after, err := dc.oomKills(ctx)
+	if err != nil {
+		dc.GetLogger().WithError(err).Warn("Cannot read OOM events")
+	} else if after > before {
+		return exitCode, &contman.ExitError{ContainerID: dc.id, Code: exitCode, OOMKilled: true}
+	}
 	return exitCode, nil
 }
 
-func (dc *DockerContainer) CopyFrom(src, dest string) error {
-	ctx := dc.getContext()
+// oomKills returns number of processes of the running container killed by
+// OOM killer
+func (dc *DockerContainer) oomKills(ctx context.Context) (int, error) {
+	var out bytes.Buffer
+	if _, err := dc.exec(ctx, contman.ExecConfig{Cmd: cgroups.EventsScript, Stdout: &out}); err != nil {
+		return 0, err
+	}
+	return cgroups.OOMKills(out.Bytes()), nil
+}
+
+// exec runs command in the container returning its exit code
+func (dc *DockerContainer) exec(ctx context.Context, config contman.ExecConfig) (int, error) {
+	l := dc.GetLogger().WithField("cmd", config.Cmd)
+
+	resp, err := dc.manager.client.ContainerExecCreate(ctx, dc.id, types.ExecConfig{
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          formatEnv(config.Env),
+		WorkingDir:   config.WorkingDir,
+		Cmd:          []string{"sh", "-c", config.Cmd},
+	})
+	if err != nil {
+		l.WithError(err).Error("Error creating exec")
+		return 0, err
+	}
+
+	attach, err := dc.manager.client.ContainerExecAttach(ctx, resp.ID, types.ExecStartCheck{})
+	if err != nil {
+		l.WithError(err).Error("Error attaching to exec")
+		return 0, err
+	}
+	defer attach.Close()
+
+	if _, err := stdcopy.StdCopy(orDiscard(config.Stdout), orDiscard(config.Stderr), attach.Reader); err != nil {
+		l.WithError(err).Error("Error reading exec output")
+		return 0, err
+	}
+
+	// Output stream is closed a little before the daemon marks exec as
+	// finished, so poll until exit code becomes available
+	for {
+		inspect, err := dc.manager.client.ContainerExecInspect(ctx, resp.ID)
+		if err != nil {
+			l.WithError(err).Error("Error inspecting exec")
+			return 0, err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (dc *DockerContainer) CopyFrom(ctx context.Context, src, dest string) error {
 	l := dc.GetLogger().WithFields(log.Fields{
 		"src":  src,
 		"dest": dest,
 	})
 	reader, stat, err := dc.manager.client.CopyFromContainer(ctx, dc.id, src)
+	if client.IsErrNotFound(err) {
+		return fmt.Errorf("%w: %w", contman.ErrNotFound, err)
+	}
 	if err != nil {
 		l.WithError(err).Error("Error copying from container")
 		return err
@@ -98,7 +259,7 @@ func (dc *DockerContainer) CopyFrom(src, dest string) error {
 
 	l.Infof("Found in container: %v", stat)
 
-	err = extractTarFromReader(reader, dest)
+	err = archive.ExtractTarFromReader(reader, dc.hostPath(dest))
 	if err != nil {
 		l.WithError(err).Error("Error extracting from container")
 		return err
@@ -107,8 +268,7 @@ func (dc *DockerContainer) CopyFrom(src, dest string) error {
 	return nil
 }
 
-func (dc *DockerContainer) CopyTo(src, dest string) error {
-	ctx := dc.getContext()
+func (dc *DockerContainer) CopyTo(ctx context.Context, src, dest string) error {
 	l := log.WithFields(log.Fields{
 		"src":  src,
 		"dest": dest,
@@ -117,13 +277,11 @@ func (dc *DockerContainer) CopyTo(src, dest string) error {
 	defer reader.Close()
 
 	go func() {
-		defer writer.Close()
-		err := createTarToWriter(src, writer)
+		err := archive.CreateTarToWriter(dc.hostPath(src), src, writer)
 		if err != nil {
 			l.WithError(err).Error("Failed to create tar archive")
-			return
 		}
-
+		_ = writer.CloseWithError(err)
 	}()
 
 	err := dc.manager.client.CopyToContainer(ctx, dc.id, dest, reader, types.CopyToContainerOptions{})
@@ -135,15 +293,20 @@ func (dc *DockerContainer) CopyTo(src, dest string) error {
 	return nil
 }
 
-func (dc *DockerContainer) GetLogger() *log.Entry {
-	return log.WithField("containerID", dc.id)
+func orDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return ioutil.Discard
+	}
+	return w
 }
 
-func (dc *DockerContainer) getContext() context.Context {
-	select {
-	case <-dc.manager.context.Done():
-		return context.TODO()
-	default:
-		return dc.manager.context
+func (dc *DockerContainer) hostPath(path string) string {
+	if dc.hostDir == "" || filepath.IsAbs(path) {
+		return path
 	}
+	return filepath.Join(dc.hostDir, path)
+}
+
+func (dc *DockerContainer) GetLogger() *log.Entry {
+	return log.WithField("containerID", dc.id)
 }
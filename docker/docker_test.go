@@ -2,6 +2,7 @@ package docker
 
 import (
 	"testing"
+	"time"
 
 	"github.com/elemir/contman"
 )
@@ -11,13 +12,88 @@ var alpineReceipt = contman.Receipt{
 	Cmd:   "echo Hello World!",
 }
 
+var stepsReceipt = contman.Receipt{
+	Image: "alpine:latest",
+	Steps: []contman.Step{
+		{Cmd: "echo $GREETING", Env: map[string]string{"GREETING": "Hello World!"}},
+		{Cmd: "false", ContinueOnError: true},
+		{Cmd: "test \"$(pwd)\" = /tmp", WorkingDir: "/tmp"},
+	},
+}
+
 func TestRun(t *testing.T) {
 	dm, err := NewDockerManager()
 	if err != nil {
 		t.Error("Cannot create docker manager: ", err)
 	}
-	err = contman.RunReceipt(dm, alpineReceipt)
+	_, err = contman.RunReceipt(dm, alpineReceipt)
+	if err != nil {
+		t.Error("Cannot run receipt: ", err)
+	}
+}
+
+func TestRunSteps(t *testing.T) {
+	dm, err := NewDockerManager()
+	if err != nil {
+		t.Error("Cannot create docker manager: ", err)
+	}
+	_, err = contman.RunReceipt(dm, stepsReceipt)
 	if err != nil {
 		t.Error("Cannot run receipt: ", err)
 	}
 }
+
+func TestRunPipeline(t *testing.T) {
+	pipeline := contman.Pipeline{
+		Stages: []contman.Stage{
+			{
+				Name: "build",
+				Receipt: contman.Receipt{
+					Image:      "alpine:latest",
+					Cmd:        "mkdir -p /out && echo Hello World! > /out/hello",
+					OutputCopy: map[string]string{"/out": "."},
+				},
+			},
+			{
+				Name: "check",
+				Receipt: contman.Receipt{
+					Image:     "alpine:latest",
+					Cmd:       "grep -q Hello /in/out/hello",
+					InputCopy: map[string]string{"out": "/in"},
+				},
+				DependsOn: []string{"build"},
+			},
+		},
+	}
+
+	dm, err := NewDockerManager()
+	if err != nil {
+		t.Error("Cannot create docker manager: ", err)
+	}
+	_, err = contman.RunPipeline(dm, pipeline)
+	if err != nil {
+		t.Error("Cannot run pipeline: ", err)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	receipt := contman.Receipt{
+		Image:       "alpine:latest",
+		Cmd:         "sleep 60",
+		Timeout:     10 * time.Second,
+		StopTimeout: time.Second,
+	}
+
+	dm, err := NewDockerManager()
+	if err != nil {
+		t.Error("Cannot create docker manager: ", err)
+	}
+	_, err = contman.RunReceipt(dm, receipt)
+	timeoutErr, ok := err.(*contman.TimeoutError)
+	if !ok {
+		t.Fatal("Expected timeout error, got: ", err)
+	}
+	if timeoutErr.Phase != contman.PhaseRun && timeoutErr.Phase != contman.PhasePull {
+		t.Error("Unexpected timeout phase: ", timeoutErr.Phase)
+	}
+}
@@ -0,0 +1,94 @@
+package dockertest
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+var instructions = map[string]bool{
+	"ADD": true, "ARG": true, "CMD": true, "COPY": true, "ENTRYPOINT": true,
+	"ENV": true, "EXPOSE": true, "FROM": true, "HEALTHCHECK": true,
+	"LABEL": true, "MAINTAINER": true, "ONBUILD": true, "RUN": true,
+	"SHELL": true, "STOPSIGNAL": true, "USER": true, "VOLUME": true,
+	"WORKDIR": true,
+}
+
+// imageBuild builds image from Dockerfile of the context without running
+// anything, unknown instructions fail the build inside the output stream
+// like the daemon does
+func (s *Server) imageBuild(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dockerfile := query.Get("dockerfile")
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	data, err := readContextFile(r.Body, dockerfile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var steps []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			steps = append(steps, line)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	for i, step := range steps {
+		instruction := strings.ToUpper(strings.Fields(step)[0])
+		if !instructions[instruction] {
+			message := "Dockerfile parse error: unknown instruction: " + instruction
+			enc.Encode(map[string]interface{}{"errorDetail": map[string]string{"message": message}, "error": message})
+			return
+		}
+		enc.Encode(map[string]string{"stream": fmt.Sprintf("Step %d/%d : %s\n", i+1, len(steps), step)})
+	}
+
+	s.mu.Lock()
+	id := "sha256:" + s.newID("")
+	image := &types.ImageInspect{ID: id}
+	for _, tag := range query["t"] {
+		if !strings.Contains(tag, ":") {
+			tag += ":latest"
+		}
+		image.RepoTags = append(image.RepoTags, tag)
+		s.images[tag] = image
+	}
+	if len(image.RepoTags) == 0 {
+		s.images[id] = image
+	}
+	s.mu.Unlock()
+
+	enc.Encode(map[string]interface{}{"aux": types.BuildResult{ID: id}})
+	enc.Encode(map[string]string{"stream": "Successfully built " + id[7:19] + "\n"})
+}
+
+func readContextFile(r io.Reader, name string) ([]byte, error) {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Cannot locate specified Dockerfile: %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == name {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
@@ -0,0 +1,572 @@
+package dockertest
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+
+	"github.com/elemir/contman/internal/cgroups"
+)
+
+// Exit codes of processes terminated by stop and kill requests
+const (
+	StoppedExitCode = 143
+	KilledExitCode  = 137
+)
+
+// Process describes what happens when a command runs in the fake daemon
+type Process struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	// Files are written into container filesystem when the process exits
+	Files map[string]string
+	// Block keeps the process running until the container is stopped
+	Block bool
+	// OOMKilled marks container as killed by OOM killer, processes of execs
+	// leave the container running
+	OOMKilled bool
+}
+
+type file struct {
+	data []byte
+	mode int64
+	dir  bool
+}
+
+type Container struct {
+	mu sync.Mutex
+
+	ID               string
+	Name             string
+	ImageID          string
+	Config           *container.Config
+	HostConfig       *container.HostConfig
+	NetworkingConfig *network.NetworkingConfig
+
+	status    string
+	exitCode  int
+	oomKilled bool
+	// oomKills counts processes killed by OOM killer, which cgroup of the
+	// container reports to cgroups.EventsScript
+	oomKills int
+	stdout   bytes.Buffer
+	stderr   bytes.Buffer
+	files    map[string]file
+	exited   chan struct{}
+	removed  bool
+}
+
+func (c *Container) Status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+func (c *Container) Removed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removed
+}
+
+func (c *Container) ExitCode() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.exitCode
+}
+
+func (c *Container) WriteFile(name string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeFile(name, data)
+}
+
+func (c *Container) writeFile(name string, data []byte) {
+	name = path.Clean("/" + name)
+	c.files[name] = file{data: data, mode: 0644}
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		c.files[dir] = file{mode: 0755, dir: true}
+	}
+}
+
+func (c *Container) ReadFile(name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.files[path.Clean("/"+name)]
+	return f.data, ok && !f.dir
+}
+
+// finish applies results of p and marks container as exited, it must be
+// called with c.mu held.
+func (c *Container) finish(p Process) {
+	if c.status != "running" {
+		return
+	}
+	for name, data := range p.Files {
+		c.writeFile(name, []byte(data))
+	}
+	c.stdout.WriteString(p.Stdout)
+	c.stderr.WriteString(p.Stderr)
+	c.oomKilled = p.OOMKilled
+	c.terminate(p.ExitCode)
+}
+
+func (c *Container) terminate(exitCode int) {
+	c.status = "exited"
+	c.exitCode = exitCode
+	close(c.exited)
+}
+
+type exec struct {
+	id        string
+	container *Container
+	config    types.ExecConfig
+	running   bool
+	exitCode  int
+}
+
+// Container returns container by ID, including removed ones
+func (s *Server) Container(id string) *Container {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.containers[id]
+}
+
+func (s *Server) Containers() []*Container {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	containers := make([]*Container, 0, len(s.containers))
+	for _, c := range s.containers {
+		containers = append(containers, c)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ID < containers[j].ID })
+	return containers
+}
+
+func (s *Server) lookupContainer(w http.ResponseWriter, id string) *Container {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.containers {
+		if (c.ID == id || strings.HasPrefix(c.ID, id) || c.Name == id) && !c.Removed() {
+			return c
+		}
+	}
+	writeError(w, http.StatusNotFound, "No such container: "+id)
+	return nil
+}
+
+func (s *Server) containerCreate(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		*container.Config
+		HostConfig       *container.HostConfig
+		NetworkingConfig *network.NetworkingConfig
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	image := s.findImage(body.Config.Image)
+	if image == nil {
+		writeError(w, http.StatusNotFound, "No such image: "+body.Config.Image)
+		return
+	}
+
+	if body.HostConfig != nil {
+		for _, m := range body.HostConfig.Mounts {
+			if m.Type == mount.TypeVolume {
+				s.addVolume(m.Source, nil)
+			}
+		}
+	}
+
+	c := &Container{
+		ID:               s.newID("c"),
+		Name:             r.URL.Query().Get("name"),
+		ImageID:          image.ID,
+		Config:           body.Config,
+		HostConfig:       body.HostConfig,
+		NetworkingConfig: body.NetworkingConfig,
+		status:           "created",
+		files:            map[string]file{},
+		exited:           make(chan struct{}),
+	}
+	s.containers[c.ID] = c
+
+	writeJSON(w, http.StatusCreated, container.ContainerCreateCreatedBody{ID: c.ID})
+}
+
+func (s *Server) containerStart(w http.ResponseWriter, id string) {
+	c := s.lookupContainer(w, id)
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status == "running" {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if c.status != "created" {
+		writeError(w, http.StatusConflict, "container already finished")
+		return
+	}
+	c.status = "running"
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) containerWait(w http.ResponseWriter, id string) {
+	c := s.lookupContainer(w, id)
+	if c == nil {
+		return
+	}
+
+	p := s.process(append(c.Config.Entrypoint, c.Config.Cmd...))
+	if p.Block {
+		<-c.exited
+	} else {
+		c.mu.Lock()
+		c.finish(p)
+		c.mu.Unlock()
+	}
+
+	writeJSON(w, http.StatusOK, container.ContainerWaitOKBody{StatusCode: int64(c.ExitCode())})
+}
+
+func (s *Server) containerLogs(w http.ResponseWriter, r *http.Request, id string) {
+	c := s.lookupContainer(w, id)
+	if c == nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if r.URL.Query().Get("follow") == "1" {
+		// Client waits for headers before it starts waiting the container
+		w.(http.Flusher).Flush()
+		select {
+		case <-c.exited:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeOutput(w, c.Config.Tty, c.stdout.Bytes(), c.stderr.Bytes())
+}
+
+// writeOutput writes process output either raw or multiplexed the way
+// stdcopy expects it.
+func writeOutput(w io.Writer, tty bool, stdout, stderr []byte) {
+	if tty {
+		w.Write(stdout)
+		w.Write(stderr)
+		return
+	}
+	for stream, data := range [][]byte{1: stdout, 2: stderr} {
+		if len(data) == 0 {
+			continue
+		}
+		header := make([]byte, 8)
+		header[0] = byte(stream)
+		binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+		w.Write(header)
+		w.Write(data)
+	}
+}
+
+func (s *Server) containerInspect(w http.ResponseWriter, id string) {
+	c := s.lookupContainer(w, id)
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeJSON(w, http.StatusOK, types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    c.ID,
+			Name:  "/" + c.Name,
+			Image: c.ImageID,
+			State: &types.ContainerState{
+				Status:    c.status,
+				Running:   c.status == "running",
+				ExitCode:  c.exitCode,
+				OOMKilled: c.oomKilled,
+			},
+			HostConfig: c.HostConfig,
+		},
+		Config: c.Config,
+	})
+}
+
+func (s *Server) containerTerminate(w http.ResponseWriter, id string, exitCode int) {
+	c := s.lookupContainer(w, id)
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status != "running" {
+		if exitCode == KilledExitCode {
+			writeError(w, http.StatusConflict, "Container "+id+" is not running")
+		} else {
+			w.WriteHeader(http.StatusNotModified)
+		}
+		return
+	}
+	c.terminate(exitCode)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) containerRemove(w http.ResponseWriter, id string) {
+	c := s.lookupContainer(w, id)
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status == "running" {
+		writeError(w, http.StatusConflict, "You cannot remove a running container "+id)
+		return
+	}
+	c.removed = true
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) archiveGet(w http.ResponseWriter, r *http.Request, id string) {
+	c := s.lookupContainer(w, id)
+	if c == nil {
+		return
+	}
+
+	src := path.Clean("/" + r.URL.Query().Get("path"))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	root, ok := c.files[src]
+	if !ok && src != "/" {
+		writeError(w, http.StatusNotFound, "Could not find the file "+src+" in container "+id)
+		return
+	}
+
+	stat := types.ContainerPathStat{Name: path.Base(src), Size: int64(len(root.data)), Mode: os.FileMode(root.mode)}
+	if root.dir || src == "/" {
+		stat.Mode |= os.ModeDir
+	}
+	encoded, _ := json.Marshal(stat)
+	w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(encoded))
+	w.Header().Set("Content-Type", "application/x-tar")
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	var names []string
+	for name := range c.files {
+		if name == src || strings.HasPrefix(name, strings.TrimSuffix(src, "/")+"/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	for _, name := range names {
+		f := c.files[name]
+		header := &tar.Header{
+			Name:     strings.TrimPrefix(strings.TrimPrefix(name, path.Dir(src)), "/"),
+			Mode:     f.mode,
+			Size:     int64(len(f.data)),
+			Typeflag: tar.TypeReg,
+		}
+		if f.dir {
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+		}
+		tw.WriteHeader(header)
+		tw.Write(f.data)
+	}
+}
+
+func (s *Server) archivePut(w http.ResponseWriter, r *http.Request, id string) {
+	c := s.lookupContainer(w, id)
+	if c == nil {
+		return
+	}
+
+	dest := path.Clean("/" + r.URL.Query().Get("path"))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tr := tar.NewReader(r.Body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		name := path.Join(dest, header.Name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			c.files[name] = file{mode: header.Mode, dir: true}
+		case tar.TypeReg:
+			var buf bytes.Buffer
+			io.Copy(&buf, tr)
+			c.writeFile(name, buf.Bytes())
+			f := c.files[name]
+			f.mode = header.Mode
+			c.files[name] = f
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) execCreate(w http.ResponseWriter, r *http.Request, id string) {
+	c := s.lookupContainer(w, id)
+	if c == nil {
+		return
+	}
+
+	var config types.ExecConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if c.Status() != "running" {
+		writeError(w, http.StatusConflict, "Container "+id+" is not running")
+		return
+	}
+
+	s.mu.Lock()
+	e := &exec{id: s.newID("e"), container: c, config: config}
+	s.execs[e.id] = e
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, types.IDResponse{ID: e.id})
+}
+
+// Execs returns configs of all execs created in container id, except of
+// reads of OOM kill counters the manager does around every exec
+func (s *Server) Execs(id string) []types.ExecConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var execs []*exec
+	for _, e := range s.execs {
+		if e.container.ID == id && commandLine(e.config.Cmd) != cgroups.EventsScript {
+			execs = append(execs, e)
+		}
+	}
+	sort.Slice(execs, func(i, j int) bool { return execs[i].id < execs[j].id })
+
+	configs := make([]types.ExecConfig, len(execs))
+	for i, e := range execs {
+		configs[i] = e.config
+	}
+	return configs
+}
+
+func (s *Server) lookupExec(w http.ResponseWriter, id string) *exec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.execs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such exec instance: "+id)
+	}
+	return e
+}
+
+func (s *Server) execStart(w http.ResponseWriter, r *http.Request, id string) {
+	e := s.lookupExec(w, id)
+	if e == nil {
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "connection cannot be hijacked")
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "HTTP/1.1 101 UPGRADED\r\n"+
+		"Content-Type: application/vnd.docker.raw-stream\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: tcp\r\n\r\n")
+
+	s.mu.Lock()
+	e.running = true
+	s.mu.Unlock()
+
+	p := s.process(e.config.Cmd)
+	for name, data := range p.Files {
+		e.container.WriteFile(name, []byte(data))
+	}
+	e.container.mu.Lock()
+	if p.OOMKilled {
+		e.container.oomKilled = true
+		e.container.oomKills++
+	}
+	if commandLine(e.config.Cmd) == cgroups.EventsScript {
+		p.Stdout = fmt.Sprintf("oom 1\noom_kill %d\n", e.container.oomKills)
+	}
+	e.container.mu.Unlock()
+	writeOutput(conn, e.config.Tty, []byte(p.Stdout), []byte(p.Stderr))
+
+	s.mu.Lock()
+	e.running = false
+	e.exitCode = p.ExitCode
+	s.mu.Unlock()
+}
+
+func (s *Server) execInspect(w http.ResponseWriter, id string) {
+	e := s.lookupExec(w, id)
+	if e == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, types.ContainerExecInspect{
+		ExecID:      e.id,
+		ContainerID: e.container.ID,
+		Running:     e.running,
+		ExitCode:    e.exitCode,
+	})
+}
@@ -0,0 +1,285 @@
+package dockertest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// Pushed returns images pushed to the registry, pushed images become
+// available for pulling
+func (s *Server) Pushed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var refs []string
+	for ref := range s.pushed {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// uniqueImages returns every image once, images are stored under all their
+// tags. It must be called with s.mu held.
+func (s *Server) uniqueImages() []*types.ImageInspect {
+	seen := map[*types.ImageInspect]bool{}
+	var images []*types.ImageInspect
+	for _, image := range s.images {
+		if !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images
+}
+
+func imageLabels(image *types.ImageInspect) map[string]string {
+	if image.Config == nil {
+		return nil
+	}
+	return image.Config.Labels
+}
+
+// matchImage applies dangling, label and reference filters to image
+func matchImage(args filters.Args, image *types.ImageInspect) bool {
+	if args.Include("dangling") && args.ExactMatch("dangling", "true") != (len(image.RepoTags) == 0) {
+		return false
+	}
+	if !args.MatchKVList("label", imageLabels(image)) {
+		return false
+	}
+	if !args.Include("reference") {
+		return true
+	}
+	for _, tag := range image.RepoTags {
+		for _, pattern := range args.Get("reference") {
+			if ok, _ := path.Match(pattern, tag); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, strings.TrimSuffix(tag, ":latest")); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) imageList(w http.ResponseWriter, r *http.Request) {
+	args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summaries := []types.ImageSummary{}
+	for _, image := range s.uniqueImages() {
+		if !matchImage(args, image) {
+			continue
+		}
+		summaries = append(summaries, types.ImageSummary{
+			ID:          image.ID,
+			RepoTags:    image.RepoTags,
+			RepoDigests: image.RepoDigests,
+			Labels:      imageLabels(image),
+			Size:        image.Size,
+		})
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// imagePush pushes image, or every tag of the repository when no tag is
+// given. Like registries do, pushing without credentials is denied inside
+// the output stream.
+func (s *Server) imagePush(w http.ResponseWriter, r *http.Request, name string) {
+	var auth types.AuthConfig
+	data, _ := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth"))
+	_ = json.Unmarshal(data, &auth)
+	authorized := auth.Username != "" || auth.IdentityToken != "" || auth.RegistryToken != ""
+
+	s.mu.Lock()
+	var refs []string
+	for ref := range s.images {
+		if tag := r.URL.Query().Get("tag"); ref == name+":"+tag || tag == "" && strings.HasPrefix(ref, name+":") {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+	if len(refs) > 0 && authorized {
+		for _, ref := range refs {
+			s.registry[ref] = s.images[ref]
+			s.pushed[ref] = true
+		}
+	}
+	s.mu.Unlock()
+
+	if len(refs) == 0 {
+		writeError(w, http.StatusNotFound, "An image does not exist locally with the tag: "+name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]string{"status": "The push refers to repository [" + name + "]"})
+	if !authorized {
+		message := "denied: requested access to the resource is denied"
+		enc.Encode(map[string]interface{}{"errorDetail": map[string]string{"message": message}, "error": message})
+		return
+	}
+	for _, ref := range refs {
+		enc.Encode(map[string]string{"status": "Pushed", "id": shortID(s.images[ref].ID)})
+		enc.Encode(map[string]string{"status": ref[len(name)+1:] + ": digest: " + s.images[ref].ID})
+	}
+}
+
+func (s *Server) imageTag(w http.ResponseWriter, r *http.Request, name string) {
+	ref := r.URL.Query().Get("repo") + ":" + r.URL.Query().Get("tag")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	image := s.findImage(name)
+	if image == nil {
+		writeError(w, http.StatusNotFound, "No such image: "+name)
+		return
+	}
+	if old, ok := s.images[ref]; ok {
+		untag(old, ref)
+	}
+	delete(s.images, image.ID)
+	s.images[ref] = image
+	image.RepoTags = append(image.RepoTags, ref)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func untag(image *types.ImageInspect, ref string) {
+	var tags []string
+	for _, tag := range image.RepoTags {
+		if tag != ref {
+			tags = append(tags, tag)
+		}
+	}
+	image.RepoTags = tags
+}
+
+// usedImages returns IDs of images of containers which are not removed, it
+// must be called with s.mu held
+func (s *Server) usedImages() map[string]bool {
+	used := map[string]bool{}
+	for _, c := range s.containers {
+		c.mu.Lock()
+		if !c.removed {
+			used[c.ImageID] = true
+		}
+		c.mu.Unlock()
+	}
+	return used
+}
+
+// deleteImage removes image with all its tags, it must be called with s.mu
+// held
+func (s *Server) deleteImage(image *types.ImageInspect) []types.ImageDeleteResponseItem {
+	var items []types.ImageDeleteResponseItem
+	for ref, i := range s.images {
+		if i == image {
+			delete(s.images, ref)
+			if ref != image.ID {
+				items = append(items, types.ImageDeleteResponseItem{Untagged: ref})
+			}
+		}
+	}
+	return append(items, types.ImageDeleteResponseItem{Deleted: image.ID})
+}
+
+// imageRemove untags image referenced by a tag when it has other ones,
+// otherwise removes it unless it is used by a container or force is set
+func (s *Server) imageRemove(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	image := s.findImage(name)
+	if image == nil {
+		writeError(w, http.StatusNotFound, "No such image: "+name)
+		return
+	}
+	if _, tagged := s.images[name]; tagged && name != image.ID && len(image.RepoTags) > 1 {
+		delete(s.images, name)
+		untag(image, name)
+		writeJSON(w, http.StatusOK, []types.ImageDeleteResponseItem{{Untagged: name}})
+		return
+	}
+	if s.usedImages()[image.ID] && r.URL.Query().Get("force") != "1" {
+		writeError(w, http.StatusConflict, fmt.Sprintf("conflict: unable to remove repository reference %q - container is using its referenced image %s", name, shortID(image.ID)))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.deleteImage(image))
+}
+
+// imagePrune removes images not used by containers, only dangling ones
+// unless dangling filter is false
+func (s *Server) imagePrune(w http.ResponseWriter, r *http.Request) {
+	args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !args.Include("dangling") {
+		args.Add("dangling", "true")
+	} else if args.ExactMatch("dangling", "false") {
+		args.Del("dangling", "false")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used := s.usedImages()
+	report := types.ImagesPruneReport{ImagesDeleted: []types.ImageDeleteResponseItem{}}
+	for _, image := range s.uniqueImages() {
+		if !used[image.ID] && matchImage(args, image) {
+			report.ImagesDeleted = append(report.ImagesDeleted, s.deleteImage(image)...)
+		}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// distributionInspect reports the first repo digest of the registry image
+func (s *Server) distributionInspect(w http.ResponseWriter, name string) {
+	s.mu.Lock()
+	image, ok := s.registry[name]
+	if !ok {
+		image = matchRef(s.registry, name)
+	}
+	s.mu.Unlock()
+
+	if image == nil || len(image.RepoDigests) == 0 {
+		writeError(w, http.StatusNotFound, "manifest unknown")
+		return
+	}
+	ref, err := reference.ParseNormalizedNamed(image.RepoDigests[0])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	canonical, ok := ref.(reference.Canonical)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "no digest in "+image.RepoDigests[0])
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"Descriptor": map[string]interface{}{
+			"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+			"digest":    canonical.Digest().String(),
+		},
+	})
+}
@@ -0,0 +1,425 @@
+// Package dockertest provides a stand-in for Docker Engine API, which allows
+// testing the docker backend without a running daemon.
+package dockertest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+const APIVersion = "1.37"
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// Request is a request received by the server, Path has no API version
+// prefix.
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+type failure struct {
+	status  int
+	message string
+}
+
+type Server struct {
+	mu sync.Mutex
+
+	server     *httptest.Server
+	requests   []Request
+	failures   map[string]failure
+	images     map[string]*types.ImageInspect
+	registry   map[string]*types.ImageInspect
+	pushed     map[string]bool
+	brokenPull map[string]string
+	containers map[string]*Container
+	execs      map[string]*exec
+	processes  map[string]Process
+	volumes    map[string]*types.Volume
+	lastID     int
+}
+
+func NewServer() *Server {
+	s := newServer()
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewTLSServer starts server serving TLS with a self-signed certificate,
+// which is returned by CACertificate
+func NewTLSServer() *Server {
+	s := newServer()
+	s.server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func newServer() *Server {
+	return &Server{
+		failures:   map[string]failure{},
+		images:     map[string]*types.ImageInspect{},
+		registry:   map[string]*types.ImageInspect{},
+		pushed:     map[string]bool{},
+		brokenPull: map[string]string{},
+		containers: map[string]*Container{},
+		execs:      map[string]*exec{},
+		processes:  map[string]Process{},
+		volumes:    map[string]*types.Volume{},
+	}
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Host returns address of the server suitable for DOCKER_HOST
+func (s *Server) Host() string {
+	return "tcp://" + s.server.Listener.Addr().String()
+}
+
+// CACertificate returns PEM encoded certificate of TLS server
+func (s *Server) CACertificate() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw})
+}
+
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// RequestsTo returns recorded requests handled by route
+func (s *Server) RequestsTo(route string) []Request {
+	var requests []Request
+	for _, req := range s.Requests() {
+		if r, _ := matchRoute(req.Method, req.Path); r == route {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+// Fail makes every request to route fail with given HTTP status. Routes are
+// named after the API operations: "ping", "container-create",
+// "container-start", "container-wait", "container-logs",
+// "container-inspect", "container-stop", "container-kill",
+// "container-remove", "archive-get", "archive-put", "exec-create",
+// "exec-start", "exec-inspect", "image-list", "image-pull",
+// "image-inspect", "image-build", "image-push", "image-tag",
+// "image-remove", "image-prune", "distribution-inspect", "volume-create",
+// "volume-list" and "volume-prune".
+func (s *Server) Fail(route string, status int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[route] = failure{status: status, message: message}
+}
+
+// AddImage puts image into local image store of the daemon
+func (s *Server) AddImage(ref, id string, repoDigests ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[ref] = &types.ImageInspect{ID: id, RepoTags: []string{ref}, RepoDigests: repoDigests}
+}
+
+// AddRemoteImage makes image available for pulling
+func (s *Server) AddRemoteImage(ref, id string, repoDigests ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registry[ref] = &types.ImageInspect{ID: id, RepoTags: []string{ref}, RepoDigests: repoDigests}
+}
+
+// BreakPull makes pulls of ref fail with message reported inside the stream
+// after the download starts, as the daemon does for failed layers
+func (s *Server) BreakPull(ref, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.brokenPull[ref] = message
+}
+
+func (s *Server) HasImage(ref string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.images[ref]
+	return ok
+}
+
+// OnCmd sets the process run for command line cmd, both in containers and
+// execs. Commands run by shell are matched by the script passed to "sh -c".
+// Process for empty cmd is used for commands without their own one.
+func (s *Server) OnCmd(cmd string, p Process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processes[cmd] = p
+}
+
+func (s *Server) process(cmd []string) Process {
+	line := commandLine(cmd)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.processes[line]; ok {
+		return p
+	}
+	return s.processes[""]
+}
+
+func commandLine(cmd []string) string {
+	if len(cmd) == 3 && cmd[0] == "sh" && cmd[1] == "-c" {
+		return cmd[2]
+	}
+	return strings.Join(cmd, " ")
+}
+
+func (s *Server) newID(prefix string) string {
+	s.lastID++
+	return fmt.Sprintf("%s%0*d", prefix, 64-len(prefix), s.lastID)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	path := versionPrefix.ReplaceAllString(r.URL.Path, "/")
+	route, params := matchRoute(r.Method, path)
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{
+		Method: r.Method,
+		Path:   path,
+		Query:  r.URL.Query(),
+		Header: r.Header,
+		Body:   body,
+	})
+	fail, failed := s.failures[route]
+	s.mu.Unlock()
+
+	w.Header().Set("API-Version", APIVersion)
+	w.Header().Set("OSType", "linux")
+
+	if failed {
+		writeError(w, fail.status, fail.message)
+		return
+	}
+
+	switch route {
+	case "ping":
+		w.Write([]byte("OK"))
+	case "container-create":
+		s.containerCreate(w, r)
+	case "container-start":
+		s.containerStart(w, params[0])
+	case "container-wait":
+		s.containerWait(w, params[0])
+	case "container-logs":
+		s.containerLogs(w, r, params[0])
+	case "container-inspect":
+		s.containerInspect(w, params[0])
+	case "container-stop":
+		s.containerTerminate(w, params[0], StoppedExitCode)
+	case "container-kill":
+		s.containerTerminate(w, params[0], KilledExitCode)
+	case "container-remove":
+		s.containerRemove(w, params[0])
+	case "archive-get":
+		s.archiveGet(w, r, params[0])
+	case "archive-put":
+		s.archivePut(w, r, params[0])
+	case "exec-create":
+		s.execCreate(w, r, params[0])
+	case "exec-start":
+		s.execStart(w, r, params[0])
+	case "exec-inspect":
+		s.execInspect(w, params[0])
+	case "image-list":
+		s.imageList(w, r)
+	case "image-pull":
+		s.imagePull(w, r)
+	case "image-inspect":
+		s.imageInspect(w, params[0])
+	case "image-build":
+		s.imageBuild(w, r)
+	case "image-push":
+		s.imagePush(w, r, params[0])
+	case "image-tag":
+		s.imageTag(w, r, params[0])
+	case "image-remove":
+		s.imageRemove(w, r, params[0])
+	case "image-prune":
+		s.imagePrune(w, r)
+	case "distribution-inspect":
+		s.distributionInspect(w, params[0])
+	case "volume-create":
+		s.volumeCreate(w, r)
+	case "volume-list":
+		s.volumeList(w, r)
+	case "volume-prune":
+		s.volumePrune(w, r)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("page not found: %s %s", r.Method, path))
+	}
+}
+
+var routes = []struct {
+	method  string
+	pattern *regexp.Regexp
+	name    string
+}{
+	{"GET", regexp.MustCompile(`^/_ping$`), "ping"},
+	{"POST", regexp.MustCompile(`^/containers/create$`), "container-create"},
+	{"POST", regexp.MustCompile(`^/containers/([^/]+)/start$`), "container-start"},
+	{"POST", regexp.MustCompile(`^/containers/([^/]+)/wait$`), "container-wait"},
+	{"GET", regexp.MustCompile(`^/containers/([^/]+)/logs$`), "container-logs"},
+	{"GET", regexp.MustCompile(`^/containers/([^/]+)/json$`), "container-inspect"},
+	{"POST", regexp.MustCompile(`^/containers/([^/]+)/stop$`), "container-stop"},
+	{"POST", regexp.MustCompile(`^/containers/([^/]+)/kill$`), "container-kill"},
+	{"DELETE", regexp.MustCompile(`^/containers/([^/]+)$`), "container-remove"},
+	{"GET", regexp.MustCompile(`^/containers/([^/]+)/archive$`), "archive-get"},
+	{"HEAD", regexp.MustCompile(`^/containers/([^/]+)/archive$`), "archive-get"},
+	{"PUT", regexp.MustCompile(`^/containers/([^/]+)/archive$`), "archive-put"},
+	{"POST", regexp.MustCompile(`^/containers/([^/]+)/exec$`), "exec-create"},
+	{"POST", regexp.MustCompile(`^/exec/([^/]+)/start$`), "exec-start"},
+	{"GET", regexp.MustCompile(`^/exec/([^/]+)/json$`), "exec-inspect"},
+	{"GET", regexp.MustCompile(`^/images/json$`), "image-list"},
+	{"POST", regexp.MustCompile(`^/images/create$`), "image-pull"},
+	{"GET", regexp.MustCompile(`^/images/(.+)/json$`), "image-inspect"},
+	{"POST", regexp.MustCompile(`^/build$`), "image-build"},
+	{"POST", regexp.MustCompile(`^/images/prune$`), "image-prune"},
+	{"POST", regexp.MustCompile(`^/images/(.+)/push$`), "image-push"},
+	{"POST", regexp.MustCompile(`^/images/(.+)/tag$`), "image-tag"},
+	{"DELETE", regexp.MustCompile(`^/images/(.+)$`), "image-remove"},
+	{"GET", regexp.MustCompile(`^/distribution/(.+)/json$`), "distribution-inspect"},
+	{"POST", regexp.MustCompile(`^/volumes/create$`), "volume-create"},
+	{"GET", regexp.MustCompile(`^/volumes$`), "volume-list"},
+	{"POST", regexp.MustCompile(`^/volumes/prune$`), "volume-prune"},
+}
+
+func matchRoute(method, path string) (string, []string) {
+	for _, route := range routes {
+		if route.method != method {
+			continue
+		}
+		if m := route.pattern.FindStringSubmatch(path); m != nil {
+			return route.name, m[1:]
+		}
+	}
+	return "", nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
+
+func (s *Server) imagePull(w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("fromImage")
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		ref += ":" + tag
+	}
+
+	s.mu.Lock()
+	image, ok := s.registry[ref]
+	broken, isBroken := s.brokenPull[ref]
+	if ok && !isBroken {
+		s.images[ref] = image
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("pull access denied for %s, repository does not exist", ref))
+		return
+	}
+
+	layer := shortID(image.ID)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]string{"status": "Pulling from " + ref})
+	enc.Encode(map[string]string{"status": "Pulling fs layer", "id": layer})
+	for _, current := range []int64{512, 1024} {
+		enc.Encode(map[string]interface{}{
+			"status":         "Downloading",
+			"id":             layer,
+			"progressDetail": map[string]int64{"current": current, "total": 1024},
+		})
+	}
+	if isBroken {
+		enc.Encode(map[string]interface{}{"error": broken, "errorDetail": map[string]string{"message": broken}})
+		return
+	}
+	enc.Encode(map[string]string{"status": "Download complete", "id": layer})
+	enc.Encode(map[string]string{"status": "Status: Downloaded newer image for " + ref})
+}
+
+// shortID is the 12 character form of an image or layer ID, it is derived
+// from a hash, so images added by tests may have IDs of any length
+func shortID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func (s *Server) findImage(name string) *types.ImageInspect {
+	if image, ok := s.images[name]; ok {
+		return image
+	}
+	for _, image := range s.images {
+		if image.ID == name {
+			return image
+		}
+	}
+	return matchRef(s.images, name)
+}
+
+// matchRef finds image by its reference the way the daemon does, short
+// names are normalized and digest references match repo digests
+func matchRef(images map[string]*types.ImageInspect, name string) *types.ImageInspect {
+	ref := normalizeRef(name)
+	for _, image := range images {
+		for _, r := range append(append([]string(nil), image.RepoTags...), image.RepoDigests...) {
+			if normalizeRef(r) == ref {
+				return image
+			}
+		}
+	}
+	return nil
+}
+
+func normalizeRef(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.TagNameOnly(named).String()
+}
+
+func (s *Server) imageInspect(w http.ResponseWriter, name string) {
+	s.mu.Lock()
+	image := s.findImage(name)
+	s.mu.Unlock()
+
+	if image == nil {
+		writeError(w, http.StatusNotFound, "No such image: "+name)
+		return
+	}
+	writeJSON(w, http.StatusOK, image)
+}
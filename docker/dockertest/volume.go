@@ -0,0 +1,110 @@
+package dockertest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	volumetypes "github.com/docker/docker/api/types/volume"
+)
+
+// HasVolume tells whether volume exists in the daemon
+func (s *Server) HasVolume(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.volumes[name]
+	return ok
+}
+
+// addVolume creates volume unless it exists, it must be called with s.mu
+// held
+func (s *Server) addVolume(name string, labels map[string]string) *types.Volume {
+	if v, ok := s.volumes[name]; ok {
+		return v
+	}
+	v := &types.Volume{Name: name, Driver: "local", Labels: labels, Mountpoint: "/var/lib/docker/volumes/" + name + "/_data", Scope: "local"}
+	s.volumes[name] = v
+	return v
+}
+
+func (s *Server) volumeCreate(w http.ResponseWriter, r *http.Request) {
+	var body volumetypes.VolumeCreateBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if body.Name == "" {
+		body.Name = s.newID("v")
+	}
+	writeJSON(w, http.StatusCreated, s.addVolume(body.Name, body.Labels))
+}
+
+// matchVolumes returns volumes matching label filters of request sorted by
+// name, it must be called with s.mu held
+func (s *Server) matchVolumes(w http.ResponseWriter, r *http.Request) ([]*types.Volume, bool) {
+	args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	var volumes []*types.Volume
+	for _, v := range s.volumes {
+		if args.MatchKVList("label", v.Labels) {
+			volumes = append(volumes, v)
+		}
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, true
+}
+
+func (s *Server) volumeList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	volumes, ok := s.matchVolumes(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, volumetypes.VolumeListOKBody{Volumes: volumes, Warnings: []string{}})
+}
+
+// volumePrune removes volumes which are not mounted by any container that
+// is not removed
+func (s *Server) volumePrune(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	volumes, ok := s.matchVolumes(w, r)
+	if !ok {
+		return
+	}
+
+	used := map[string]bool{}
+	for _, c := range s.containers {
+		c.mu.Lock()
+		if !c.removed && c.HostConfig != nil {
+			for _, m := range c.HostConfig.Mounts {
+				if m.Type == mount.TypeVolume {
+					used[m.Source] = true
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	report := types.VolumesPruneReport{VolumesDeleted: []string{}}
+	for _, v := range volumes {
+		if !used[v.Name] {
+			delete(s.volumes, v.Name)
+			report.VolumesDeleted = append(report.VolumesDeleted, v.Name)
+		}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -1,24 +1,25 @@
 package docker
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"runtime"
 	"sync"
 
-	"github.com/docker/cli/cli/command"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/pkg/ioutils"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/docker/pkg/term"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/net/context"
 )
 
 /*
 
 This is copy from https://github.com/docker/cli/blob/feb4d7993554f707a50ba9e57e8b2e996456753d/cli/command/container/hijack.go
-There is no way to import this because of private methods and types
+There is no way to import this because of private methods and types.
+Streams of docker CLI are replaced by terminal, so docker/cli with its
+dependencies is not required.
 
 */
 
@@ -29,7 +30,7 @@ var defaultEscapeKeys = []byte{16, 17}
 // A hijackedIOStreamer handles copying input to and output from streams to the
 // connection.
 type hijackedIOStreamer struct {
-	streams      command.Streams
+	terminal     *terminal
 	inputStream  io.ReadCloser
 	outputStream io.Writer
 	errorStream  io.Writer
@@ -85,7 +86,7 @@ func (h *hijackedIOStreamer) setupInput() (restore func(), err error) {
 		return func() {}, nil
 	}
 
-	if err := setRawTerminal(h.streams); err != nil {
+	if err := h.terminal.setRaw(); err != nil {
 		return nil, fmt.Errorf("unable to set IO streams as raw terminal: %s", err)
 	}
 
@@ -94,7 +95,7 @@ func (h *hijackedIOStreamer) setupInput() (restore func(), err error) {
 	var restoreOnce sync.Once
 	restore = func() {
 		restoreOnce.Do(func() {
-			restoreTerminal(h.streams, h.inputStream)
+			restoreTerminal(h.terminal, h.inputStream)
 		})
 	}
 
@@ -185,17 +186,44 @@ func (h *hijackedIOStreamer) beginInputStream(restoreInput func()) (doneC <-chan
 	return inputDone, detached
 }
 
-func setRawTerminal(streams command.Streams) error {
-	if err := streams.In().SetRawTerminal(); err != nil {
+// terminal keeps state of input and output terminals, which are switched
+// to raw mode while the connection is hijacked
+type terminal struct {
+	in, out           uintptr
+	inState, outState *term.State
+}
+
+// newTerminal returns terminal of in and out, ok tells whether in is a
+// terminal
+func newTerminal(in, out interface{}) (t *terminal, ok bool) {
+	t = &terminal{}
+	t.in, ok = term.GetFdInfo(in)
+	t.out, _ = term.GetFdInfo(out)
+	return t, ok
+}
+
+func (t *terminal) setRaw() (err error) {
+	if t.inState, err = term.SetRawTerminal(t.in); err != nil {
 		return err
 	}
-	return streams.Out().SetRawTerminal()
+	if term.IsTerminal(t.out) {
+		t.outState, err = term.SetRawTerminalOutput(t.out)
+	}
+	return err
+}
+
+func (t *terminal) restore() {
+	if t.inState != nil {
+		term.RestoreTerminal(t.in, t.inState)
+	}
+	if t.outState != nil {
+		term.RestoreTerminal(t.out, t.outState)
+	}
 }
 
 // nolint: unparam
-func restoreTerminal(streams command.Streams, in io.Closer) error {
-	streams.In().RestoreTerminal()
-	streams.Out().RestoreTerminal()
+func restoreTerminal(t *terminal, in io.Closer) error {
+	t.restore()
 	// WARNING: DO NOT REMOVE THE OS CHECKS !!!
 	// For some reason this Close call blocks on darwin..
 	// As the client exits right after, simply discard the close
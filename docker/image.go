@@ -0,0 +1,175 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/jsonstream"
+	"github.com/elemir/contman/internal/references"
+)
+
+func (dm *DockerManager) PushImage(ctx context.Context, image string) error {
+	authStr, err := dm.registryAuth(ctx, image)
+	if err != nil {
+		return err
+	}
+
+	out, err := dm.client.ImagePush(ctx, image, types.ImagePushOptions{RegistryAuth: authStr})
+	if err != nil {
+		log.WithError(err).Error("Error pushing image")
+		return err
+	}
+	defer func() { _ = out.Close() }()
+
+	// Push errors are reported inside the stream after 200 status
+	logger := log.WithField("image", image)
+	err = jsonstream.Decode(out, func(msg jsonstream.Message) {
+		if msg.ID != "" {
+			logger.WithField("layer", msg.ID).Debug(msg.Status)
+		} else if msg.Status != "" {
+			logger.Debug(msg.Status)
+		}
+	})
+	if err != nil {
+		log.WithError(err).Error("Error pushing image")
+	}
+	return err
+}
+
+func (dm *DockerManager) TagImage(ctx context.Context, source, target string) error {
+	err := dm.client.ImageTag(ctx, source, target)
+	if err == nil {
+		return nil
+	}
+	// tag errors are not typed by the client, unlike inspect ones
+	if _, _, inspectErr := dm.client.ImageInspectWithRaw(ctx, source); client.IsErrNotFound(inspectErr) {
+		return fmt.Errorf("image %s: %w", source, contman.ErrNotFound)
+	}
+	log.WithError(err).Error("Error tagging image")
+	return err
+}
+
+func (dm *DockerManager) RemoveImage(ctx context.Context, image string, force bool) error {
+	_, err := dm.client.ImageRemove(ctx, image, types.ImageRemoveOptions{Force: force, PruneChildren: true})
+	if client.IsErrNotFound(err) {
+		return fmt.Errorf("image %s: %w", image, contman.ErrNotFound)
+	}
+	if err != nil {
+		log.WithError(err).Error("Error removing image")
+	}
+	return err
+}
+
+func (dm *DockerManager) ListImages(ctx context.Context, filter contman.ImageFilter) ([]contman.Image, error) {
+	args := labelFilters(filter.Labels)
+	if filter.Reference != "" {
+		args.Add("reference", filter.Reference)
+	}
+	if filter.Dangling {
+		args.Add("dangling", "true")
+	}
+	summaries, err := dm.client.ImageList(ctx, types.ImageListOptions{Filters: args})
+	if err != nil {
+		log.WithError(err).Error("Error listing images")
+		return nil, err
+	}
+
+	images := make([]contman.Image, 0, len(summaries))
+	for _, s := range summaries {
+		images = append(images, contman.Image{
+			ID:      s.ID,
+			Tags:    namedRefs(s.RepoTags),
+			Digests: namedRefs(s.RepoDigests),
+			Labels:  s.Labels,
+			Size:    s.Size,
+			Created: time.Unix(s.Created, 0),
+		})
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images, nil
+}
+
+func (dm *DockerManager) PruneImages(ctx context.Context, filter contman.ImageFilter) ([]string, error) {
+	if filter.Reference != "" {
+		return nil, errors.New("images cannot be pruned by reference")
+	}
+	args := labelFilters(filter.Labels)
+	args.Add("dangling", fmt.Sprint(filter.Dangling))
+
+	report, err := dm.client.ImagesPrune(ctx, args)
+	if err != nil {
+		log.WithError(err).Error("Error pruning images")
+		return nil, err
+	}
+	return prunedImages(report.ImagesDeleted), nil
+}
+
+// namedRefs drops "<none>:<none>" placeholders daemon reports for dangling
+// images
+func namedRefs(refs []string) []string {
+	var result []string
+	for _, ref := range refs {
+		if ref != "<none>:<none>" && ref != "<none>@<none>" {
+			result = append(result, ref)
+		}
+	}
+	return result
+}
+
+func prunedImages(items []types.ImageDeleteResponseItem) []string {
+	ids := []string{}
+	for _, item := range items {
+		if item.Deleted != "" {
+			ids = append(ids, item.Deleted)
+		}
+	}
+	return ids
+}
+
+// LocalDigest returns the repo digest of local image for the repository of
+// image reference
+func (dm *DockerManager) LocalDigest(ctx context.Context, image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+
+	info, _, err := dm.client.ImageInspectWithRaw(ctx, image)
+	if client.IsErrNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		log.WithError(err).Error("Unable to inspect image")
+		return "", err
+	}
+
+	if canonical := references.RepoDigest(info.RepoDigests, named); canonical != nil {
+		return canonical.Digest().String(), nil
+	}
+	return "", nil
+}
+
+// RemoteDigest asks the daemon for the manifest digest in the registry
+func (dm *DockerManager) RemoteDigest(ctx context.Context, image string) (string, error) {
+	authStr, err := dm.registryAuth(ctx, image)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := dm.client.DistributionInspect(ctx, image, authStr)
+	if err != nil {
+		log.WithError(err).Error("Error inspecting image in registry")
+		return "", err
+	}
+	return info.Descriptor.Digest.String(), nil
+}
@@ -0,0 +1,205 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/docker/dockertest"
+)
+
+func TestImages(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "contman-docker-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	auth := base64.StdEncoding.EncodeToString([]byte("ci:secret"))
+	config := `{"auths": {"registry.example.com": {"auth": "` + auth + `"}}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer setEnv(map[string]string{"DOCKER_CONFIG": dir})()
+
+	ctx := context.Background()
+	if err := dm.PullImage(ctx, "alpine:latest"); err != nil {
+		t.Fatal("Cannot pull image: ", err)
+	}
+	if err := dm.TagImage(ctx, "alpine:latest", "registry.example.com/base:1.0"); err != nil {
+		t.Fatal("Cannot tag image: ", err)
+	}
+	if err := dm.TagImage(ctx, "missing:latest", "registry.example.com/missing"); !errors.Is(err, contman.ErrNotFound) {
+		t.Error("Unexpected error tagging missing image: ", err)
+	}
+
+	if err := dm.PushImage(ctx, "registry.example.com/base:1.0"); err != nil {
+		t.Fatal("Cannot push image: ", err)
+	}
+	if pushed := srv.Pushed(); !reflect.DeepEqual(pushed, []string{"registry.example.com/base:1.0"}) {
+		t.Errorf("Unexpected pushed images: %v", pushed)
+	}
+	var authConfig types.AuthConfig
+	header, _ := base64.URLEncoding.DecodeString(srv.RequestsTo("image-push")[0].Header.Get("X-Registry-Auth"))
+	if err := json.Unmarshal(header, &authConfig); err != nil || authConfig.Username != "ci" || authConfig.Password != "secret" {
+		t.Errorf("Unexpected registry auth: %s", header)
+	}
+	if err := dm.PushImage(ctx, "alpine:latest"); err == nil || err.Error() != "denied: requested access to the resource is denied" {
+		t.Error("Unexpected error pushing without credentials: ", err)
+	}
+
+	images, err := dm.ListImages(ctx, contman.ImageFilter{Reference: "registry.example.com/*"})
+	if err != nil || len(images) != 1 || !reflect.DeepEqual(images[0].Tags, []string{"alpine:latest", "registry.example.com/base:1.0"}) {
+		t.Errorf("Unexpected images: %+v, %v", images, err)
+	}
+	if err := dm.RemoveImage(ctx, "registry.example.com/base:1.0", false); err != nil {
+		t.Fatal("Cannot untag image: ", err)
+	}
+
+	cntr, err := dm.ContainerCreate(ctx, contman.Config{Image: "alpine:latest", Cmd: "true"})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	if err := dm.RemoveImage(ctx, "alpine:latest", false); err == nil {
+		t.Error("Image used by container is removed")
+	}
+	if pruned, err := dm.PruneImages(ctx, contman.ImageFilter{}); err != nil || len(pruned) != 0 {
+		t.Errorf("Unexpected pruned images: %v, %v", pruned, err)
+	}
+	if err := cntr.Remove(ctx); err != nil {
+		t.Fatal("Cannot remove container: ", err)
+	}
+
+	if _, err := dm.BuildImage(ctx, contman.BuildSpec{Context: writeBuildContext(t, map[string]string{"Dockerfile": "FROM alpine\n"})}); err != nil {
+		t.Fatal("Cannot build image: ", err)
+	}
+	dangling, err := dm.ListImages(ctx, contman.ImageFilter{Dangling: true})
+	if err != nil || len(dangling) != 1 {
+		t.Fatalf("Unexpected dangling images: %+v, %v", dangling, err)
+	}
+	if pruned, err := dm.PruneImages(ctx, contman.ImageFilter{Dangling: true}); err != nil || !reflect.DeepEqual(pruned, []string{dangling[0].ID}) {
+		t.Errorf("Unexpected pruned images: %v, %v", pruned, err)
+	}
+	if pruned, err := dm.PruneImages(ctx, contman.ImageFilter{}); err != nil || !reflect.DeepEqual(pruned, []string{alpineID}) {
+		t.Errorf("Unexpected pruned images: %v, %v", pruned, err)
+	}
+	if err := dm.RemoveImage(ctx, "alpine:latest", true); !errors.Is(err, contman.ErrNotFound) {
+		t.Error("Unexpected error removing pruned image: ", err)
+	}
+	if _, err := dm.PruneImages(ctx, contman.ImageFilter{Reference: "alpine"}); err == nil {
+		t.Error("Pruning by reference is accepted")
+	}
+}
+
+func TestHasImage(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+	srv.AddImage("golang:alpine", "sha256:golang", "golang@"+digest)
+
+	ctx := context.Background()
+	for _, image := range []string{"golang:alpine", "docker.io/library/golang:alpine", "golang@" + digest, "sha256:golang"} {
+		if ok, err := dm.HasImage(ctx, image); !ok || err != nil {
+			t.Errorf("Image %s is not found: %v", image, err)
+		}
+	}
+	for _, image := range []string{"golang", "quay.io/golang:alpine", "golang@sha256:" + strings.Repeat("b", 64)} {
+		if ok, err := dm.HasImage(ctx, image); ok || err != nil {
+			t.Errorf("Image %s is found: %v", image, err)
+		}
+	}
+
+	srv.Fail("image-inspect", http.StatusInternalServerError, "daemon is broken")
+	if _, err := dm.HasImage(ctx, "golang:alpine"); err == nil {
+		t.Error("Inspect error is swallowed")
+	}
+}
+
+func TestImageDigests(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	local := "sha256:" + strings.Repeat("a", 64)
+	remote := "sha256:" + strings.Repeat("b", 64)
+	srv.AddImage("golang:alpine", "sha256:golang", "golang@"+local)
+	srv.AddRemoteImage("golang:alpine", "sha256:golang-1.12", "golang@"+remote)
+
+	ctx := context.Background()
+	if digest, err := dm.LocalDigest(ctx, "golang:alpine"); err != nil || digest != local {
+		t.Errorf("Unexpected local digest %s: %v", digest, err)
+	}
+	if digest, err := dm.RemoteDigest(ctx, "golang:alpine"); err != nil || digest != remote {
+		t.Errorf("Unexpected remote digest %s: %v", digest, err)
+	}
+	if digest, err := dm.LocalDigest(ctx, "alpine:latest"); err != nil || digest != "" {
+		t.Errorf("Unexpected digest of missing image %s: %v", digest, err)
+	}
+	if _, err := dm.RemoteDigest(ctx, "missing:latest"); err == nil {
+		t.Error("Digest of missing remote image is found")
+	}
+}
+
+func TestContainerImageDigest(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	mirror := "sha256:" + strings.Repeat("c", 64)
+	origin := "sha256:" + strings.Repeat("d", 64)
+	srv.AddImage("registry.example.com/app:1.0", "sha256:app", "mirror.example.com/app@"+mirror, "registry.example.com/app@"+origin)
+
+	ctx := context.Background()
+	cntr, err := dm.ContainerCreate(ctx, contman.Config{Image: "registry.example.com/app:1.0", Cmd: "true"})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	defer cntr.Remove(ctx)
+	if digest, err := cntr.ImageDigest(ctx); err != nil || digest != "registry.example.com/app@"+origin {
+		t.Errorf("Unexpected image digest %s: %v", digest, err)
+	}
+}
+
+func TestAuthProvider(t *testing.T) {
+	srv := dockertest.NewServer()
+	defer srv.Close()
+	srv.AddImage("registry.example.com/app:1.0", alpineID)
+
+	cli, err := client.NewClientWithOpts(client.WithHost(srv.Host()))
+	if err != nil {
+		t.Fatal("Cannot create docker client: ", err)
+	}
+	var registries []string
+	dm := NewDockerManagerWithClient(context.Background(), cli, WithAuthProvider(contman.AuthProviderFunc(func(ctx context.Context, registry string) (contman.AuthConfig, error) {
+		registries = append(registries, registry)
+		return contman.AuthConfig{IdentityToken: "refresh-token"}, nil
+	})))
+
+	if err := dm.PullImage(context.Background(), "alpine"); err == nil {
+		t.Error("Missing image is pulled")
+	}
+	if err := dm.PushImage(context.Background(), "registry.example.com/app:1.0"); err != nil {
+		t.Error("Cannot push image: ", err)
+	}
+	if !reflect.DeepEqual(registries, []string{"docker.io", "registry.example.com"}) {
+		t.Errorf("Unexpected registries: %v", registries)
+	}
+	var authConfig types.AuthConfig
+	header, _ := base64.URLEncoding.DecodeString(srv.RequestsTo("image-push")[0].Header.Get("X-Registry-Auth"))
+	if err := json.Unmarshal(header, &authConfig); err != nil || authConfig.IdentityToken != "refresh-token" || authConfig.ServerAddress != "registry.example.com" {
+		t.Errorf("Unexpected registry auth: %s", header)
+	}
+}
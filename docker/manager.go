@@ -1,15 +1,16 @@
 package docker
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 
-	docker "github.com/fsouza/go-dockerclient"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/docker/distribution/reference"
@@ -17,138 +18,235 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/docker/go-units"
 
 	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/jsonstream"
+	"github.com/elemir/contman/internal/secrets"
 )
 
 type DockerManager struct {
 	client  *client.Client
 	context context.Context
+
+	host          string
+	tls           *tlsconfig.Options
+	dockerContext string
+	tunnel        *sshTunnel
+	auth          contman.AuthProvider
 }
 
-func NewDockerManagerWithContext(ctx context.Context) (*DockerManager, error) {
-	cli, err := client.NewEnvClient()
+// NewDockerManagerWithContext connects to the daemon chosen by options. Without
+// them DOCKER_HOST, DOCKER_CONTEXT and current context of docker CLI are
+// honored, like docker CLI does.
+func NewDockerManagerWithContext(ctx context.Context, opts ...Option) (*DockerManager, error) {
+	dm := &DockerManager{}
+	for _, opt := range opts {
+		opt(dm)
+	}
+
+	clientOpts, err := dm.clientOpts()
 	if err != nil {
+		log.WithError(err).Error("Cannot configure docker client")
+		return nil, err
+	}
+	cli, err := client.NewClientWithOpts(clientOpts...)
+	if err != nil {
+		if dm.tunnel != nil {
+			dm.tunnel.Close()
+		}
 		return nil, err
 	}
 
 	cli.NegotiateAPIVersion(ctx)
+	dm.client = cli
+	dm.context = ctx
+	return dm, nil
+}
 
-	dm := &DockerManager{
-		client:  cli,
-		context: ctx,
-	}
+// NewDockerManagerWithClient creates manager using preconfigured client, e.g.
+// one connected to dockertest.Server. Options choosing the daemon are
+// ignored.
+func NewDockerManagerWithClient(ctx context.Context, cli *client.Client, opts ...Option) *DockerManager {
+	cli.NegotiateAPIVersion(ctx)
 
-	return dm, nil
+	dm := &DockerManager{}
+	for _, opt := range opts {
+		opt(dm)
+	}
+	dm.client = cli
+	dm.context = ctx
+	return dm
 }
 
-func NewDockerManager() (*DockerManager, error) {
+func NewDockerManager(opts ...Option) (*DockerManager, error) {
 	ctx := context.Background()
-	dm, err := NewDockerManagerWithContext(ctx)
+	dm, err := NewDockerManagerWithContext(ctx, opts...)
 
 	return dm, err
 }
 
-func (dm *DockerManager) PullImage(image string) error {
-	named, err := reference.ParseNormalizedNamed(image)
-	if err != nil {
-		log.WithError(err).Error("Cannot parse image name")
-		return err
+// Close closes connections to the daemon
+func (dm *DockerManager) Close() error {
+	err := dm.client.Close()
+	if dm.tunnel != nil {
+		if tunnelErr := dm.tunnel.Close(); err == nil {
+			err = tunnelErr
+		}
 	}
-	authConfig := getAuthConfig(reference.Domain(named))
-	encodedJSON, err := json.Marshal(authConfig)
+	return err
+}
+
+// PullImage logs pull progress at debug level
+func (dm *DockerManager) PullImage(ctx context.Context, image string) error {
+	return dm.PullImageProgress(ctx, image, func(e contman.PullEvent) {
+		log.WithFields(log.Fields{"image": image, "layer": e.ID}).Debug(e.Status)
+	})
+}
+
+func (dm *DockerManager) PullImageProgress(ctx context.Context, image string, progress func(contman.PullEvent)) error {
+	authStr, err := dm.registryAuth(ctx, image)
 	if err != nil {
-		log.WithError(err).Error("Error encoding auth config")
 		return err
 	}
-	authStr := base64.URLEncoding.EncodeToString(encodedJSON)
 
-	out, err := dm.client.ImagePull(dm.context, image, types.ImagePullOptions{RegistryAuth: authStr})
+	out, err := dm.client.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: authStr})
 	if err != nil {
 		log.WithError(err).Error("Error pulling image")
 		return err
 	}
 	defer func() { _ = out.Close() }()
-	_, _ = io.Copy(os.Stdout, out)
-	return nil
+
+	err = jsonstream.Decode(out, func(msg jsonstream.Message) {
+		event := contman.PullEvent{ID: msg.ID, Status: msg.Status}
+		if msg.ProgressDetail != nil {
+			event.Current = msg.ProgressDetail.Current
+			event.Total = msg.ProgressDetail.Total
+		}
+		progress(event)
+	})
+	if err != nil {
+		log.WithError(err).Error("Error pulling image")
+	}
+	return err
 }
 
-func (dm *DockerManager) HasImage(image string) bool {
+// HasImage inspects image, so the daemon normalizes its reference
+func (dm *DockerManager) HasImage(ctx context.Context, image string) (bool, error) {
 	if image == "" {
-		return false
-	}
-	if !strings.Contains(image, ":") {
-		image += ":latest"
+		return false, nil
 	}
 
-	images, err := dm.client.ImageList(dm.context, types.ImageListOptions{})
+	_, _, err := dm.client.ImageInspectWithRaw(ctx, image)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
 	if err != nil {
-		log.WithError(err).Error("Unable to list images")
-		return false
+		log.WithError(err).Error("Unable to inspect image")
+		return false, err
 	}
+	return true, nil
+}
 
-	hasImage := false
-
-OuterLoop:
-	for _, imageInfo := range images {
-		for _, tag := range imageInfo.RepoTags {
-			if tag == image {
-				hasImage = true
-				break OuterLoop
-			}
-		}
+func (dm *DockerManager) ContainerCreate(ctx context.Context, config contman.Config) (contman.Container, error) {
+	secretsDir, secretMounts, err := dm.secretMounts(config.Secrets)
+	if err != nil {
+		return nil, err
 	}
+	config.Mounts = append(append([]contman.Mount(nil), config.Mounts...), secretMounts...)
 
-	return hasImage
-}
-
-func (dm *DockerManager) ContainerCreate(config contman.Config) (contman.Container, error) {
 	mounts := make([]mount.Mount, len(config.Mounts))
 	for i, m := range config.Mounts {
 		mounts[i] = mount.Mount{
 			Source:   m.Source,
 			Target:   m.Target,
 			ReadOnly: m.ReadOnly,
-			Type:     mount.TypeBind,
+		}
+		switch m.Type {
+		case "", contman.MountBind:
+			mounts[i].Type = mount.TypeBind
+		case contman.MountVolume:
+			mounts[i].Type = mount.TypeVolume
+		case contman.MountTmpfs:
+			mounts[i].Type = mount.TypeTmpfs
+			mounts[i].Source = ""
+		default:
+			os.RemoveAll(secretsDir)
+			return nil, fmt.Errorf("unknown type %s of mount %s", m.Type, m.Target)
 		}
 	}
 
-	env := make([]string, len(config.Env))
-	i := 0
-	for key, value := range config.Env {
-		env[i] = fmt.Sprintf("%s=%s", key, value)
-		i++
-	}
-
+	entrypoint, args := config.Process()
 	containerConfig := &container.Config{
 		Image:      config.Image,
-		Entrypoint: []string{"sh"},
-		Cmd: []string{
-			"-c",
-			config.Cmd,
-		},
+		Entrypoint: entrypoint,
+		Cmd:        args,
 		WorkingDir: config.WorkingDir,
-		Env:        env,
+		Env:        formatEnv(config.Env),
+		User:       config.ProcessUser(),
+		Labels:     config.Labels,
+		Hostname:   config.Hostname,
+		Tty:        config.Tty,
+		OpenStdin:  config.StdinOpen,
+	}
+
+	exposedPorts, portBindings := formatPorts(config.Ports)
+	containerConfig.ExposedPorts = exposedPorts
+
+	securityOpt, err := formatSecurityOpt(config.Security)
+	if err != nil {
+		log.WithError(err).Error("Error reading security profile")
+		os.RemoveAll(secretsDir)
+		return nil, err
 	}
 
 	hostConfig := &container.HostConfig{
-		Mounts:      mounts,
-		NetworkMode: "host",
+		Mounts:         mounts,
+		NetworkMode:    container.NetworkMode(config.Network),
+		PortBindings:   portBindings,
+		ExtraHosts:     config.ExtraHosts,
+		DNS:            config.DNS,
+		Resources:      formatResources(config.Resources),
+		ShmSize:        config.Resources.ShmSize,
+		Tmpfs:          config.Resources.Tmpfs,
+		ReadonlyRootfs: config.Security.ReadOnlyRootfs,
+		CapDrop:        config.Security.CapDrop,
+		CapAdd:         config.Security.CapAdd,
+		SecurityOpt:    securityOpt,
+		UsernsMode:     container.UsernsMode(config.Security.UsernsMode),
 	}
 
-	resp, err := dm.client.ContainerCreate(dm.context, containerConfig, hostConfig, nil, "")
+	resp, err := dm.client.ContainerCreate(ctx, containerConfig, hostConfig, nil, "")
 
 	if err != nil {
 		log.WithError(err).Error("Error creating container")
+		os.RemoveAll(secretsDir)
 		return nil, err
 	}
 
 	return &DockerContainer{
-		manager: dm,
-		id:      resp.ID,
+		manager:    dm,
+		id:         resp.ID,
+		hostDir:    config.HostDir,
+		tty:        config.Tty,
+		secretsDir: secretsDir,
 	}, nil
 }
 
+// secretMounts bind mounts secrets from files on the host, so they are
+// refused by remote daemons
+func (dm *DockerManager) secretMounts(values map[string][]byte) (string, []contman.Mount, error) {
+	if len(values) == 0 {
+		return "", nil, nil
+	}
+	if host := dm.client.DaemonHost(); dm.tunnel != nil || !strings.HasPrefix(host, "unix://") {
+		return "", nil, fmt.Errorf("secrets are bind mounted from the host, daemon %s is not local", host)
+	}
+	return secrets.Mounts(values)
+}
+
 func (dm *DockerManager) GetSystemMounts() []contman.Mount {
 	return []contman.Mount{
 		{
@@ -163,19 +261,117 @@ func (dm *DockerManager) GetSystemMounts() []contman.Mount {
 	}
 }
 
-func getAuthConfig(registry string) *types.AuthConfig {
-	authConfigurations, err := docker.NewAuthConfigurationsFromDockerCfg()
-	if err != nil {
-		return &types.AuthConfig{}
+func formatEnv(vars map[string]string) []string {
+	env := make([]string, 0, len(vars))
+	for key, value := range vars {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
 	}
+	return env
+}
 
-	authConfiguration, ok := authConfigurations.Configs[registry]
-	if !ok {
-		return &types.AuthConfig{}
+func formatPorts(ports []contman.Port) (nat.PortSet, nat.PortMap) {
+	if len(ports) == 0 {
+		return nil, nil
 	}
 
-	return &types.AuthConfig{
-		Username: authConfiguration.Username,
-		Password: authConfiguration.Password,
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+	for _, p := range ports {
+		proto := p.Protocol
+		if proto == "" {
+			proto = "tcp"
+		}
+		port := nat.Port(fmt.Sprintf("%d/%s", p.ContainerPort, proto))
+
+		binding := nat.PortBinding{HostIP: p.HostIP}
+		if p.HostPort != 0 {
+			binding.HostPort = strconv.Itoa(p.HostPort)
+		}
+		exposed[port] = struct{}{}
+		bindings[port] = append(bindings[port], binding)
+	}
+	return exposed, bindings
+}
+
+func formatResources(r contman.Resources) container.Resources {
+	resources := container.Resources{
+		CPUQuota:   r.CPUQuota,
+		CPUPeriod:  r.CPUPeriod,
+		CPUShares:  r.CPUShares,
+		Memory:     r.Memory,
+		MemorySwap: r.MemorySwap,
+		PidsLimit:  r.PidsLimit,
+	}
+	for _, u := range r.Ulimits {
+		resources.Ulimits = append(resources.Ulimits, &units.Ulimit{Name: u.Name, Soft: u.Soft, Hard: u.Hard})
+	}
+	return resources
+}
+
+// formatSecurityOpt returns security options of the daemon, seccomp profile
+// is sent as its content the same way docker CLI does
+func formatSecurityOpt(s contman.Security) ([]string, error) {
+	var opts []string
+	if s.NoNewPrivileges {
+		opts = append(opts, "no-new-privileges")
+	}
+	switch s.SeccompProfile {
+	case "":
+	case "unconfined":
+		opts = append(opts, "seccomp=unconfined")
+	default:
+		data, err := ioutil.ReadFile(s.SeccompProfile)
+		if err != nil {
+			return nil, err
+		}
+		var profile bytes.Buffer
+		if err := json.Compact(&profile, data); err != nil {
+			return nil, fmt.Errorf("seccomp profile %s: %w", s.SeccompProfile, err)
+		}
+		opts = append(opts, "seccomp="+profile.String())
+	}
+	if s.AppArmorProfile != "" {
+		opts = append(opts, "apparmor="+s.AppArmorProfile)
+	}
+	return opts, nil
+}
+
+// registryAuth returns encoded credentials for registry of image
+func (dm *DockerManager) registryAuth(ctx context.Context, image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		log.WithError(err).Error("Cannot parse image name")
+		return "", err
+	}
+	authConfig, err := dm.getAuthConfig(ctx, reference.Domain(named))
+	if err != nil {
+		log.WithError(err).Error("Error getting registry credentials")
+		return "", err
+	}
+	encodedJSON, err := json.Marshal(authConfig)
+	if err != nil {
+		log.WithError(err).Error("Error encoding auth config")
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(encodedJSON), nil
+}
+
+// getAuthConfig asks auth provider of the manager for credentials,
+// DockerConfigAuth is used unless WithAuthProvider is given
+func (dm *DockerManager) getAuthConfig(ctx context.Context, registry string) (*types.AuthConfig, error) {
+	provider := dm.auth
+	if provider == nil {
+		provider = contman.DockerConfigAuth{}
 	}
+	auth, err := provider.GetAuth(ctx, registry)
+	if err != nil {
+		return nil, err
+	}
+	return &types.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		IdentityToken: auth.IdentityToken,
+		RegistryToken: auth.RegistryToken,
+		ServerAddress: registry,
+	}, nil
 }
@@ -0,0 +1,384 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/docker/dockertest"
+)
+
+const (
+	alpineID     = "sha256:3fd9065eaf02feaf94d68376da52541925650b81698c53c6824d92ff63f98353"
+	alpineDigest = "alpine@sha256:7df6db5aa61ae9480f52f0b3a06a140ab98d427f86d8d5de0bedab9b8df6b1c0"
+)
+
+func newTestManager(t *testing.T) (*DockerManager, *dockertest.Server) {
+	srv := dockertest.NewServer()
+	srv.AddRemoteImage("alpine:latest", alpineID, alpineDigest)
+
+	cli, err := client.NewClientWithOpts(client.WithHost(srv.Host()))
+	if err != nil {
+		srv.Close()
+		t.Fatal("Cannot create docker client: ", err)
+	}
+
+	return NewDockerManagerWithClient(context.Background(), cli), srv
+}
+
+func TestDockerReceipt(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "contman-docker-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.txt"), []byte("input"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.OnCmd("build", dockertest.Process{
+		Stdout: "building\n",
+		Stderr: "warning\n",
+		Files:  map[string]string{"/out/result.txt": "result"},
+	})
+
+	result, err := contman.RunReceipt(dm, contman.Receipt{
+		Image:      "alpine:latest",
+		Cmd:        "build",
+		Env:        map[string]string{"GOOS": "linux"},
+		InputCopy:  map[string]string{"input.txt": "/src"},
+		OutputCopy: map[string]string{"/out": "."},
+		HostDir:    dir,
+	})
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if result.ImageDigest != alpineDigest || string(result.Stdout) != "building\n" || string(result.Stderr) != "warning\n" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	if pulls := srv.RequestsTo("image-pull"); len(pulls) != 1 || pulls[0].Query.Get("fromImage") != "alpine" {
+		t.Errorf("Unexpected pulls: %+v", pulls)
+	}
+
+	cntr := srv.Container(result.ContainerID)
+	if cntr == nil || !cntr.Removed() {
+		t.Fatal("Container was not removed")
+	}
+	if cntr.HostConfig.NetworkMode != "none" || len(cntr.Config.Env) != 1 || cntr.Config.Env[0] != "GOOS=linux" {
+		t.Errorf("Unexpected container config: %+v, %+v", cntr.Config, cntr.HostConfig)
+	}
+	if data, ok := cntr.ReadFile("/src/input.txt"); !ok || string(data) != "input" {
+		t.Error("Input was not copied into container")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "out", "result.txt")); err != nil || string(data) != "result" {
+		t.Error("Output was not copied from container: ", err)
+	}
+}
+
+func TestDockerReceiptSteps(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	srv.OnCmd("echo $GREETING", dockertest.Process{Stdout: "Hello World!\n"})
+	srv.OnCmd("false", dockertest.Process{ExitCode: 1})
+
+	result, err := contman.RunReceipt(dm, stepsReceipt)
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if len(result.Steps) != 3 || result.Steps[1].ExitCode != 1 || string(result.Stdout) != "Hello World!\n" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	execs := srv.Execs(result.ContainerID)
+	if len(execs) != 3 || execs[0].Env[0] != "GREETING=Hello World!" || execs[2].WorkingDir != "/tmp" {
+		t.Errorf("Unexpected execs: %+v", execs)
+	}
+}
+
+func TestDockerPullError(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	srv.Fail("image-pull", 500, "registry is unavailable")
+
+	_, err := contman.RunReceipt(dm, alpineReceipt)
+	if err == nil || !strings.Contains(err.Error(), "registry is unavailable") {
+		t.Fatal("Expected pull error, got: ", err)
+	}
+	if creates := srv.RequestsTo("container-create"); len(creates) != 0 {
+		t.Error("Container was created after failed pull")
+	}
+
+	var auth types.AuthConfig
+	pull := srv.RequestsTo("image-pull")[0]
+	encoded, err := base64.URLEncoding.DecodeString(pull.Header.Get("X-Registry-Auth"))
+	if err != nil || json.Unmarshal(encoded, &auth) != nil {
+		t.Error("Pull has no registry auth: ", err)
+	}
+}
+
+func TestDockerPullProgress(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	var events []contman.PullEvent
+	receipt := alpineReceipt
+	receipt.PullProgress = func(e contman.PullEvent) { events = append(events, e) }
+	if _, err := contman.RunReceipt(dm, receipt); err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	downloaded := false
+	for _, e := range events {
+		downloaded = downloaded || e.Status == "Downloading" && e.ID != "" && e.Current == e.Total && e.Total > 0
+	}
+	if !downloaded {
+		t.Errorf("No layer progress in events: %+v", events)
+	}
+
+	srv.AddRemoteImage("scratch:latest", "1")
+	if err := dm.PullImage(context.Background(), "scratch:latest"); err != nil {
+		t.Error("Cannot pull image with short ID: ", err)
+	}
+
+	srv.AddRemoteImage("golang:alpine", "sha256:golang")
+	srv.BreakPull("golang:alpine", "unexpected EOF")
+	if err := dm.PullImage(context.Background(), "golang:alpine"); err == nil || err.Error() != "unexpected EOF" {
+		t.Error("Expected pull error from stream, got: ", err)
+	}
+	if ok, _ := dm.HasImage(context.Background(), "golang:alpine"); ok {
+		t.Error("Image of failed pull is stored")
+	}
+}
+
+func TestDockerWaitError(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	srv.OnCmd("sleep 60", dockertest.Process{Block: true})
+	srv.Fail("container-wait", 500, "wait failed")
+
+	_, err := contman.RunReceipt(dm, contman.Receipt{Image: "alpine:latest", Cmd: "sleep 60"})
+	if err == nil || !strings.Contains(err.Error(), "wait failed") {
+		t.Fatal("Expected wait error, got: ", err)
+	}
+
+	cntr := srv.Containers()[0]
+	if !cntr.Removed() || cntr.ExitCode() != dockertest.StoppedExitCode {
+		t.Errorf("Container %s was not stopped and removed", cntr.ID)
+	}
+}
+
+func TestDockerCopyNotFound(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	if err := dm.PullImage(context.Background(), "alpine:latest"); err != nil {
+		t.Fatal("Cannot pull image: ", err)
+	}
+	cntr, err := dm.ContainerCreate(context.Background(), contman.Config{Image: "alpine:latest", Cmd: "true"})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+
+	err = cntr.CopyFrom(context.Background(), "/missing", os.TempDir())
+	if !errors.Is(err, contman.ErrNotFound) {
+		t.Error("Expected not found error, got: ", err)
+	}
+	if err := cntr.CopyTo(context.Background(), "/missing", "/"); err == nil {
+		t.Error("Copy of missing host path succeeded")
+	}
+}
+
+func TestDockerContainerConfig(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	srv.AddImage("distroless/static:latest", alpineID)
+	srv.OnCmd("/app --serve", dockertest.Process{Stdout: "serving\n", Stderr: "warning\n"})
+
+	cntr, err := dm.ContainerCreate(context.Background(), contman.Config{
+		Image:      "distroless/static:latest",
+		Cmd:        "ignored",
+		Entrypoint: []string{"/app"},
+		Args:       []string{"--serve"},
+		User:       "1000:1000",
+		Labels:     map[string]string{"ci.job": "42"},
+		Hostname:   "builder",
+		Tty:        true,
+		StdinOpen:  true,
+		Network:    "ci",
+		Ports:      []contman.Port{{ContainerPort: 8080, HostPort: 18080}, {ContainerPort: 53, Protocol: "udp"}},
+		ExtraHosts: []string{"registry:10.0.0.2"},
+		DNS:        []string{"10.0.0.53"},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	defer cntr.Remove(context.Background())
+
+	config := srv.Container(cntr.ID()).Config
+	if config.User != "1000:1000" || config.Labels["ci.job"] != "42" || config.Hostname != "builder" || !config.Tty || !config.OpenStdin {
+		t.Errorf("Unexpected container config: %+v", config)
+	}
+	hostConfig := srv.Container(cntr.ID()).HostConfig
+	if hostConfig.NetworkMode != "ci" || hostConfig.ExtraHosts[0] != "registry:10.0.0.2" || hostConfig.DNS[0] != "10.0.0.53" {
+		t.Errorf("Unexpected host config: %+v", hostConfig)
+	}
+	if _, ok := config.ExposedPorts["53/udp"]; !ok || hostConfig.PortBindings["8080/tcp"][0].HostPort != "18080" {
+		t.Errorf("Unexpected ports: %+v, %+v", config.ExposedPorts, hostConfig.PortBindings)
+	}
+
+	if err := cntr.Start(context.Background()); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+	var stdout strings.Builder
+	exitCode, err := cntr.Wait(context.Background(), &stdout, nil)
+	if err != nil || exitCode != 0 {
+		t.Fatal("Cannot wait container: ", exitCode, err)
+	}
+	// Terminal merges output streams
+	if stdout.String() != "serving\nwarning\n" {
+		t.Errorf("Unexpected output: %q", stdout.String())
+	}
+}
+
+func TestDockerResources(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	srv.OnCmd("allocate", dockertest.Process{ExitCode: 137, OOMKilled: true})
+
+	result, err := contman.RunReceipt(dm, contman.Receipt{
+		Image: "alpine:latest",
+		Cmd:   "allocate",
+		Resources: contman.Resources{
+			CPUQuota:   50000,
+			Memory:     64 << 20,
+			MemorySwap: 64 << 20,
+			PidsLimit:  100,
+			Ulimits:    []contman.Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+			ShmSize:    16 << 20,
+			Tmpfs:      map[string]string{"/tmp": "size=64m"},
+		},
+	})
+	if exitErr, ok := err.(*contman.ExitError); !ok || !exitErr.OOMKilled || exitErr.Code != 137 {
+		t.Fatal("Expected OOM error, got: ", err)
+	}
+	if !result.OOMKilled {
+		t.Errorf("OOM is not reported: %+v", result)
+	}
+
+	hostConfig := srv.Container(result.ContainerID).HostConfig
+	if r := hostConfig.Resources; r.CPUQuota != 50000 || r.Memory != 64<<20 || r.PidsLimit != 100 || r.Ulimits[0].Hard != 2048 {
+		t.Errorf("Unexpected resources: %+v", r)
+	}
+	if hostConfig.ShmSize != 16<<20 || hostConfig.Tmpfs["/tmp"] != "size=64m" {
+		t.Errorf("Unexpected host config: %+v", hostConfig)
+	}
+
+	result, err = contman.RunReceipt(dm, contman.Receipt{Image: "alpine:latest", Steps: []contman.Step{{Cmd: "true"}, {Cmd: "allocate"}}})
+	if exitErr, ok := err.(*contman.ExitError); !ok || !exitErr.OOMKilled || !result.OOMKilled || len(result.Steps) != 2 {
+		t.Errorf("Expected OOM error of the step, got: %v, %+v", err, result)
+	}
+
+	// Daemon keeps the container marked after an exec is killed, processes
+	// killed later by other signals are not OOM kills
+	srv.OnCmd("sleep 60", dockertest.Process{Block: true})
+	srv.OnCmd("kill -9 $$", dockertest.Process{ExitCode: 137})
+	cntr, err := dm.ContainerCreate(context.Background(), contman.Config{Image: "alpine:latest", Cmd: "sleep 60"})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	if err := cntr.Start(context.Background()); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+	defer cntr.Remove(context.Background())
+	defer cntr.Kill(context.Background())
+	if _, err := cntr.Exec(context.Background(), contman.ExecConfig{Cmd: "allocate"}); err == nil || !err.(*contman.ExitError).OOMKilled {
+		t.Error("Expected OOM error of exec, got: ", err)
+	}
+	if code, err := cntr.Exec(context.Background(), contman.ExecConfig{Cmd: "kill -9 $$"}); err != nil || code != 137 {
+		t.Errorf("Unexpected exec result: %d, %v", code, err)
+	}
+}
+
+func TestDockerRemoteSecrets(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+	srv.AddImage("alpine:latest", alpineID)
+
+	_, err := dm.ContainerCreate(context.Background(), contman.Config{Image: "alpine:latest", Cmd: "true", Secrets: map[string][]byte{"token": []byte("secret")}})
+	if err == nil {
+		t.Error("Secrets are bind mounted to remote daemon")
+	}
+}
+
+func TestDockerSecurity(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+	srv.AddImage("alpine:latest", alpineID)
+
+	profile, err := ioutil.TempFile("", "contman-seccomp-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(profile.Name())
+	profile.WriteString("{\n  \"defaultAction\": \"SCMP_ACT_ERRNO\"\n}\n")
+	profile.Close()
+
+	security := contman.StrictSecurity()
+	security.CapAdd = []string{"NET_BIND_SERVICE"}
+	security.SeccompProfile = profile.Name()
+	security.AppArmorProfile = "contman-default"
+	security.UsernsMode = "host"
+
+	cntr, err := dm.ContainerCreate(context.Background(), contman.Config{
+		Image:    "alpine:latest",
+		Cmd:      "true",
+		User:     "root",
+		Security: security,
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	defer cntr.Remove(context.Background())
+
+	c := srv.Container(cntr.ID())
+	if c.Config.User != fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()) {
+		t.Errorf("Unexpected user: %s", c.Config.User)
+	}
+	hostConfig := c.HostConfig
+	if !hostConfig.ReadonlyRootfs || hostConfig.CapDrop[0] != "ALL" || hostConfig.CapAdd[0] != "NET_BIND_SERVICE" || hostConfig.UsernsMode != "host" {
+		t.Errorf("Unexpected host config: %+v", hostConfig)
+	}
+	expected := []string{"no-new-privileges", `seccomp={"defaultAction":"SCMP_ACT_ERRNO"}`, "apparmor=contman-default"}
+	if !reflect.DeepEqual([]string(hostConfig.SecurityOpt), expected) {
+		t.Errorf("Unexpected security options: %q", hostConfig.SecurityOpt)
+	}
+
+	_, err = dm.ContainerCreate(context.Background(), contman.Config{
+		Image:    "alpine:latest",
+		Security: contman.Security{SeccompProfile: "/nonexistent/seccomp.json"},
+	})
+	if err == nil {
+		t.Error("Missing seccomp profile is accepted")
+	}
+}
@@ -0,0 +1,177 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+
+	"github.com/elemir/contman"
+)
+
+type Option func(*DockerManager)
+
+// WithHost sets daemon address: unix://, tcp:// or ssh://[user@]host[:port],
+// the latter runs "docker system dial-stdio" on the remote host through ssh
+func WithHost(host string) Option {
+	return func(dm *DockerManager) {
+		dm.host = host
+	}
+}
+
+// WithTLS enables TLS with given CA and client certificate files, empty
+// caCert means system roots and empty cert and key mean no client
+// certificate
+func WithTLS(caCert, cert, key string) Option {
+	return func(dm *DockerManager) {
+		dm.tls = &tlsconfig.Options{
+			CAFile:   caCert,
+			CertFile: cert,
+			KeyFile:  key,
+		}
+	}
+}
+
+// WithDockerContext uses endpoint of a context created by "docker context
+// create", "default" context means the environment
+func WithDockerContext(name string) Option {
+	return func(dm *DockerManager) {
+		dm.dockerContext = name
+	}
+}
+
+// WithAuthProvider sets source of registry credentials for pulls and pushes,
+// contman.DockerConfigAuth is used by default
+func WithAuthProvider(provider contman.AuthProvider) Option {
+	return func(dm *DockerManager) {
+		dm.auth = provider
+	}
+}
+
+// configDir returns directory of docker CLI configuration
+func configDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker")
+}
+
+// currentContext returns context chosen by DOCKER_CONTEXT or "docker context
+// use", empty for the default one
+func currentContext() string {
+	if name := os.Getenv("DOCKER_CONTEXT"); name != "" {
+		return name
+	}
+
+	var config struct {
+		CurrentContext string `json:"currentContext"`
+	}
+	data, err := ioutil.ReadFile(filepath.Join(configDir(), "config.json"))
+	if err != nil || json.Unmarshal(data, &config) != nil {
+		return ""
+	}
+	return config.CurrentContext
+}
+
+type contextEndpoint struct {
+	Host          string `json:"Host"`
+	SkipTLSVerify bool   `json:"SkipTLSVerify"`
+}
+
+// loadContext reads docker endpoint of context from context store, TLS
+// material is used when the store has one
+func loadContext(name string) (*contextEndpoint, *tlsconfig.Options, error) {
+	sum := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(sum[:])
+
+	var meta struct {
+		Endpoints map[string]contextEndpoint `json:"Endpoints"`
+	}
+	data, err := ioutil.ReadFile(filepath.Join(configDir(), "contexts", "meta", id, "meta.json"))
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("docker context %s: %w", name, contman.ErrNotFound)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, nil, fmt.Errorf("docker context %s: %w", name, err)
+	}
+	endpoint, ok := meta.Endpoints["docker"]
+	if !ok {
+		return nil, nil, fmt.Errorf("docker context %s has no docker endpoint", name)
+	}
+
+	tlsDir := filepath.Join(configDir(), "contexts", "tls", id, "docker")
+	opts := &tlsconfig.Options{InsecureSkipVerify: endpoint.SkipTLSVerify}
+	hasTLS := endpoint.SkipTLSVerify
+	for file, path := range map[string]*string{"ca.pem": &opts.CAFile, "cert.pem": &opts.CertFile, "key.pem": &opts.KeyFile} {
+		if _, err := os.Stat(filepath.Join(tlsDir, file)); err == nil {
+			*path = filepath.Join(tlsDir, file)
+			hasTLS = true
+		}
+	}
+	if !hasTLS {
+		opts = nil
+	}
+
+	return &endpoint, opts, nil
+}
+
+// clientOpts turns manager options into client options, environment is used
+// only when neither host nor context is set
+func (dm *DockerManager) clientOpts() ([]func(*client.Client) error, error) {
+	if dm.host == "" && dm.dockerContext == "" && os.Getenv("DOCKER_HOST") == "" {
+		dm.dockerContext = currentContext()
+	}
+	if dm.dockerContext != "" && dm.dockerContext != "default" {
+		endpoint, tls, err := loadContext(dm.dockerContext)
+		if err != nil {
+			return nil, err
+		}
+		if dm.host == "" {
+			dm.host = endpoint.Host
+		}
+		if dm.tls == nil {
+			dm.tls = tls
+		}
+	}
+	if dm.host == "" && dm.tls == nil {
+		return []func(*client.Client) error{client.FromEnv}, nil
+	}
+
+	var opts []func(*client.Client) error
+	if dm.tls != nil {
+		config, err := tlsconfig.Client(*dm.tls)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, client.WithHTTPClient(&http.Client{
+			Transport:     &http.Transport{TLSClientConfig: config},
+			CheckRedirect: client.CheckRedirect,
+		}))
+	}
+
+	host := dm.host
+	if strings.HasPrefix(host, "ssh://") {
+		tunnel, err := newSSHTunnel(host)
+		if err != nil {
+			return nil, err
+		}
+		dm.tunnel = tunnel
+		host = tunnel.Host()
+	}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	return opts, nil
+}
@@ -0,0 +1,185 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/docker/dockertest"
+)
+
+// TestMain turns the test binary into a fake ssh when it is run under this
+// name, it forwards stdio to CONTMAN_FAKE_SSH_ADDR instead of dial-stdio
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == "ssh" {
+		os.Exit(fakeSSH(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+func fakeSSH(args []string) int {
+	if strings.Join(args[len(args)-3:], " ") != "docker system dial-stdio" {
+		return 255
+	}
+	conn, err := net.Dial("tcp", os.Getenv("CONTMAN_FAKE_SSH_ADDR"))
+	if err != nil {
+		return 255
+	}
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	_, _ = io.Copy(os.Stdout, conn)
+	return 0
+}
+
+// setEnv sets environment variables until returned function is called
+func setEnv(vars map[string]string) func() {
+	old := map[string]string{}
+	for key, value := range vars {
+		old[key] = os.Getenv(key)
+		os.Setenv(key, value)
+	}
+	return func() {
+		for key, value := range old {
+			os.Setenv(key, value)
+		}
+	}
+}
+
+func newRemoteServer() *dockertest.Server {
+	srv := dockertest.NewServer()
+	srv.AddRemoteImage("alpine:latest", alpineID, alpineDigest)
+	srv.OnCmd("echo $GREETING", dockertest.Process{Stdout: "Hello World!\n"})
+	return srv
+}
+
+func TestSSHArgs(t *testing.T) {
+	args, err := sshArgs("ssh://builder@remote.example.com:2222")
+	if err != nil {
+		t.Fatal("Cannot parse host: ", err)
+	}
+	expected := []string{"-T", "-o", "ConnectTimeout=30", "-l", "builder", "-p", "2222", "--", "remote.example.com", "docker", "system", "dial-stdio"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Unexpected args: %v", args)
+	}
+
+	if _, err := sshArgs("ssh://remote.example.com/path"); err == nil {
+		t.Error("Path in ssh host is accepted")
+	}
+}
+
+func TestMultipleDaemons(t *testing.T) {
+	defer setEnv(map[string]string{"DOCKER_HOST": "tcp://127.0.0.1:1"})()
+
+	srvs := []*dockertest.Server{newRemoteServer(), newRemoteServer()}
+	for _, srv := range srvs {
+		defer srv.Close()
+	}
+
+	for i, srv := range srvs {
+		dm, err := NewDockerManager(WithHost(srv.Host()))
+		if err != nil {
+			t.Fatal("Cannot create docker manager: ", err)
+		}
+		defer dm.Close()
+
+		for j := 0; j <= i; j++ {
+			if _, err := contman.RunReceipt(dm, alpineReceipt); err != nil {
+				t.Fatal("Cannot run receipt: ", err)
+			}
+		}
+	}
+
+	for i, srv := range srvs {
+		if n := len(srv.RequestsTo("container-create")); n != i+1 {
+			t.Errorf("Server %d got %d containers", i, n)
+		}
+	}
+}
+
+func TestDockerContext(t *testing.T) {
+	srv := dockertest.NewTLSServer()
+	defer srv.Close()
+	srv.AddRemoteImage("alpine:latest", alpineID, alpineDigest)
+
+	dir, err := ioutil.TempDir("", "contman-docker-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sum := sha256.Sum256([]byte("remote"))
+	id := hex.EncodeToString(sum[:])
+	files := map[string]string{
+		"config.json": `{"currentContext": "remote"}`,
+		filepath.Join("contexts", "meta", id, "meta.json"):       `{"Name": "remote", "Endpoints": {"docker": {"Host": "` + srv.Host() + `"}}}`,
+		filepath.Join("contexts", "tls", id, "docker", "ca.pem"): string(srv.CACertificate()),
+	}
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer setEnv(map[string]string{"DOCKER_CONFIG": dir, "DOCKER_HOST": "", "DOCKER_CONTEXT": ""})()
+
+	dm, err := NewDockerManager()
+	if err != nil {
+		t.Fatal("Cannot create docker manager: ", err)
+	}
+	defer dm.Close()
+	if _, err := contman.RunReceipt(dm, stepsReceipt); err != nil {
+		t.Fatal("Cannot run receipt over TLS: ", err)
+	}
+
+	if _, err := NewDockerManager(WithDockerContext("missing")); err == nil {
+		t.Error("Missing context is accepted")
+	}
+}
+
+func TestSSHTunnel(t *testing.T) {
+	srv := newRemoteServer()
+	defer srv.Close()
+
+	bin, err := ioutil.TempDir("", "contman-ssh-bin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(self, filepath.Join(bin, "ssh")); err != nil {
+		t.Fatal(err)
+	}
+	defer setEnv(map[string]string{
+		"PATH":                  bin + string(os.PathListSeparator) + os.Getenv("PATH"),
+		"CONTMAN_FAKE_SSH_ADDR": strings.TrimPrefix(srv.Host(), "tcp://"),
+	})()
+
+	dm, err := NewDockerManager(WithHost("ssh://builder@remote.example.com"))
+	if err != nil {
+		t.Fatal("Cannot create docker manager: ", err)
+	}
+	defer dm.Close()
+
+	result, err := contman.RunReceipt(dm, stepsReceipt)
+	if err != nil {
+		t.Fatal("Cannot run receipt through ssh: ", err)
+	}
+	if string(result.Stdout) != "Hello World!\n" {
+		t.Errorf("Unexpected output: %q", result.Stdout)
+	}
+}
@@ -0,0 +1,119 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sshTunnel serves a local unix socket, every connection to it is forwarded
+// to the remote daemon by "docker system dial-stdio" run through ssh. Docker
+// client dials hijacked connections by itself, so a custom dialer is not
+// enough.
+type sshTunnel struct {
+	dir      string
+	listener net.Listener
+	args     []string
+}
+
+// sshArgs returns ssh arguments running dial-stdio on host of ssh:// URL
+func sshArgs(host string) ([]string, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("invalid ssh host %q", host)
+	}
+
+	args := []string{"-T", "-o", "ConnectTimeout=30"}
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	return append(args, "--", u.Hostname(), "docker", "system", "dial-stdio"), nil
+}
+
+func newSSHTunnel(host string) (*sshTunnel, error) {
+	args, err := sshArgs(host)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "contman-ssh-")
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "docker.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	t := &sshTunnel{
+		dir:      dir,
+		listener: listener,
+		args:     args,
+	}
+	go t.serve()
+	return t, nil
+}
+
+// Host returns address of the local socket suitable for DOCKER_HOST
+func (t *sshTunnel) Host() string {
+	return "unix://" + t.listener.Addr().String()
+}
+
+func (t *sshTunnel) serve() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.forward(conn)
+	}
+}
+
+func (t *sshTunnel) forward(conn net.Conn) {
+	defer conn.Close()
+	l := log.WithField("args", t.args)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("ssh", t.args...)
+	cmd.Stdout = conn
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		l.WithError(err).Error("Error starting ssh")
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		l.WithError(err).Error("Error starting ssh")
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(stdin, conn)
+		stdin.Close()
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		l.WithError(err).WithField("stderr", stderr.String()).Error("Error running ssh")
+	}
+}
+
+func (t *sshTunnel) Close() error {
+	err := t.listener.Close()
+	os.RemoveAll(t.dir)
+	return err
+}
@@ -0,0 +1,54 @@
+package docker
+
+import (
+	"context"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/docker/docker/api/types/filters"
+	volumetypes "github.com/docker/docker/api/types/volume"
+
+	"github.com/elemir/contman"
+)
+
+func (dm *DockerManager) VolumeCreate(ctx context.Context, name string, labels map[string]string) (contman.Volume, error) {
+	v, err := dm.client.VolumeCreate(ctx, volumetypes.VolumeCreateBody{Name: name, Labels: labels})
+	if err != nil {
+		log.WithError(err).WithField("volume", name).Error("Error creating volume")
+		return contman.Volume{}, err
+	}
+	return contman.Volume{Name: v.Name, Labels: v.Labels}, nil
+}
+
+func (dm *DockerManager) VolumeList(ctx context.Context, labels map[string]string) ([]contman.Volume, error) {
+	resp, err := dm.client.VolumeList(ctx, labelFilters(labels))
+	if err != nil {
+		log.WithError(err).Error("Error listing volumes")
+		return nil, err
+	}
+
+	volumes := make([]contman.Volume, 0, len(resp.Volumes))
+	for _, v := range resp.Volumes {
+		volumes = append(volumes, contman.Volume{Name: v.Name, Labels: v.Labels})
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+func (dm *DockerManager) VolumePrune(ctx context.Context, labels map[string]string) ([]string, error) {
+	report, err := dm.client.VolumesPrune(ctx, labelFilters(labels))
+	if err != nil {
+		log.WithError(err).Error("Error pruning volumes")
+		return nil, err
+	}
+	return report.VolumesDeleted, nil
+}
+
+func labelFilters(labels map[string]string) filters.Args {
+	args := filters.NewArgs()
+	for key, value := range labels {
+		args.Add("label", key+"="+value)
+	}
+	return args
+}
@@ -0,0 +1,61 @@
+package docker
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/mount"
+
+	"github.com/elemir/contman"
+)
+
+func TestVolumes(t *testing.T) {
+	dm, srv := newTestManager(t)
+	defer srv.Close()
+
+	result, err := contman.RunReceipt(dm, contman.Receipt{
+		Image:  "alpine:latest",
+		Cmd:    "go build ./...",
+		Caches: map[string]string{"go-mod": "/go/pkg/mod"},
+	})
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	mounts := srv.Container(result.ContainerID).HostConfig.Mounts
+	if len(mounts) != 1 || mounts[0].Type != mount.TypeVolume || mounts[0].Source != "go-mod" {
+		t.Errorf("Unexpected mounts: %+v", mounts)
+	}
+	if !srv.HasVolume("go-mod") {
+		t.Error("Cache volume is not created")
+	}
+
+	ctx := context.Background()
+	if _, err := dm.VolumeCreate(ctx, "npm", map[string]string{"contman.cache": "npm"}); err != nil {
+		t.Fatal("Cannot create volume: ", err)
+	}
+	volumes, err := dm.VolumeList(ctx, map[string]string{"contman.cache": "npm"})
+	if err != nil || !reflect.DeepEqual(volumes, []contman.Volume{{Name: "npm", Labels: map[string]string{"contman.cache": "npm"}}}) {
+		t.Errorf("Unexpected volumes: %+v, %v", volumes, err)
+	}
+
+	cntr, err := dm.ContainerCreate(ctx, contman.Config{
+		Image:  "alpine:latest",
+		Cmd:    "true",
+		Mounts: []contman.Mount{{Type: contman.MountVolume, Source: "npm", Target: "/root/.npm"}, {Type: contman.MountTmpfs, Target: "/tmp"}},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	pruned, err := dm.VolumePrune(ctx, nil)
+	if err != nil || !reflect.DeepEqual(pruned, []string{"go-mod"}) {
+		t.Errorf("Unexpected pruned volumes: %v, %v", pruned, err)
+	}
+	if mounts := srv.Container(cntr.ID()).HostConfig.Mounts; mounts[1].Type != mount.TypeTmpfs || mounts[1].Source != "" {
+		t.Errorf("Unexpected tmpfs mount: %+v", mounts[1])
+	}
+
+	if _, err := dm.ContainerCreate(ctx, contman.Config{Image: "alpine:latest", Mounts: []contman.Mount{{Type: "overlay", Target: "/"}}}); err == nil {
+		t.Error("Unknown mount type is accepted")
+	}
+}
@@ -0,0 +1,41 @@
+package contman
+
+import (
+	"context"
+	"time"
+)
+
+// Image is an image of the manager image store
+type Image struct {
+	ID      string
+	Tags    []string
+	Digests []string
+	Labels  map[string]string
+	Size    int64
+	Created time.Time
+}
+
+// ImageFilter selects images, its zero value selects all of them
+type ImageFilter struct {
+	// Reference is a pattern of image name, e.g. "registry.example.com/app:*"
+	Reference string
+	// Labels are labels selected images have
+	Labels map[string]string
+	// Dangling selects untagged images only
+	Dangling bool
+}
+
+// ImageManager is implemented by managers able to manage images lifecycle
+type ImageManager interface {
+	// PushImage pushes image to its registry with credentials of the
+	// manager
+	PushImage(ctx context.Context, image string) error
+	TagImage(ctx context.Context, source, target string) error
+	// RemoveImage removes image or just its tag, if image has other ones.
+	// Images used by containers are removed only if force is set.
+	RemoveImage(ctx context.Context, image string, force bool) error
+	ListImages(ctx context.Context, filter ImageFilter) ([]Image, error)
+	// PruneImages removes images not used by any container and returns
+	// their IDs, Reference of filter is not supported
+	PruneImages(ctx context.Context, filter ImageFilter) ([]string, error)
+}
@@ -1,4 +1,5 @@
-package docker
+// Package archive contains tar helpers shared by container backends.
+package archive
 
 import (
 	"archive/tar"
@@ -101,7 +102,9 @@ func extractEntryToFile(src io.Reader, target string, mode os.FileMode) error {
 	return os.Chmod(target, mode)
 }
 
-func extractTarFromReader(r io.Reader, dest string) error {
+// ExtractTarFromReader unpacks tar stream into dest, leaving unchanged files
+// untouched
+func ExtractTarFromReader(r io.Reader, dest string) error {
 	tr := tar.NewReader(r)
 
 	for {
@@ -131,6 +134,9 @@ func extractTarFromReader(r io.Reader, dest string) error {
 			if !changed {
 				continue
 			}
+			if err := mkdir(filepath.Dir(target)); err != nil {
+				return err
+			}
 			logrus.WithField("target", target).Debug("extracting entry")
 			if err := extractEntryToFile(src, target, os.FileMode(header.Mode)); err != nil {
 				return err
@@ -139,11 +145,12 @@ func extractTarFromReader(r io.Reader, dest string) error {
 	}
 }
 
-func createTarToWriter(src string, w io.Writer) error {
+// CreateTarToWriter archives root, naming entries as if it was located at src
+func CreateTarToWriter(root, src string, w io.Writer) error {
 	tw := tar.NewWriter(w)
 	defer tw.Close()
 
-	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+	return filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -153,7 +160,7 @@ func createTarToWriter(src string, w io.Writer) error {
 			return err
 		}
 
-		header.Name = strings.TrimPrefix(file, string(filepath.Separator))
+		header.Name = strings.TrimPrefix(src+strings.TrimPrefix(file, root), string(filepath.Separator))
 
 		if err := tw.WriteHeader(header); err != nil {
 			return err
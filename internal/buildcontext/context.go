@@ -0,0 +1,142 @@
+// Package buildcontext archives build contexts of docker and podman
+// builders, it is kept apart from archive as it depends on the docker module.
+package buildcontext
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/builder/dockerignore"
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+// Create archives build context dir into w leaving out files
+// matched by patterns of dockerignore file. Both dockerfile and the ignore
+// file are relative to dir and always archived, as the builder needs them.
+func Create(dir, dockerfile, ignore string, w io.Writer) error {
+	patterns, err := readIgnore(filepath.Join(dir, ignore))
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{}
+	for _, file := range []string{dockerfile, ignore} {
+		file = filepath.Clean(file)
+		if filepath.IsAbs(file) || file == ".." || strings.HasPrefix(file, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s is outside of build context", file)
+		}
+		keep[file] = true
+	}
+	pm, err := fileutils.NewPatternMatcher(patterns)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	err = filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil || name == "." {
+			return err
+		}
+		// kept files are added after the walk, which skips excluded
+		// directories they may be in
+		if keep[name] {
+			return nil
+		}
+
+		excluded, err := pm.Matches(name)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			// excluded directory may still contain files matched by
+			// exception patterns
+			if fi.IsDir() && !pm.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return addFile(tw, file, name, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range sortedKeys(keep) {
+		file := filepath.Join(dir, name)
+		fi, err := os.Lstat(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := addFile(tw, file, name, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addFile writes file into the archive under name relative to the context
+func addFile(tw *tar.Writer, file, name string, fi os.FileInfo) error {
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if fi.IsDir() {
+		header.Name += "/"
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func readIgnore(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return dockerignore.ReadAll(f)
+}
@@ -0,0 +1,83 @@
+package buildcontext
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contman-context-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"Dockerfile":        "FROM alpine\n",
+		"ci.dockerignore":   "*.dockerignore\nDockerfile\nci\nvendor\nlogs\n!logs/keep.log\n",
+		"ci/build.ignore":   "ci\nvendor\nlogs\n",
+		"ci/Dockerfile":     "FROM golang\n",
+		"main.go":           "package main\n",
+		"vendor/lib/lib.go": "package lib\n",
+		"logs/build.log":    "log\n",
+		"logs/keep.log":     "keep\n",
+		"cmd/tool/.gitkeep": "",
+	}
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Create(dir, "Dockerfile", "ci.dockerignore", &buf); err != nil {
+		t.Fatal("Cannot create build context: ", err)
+	}
+
+	expected := []string{"Dockerfile", "ci.dockerignore", "cmd/", "cmd/tool/", "cmd/tool/.gitkeep", "logs/keep.log", "main.go"}
+	if names := entries(t, &buf); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected entries: %v", names)
+	}
+
+	// Dockerfile is sent even from an excluded directory
+	buf.Reset()
+	if err := Create(dir, "ci/Dockerfile", "ci/build.ignore", &buf); err != nil {
+		t.Fatal("Cannot create build context: ", err)
+	}
+	expected = []string{"Dockerfile", "ci.dockerignore", "ci/Dockerfile", "ci/build.ignore", "cmd/", "cmd/tool/", "cmd/tool/.gitkeep", "main.go"}
+	if names := entries(t, &buf); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected entries: %v", names)
+	}
+
+	if err := Create(dir, "../Dockerfile", "", &buf); err == nil {
+		t.Error("Dockerfile outside of context is accepted")
+	}
+}
+
+func entries(t *testing.T, r io.Reader) []string {
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,37 @@
+// Package cgroups reads state of control groups containers run in.
+package cgroups
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// EventsScript prints OOM kill counters of cgroup v2 and v1 when it is run
+// in a container having its own cgroup namespace
+const EventsScript = "cat /sys/fs/cgroup/memory.events /sys/fs/cgroup/memory/memory.oom_control 2>/dev/null; true"
+
+// OOMKilled tells whether memory.events of cgroup v2 or memory.oom_control
+// of cgroup v1 report a process killed by OOM killer. Both have "oom_kill N"
+// line, several files may be concatenated.
+func OOMKilled(events []byte) bool {
+	return OOMKills(events) > 0
+}
+
+// OOMKills returns number of processes killed by OOM killer in events read
+// the way OOMKilled does, so kills of a single process can be told apart by
+// comparing counters read before and after it
+func OOMKills(events []byte) int {
+	kills := 0
+	scanner := bufio.NewScanner(bytes.NewReader(events))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			if n, err := strconv.Atoi(fields[1]); err == nil {
+				kills += n
+			}
+		}
+	}
+	return kills
+}
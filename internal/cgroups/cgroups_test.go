@@ -0,0 +1,47 @@
+package cgroups
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOOMKilled(t *testing.T) {
+	for events, expected := range map[string]bool{
+		"low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n":                 true,
+		"low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n":                 false,
+		"oom_kill_disable 0\nunder_oom 0\noom_kill 2\n":             true,
+		"oom_kill_disable 0\nunder_oom 0\n":                         false,
+		"oom_kill 0\noom_kill_disable 0\nunder_oom 0\noom_kill 0\n": false,
+		"": false,
+	} {
+		if OOMKilled([]byte(events)) != expected {
+			t.Errorf("Unexpected result for %q", events)
+		}
+	}
+}
+
+func TestOOMKills(t *testing.T) {
+	for events, expected := range map[string]int{
+		"low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n":     1,
+		"oom_kill_disable 0\nunder_oom 0\noom_kill 2\n": 2,
+		"oom_kill_disable 0\nunder_oom 0\n":             0,
+		"oom_kill x\n":                                  0,
+	} {
+		if kills := OOMKills([]byte(events)); kills != expected {
+			t.Errorf("Unexpected kills for %q: %d", events, kills)
+		}
+	}
+}
+
+func TestOOMNotifier(t *testing.T) {
+	n := NewOOMNotifier()
+	if n.Killed(time.Millisecond) {
+		t.Error("OOM kill is reported before notification")
+	}
+
+	go n.Notify()
+	if !n.Killed(time.Second) {
+		t.Error("OOM kill is not reported")
+	}
+	n.Notify()
+}
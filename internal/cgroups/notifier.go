@@ -0,0 +1,32 @@
+package cgroups
+
+import (
+	"sync"
+	"time"
+)
+
+// OOMNotifier records OOM kills reported by events of a container. Events
+// arrive independently of exit statuses, so Killed waits for them a little.
+type OOMNotifier struct {
+	once   sync.Once
+	killed chan struct{}
+}
+
+func NewOOMNotifier() *OOMNotifier {
+	return &OOMNotifier{killed: make(chan struct{})}
+}
+
+// Notify records an OOM kill
+func (n *OOMNotifier) Notify() {
+	n.once.Do(func() { close(n.killed) })
+}
+
+// Killed tells whether an OOM kill is recorded within timeout
+func (n *OOMNotifier) Killed(timeout time.Duration) bool {
+	select {
+	case <-n.killed:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
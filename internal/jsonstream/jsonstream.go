@@ -0,0 +1,55 @@
+// Package jsonstream decodes JSON message streams of Docker compatible APIs,
+// which report progress of builds and pulls.
+package jsonstream
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+type ErrorDetail struct {
+	Message string `json:"message"`
+}
+
+// ProgressDetail is progress of a layer being downloaded or extracted
+type ProgressDetail struct {
+	Current int64 `json:"current"`
+	Total   int64 `json:"total"`
+}
+
+// Message is a single message of the stream, Aux carries a result specific
+// to the operation, e.g. ID of built image
+type Message struct {
+	Stream         string          `json:"stream"`
+	Status         string          `json:"status"`
+	ID             string          `json:"id"`
+	ProgressDetail *ProgressDetail `json:"progressDetail"`
+	Error          string          `json:"error"`
+	ErrorDetail    *ErrorDetail    `json:"errorDetail"`
+	Aux            json.RawMessage `json:"aux"`
+}
+
+// Decode calls f for every message read from r until EOF. Errors are
+// reported inside the stream after successful status, so a message with an
+// error stops decoding and is returned as error.
+func Decode(r io.Reader, f func(Message)) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg Message
+		err := dec.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return errors.New(msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		f(msg)
+	}
+}
@@ -0,0 +1,17 @@
+// Package names validates names used as file names on the host, such as
+// names of volumes and secrets.
+package names
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Check returns error unless name is a single path element, so joining it
+// to a directory never leaves the directory. Kind names the checked thing.
+func Check(kind, name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid %s name %q", kind, name)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package names
+
+import "testing"
+
+func TestCheck(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"go-mod":  true,
+		".cache":  true,
+		"":        false,
+		".":       false,
+		"..":      false,
+		"../root": false,
+		"a/b":     false,
+		`a\b`:     false,
+	} {
+		if err := Check("volume", name); (err == nil) != valid {
+			t.Errorf("Unexpected result for %q: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+// Package references matches image references against repo digests reported
+// by docker compatible daemons.
+package references
+
+import (
+	"github.com/docker/distribution/reference"
+)
+
+// RepoDigest returns the repo digest of the repository of named, images
+// pulled from several repositories have one for each of them
+func RepoDigest(repoDigests []string, named reference.Named) reference.Canonical {
+	for _, repoDigest := range repoDigests {
+		ref, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		if canonical, ok := ref.(reference.Canonical); ok && ref.Name() == named.Name() {
+			return canonical
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Package runtimespec applies contman settings to OCI runtime specs shared
+// by the backends running containers without a daemon API.
+package runtimespec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/elemir/contman"
+)
+
+// SetResources sets cgroup limits, rlimits, size of /dev/shm and tmpfs
+// mounts of spec
+func SetResources(spec *specs.Spec, r contman.Resources) {
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = &specs.LinuxResources{}
+	}
+	resources := spec.Linux.Resources
+
+	if r.CPUQuota != 0 || r.CPUPeriod != 0 || r.CPUShares != 0 {
+		resources.CPU = &specs.LinuxCPU{}
+		if r.CPUQuota != 0 {
+			resources.CPU.Quota = &r.CPUQuota
+		}
+		if r.CPUPeriod != 0 {
+			period := uint64(r.CPUPeriod)
+			resources.CPU.Period = &period
+		}
+		if r.CPUShares != 0 {
+			shares := uint64(r.CPUShares)
+			resources.CPU.Shares = &shares
+		}
+	}
+	if r.Memory != 0 || r.MemorySwap != 0 {
+		resources.Memory = &specs.LinuxMemory{}
+		if r.Memory != 0 {
+			resources.Memory.Limit = &r.Memory
+		}
+		if r.MemorySwap != 0 {
+			resources.Memory.Swap = &r.MemorySwap
+		}
+	}
+	if r.PidsLimit != 0 {
+		resources.Pids = &specs.LinuxPids{Limit: r.PidsLimit}
+	}
+
+	if spec.Process != nil {
+		for _, u := range r.Ulimits {
+			spec.Process.Rlimits = append(spec.Process.Rlimits, specs.POSIXRlimit{
+				Type: "RLIMIT_" + strings.ToUpper(u.Name),
+				Hard: uint64(u.Hard),
+				Soft: uint64(u.Soft),
+			})
+		}
+	}
+
+	if r.ShmSize != 0 {
+		for i, m := range spec.Mounts {
+			if m.Destination != "/dev/shm" {
+				continue
+			}
+			options := []string{}
+			for _, option := range m.Options {
+				if !strings.HasPrefix(option, "size=") {
+					options = append(options, option)
+				}
+			}
+			spec.Mounts[i].Options = append(options, fmt.Sprintf("size=%d", r.ShmSize))
+		}
+	}
+
+	targets := make([]string, 0, len(r.Tmpfs))
+	for target := range r.Tmpfs {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		options := []string{"nosuid", "nodev"}
+		if r.Tmpfs[target] != "" {
+			options = append(options, strings.Split(r.Tmpfs[target], ",")...)
+		}
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: target,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     options,
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package runtimespec
+
+import (
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/elemir/contman"
+)
+
+func TestSetResources(t *testing.T) {
+	spec := &specs.Spec{
+		Process: &specs.Process{},
+		Mounts:  []specs.Mount{{Destination: "/dev/shm", Type: "tmpfs", Options: []string{"nosuid", "size=65536k"}}},
+	}
+	SetResources(spec, contman.Resources{
+		CPUQuota:  50000,
+		Memory:    64 << 20,
+		PidsLimit: 100,
+		Ulimits:   []contman.Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+		ShmSize:   1 << 20,
+		Tmpfs:     map[string]string{"/tmp": "size=64m"},
+	})
+
+	r := spec.Linux.Resources
+	if *r.CPU.Quota != 50000 || r.CPU.Period != nil || *r.Memory.Limit != 64<<20 || r.Pids.Limit != 100 {
+		t.Errorf("Unexpected resources: %+v", r)
+	}
+	if rl := spec.Process.Rlimits; len(rl) != 1 || rl[0].Type != "RLIMIT_NOFILE" || rl[0].Hard != 2048 {
+		t.Errorf("Unexpected rlimits: %+v", rl)
+	}
+	if options := spec.Mounts[0].Options; len(options) != 2 || options[1] != "size=1048576" {
+		t.Errorf("Unexpected shm options: %v", options)
+	}
+	if len(spec.Mounts) != 2 || spec.Mounts[1].Destination != "/tmp" || spec.Mounts[1].Options[2] != "size=64m" {
+		t.Errorf("Unexpected mounts: %+v", spec.Mounts)
+	}
+}
@@ -0,0 +1,80 @@
+package runtimespec
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/elemir/contman"
+)
+
+// SetSecurity applies security settings to spec. Seccomp profiles in docker
+// format and user namespace modes need a daemon, so they are rejected.
+func SetSecurity(spec *specs.Spec, s contman.Security) error {
+	if s.SeccompProfile != "" && s.SeccompProfile != "unconfined" {
+		return fmt.Errorf("seccomp profile %s is not supported without a daemon", s.SeccompProfile)
+	}
+	if s.UsernsMode != "" && s.UsernsMode != "host" {
+		return fmt.Errorf("user namespace mode %s is not supported without a daemon", s.UsernsMode)
+	}
+
+	if s.ReadOnlyRootfs && spec.Root != nil {
+		spec.Root.Readonly = true
+	}
+	if spec.Process == nil {
+		return nil
+	}
+	if s.NoNewPrivileges {
+		spec.Process.NoNewPrivileges = true
+	}
+	if s.AppArmorProfile != "" {
+		spec.Process.ApparmorProfile = s.AppArmorProfile
+	}
+	if s.RunAsHostUser {
+		spec.Process.User = specs.User{UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}
+	}
+
+	if caps := spec.Process.Capabilities; caps != nil {
+		caps.Bounding = updateCaps(caps.Bounding, s.CapDrop, s.CapAdd)
+		caps.Effective = updateCaps(caps.Effective, s.CapDrop, s.CapAdd)
+		caps.Permitted = updateCaps(caps.Permitted, s.CapDrop, s.CapAdd)
+		caps.Inheritable = updateCaps(caps.Inheritable, s.CapDrop, nil)
+		caps.Ambient = updateCaps(caps.Ambient, s.CapDrop, nil)
+	}
+	return nil
+}
+
+// updateCaps drops and then adds capabilities, names are accepted with or
+// without CAP_ prefix
+func updateCaps(caps, drop, add []string) []string {
+	dropped := map[string]bool{}
+	for _, name := range drop {
+		dropped[capName(name)] = true
+	}
+
+	var result []string
+	present := map[string]bool{}
+	for _, name := range caps {
+		if !dropped["CAP_ALL"] && !dropped[name] {
+			result = append(result, name)
+			present[name] = true
+		}
+	}
+	for _, name := range add {
+		if name = capName(name); !present[name] {
+			result = append(result, name)
+			present[name] = true
+		}
+	}
+	return result
+}
+
+func capName(name string) string {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	return name
+}
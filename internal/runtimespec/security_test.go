@@ -0,0 +1,40 @@
+package runtimespec
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/elemir/contman"
+)
+
+func TestSetSecurity(t *testing.T) {
+	spec := &specs.Spec{
+		Root: &specs.Root{Path: "rootfs"},
+		Process: &specs.Process{
+			Capabilities: &specs.LinuxCapabilities{
+				Bounding:  []string{"CAP_CHOWN", "CAP_KILL"},
+				Effective: []string{"CAP_CHOWN", "CAP_KILL"},
+				Permitted: []string{"CAP_CHOWN", "CAP_KILL"},
+			},
+		},
+	}
+	security := contman.StrictSecurity()
+	security.CapAdd = []string{"net_bind_service"}
+	if err := SetSecurity(spec, security); err != nil {
+		t.Fatal("Cannot set security: ", err)
+	}
+
+	if !spec.Root.Readonly || !spec.Process.NoNewPrivileges || spec.Process.User.UID != uint32(os.Getuid()) {
+		t.Errorf("Unexpected spec: %+v", spec.Process)
+	}
+	if caps := spec.Process.Capabilities; !reflect.DeepEqual(caps.Bounding, []string{"CAP_NET_BIND_SERVICE"}) || caps.Ambient != nil {
+		t.Errorf("Unexpected capabilities: %+v", caps)
+	}
+
+	if err := SetSecurity(spec, contman.Security{SeccompProfile: "profile.json"}); err == nil {
+		t.Error("Seccomp profile is accepted")
+	}
+}
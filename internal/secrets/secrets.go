@@ -0,0 +1,59 @@
+// Package secrets stores secrets of containers run on the host.
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/names"
+)
+
+// tempDir returns directory for secret files, it is /dev/shm when
+// available, so secrets never hit the disk
+func tempDir() string {
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		return "/dev/shm"
+	}
+	log.Warn("No tmpfs for secrets, they are stored in temporary directory")
+	return ""
+}
+
+// Mounts stores secrets into a private temporary directory and returns
+// read-only mounts of them at contman.SecretsDir. The directory should be
+// removed once the container is gone, it is empty without secrets.
+func Mounts(secrets map[string][]byte) (string, []contman.Mount, error) {
+	if len(secrets) == 0 {
+		return "", nil, nil
+	}
+	tmp, err := ioutil.TempDir(tempDir(), "contman-secrets-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	keys := make([]string, 0, len(secrets))
+	for name := range secrets {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+
+	var mounts []contman.Mount
+	for _, name := range keys {
+		if err := names.Check("secret", name); err != nil {
+			os.RemoveAll(tmp)
+			return "", nil, err
+		}
+		file := filepath.Join(tmp, name)
+		if err := ioutil.WriteFile(file, secrets[name], 0444); err != nil {
+			os.RemoveAll(tmp)
+			return "", nil, err
+		}
+		mounts = append(mounts, contman.Mount{Source: file, Target: path.Join(contman.SecretsDir, name), ReadOnly: true})
+	}
+	return tmp, mounts, nil
+}
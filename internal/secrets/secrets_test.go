@@ -0,0 +1,26 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMounts(t *testing.T) {
+	dir, mounts, err := Mounts(map[string][]byte{"token": []byte("secret"), "key": []byte("value")})
+	if err != nil {
+		t.Fatal("Cannot write secrets: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if len(mounts) != 2 || mounts[0].Target != "/run/secrets/key" || !mounts[0].ReadOnly {
+		t.Errorf("Unexpected mounts: %+v", mounts)
+	}
+	if data, err := ioutil.ReadFile(mounts[1].Source); err != nil || string(data) != "secret" {
+		t.Error("Secret is not written: ", err)
+	}
+
+	if _, _, err := Mounts(map[string][]byte{"../token": nil}); err == nil {
+		t.Error("Invalid name is accepted")
+	}
+}
@@ -0,0 +1,74 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrMarker is returned by MarkerWriter once the marker is written, so
+// io.Copy stops
+var ErrMarker = errors.New("marker is reached")
+
+// MarkerWriter passes output to w until marker, which is dropped together
+// with everything after it. Output which may be the beginning of the marker
+// is held back until the next write or Flush.
+type MarkerWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	marker  []byte
+	pending []byte
+	reached bool
+}
+
+func NewMarkerWriter(w io.Writer, marker []byte) *MarkerWriter {
+	return &MarkerWriter{w: w, marker: marker}
+}
+
+func (mw *MarkerWriter) Write(p []byte) (int, error) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if mw.reached {
+		return 0, ErrMarker
+	}
+
+	data := append(mw.pending, p...)
+	n := len(data)
+	if i := bytes.Index(data, mw.marker); i >= 0 {
+		n = i
+		mw.reached = true
+	} else {
+		for k := len(mw.marker) - 1; k > 0; k-- {
+			if len(data) >= k && bytes.HasSuffix(data, mw.marker[:k]) {
+				n = len(data) - k
+				break
+			}
+		}
+	}
+	mw.pending = append([]byte(nil), data[n:]...)
+
+	if n > 0 {
+		if _, err := mw.w.Write(data[:n]); err != nil {
+			return 0, err
+		}
+	}
+	if mw.reached {
+		mw.pending = nil
+		return len(p), ErrMarker
+	}
+	return len(p), nil
+}
+
+// Flush writes output held back as it is, the stream has ended without the
+// marker
+func (mw *MarkerWriter) Flush() error {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if len(mw.pending) == 0 {
+		return nil
+	}
+	_, err := mw.w.Write(mw.pending)
+	mw.pending = nil
+	return err
+}
@@ -0,0 +1,76 @@
+package stream
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Redacted replaces secret values in redacted output
+const Redacted = "***"
+
+// RedactWriter replaces every occurrence of secrets with Redacted. Output
+// which may be the beginning of a secret is held back until the next write
+// or Flush.
+type RedactWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	secrets [][]byte
+	pending []byte
+}
+
+func NewRedactWriter(w io.Writer, secrets [][]byte) *RedactWriter {
+	rw := &RedactWriter{w: w}
+	for _, secret := range secrets {
+		if len(secret) > 0 {
+			rw.secrets = append(rw.secrets, secret)
+		}
+	}
+	return rw
+}
+
+func (rw *RedactWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	data := append(rw.pending, p...)
+	var out bytes.Buffer
+	i := 0
+scan:
+	for i < len(data) {
+		for _, secret := range rw.secrets {
+			if bytes.HasPrefix(data[i:], secret) {
+				out.WriteString(Redacted)
+				i += len(secret)
+				continue scan
+			}
+		}
+		for _, secret := range rw.secrets {
+			if len(data)-i < len(secret) && bytes.HasPrefix(secret, data[i:]) {
+				break scan
+			}
+		}
+		out.WriteByte(data[i])
+		i++
+	}
+	rw.pending = append([]byte(nil), data[i:]...)
+
+	if out.Len() > 0 {
+		if _, err := rw.w.Write(out.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes output held back as it is, it cannot be a secret anymore
+func (rw *RedactWriter) Flush() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if len(rw.pending) == 0 {
+		return nil
+	}
+	_, err := rw.w.Write(rw.pending)
+	rw.pending = nil
+	return err
+}
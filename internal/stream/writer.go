@@ -0,0 +1,38 @@
+// Package stream contains io helpers shared by container backends.
+package stream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// DeferredWriter buffers output until its destination is attached. Backends
+// have to set up process streams in Start, while writers arrive with Wait.
+type DeferredWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	w   io.Writer
+}
+
+func (dw *DeferredWriter) Write(p []byte) (int, error) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.w != nil {
+		return dw.w.Write(p)
+	}
+	return dw.buf.Write(p)
+}
+
+// Attach flushes buffered output to w and passes all further writes to it,
+// nil w discards output
+func (dw *DeferredWriter) Attach(w io.Writer) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if w == nil {
+		w = ioutil.Discard
+	}
+	_, _ = dw.buf.WriteTo(w)
+	dw.w = w
+}
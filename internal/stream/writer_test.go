@@ -0,0 +1,61 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeferredWriter(t *testing.T) {
+	var dw DeferredWriter
+	dw.Write([]byte("before "))
+
+	var buf bytes.Buffer
+	dw.Attach(&buf)
+	dw.Write([]byte("after"))
+
+	if buf.String() != "before after" {
+		t.Errorf("Unexpected output: %q", buf.String())
+	}
+}
+
+func TestRedactWriter(t *testing.T) {
+	var buf bytes.Buffer
+	rw := NewRedactWriter(&buf, [][]byte{[]byte("hunter2"), []byte("s3cr3t"), nil})
+
+	// Secrets split across writes are redacted as well
+	for _, chunk := range []string{"password: hun", "ter2\n", "token: s3cr", "3t, hunt"} {
+		rw.Write([]byte(chunk))
+	}
+	if buf.String() != "password: ***\ntoken: ***, " {
+		t.Errorf("Unexpected output before flush: %q", buf.String())
+	}
+
+	rw.Flush()
+	if buf.String() != "password: ***\ntoken: ***, hunt" {
+		t.Errorf("Unexpected output: %q", buf.String())
+	}
+}
+
+func TestMarkerWriter(t *testing.T) {
+	var buf bytes.Buffer
+	mw := NewMarkerWriter(&buf, []byte("<done>\n"))
+
+	for _, chunk := range []string{"line\n", "no newline<do", "ne>\nafter"} {
+		mw.Write([]byte(chunk))
+	}
+	if _, err := mw.Write([]byte("more")); err != ErrMarker {
+		t.Error("Write after marker succeeded: ", err)
+	}
+	mw.Flush()
+	if buf.String() != "line\nno newline" {
+		t.Errorf("Unexpected output: %q", buf.String())
+	}
+
+	buf.Reset()
+	mw = NewMarkerWriter(&buf, []byte("<done>\n"))
+	mw.Write([]byte("ends with <do"))
+	mw.Flush()
+	if buf.String() != "ends with <do" {
+		t.Errorf("Unexpected output without marker: %q", buf.String())
+	}
+}
@@ -0,0 +1,126 @@
+// Package volumes keeps named volumes as directories on the host for
+// backends without a volume store of their own.
+package volumes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/names"
+)
+
+// labelsFile is kept next to the data of a volume, outside of what is mounted
+const labelsFile = "labels.json"
+
+// Store keeps every volume in Dir/<name>/data with its labels aside
+type Store struct {
+	Dir string
+}
+
+// Path returns directory of the volume mounted into containers, the volume
+// is created without labels when it is missing
+func (s Store) Path(name string) (string, error) {
+	if err := names.Check("volume", name); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(s.Dir, name, "data")
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// Create creates the volume, labels of an existing volume are kept
+func (s Store) Create(name string, labels map[string]string) (contman.Volume, error) {
+	if v, err := s.volume(name); err == nil {
+		return v, nil
+	}
+	if _, err := s.Path(name); err != nil {
+		return contman.Volume{}, err
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return contman.Volume{}, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.Dir, name, labelsFile), data, 0644); err != nil {
+		return contman.Volume{}, err
+	}
+	return contman.Volume{Name: name, Labels: labels}, nil
+}
+
+// volume reads the volume, it fails when the volume does not exist
+func (s Store) volume(name string) (contman.Volume, error) {
+	if err := names.Check("volume", name); err != nil {
+		return contman.Volume{}, err
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, name, "data")); err != nil {
+		return contman.Volume{}, err
+	}
+	v := contman.Volume{Name: name}
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, name, labelsFile))
+	if os.IsNotExist(err) {
+		return v, nil
+	}
+	if err != nil {
+		return contman.Volume{}, err
+	}
+	return v, json.Unmarshal(data, &v.Labels)
+}
+
+// List returns volumes having all of labels sorted by name
+func (s Store) List(labels map[string]string) ([]contman.Volume, error) {
+	entries, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []contman.Volume
+	for _, entry := range entries {
+		v, err := s.volume(entry.Name())
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if matchLabels(v.Labels, labels) {
+			volumes = append(volumes, v)
+		}
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+// Prune removes volumes having all of labels, except those which data
+// directories are used, and returns their names
+func (s Store) Prune(labels map[string]string, used map[string]bool) ([]string, error) {
+	volumes, err := s.List(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, v := range volumes {
+		if used[filepath.Join(s.Dir, v.Name, "data")] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.Dir, v.Name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, v.Name)
+	}
+	return removed, nil
+}
+
+func matchLabels(have, want map[string]string) bool {
+	for key, value := range want {
+		if v, ok := have[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
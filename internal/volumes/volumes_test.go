@@ -0,0 +1,45 @@
+package volumes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contman-volumes-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := Store{Dir: dir}
+
+	if _, err := s.Create("cache", map[string]string{"kind": "cache"}); err != nil {
+		t.Fatal("Cannot create volume: ", err)
+	}
+	if v, _ := s.Create("cache", nil); v.Labels["kind"] != "cache" {
+		t.Errorf("Labels of existing volume are lost: %+v", v)
+	}
+	used, err := s.Path("used")
+	if err != nil {
+		t.Fatal("Cannot create volume: ", err)
+	}
+	if _, err := s.Path(".."); err == nil {
+		t.Error("Volume outside of store is created")
+	}
+
+	list, err := s.List(map[string]string{"kind": "cache"})
+	if err != nil || len(list) != 1 || list[0].Name != "cache" {
+		t.Errorf("Unexpected volumes: %+v, %v", list, err)
+	}
+
+	removed, err := s.Prune(nil, map[string]bool{used: true})
+	if err != nil || !reflect.DeepEqual(removed, []string{"cache"}) {
+		t.Errorf("Unexpected pruned volumes: %v, %v", removed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cache")); !os.IsNotExist(err) {
+		t.Error("Volume is not removed: ", err)
+	}
+}
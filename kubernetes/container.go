@@ -0,0 +1,599 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	typednetworkingv1 "k8s.io/client-go/kubernetes/typed/networking/v1"
+	utilexec "k8s.io/client-go/util/exec"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/archive"
+	"github.com/elemir/contman/internal/cgroups"
+	"github.com/elemir/contman/internal/stream"
+)
+
+const (
+	// controlDir is a memory backed volume of every pod keeping files of
+	// wrapper, which stays writable with read-only root filesystem
+	controlDir = "/.contman"
+	// startMarker is created by Start once pending copies are done, the
+	// command of the pod waits for it
+	startMarker = controlDir + "/start"
+	// exitFile has exit code of the command, the container keeps running
+	// after the command exits, so output can be copied by exec
+	exitFile = controlDir + "/exit"
+
+	// killedExitCode is exit code of a command killed by SIGKILL
+	killedExitCode = 128 + 9
+
+	// terminationTimeout limits waiting for status of a container, which
+	// cannot be executed into
+	terminationTimeout = 10 * time.Second
+)
+
+// wrapper runs command passed as arguments following controlDir once
+// started, it prints marker passed as $0 after the command exits, so
+// following logs can stop, and blocks until the pod is deleted
+const wrapper = `dir=$1
+shift
+while [ ! -e "$dir/start" ]; do sleep 0.1; done
+"$@"
+code=$?
+echo $code > "$dir/exit.tmp" && mv "$dir/exit.tmp" "$dir/exit"
+trap 'exit $code' TERM
+printf '%s\n' "$0"
+while :; do sleep 1; done
+`
+
+// waitExitCmd blocks until the command exits and prints its exit code
+var waitExitCmd = []string{"sh", "-c", fmt.Sprintf("while [ ! -e %[1]s ]; do sleep 0.1; done; cat %[1]s", exitFile)}
+
+// oomEventsCmd prints OOM kill counters of cgroup v2 and v1 of the container
+var oomEventsCmd = []string{"sh", "-c", cgroups.EventsScript}
+
+// failedReasons are reasons of waiting containers which are not going to
+// start without intervention
+var failedReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+type copyRequest struct {
+	src  string
+	dest string
+}
+
+type KubernetesContainer struct {
+	manager *KubernetesManager
+	name    string
+	pod     *corev1.Pod
+	// policy isolates the pod without network and secret holds secrets of
+	// the pod, both are created before the pod
+	policy  *networkingv1.NetworkPolicy
+	secret  *corev1.Secret
+	hostDir string
+	// marker is printed by wrapper once the command exits
+	marker string
+
+	mu      sync.Mutex
+	started bool
+	exited  bool
+	// pending are copies requested before the pod exists
+	pending []copyRequest
+}
+
+func (kc *KubernetesContainer) ID() string {
+	return kc.name
+}
+
+func (kc *KubernetesContainer) pods() typedcorev1.PodInterface {
+	return kc.manager.client.CoreV1().Pods(kc.manager.namespace)
+}
+
+func (kc *KubernetesContainer) secrets() typedcorev1.SecretInterface {
+	return kc.manager.client.CoreV1().Secrets(kc.manager.namespace)
+}
+
+func (kc *KubernetesContainer) policies() typednetworkingv1.NetworkPolicyInterface {
+	return kc.manager.client.NetworkingV1().NetworkPolicies(kc.manager.namespace)
+}
+
+// createObjects creates network policy and secret of the pod if it has them
+func (kc *KubernetesContainer) createObjects(ctx context.Context) error {
+	if kc.policy != nil {
+		if _, err := kc.policies().Create(ctx, kc.policy, metav1.CreateOptions{}); err != nil {
+			kc.GetLogger().WithError(err).Error("Error creating network policy")
+			return err
+		}
+	}
+	if kc.secret != nil {
+		if _, err := kc.secrets().Create(ctx, kc.secret, metav1.CreateOptions{}); err != nil {
+			kc.GetLogger().WithError(err).Error("Error creating secret")
+			if err := kc.deleteObjects(ctx); err != nil {
+				kc.GetLogger().WithError(err).Error("Error removing objects of the pod")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteObjects deletes network policy and secret of the pod
+func (kc *KubernetesContainer) deleteObjects(ctx context.Context) error {
+	if kc.policy != nil {
+		err := kc.policies().Delete(ctx, kc.policy.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	if kc.secret != nil {
+		err := kc.secrets().Delete(ctx, kc.secret.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kc *KubernetesContainer) isStarted() bool {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	return kc.started
+}
+
+// ImageDigest returns digest of the image kubelet has pulled, it is empty
+// until the pod is started, RunReceipt asks again once the container is run
+func (kc *KubernetesContainer) ImageDigest(ctx context.Context) (string, error) {
+	if !kc.isStarted() {
+		return "", nil
+	}
+	pod, err := kc.pods().Get(ctx, kc.name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	status := containerStatus(pod)
+	if status == nil {
+		return "", nil
+	}
+	return status.ImageID[strings.LastIndex(status.ImageID, "@")+1:], nil
+}
+
+// waitPod watches the pod until cond is satisfied, nil pod is passed to
+// cond once the pod is deleted
+func (kc *KubernetesContainer) waitPod(ctx context.Context, cond func(*corev1.Pod) (bool, error)) (*corev1.Pod, error) {
+	// Watch is started before getting the pod, so no change is missed
+	w, err := kc.pods().Watch(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", kc.name).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	pod, err := kc.pods().Get(ctx, kc.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		pod, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if done, err := cond(pod); done || err != nil {
+			return pod, err
+		}
+
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return nil, fmt.Errorf("watch of pod %s is closed", kc.name)
+			}
+			switch event.Type {
+			case watch.Error:
+				return nil, apierrors.FromObject(event.Object)
+			case watch.Deleted:
+				pod = nil
+			default:
+				if p, ok := event.Object.(*corev1.Pod); ok && p.Name == kc.name {
+					pod = p
+				}
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (kc *KubernetesContainer) Start(ctx context.Context) error {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if kc.started {
+		return fmt.Errorf("container %s is already started", kc.name)
+	}
+
+	if err := kc.createObjects(ctx); err != nil {
+		return err
+	}
+	if _, err := kc.pods().Create(ctx, kc.pod, metav1.CreateOptions{}); err != nil {
+		kc.GetLogger().WithError(err).Error("Error creating pod")
+		if err := kc.deleteObjects(ctx); err != nil {
+			kc.GetLogger().WithError(err).Error("Error removing objects of the pod")
+		}
+		return err
+	}
+	kc.started = true
+
+	_, err := kc.waitPod(ctx, func(pod *corev1.Pod) (bool, error) {
+		if pod == nil {
+			return false, fmt.Errorf("pod %s is deleted", kc.name)
+		}
+		if status := containerStatus(pod); status != nil && status.State.Waiting != nil && failedReasons[status.State.Waiting.Reason] {
+			waiting := status.State.Waiting
+			return false, fmt.Errorf("pod %s cannot start: %s: %s", kc.name, waiting.Reason, waiting.Message)
+		}
+		return pod.Status.Phase != corev1.PodPending, nil
+	})
+	if err != nil {
+		kc.GetLogger().WithError(err).Error("Error starting container")
+		return err
+	}
+
+	for _, req := range kc.pending {
+		if err := kc.copyTo(ctx, req.src, req.dest); err != nil {
+			return err
+		}
+	}
+	kc.pending = nil
+
+	if _, err := kc.exec(ctx, []string{"touch", startMarker}, nil, nil, nil); err != nil {
+		kc.GetLogger().WithError(err).Error("Error starting container")
+		return err
+	}
+	return nil
+}
+
+// deletePod deletes the pod and waits until it is gone
+func (kc *KubernetesContainer) deletePod(ctx context.Context, grace int64) error {
+	err := kc.pods().Delete(ctx, kc.name, metav1.DeleteOptions{GracePeriodSeconds: &grace})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = kc.waitPod(ctx, func(pod *corev1.Pod) (bool, error) {
+		return pod == nil, nil
+	})
+	return err
+}
+
+func (kc *KubernetesContainer) Stop(ctx context.Context, timeout time.Duration) error {
+	running, _ := kc.IsRunning(ctx)
+	if !running {
+		return nil
+	}
+
+	err := kc.deletePod(ctx, int64(timeout/time.Second))
+	if err != nil {
+		kc.GetLogger().WithError(err).Error("Error stopping container")
+	}
+	return err
+}
+
+func (kc *KubernetesContainer) Kill(ctx context.Context) error {
+	running, _ := kc.IsRunning(ctx)
+	if !running {
+		return nil
+	}
+
+	err := kc.deletePod(ctx, 0)
+	if err != nil {
+		kc.GetLogger().WithError(err).Error("Error killing container")
+	}
+	return err
+}
+
+func (kc *KubernetesContainer) Remove(ctx context.Context) error {
+	if !kc.isStarted() {
+		return nil
+	}
+
+	var grace int64
+	err := kc.pods().Delete(ctx, kc.name, metav1.DeleteOptions{GracePeriodSeconds: &grace})
+	if err != nil && !apierrors.IsNotFound(err) {
+		kc.GetLogger().WithError(err).Errorf("Error removing container")
+		return err
+	}
+	if err := kc.deleteObjects(ctx); err != nil {
+		kc.GetLogger().WithError(err).Error("Error removing objects of the pod")
+		return err
+	}
+	return nil
+}
+
+// IsRunning reports false once Wait has seen the command exit, though the
+// pod keeps running until it is removed
+func (kc *KubernetesContainer) IsRunning(ctx context.Context) (bool, error) {
+	kc.mu.Lock()
+	started, exited := kc.started, kc.exited
+	kc.mu.Unlock()
+	if !started || exited {
+		return false, nil
+	}
+
+	pod, err := kc.pods().Get(ctx, kc.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return pod.Status.Phase == corev1.PodPending || pod.Status.Phase == corev1.PodRunning, nil
+}
+
+// Wait follows logs of the pod until wrapper prints the marker and gets exit
+// code of the command by exec, the container keeps running for copies
+func (kc *KubernetesContainer) Wait(ctx context.Context, stdout, stderr io.Writer) (int, error) {
+	if !kc.isStarted() {
+		return 0, fmt.Errorf("container %s is not started", kc.name)
+	}
+
+	logsDone := make(chan struct{})
+	if stdout != nil || stderr != nil {
+		logs, err := kc.pods().GetLogs(kc.name, &corev1.PodLogOptions{
+			Container: containerName,
+			Follow:    true,
+		}).Stream(ctx)
+		if err != nil {
+			kc.GetLogger().WithError(err).Error("Error getting container logs")
+			return 0, err
+		}
+		defer logs.Close()
+
+		go func() {
+			defer close(logsDone)
+			mw := stream.NewMarkerWriter(orDiscard(stdout), []byte(kc.marker+"\n"))
+			if _, err := io.Copy(mw, logs); err != nil && err != stream.ErrMarker && ctx.Err() == nil {
+				kc.GetLogger().WithError(err).Error("Error reading container logs")
+			}
+			_ = mw.Flush()
+		}()
+	} else {
+		close(logsDone)
+	}
+
+	var out bytes.Buffer
+	_, err := kc.exec(ctx, waitExitCmd, nil, &out, ioutil.Discard)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		// The container is gone, e.g. killed with the whole cgroup by OOM
+		// killer, so its status has the exit code
+		return kc.waitTerminated(ctx, logsDone, err)
+	}
+	exitCode, err := strconv.Atoi(strings.TrimSpace(out.String()))
+	if err != nil {
+		return 0, fmt.Errorf("invalid exit code %q of container %s", out.String(), kc.name)
+	}
+
+	kc.mu.Lock()
+	kc.exited = true
+	kc.mu.Unlock()
+
+	select {
+	case <-logsDone:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	// Only the command is killed when the container survives OOM killer
+	if exitCode == killedExitCode && kc.oomKilled(ctx) {
+		return exitCode, &contman.ExitError{ContainerID: kc.name, Code: exitCode, OOMKilled: true}
+	}
+	return exitCode, nil
+}
+
+// waitTerminated returns exit code of terminated container, execErr is
+// returned when the container is still running
+func (kc *KubernetesContainer) waitTerminated(ctx context.Context, logsDone <-chan struct{}, execErr error) (int, error) {
+	wctx, cancel := context.WithTimeout(ctx, terminationTimeout)
+	defer cancel()
+
+	pod, err := kc.waitPod(wctx, func(pod *corev1.Pod) (bool, error) {
+		if pod == nil {
+			return false, fmt.Errorf("pod %s is deleted", kc.name)
+		}
+		status := containerStatus(pod)
+		return status != nil && status.State.Terminated != nil ||
+			pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed, nil
+	})
+	if err != nil {
+		kc.GetLogger().WithError(execErr).Error("Error waiting container")
+		return 0, execErr
+	}
+
+	kc.mu.Lock()
+	kc.exited = true
+	kc.mu.Unlock()
+
+	select {
+	case <-logsDone:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	status := containerStatus(pod)
+	if status == nil || status.State.Terminated == nil {
+		return 0, fmt.Errorf("pod %s failed: %s", kc.name, pod.Status.Message)
+	}
+	exitCode := int(status.State.Terminated.ExitCode)
+	if status.State.Terminated.Reason == "OOMKilled" {
+		return exitCode, &contman.ExitError{ContainerID: kc.name, Code: exitCode, OOMKilled: true}
+	}
+	return exitCode, nil
+}
+
+// oomKilled tells whether OOM killer has killed a process of the container
+func (kc *KubernetesContainer) oomKilled(ctx context.Context) bool {
+	var out bytes.Buffer
+	if _, err := kc.exec(ctx, oomEventsCmd, nil, &out, ioutil.Discard); err != nil {
+		kc.GetLogger().WithError(err).Warn("Cannot read OOM events")
+		return false
+	}
+	return cgroups.OOMKilled(out.Bytes())
+}
+
+// exec runs cmd in the pod, returning its exit code
+func (kc *KubernetesContainer) exec(ctx context.Context, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	err := kc.manager.executor.Exec(ctx, kc.manager.namespace, kc.name, containerName, cmd, stdin, stdout, stderr)
+
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+	return 0, err
+}
+
+func (kc *KubernetesContainer) Exec(ctx context.Context, config contman.ExecConfig) (int, error) {
+	l := kc.GetLogger().WithField("cmd", config.Cmd)
+
+	// Exec inherits environment of the container, only overrides are set
+	cmd := []string{"env"}
+	for _, env := range envVars(config.Env) {
+		cmd = append(cmd, env.Name+"="+env.Value)
+	}
+	cmd = append(cmd, "sh", "-c", config.Cmd)
+	if config.WorkingDir != "" {
+		cmd = append([]string{"sh", "-c", `cd "$0" && exec "$@"`, config.WorkingDir}, cmd...)
+	}
+
+	exitCode, err := kc.exec(ctx, cmd, nil, orDiscard(config.Stdout), orDiscard(config.Stderr))
+	if err != nil {
+		l.WithError(err).Error("Error executing command")
+	}
+	if err == nil && exitCode == killedExitCode && kc.oomKilled(ctx) {
+		return exitCode, &contman.ExitError{ContainerID: kc.name, Code: exitCode, OOMKilled: true}
+	}
+	return exitCode, err
+}
+
+func (kc *KubernetesContainer) CopyFrom(ctx context.Context, src, dest string) error {
+	l := kc.GetLogger().WithFields(log.Fields{
+		"src":  src,
+		"dest": dest,
+	})
+
+	exitCode, err := kc.exec(ctx, []string{"test", "-e", src}, nil, nil, nil)
+	if err != nil {
+		l.WithError(err).Error("Error copying from container")
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("%s: %w", src, contman.ErrNotFound)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		cmd := []string{"tar", "-cf", "-", "-C", path.Dir(src), path.Base(src)}
+		exitCode, err := kc.exec(ctx, cmd, nil, writer, ioutil.Discard)
+		if err == nil && exitCode != 0 {
+			err = fmt.Errorf("tar exited with code %d", exitCode)
+		}
+		_ = writer.CloseWithError(err)
+	}()
+	defer reader.Close()
+
+	err = archive.ExtractTarFromReader(reader, kc.hostPath(dest))
+	if err != nil {
+		l.WithError(err).Error("Error copying from container")
+	}
+	return err
+}
+
+// CopyTo copies src into the pod, copies requested before Start are done
+// once the pod is running
+func (kc *KubernetesContainer) CopyTo(ctx context.Context, src, dest string) error {
+	kc.mu.Lock()
+	if !kc.started {
+		kc.pending = append(kc.pending, copyRequest{src: src, dest: dest})
+		kc.mu.Unlock()
+		return nil
+	}
+	kc.mu.Unlock()
+
+	return kc.copyTo(ctx, src, dest)
+}
+
+func (kc *KubernetesContainer) copyTo(ctx context.Context, src, dest string) error {
+	l := kc.GetLogger().WithFields(log.Fields{
+		"src":  src,
+		"dest": dest,
+	})
+
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(archive.CreateTarToWriter(kc.hostPath(src), src, writer))
+	}()
+	defer reader.Close()
+
+	cmd := []string{"sh", "-c", `mkdir -p "$0" && tar -xf - -C "$0"`, dest}
+	exitCode, err := kc.exec(ctx, cmd, reader, ioutil.Discard, ioutil.Discard)
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("tar exited with code %d", exitCode)
+	}
+	if err != nil {
+		l.WithError(err).Error("Error copying to container")
+	}
+	return err
+}
+
+func (kc *KubernetesContainer) GetLogger() *log.Entry {
+	return log.WithField("containerID", kc.name)
+}
+
+func (kc *KubernetesContainer) hostPath(path string) string {
+	if kc.hostDir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(kc.hostDir, path)
+}
+
+func containerStatus(pod *corev1.Pod) *corev1.ContainerStatus {
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == containerName {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+	return nil
+}
+
+func orDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return ioutil.Discard
+	}
+	return w
+}
@@ -0,0 +1,552 @@
+package kubernetes
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	utilexec "k8s.io/client-go/util/exec"
+
+	"github.com/elemir/contman"
+)
+
+// fakeExecutor emulates wrapper of the pod command: touching start marker
+// runs the command, which exits with exitCode, or kills the whole container
+// when oomKilled is set. Exec into a terminated container fails as it does
+// on a cluster, other commands run right on the host.
+type fakeExecutor struct {
+	client      *fake.Clientset
+	keepRunning bool
+	exitCode    int32
+	oomKilled   bool
+	// commandOOMKilled makes cgroup of a running container report OOM kill
+	commandOOMKilled bool
+
+	mu     sync.Mutex
+	exited map[string]bool
+}
+
+func (fe *fakeExecutor) Exec(ctx context.Context, namespace, pod, container string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	p, err := fe.client.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if p.Status.ContainerStatuses[0].State.Terminated != nil {
+		return fmt.Errorf("container %s of pod %s is not running", container, pod)
+	}
+
+	switch {
+	case reflect.DeepEqual(cmd, []string{"touch", startMarker}):
+		if fe.keepRunning {
+			return nil
+		}
+		if fe.oomKilled {
+			p.Status.Phase = corev1.PodFailed
+			p.Status.ContainerStatuses[0].State = corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{ExitCode: fe.exitCode, Reason: "OOMKilled"},
+			}
+			_, err = fe.client.CoreV1().Pods(namespace).UpdateStatus(ctx, p, metav1.UpdateOptions{})
+			return err
+		}
+		fe.mu.Lock()
+		fe.exited[pod] = true
+		fe.mu.Unlock()
+		return nil
+	case reflect.DeepEqual(cmd, waitExitCmd):
+		fe.mu.Lock()
+		exited := fe.exited[pod]
+		fe.mu.Unlock()
+		if !exited {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		_, err := fmt.Fprintln(stdout, fe.exitCode)
+		return err
+	case reflect.DeepEqual(cmd, oomEventsCmd):
+		kills := 0
+		if fe.commandOOMKilled {
+			kills = 1
+		}
+		_, err := fmt.Fprintf(stdout, "oom 1\noom_kill %d\n", kills)
+		return err
+	}
+
+	c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Stderr = stderr
+	err = c.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return utilexec.CodeExitError{Err: err, Code: exitErr.ExitCode()}
+	}
+	return err
+}
+
+// newTestManager returns manager on fake clientset, which marks created pods
+// as running
+func newTestManager(t *testing.T, opts ...Option) (*KubernetesManager, *fakeExecutor) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		pod.Status.Phase = corev1.PodRunning
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			Name:    containerName,
+			ImageID: "docker.io/library/alpine@sha256:0123",
+			State:   corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+		}}
+		return false, nil, nil
+	})
+
+	executor := &fakeExecutor{client: client, exited: map[string]bool{}}
+	km, err := NewKubernetesManager(append(opts, WithClientset(client), WithExecutor(executor))...)
+	if err != nil {
+		t.Fatal("Cannot create manager: ", err)
+	}
+	return km, executor
+}
+
+func TestKubernetesReceipt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contman-kubernetes-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.txt"), []byte("input"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	km, executor := newTestManager(t)
+	podDir := filepath.Join(dir, "pod")
+	result, err := contman.RunReceipt(km, contman.Receipt{
+		Image:      "alpine:latest",
+		Cmd:        "cat /in/input.txt",
+		InputCopy:  map[string]string{"input.txt": podDir},
+		OutputCopy: map[string]string{filepath.Join(podDir, "input.txt"): "out"},
+		HostDir:    dir,
+	})
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if string(result.Stdout) != "fake logs" {
+		t.Errorf("Unexpected output: %q", result.Stdout)
+	}
+	if result.ImageDigest != "sha256:0123" {
+		t.Errorf("Unexpected digest: %s", result.ImageDigest)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "out", "input.txt")); err != nil || string(data) != "input" {
+		t.Error("Copy through pod failed: ", err)
+	}
+	pods, _ := executor.client.CoreV1().Pods(DefaultNamespace).List(context.Background(), metav1.ListOptions{})
+	if len(pods.Items) != 0 {
+		t.Error("Pod was not removed")
+	}
+
+	executor.exitCode = 2
+	_, err = contman.RunReceipt(km, contman.Receipt{Image: "alpine:latest", Cmd: "exit 2", HostDir: dir})
+	if exitErr, ok := err.(*contman.ExitError); !ok || exitErr.Code != 2 {
+		t.Error("Expected exit error, got: ", err)
+	}
+
+	executor.keepRunning = true
+	result, err = contman.RunReceipt(km, contman.Receipt{
+		Image: "alpine:latest",
+		Steps: []contman.Step{
+			{Cmd: "test \"$STEP\" = 1", Env: map[string]string{"STEP": "1"}},
+			{Cmd: "test \"$(pwd)\" = \"" + dir + "\"", WorkingDir: dir},
+			{Cmd: "exit 3"},
+		},
+	})
+	if stepErr, ok := err.(*contman.StepError); !ok || stepErr.Index != 2 || stepErr.ExitCode != 3 {
+		t.Fatalf("Expected failure of last step, got: %v, %+v", err, result)
+	}
+}
+
+func TestServiceAccount(t *testing.T) {
+	km, executor := newTestManager(t, WithNamespace("ci"), WithServiceAccount("builder"))
+	executor.keepRunning = true
+
+	cntr, err := km.ContainerCreate(context.Background(), contman.Config{
+		Image:  "alpine:latest",
+		Cmd:    "true",
+		Mounts: append(km.GetSystemMounts(), contman.Mount{Source: "/cache", Target: "/cache"}),
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	if err := cntr.Start(context.Background()); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+	defer cntr.Remove(context.Background())
+
+	if digest, _ := cntr.ImageDigest(context.Background()); digest != "sha256:0123" {
+		t.Errorf("Unexpected digest: %s", digest)
+	}
+
+	pod, err := executor.client.CoreV1().Pods("ci").Get(context.Background(), cntr.ID(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("Cannot get pod: ", err)
+	}
+	if pod.Spec.ServiceAccountName != "builder" || !*pod.Spec.AutomountServiceAccountToken {
+		t.Errorf("Service account is not mounted: %+v", pod.Spec)
+	}
+	if len(pod.Spec.Volumes) != 2 || pod.Spec.Volumes[0].HostPath.Path != "/cache" {
+		t.Errorf("Unexpected volumes: %+v", pod.Spec.Volumes)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	km, _ := newTestManager(t)
+
+	cntr, err := km.ContainerCreate(context.Background(), contman.Config{
+		Image:      "alpine:latest",
+		Cmd:        "true",
+		Network:    contman.NetworkHost,
+		Ports:      []contman.Port{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+		ExtraHosts: []string{"proxy:10.0.0.2", "mirror:10.0.0.2"},
+		DNS:        []string{"10.0.0.53"},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	spec := cntr.(*KubernetesContainer).pod.Spec
+	if !spec.HostNetwork || spec.DNSPolicy != corev1.DNSNone || spec.DNSConfig.Nameservers[0] != "10.0.0.53" {
+		t.Errorf("Unexpected network: %+v", spec)
+	}
+	if len(spec.HostAliases) != 1 || len(spec.HostAliases[0].Hostnames) != 2 {
+		t.Errorf("Unexpected host aliases: %+v", spec.HostAliases)
+	}
+	if port := spec.Containers[0].Ports[0]; port.HostPort != 8080 || port.Protocol != corev1.ProtocolTCP {
+		t.Errorf("Unexpected port: %+v", port)
+	}
+
+	if _, err := km.ContainerCreate(context.Background(), contman.Config{Image: "alpine:latest", Network: "container:other"}); err == nil {
+		t.Error("Container network is accepted")
+	}
+}
+
+func TestNetworkNone(t *testing.T) {
+	km, _ := newTestManager(t)
+	ctx := context.Background()
+
+	cntr, err := km.ContainerCreate(ctx, contman.Config{Image: "alpine:latest", Cmd: "true", Network: contman.NetworkNone})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	if err := cntr.Start(ctx); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+
+	policies := km.client.NetworkingV1().NetworkPolicies(km.namespace)
+	policy, err := policies.Get(ctx, cntr.ID(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("Network policy is not created: ", err)
+	}
+	if len(policy.Spec.PolicyTypes) != 2 || len(policy.Spec.Ingress) != 0 || len(policy.Spec.Egress) != 0 {
+		t.Errorf("Policy does not deny all traffic: %+v", policy.Spec)
+	}
+	pod, _ := km.client.CoreV1().Pods(km.namespace).Get(ctx, cntr.ID(), metav1.GetOptions{})
+	if policy.Spec.PodSelector.MatchLabels[podLabel] != cntr.ID() || pod.Labels[podLabel] != cntr.ID() {
+		t.Errorf("Policy does not select the pod: %+v", pod.Labels)
+	}
+
+	if err := cntr.Remove(ctx); err != nil {
+		t.Fatal("Cannot remove container: ", err)
+	}
+	if _, err := policies.Get(ctx, cntr.ID(), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Error("Network policy is not removed: ", err)
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	km, _ := newTestManager(t)
+	ctx := context.Background()
+
+	cntr, err := km.ContainerCreate(ctx, contman.Config{Image: "alpine:latest", Cmd: "true", Secrets: map[string][]byte{"token": []byte("secret")}})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	if err := cntr.Start(ctx); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+
+	secrets := km.client.CoreV1().Secrets(km.namespace)
+	secret, err := secrets.Get(ctx, cntr.ID(), metav1.GetOptions{})
+	if err != nil || string(secret.Data["token"]) != "secret" {
+		t.Fatal("Secret is not created: ", err)
+	}
+	pod := cntr.(*KubernetesContainer).pod
+	if m := pod.Spec.Containers[0].VolumeMounts[0]; m.MountPath != contman.SecretsDir || !m.ReadOnly || pod.Spec.Volumes[0].Secret.SecretName != secret.Name {
+		t.Errorf("Unexpected secret volume: %+v", pod.Spec)
+	}
+
+	if err := cntr.Remove(ctx); err != nil {
+		t.Fatal("Cannot remove container: ", err)
+	}
+	if _, err := secrets.Get(ctx, cntr.ID(), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Error("Secret is not removed: ", err)
+	}
+}
+
+func TestResources(t *testing.T) {
+	km, executor := newTestManager(t)
+	executor.exitCode = 137
+	executor.oomKilled = true
+
+	var spec corev1.PodSpec
+	executor.client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		spec = action.(k8stesting.CreateAction).GetObject().(*corev1.Pod).Spec
+		return false, nil, nil
+	})
+
+	result, err := contman.RunReceipt(km, contman.Receipt{
+		Image:     "alpine:latest",
+		Cmd:       "allocate",
+		Resources: contman.Resources{CPUQuota: 150000, Memory: 64 << 20, ShmSize: 1 << 20},
+	})
+	if exitErr, ok := err.(*contman.ExitError); !ok || !exitErr.OOMKilled || !result.OOMKilled {
+		t.Fatal("Expected OOM error, got: ", err)
+	}
+
+	limits := spec.Containers[0].Resources.Limits
+	if limits.Cpu().MilliValue() != 1500 || limits.Memory().Value() != 64<<20 {
+		t.Errorf("Unexpected limits: %v", limits)
+	}
+	if len(spec.Volumes) != 2 || spec.Volumes[0].EmptyDir.SizeLimit.Value() != 1<<20 {
+		t.Errorf("Unexpected volumes: %+v", spec.Volumes)
+	}
+
+	cntr, err := km.ContainerCreate(context.Background(), contman.Config{Image: "alpine:latest", Cmd: "allocate"})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	defer cntr.Remove(context.Background())
+	if err := cntr.Start(context.Background()); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+	if _, err := cntr.Wait(context.Background(), nil, nil); err == nil {
+		t.Error("Expected OOM error")
+	}
+	if err := cntr.CopyFrom(context.Background(), "/tmp", os.TempDir()); err == nil {
+		t.Error("Copy from terminated container succeeded")
+	}
+
+	executor.oomKilled = false
+	executor.commandOOMKilled = true
+	result, err = contman.RunReceipt(km, contman.Receipt{Image: "alpine:latest", Cmd: "allocate"})
+	if exitErr, ok := err.(*contman.ExitError); !ok || !exitErr.OOMKilled || !result.OOMKilled {
+		t.Error("Expected OOM error of the command, got: ", err)
+	}
+
+	result, err = contman.RunReceipt(km, contman.Receipt{Image: "alpine:latest", Steps: []contman.Step{{Cmd: "exit 137"}}})
+	if exitErr, ok := err.(*contman.ExitError); !ok || !exitErr.OOMKilled || !result.OOMKilled {
+		t.Error("Expected OOM error of the step, got: ", err)
+	}
+}
+
+func TestMountTypes(t *testing.T) {
+	km, _ := newTestManager(t)
+
+	cntr, err := km.ContainerCreate(context.Background(), contman.Config{
+		Image: "alpine:latest",
+		Cmd:   "true",
+		Mounts: []contman.Mount{
+			{Source: "/srv/data", Target: "/data"},
+			{Type: contman.MountVolume, Source: "go-mod", Target: "/go/pkg/mod"},
+			{Type: contman.MountTmpfs, Target: "/tmp"},
+		},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	volumes := cntr.(*KubernetesContainer).pod.Spec.Volumes
+	if len(volumes) != 4 || volumes[0].HostPath == nil || volumes[2].EmptyDir == nil {
+		t.Fatalf("Unexpected volumes: %+v", volumes)
+	}
+	if claim := volumes[1].PersistentVolumeClaim; claim == nil || claim.ClaimName != "go-mod" {
+		t.Errorf("Unexpected volume: %+v", volumes[1])
+	}
+
+	if _, err := km.ContainerCreate(context.Background(), contman.Config{
+		Image:  "alpine:latest",
+		Mounts: []contman.Mount{{Type: "nfs", Target: "/data"}},
+	}); err == nil {
+		t.Error("Unknown mount type is accepted")
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	km, _ := newTestManager(t, WithVolumeSize(resource.MustParse("5Gi")))
+	ctx := context.Background()
+
+	cacheLabels := map[string]string{contman.CacheLabel: "true"}
+	for _, name := range []string{"go-mod", "npm"} {
+		if _, err := km.VolumeCreate(ctx, name, cacheLabels); err != nil {
+			t.Fatal("Cannot create volume: ", err)
+		}
+	}
+	if v, err := km.VolumeCreate(ctx, "npm", nil); err != nil || v.Labels[contman.CacheLabel] != "true" {
+		t.Errorf("Existing volume is not returned: %+v, %v", v, err)
+	}
+	if _, err := km.VolumeCreate(ctx, "..", nil); err == nil {
+		t.Error("Invalid volume name is accepted")
+	}
+	claim, _ := km.claims().Get(ctx, "npm", metav1.GetOptions{})
+	if size := claim.Spec.Resources.Requests[corev1.ResourceStorage]; size.String() != "5Gi" {
+		t.Errorf("Unexpected claim size: %s", size.String())
+	}
+
+	cntr, err := km.ContainerCreate(ctx, contman.Config{
+		Image:  "alpine:latest",
+		Cmd:    "true",
+		Mounts: []contman.Mount{{Type: contman.MountVolume, Source: "go-mod", Target: "/go/pkg/mod"}},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	km.client.CoreV1().Pods(km.namespace).Create(ctx, cntr.(*KubernetesContainer).pod, metav1.CreateOptions{})
+
+	volumes, err := km.VolumeList(ctx, cacheLabels)
+	if err != nil || len(volumes) != 2 || volumes[0].Name != "go-mod" {
+		t.Errorf("Unexpected volumes: %+v, %v", volumes, err)
+	}
+	if pruned, err := km.VolumePrune(ctx, cacheLabels); err != nil || !reflect.DeepEqual(pruned, []string{"npm"}) {
+		t.Errorf("Unexpected pruned volumes: %v, %v", pruned, err)
+	}
+}
+
+func TestSecurity(t *testing.T) {
+	km, _ := newTestManager(t)
+
+	security := contman.StrictSecurity()
+	security.SeccompProfile = "profiles/receipt.json"
+	security.UsernsMode = "auto"
+	cntr, err := km.ContainerCreate(context.Background(), contman.Config{Image: "alpine:latest", Cmd: "true", Security: security})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+
+	pod := cntr.(*KubernetesContainer).pod
+	sc := pod.Spec.Containers[0].SecurityContext
+	if !*sc.ReadOnlyRootFilesystem || *sc.AllowPrivilegeEscalation || sc.Capabilities.Drop[0] != "ALL" || *sc.RunAsUser != int64(os.Getuid()) {
+		t.Errorf("Unexpected security context: %+v", sc)
+	}
+	if *sc.SeccompProfile.LocalhostProfile != "profiles/receipt.json" || *pod.Spec.HostUsers {
+		t.Errorf("Unexpected pod: %+v", pod.Spec)
+	}
+}
+
+// TestWrapperReadOnlyRootfs runs command of a strictly secured pod on the
+// host with controlDir replaced, wrapper has to write only into it
+func TestWrapperReadOnlyRootfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contman-kubernetes-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	km, _ := newTestManager(t)
+	cntr, err := km.ContainerCreate(context.Background(), contman.Config{Image: "alpine:latest", Cmd: "exit 3", Security: contman.StrictSecurity()})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	pod := cntr.(*KubernetesContainer).pod
+	container := pod.Spec.Containers[0]
+	if !*container.SecurityContext.ReadOnlyRootFilesystem {
+		t.Fatalf("Root filesystem is writable: %+v", container.SecurityContext)
+	}
+	var control *corev1.VolumeMount
+	for i, m := range container.VolumeMounts {
+		if m.MountPath == controlDir {
+			control = &container.VolumeMounts[i]
+		}
+	}
+	if control == nil || control.ReadOnly {
+		t.Fatalf("Control directory is not mounted writable: %+v", container.VolumeMounts)
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == control.Name && (v.EmptyDir == nil || v.EmptyDir.Medium != corev1.StorageMediumMemory) {
+			t.Errorf("Control directory is not in memory: %+v", v)
+		}
+	}
+
+	command := append([]string(nil), container.Command...)
+	if command[4] != controlDir {
+		t.Fatalf("Unexpected command: %v", command)
+	}
+	command[4] = dir
+	c := exec.Command(command[0], command[1:]...)
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("Cannot run wrapper: ", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(startMarker)), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != cntr.(*KubernetesContainer).marker+"\n" {
+		t.Errorf("Unexpected output of wrapper: %q, %v", line, err)
+	}
+	c.Process.Signal(syscall.SIGTERM)
+	c.Wait()
+	if code, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(exitFile))); err != nil || string(code) != "3\n" {
+		t.Errorf("Unexpected exit file: %q, %v", code, err)
+	}
+	if code := c.ProcessState.ExitCode(); code != 3 {
+		t.Errorf("Unexpected exit code of wrapper: %d", code)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	km, _ := newTestManager(t)
+
+	cntr, err := km.ContainerCreate(context.Background(), contman.Config{
+		Image:      "alpine:latest",
+		Entrypoint: []string{"/bin/echo"},
+		Args:       []string{"hello"},
+		User:       "1000:100",
+		Hostname:   "builder",
+		Labels:     map[string]string{"receipt": "test"},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	pod := cntr.(*KubernetesContainer).pod
+	container := pod.Spec.Containers[0]
+	if command := container.Command[len(container.Command)-2:]; command[0] != "/bin/echo" || command[1] != "hello" {
+		t.Errorf("Unexpected command: %v", container.Command)
+	}
+	if sc := container.SecurityContext; *sc.RunAsUser != 1000 || *sc.RunAsGroup != 100 {
+		t.Errorf("Unexpected security context: %+v", sc)
+	}
+	if pod.Spec.Hostname != "builder" || pod.Labels["receipt"] != "test" || pod.Labels[managedByLabel] != "contman" {
+		t.Errorf("Unexpected pod: %+v", pod.ObjectMeta)
+	}
+
+	for _, config := range []contman.Config{
+		{Image: "alpine:latest", Args: []string{"hello"}},
+		{Image: "alpine:latest", Cmd: "true", User: "nobody"},
+	} {
+		if _, err := km.ContainerCreate(context.Background(), config); err == nil {
+			t.Errorf("Config %+v was accepted", config)
+		}
+	}
+}
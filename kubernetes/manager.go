@@ -0,0 +1,493 @@
+// Package kubernetes implements contman.Manager running every container as a
+// single-container Pod of a Kubernetes cluster.
+//
+// Images are pulled by kubelet of the node the pod is scheduled to, files
+// are copied by tar streamed over the exec API. The container keeps running
+// after its command exits until it is removed, so output can be copied.
+// Pod logs do not separate output streams, so everything the command prints
+// goes to stdout.
+package kubernetes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/elemir/contman"
+)
+
+const (
+	DefaultNamespace      = "default"
+	DefaultServiceAccount = "default"
+	DefaultVolumeSize     = "1Gi"
+
+	// ServiceAccountPrefix marks Mount.Source naming a service account,
+	// its token is mounted into the pod instead of a host path
+	ServiceAccountPrefix = "serviceaccount:"
+
+	serviceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+	containerName      = "receipt"
+	managedByLabel     = "app.kubernetes.io/managed-by"
+	// podLabel selects the pod by its name in a NetworkPolicy
+	podLabel = "contman/pod"
+)
+
+type KubernetesManager struct {
+	client         kubernetes.Interface
+	config         *rest.Config
+	executor       Executor
+	kubeconfig     string
+	namespace      string
+	serviceAccount string
+	volumeSize     resource.Quantity
+}
+
+type Option func(*KubernetesManager)
+
+// WithKubeconfig sets kubeconfig file, KUBECONFIG, ~/.kube/config or
+// in-cluster configuration is used by default
+func WithKubeconfig(path string) Option {
+	return func(km *KubernetesManager) {
+		km.kubeconfig = path
+	}
+}
+
+// WithRESTConfig sets cluster configuration instead of loading kubeconfig
+func WithRESTConfig(config *rest.Config) Option {
+	return func(km *KubernetesManager) {
+		km.config = config
+	}
+}
+
+// WithClientset sets clientset used to manage pods, e.g. a fake one of
+// k8s.io/client-go/kubernetes/fake together with WithExecutor
+func WithClientset(client kubernetes.Interface) Option {
+	return func(km *KubernetesManager) {
+		km.client = client
+	}
+}
+
+// WithExecutor sets executor of commands in pods, SPDY executor of the
+// cluster configuration is used by default
+func WithExecutor(executor Executor) Option {
+	return func(km *KubernetesManager) {
+		km.executor = executor
+	}
+}
+
+// WithNamespace sets namespace of pods, namespace of kubeconfig context or
+// DefaultNamespace is used by default
+func WithNamespace(namespace string) Option {
+	return func(km *KubernetesManager) {
+		km.namespace = namespace
+	}
+}
+
+// WithServiceAccount sets service account returned by GetSystemMounts
+func WithServiceAccount(name string) Option {
+	return func(km *KubernetesManager) {
+		km.serviceAccount = name
+	}
+}
+
+// WithVolumeSize sets storage requested by claims of VolumeCreate,
+// DefaultVolumeSize is used by default
+func WithVolumeSize(size resource.Quantity) Option {
+	return func(km *KubernetesManager) {
+		km.volumeSize = size
+	}
+}
+
+func NewKubernetesManager(opts ...Option) (*KubernetesManager, error) {
+	km := &KubernetesManager{
+		serviceAccount: DefaultServiceAccount,
+		volumeSize:     resource.MustParse(DefaultVolumeSize),
+	}
+	for _, opt := range opts {
+		opt(km)
+	}
+
+	if km.config == nil && (km.client == nil || km.executor == nil) {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = km.kubeconfig
+		cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+
+		config, err := cc.ClientConfig()
+		if err != nil {
+			log.WithError(err).Error("Cannot load kubernetes configuration")
+			return nil, err
+		}
+		km.config = config
+		if km.namespace == "" {
+			km.namespace, _, _ = cc.Namespace()
+		}
+	}
+	if km.namespace == "" {
+		km.namespace = DefaultNamespace
+	}
+
+	if km.client == nil {
+		client, err := kubernetes.NewForConfig(km.config)
+		if err != nil {
+			log.WithError(err).Error("Cannot create kubernetes client")
+			return nil, err
+		}
+		km.client = client
+	}
+	if km.executor == nil {
+		if km.config == nil {
+			return nil, errors.New("executor requires kubernetes REST configuration")
+		}
+		km.executor = &spdyExecutor{client: km.client, config: km.config}
+	}
+
+	return km, nil
+}
+
+// PullImage does nothing, images are pulled by kubelet when pod starts
+func (km *KubernetesManager) PullImage(ctx context.Context, image string) error {
+	return nil
+}
+
+// HasImage always reports false, images of cluster nodes are unknown
+func (km *KubernetesManager) HasImage(ctx context.Context, image string) (bool, error) {
+	return false, nil
+}
+
+// ContainerCreate only prepares pod, it is created by Start. The process is
+// run by wrapper, so entrypoint of the image is not known and Args require
+// Entrypoint.
+func (km *KubernetesManager) ContainerCreate(ctx context.Context, config contman.Config) (contman.Container, error) {
+	name := "contman-" + newID()
+	marker := "contman-exited-" + newID()
+	automount := false
+
+	entrypoint, args := config.Process()
+	if entrypoint == nil {
+		return nil, errors.New("kubernetes manager requires Cmd or Entrypoint, entrypoint of the image is unknown")
+	}
+	container := corev1.Container{
+		Name:       containerName,
+		Image:      config.Image,
+		Command:    append(append([]string{"sh", "-c", wrapper, marker, controlDir}, entrypoint...), args...),
+		Env:        envVars(config.Env),
+		WorkingDir: config.WorkingDir,
+	}
+	pod := &corev1.Pod{}
+	pod.Name = name
+	pod.Labels = map[string]string{}
+	for key, value := range config.Labels {
+		pod.Labels[key] = value
+	}
+	pod.Labels[managedByLabel] = "contman"
+	pod.Spec.RestartPolicy = corev1.RestartPolicyNever
+	pod.Spec.Hostname = config.Hostname
+
+	for i, m := range config.Mounts {
+		if strings.HasPrefix(m.Source, ServiceAccountPrefix) {
+			pod.Spec.ServiceAccountName = strings.TrimPrefix(m.Source, ServiceAccountPrefix)
+			automount = true
+			continue
+		}
+
+		source, err := volumeSource(m)
+		if err != nil {
+			return nil, err
+		}
+		volume := fmt.Sprintf("mount-%d", i)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         volume,
+			VolumeSource: source,
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      volume,
+			MountPath: m.Target,
+			ReadOnly:  m.ReadOnly,
+		})
+	}
+	pod.Spec.AutomountServiceAccountToken = &automount
+
+	var secret *corev1.Secret
+	if len(config.Secrets) > 0 {
+		secret = secretVolume(name, config.Secrets, &pod.Spec, &container)
+	}
+
+	if err := setNetwork(&pod.Spec, &container, config); err != nil {
+		return nil, err
+	}
+	var policy *networkingv1.NetworkPolicy
+	if config.Network == contman.NetworkNone {
+		pod.Labels[podLabel] = name
+		policy = denyAllPolicy(name)
+	}
+	setResources(&pod.Spec, &container, config.Resources)
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name:         "contman",
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: "contman", MountPath: controlDir})
+	if err := setSecurity(&pod.Spec, &container, config.Security); err != nil {
+		return nil, err
+	}
+	if err := setUser(&container, config.ProcessUser()); err != nil {
+		return nil, err
+	}
+	pod.Spec.Containers = []corev1.Container{container}
+
+	return &KubernetesContainer{
+		manager: km,
+		name:    name,
+		pod:     pod,
+		policy:  policy,
+		secret:  secret,
+		hostDir: config.HostDir,
+		marker:  marker,
+	}, nil
+}
+
+// setNetwork maps network settings to the pod. Pods always have a network
+// of the cluster, NetworkBridge means the pod network and NetworkNone is
+// isolated by denyAllPolicy.
+func setNetwork(spec *corev1.PodSpec, container *corev1.Container, config contman.Config) error {
+	switch config.Network {
+	case "", contman.NetworkNone, contman.NetworkBridge:
+	case contman.NetworkHost:
+		spec.HostNetwork = true
+		spec.DNSPolicy = corev1.DNSClusterFirstWithHostNet
+	default:
+		return fmt.Errorf("network %s is not supported by kubernetes backend", config.Network)
+	}
+
+	for _, p := range config.Ports {
+		container.Ports = append(container.Ports, corev1.ContainerPort{
+			ContainerPort: int32(p.ContainerPort),
+			HostPort:      int32(p.HostPort),
+			HostIP:        p.HostIP,
+			Protocol:      corev1.Protocol(strings.ToUpper(p.Protocol)),
+		})
+	}
+
+	aliases := map[string][]string{}
+	var ips []string
+	for _, host := range config.ExtraHosts {
+		parts := strings.SplitN(host, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid extra host %q", host)
+		}
+		if _, ok := aliases[parts[1]]; !ok {
+			ips = append(ips, parts[1])
+		}
+		aliases[parts[1]] = append(aliases[parts[1]], parts[0])
+	}
+	for _, ip := range ips {
+		spec.HostAliases = append(spec.HostAliases, corev1.HostAlias{IP: ip, Hostnames: aliases[ip]})
+	}
+
+	if len(config.DNS) > 0 {
+		spec.DNSPolicy = corev1.DNSNone
+		spec.DNSConfig = &corev1.PodDNSConfig{Nameservers: config.DNS}
+	}
+	return nil
+}
+
+// setResources maps CPU and memory limits and memory backed volumes of
+// /dev/shm and tmpfs to the pod. Kubernetes has no per-pod swap, pids and
+// rlimit settings, they are up to the node configuration, and options of
+// tmpfs mounts are ignored.
+func setResources(spec *corev1.PodSpec, container *corev1.Container, r contman.Resources) {
+	limits := corev1.ResourceList{}
+	if r.CPUQuota > 0 {
+		period := r.CPUPeriod
+		if period == 0 {
+			period = 100000
+		}
+		limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(r.CPUQuota*1000/period, resource.DecimalSI)
+	}
+	if r.Memory > 0 {
+		limits[corev1.ResourceMemory] = *resource.NewQuantity(r.Memory, resource.BinarySI)
+	}
+	if len(limits) > 0 {
+		container.Resources.Limits = limits
+	}
+	if r.CPUShares > 0 {
+		// 1024 shares are one CPU for kubelet
+		container.Resources.Requests = corev1.ResourceList{
+			corev1.ResourceCPU: *resource.NewMilliQuantity(r.CPUShares*1000/1024, resource.DecimalSI),
+		}
+	}
+
+	volumes := map[string]int64{}
+	if r.ShmSize > 0 {
+		volumes["/dev/shm"] = r.ShmSize
+	}
+	for target := range r.Tmpfs {
+		volumes[target] = 0
+	}
+	targets := make([]string, 0, len(volumes))
+	for target := range volumes {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for i, target := range targets {
+		emptyDir := &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}
+		if size := volumes[target]; size > 0 {
+			emptyDir.SizeLimit = resource.NewQuantity(size, resource.BinarySI)
+		}
+		name := fmt.Sprintf("tmpfs-%d", i)
+		spec.Volumes = append(spec.Volumes, corev1.Volume{Name: name, VolumeSource: corev1.VolumeSource{EmptyDir: emptyDir}})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: name, MountPath: target})
+	}
+}
+
+// volumeSource maps binds to host paths of the node, volumes to persistent
+// volume claims of the same name and tmpfs to memory backed empty dirs
+func volumeSource(m contman.Mount) (corev1.VolumeSource, error) {
+	switch m.Type {
+	case "", contman.MountBind:
+		return corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: m.Source}}, nil
+	case contman.MountVolume:
+		return corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: m.Source}}, nil
+	case contman.MountTmpfs:
+		return corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}}, nil
+	}
+	return corev1.VolumeSource{}, fmt.Errorf("unknown type %s of mount %s", m.Type, m.Target)
+}
+
+// setSecurity maps security settings to security context of the container.
+// Seccomp and AppArmor profiles have to be installed on nodes, seccomp
+// profile path is relative to seccomp directory of kubelet. UsernsMode "auto"
+// puts the pod into its own user namespace.
+func setSecurity(spec *corev1.PodSpec, container *corev1.Container, s contman.Security) error {
+	sc := &corev1.SecurityContext{}
+	if s.ReadOnlyRootfs {
+		sc.ReadOnlyRootFilesystem = &s.ReadOnlyRootfs
+	}
+	if len(s.CapDrop) > 0 || len(s.CapAdd) > 0 {
+		sc.Capabilities = &corev1.Capabilities{}
+		for _, name := range s.CapDrop {
+			sc.Capabilities.Drop = append(sc.Capabilities.Drop, corev1.Capability(name))
+		}
+		for _, name := range s.CapAdd {
+			sc.Capabilities.Add = append(sc.Capabilities.Add, corev1.Capability(name))
+		}
+	}
+	if s.NoNewPrivileges {
+		escalation := false
+		sc.AllowPrivilegeEscalation = &escalation
+	}
+	switch s.SeccompProfile {
+	case "":
+	case "unconfined":
+		sc.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined}
+	default:
+		profile := s.SeccompProfile
+		sc.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &profile}
+	}
+	if s.AppArmorProfile != "" {
+		profile := s.AppArmorProfile
+		sc.AppArmorProfile = &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeLocalhost, LocalhostProfile: &profile}
+	}
+	container.SecurityContext = sc
+
+	switch s.UsernsMode {
+	case "":
+	case "host", "auto":
+		hostUsers := s.UsernsMode == "host"
+		spec.HostUsers = &hostUsers
+	default:
+		return fmt.Errorf("user namespace mode %s is not supported by kubernetes backend", s.UsernsMode)
+	}
+	return nil
+}
+
+// secretVolume returns Secret of the pod holding secrets, which kubelet
+// mounts at contman.SecretsDir from tmpfs
+func secretVolume(name string, secrets map[string][]byte, spec *corev1.PodSpec, container *corev1.Container) *corev1.Secret {
+	secret := &corev1.Secret{}
+	secret.Name = name
+	secret.Labels = map[string]string{managedByLabel: "contman"}
+	secret.Data = secrets
+
+	mode := int32(0444)
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name:         "secrets",
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: name, DefaultMode: &mode}},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: "secrets", MountPath: contman.SecretsDir, ReadOnly: true})
+	return secret
+}
+
+// denyAllPolicy denies all ingress and egress traffic of the pod, it is
+// enforced only by network plugins supporting NetworkPolicy
+func denyAllPolicy(name string) *networkingv1.NetworkPolicy {
+	policy := &networkingv1.NetworkPolicy{}
+	policy.Name = name
+	policy.Labels = map[string]string{managedByLabel: "contman"}
+	policy.Spec.PodSelector.MatchLabels = map[string]string{podLabel: name}
+	policy.Spec.PolicyTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress}
+	return policy
+}
+
+// setUser sets numeric "uid[:gid]" user of the container, security context
+// has no user names
+func setUser(container *corev1.Container, user string) error {
+	if user == "" {
+		return nil
+	}
+	parts := strings.SplitN(user, ":", 2)
+	uid, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("user %s is not numeric, kubernetes cannot resolve user names", user)
+	}
+	container.SecurityContext.RunAsUser = &uid
+	if len(parts) == 2 {
+		gid, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("group %s is not numeric, kubernetes cannot resolve group names", parts[1])
+		}
+		container.SecurityContext.RunAsGroup = &gid
+	}
+	return nil
+}
+
+// GetSystemMounts returns token of the manager service account, pods talk
+// to the cluster API instead of a daemon socket
+func (km *KubernetesManager) GetSystemMounts() []contman.Mount {
+	return []contman.Mount{
+		{
+			Source:   ServiceAccountPrefix + km.serviceAccount,
+			Target:   serviceAccountPath,
+			ReadOnly: true,
+		},
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func envVars(vars map[string]string) []corev1.EnvVar {
+	env := make([]corev1.EnvVar, 0, len(vars))
+	for key, value := range vars {
+		env = append(env, corev1.EnvVar{Name: key, Value: value})
+	}
+	sort.Slice(env, func(i, j int) bool { return env[i].Name < env[j].Name })
+	return env
+}
@@ -0,0 +1,99 @@
+package kubernetes
+
+import (
+	"context"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/names"
+)
+
+func (km *KubernetesManager) claims() typedcorev1.PersistentVolumeClaimInterface {
+	return km.client.CoreV1().PersistentVolumeClaims(km.namespace)
+}
+
+// VolumeCreate creates persistent volume claim of the name, which mounts of
+// volumes refer to, existing claim is returned as is
+func (km *KubernetesManager) VolumeCreate(ctx context.Context, name string, labels map[string]string) (contman.Volume, error) {
+	if err := names.Check("volume", name); err != nil {
+		return contman.Volume{}, err
+	}
+
+	claim := &corev1.PersistentVolumeClaim{}
+	claim.Name = name
+	claim.Labels = map[string]string{}
+	for key, value := range labels {
+		claim.Labels[key] = value
+	}
+	claim.Labels[managedByLabel] = "contman"
+	claim.Spec.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	claim.Spec.Resources.Requests = corev1.ResourceList{corev1.ResourceStorage: km.volumeSize}
+
+	created, err := km.claims().Create(ctx, claim, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		created, err = km.claims().Get(ctx, name, metav1.GetOptions{})
+	}
+	if err != nil {
+		log.WithError(err).WithField("volume", name).Error("Error creating volume")
+		return contman.Volume{}, err
+	}
+	return contman.Volume{Name: created.Name, Labels: created.Labels}, nil
+}
+
+func (km *KubernetesManager) VolumeList(ctx context.Context, labels map[string]string) ([]contman.Volume, error) {
+	list, err := km.claims().List(ctx, metav1.ListOptions{LabelSelector: k8slabels.SelectorFromSet(labels).String()})
+	if err != nil {
+		log.WithError(err).Error("Error listing volumes")
+		return nil, err
+	}
+
+	volumes := make([]contman.Volume, 0, len(list.Items))
+	for _, claim := range list.Items {
+		volumes = append(volumes, contman.Volume{Name: claim.Name, Labels: claim.Labels})
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+// VolumePrune deletes claims which no pod of the namespace refers to
+func (km *KubernetesManager) VolumePrune(ctx context.Context, labels map[string]string) ([]string, error) {
+	volumes, err := km.VolumeList(ctx, labels)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := km.client.CoreV1().Pods(km.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		log.WithError(err).Error("Error listing pods")
+		return nil, err
+	}
+
+	used := map[string]bool{}
+	for _, pod := range pods.Items {
+		for _, v := range pod.Spec.Volumes {
+			if v.PersistentVolumeClaim != nil {
+				used[v.PersistentVolumeClaim.ClaimName] = true
+			}
+		}
+	}
+
+	var pruned []string
+	for _, v := range volumes {
+		if used[v.Name] {
+			continue
+		}
+		err := km.claims().Delete(ctx, v.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.WithError(err).WithField("volume", v.Name).Error("Error pruning volume")
+			return pruned, err
+		}
+		pruned = append(pruned, v.Name)
+	}
+	return pruned, nil
+}
@@ -0,0 +1,312 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/archive"
+	"github.com/elemir/contman/internal/stream"
+)
+
+type LocalContainer struct {
+	id      string
+	root    string
+	config  contman.Config
+	hostDir string
+	// release marks volumes of the container unused
+	release func()
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	done     chan struct{}
+	exitCode int
+	stdout   stream.DeferredWriter
+	stderr   stream.DeferredWriter
+}
+
+func (lc *LocalContainer) ID() string {
+	return lc.id
+}
+
+// ImageDigest returns nothing, there are no images
+func (lc *LocalContainer) ImageDigest(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// mount symlinks source into the container root, read-only sources are
+// copied instead so the command cannot modify them. Tmpfs is an empty
+// directory of the root.
+func (lc *LocalContainer) mount(m contman.Mount) error {
+	target := rootPath(lc.root, m.Target)
+	switch m.Type {
+	case "", contman.MountBind, contman.MountVolume:
+	case contman.MountTmpfs:
+		return os.MkdirAll(target, 0755)
+	default:
+		return fmt.Errorf("unknown type %s of mount %s", m.Type, m.Target)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if !m.ReadOnly {
+		return os.Symlink(m.Source, target)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(archive.CreateTarToWriter(m.Source, "", writer))
+	}()
+	defer reader.Close()
+
+	return archive.ExtractTarFromReader(reader, target)
+}
+
+// command prepares argv run in its own process group, so the whole process
+// tree can be signalled
+func (lc *LocalContainer) command(ctx context.Context, argv []string, env map[string]string, wd string) (*exec.Cmd, error) {
+	dir := rootPath(lc.root, wd)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	c.Dir = dir
+	c.Env = append(append(os.Environ(), formatEnv(lc.config.Env)...), formatEnv(env)...)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return c, nil
+}
+
+func (lc *LocalContainer) Start(ctx context.Context) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.cmd != nil {
+		return fmt.Errorf("container %s is already started", lc.id)
+	}
+
+	cmd, err := lc.command(context.Background(), processArgs(lc.config), nil, lc.config.WorkingDir)
+	if err != nil {
+		lc.GetLogger().WithError(err).Error("Error creating working directory")
+		return err
+	}
+	cmd.Stdout = &lc.stdout
+	cmd.Stderr = &lc.stderr
+	if err := cmd.Start(); err != nil {
+		lc.GetLogger().WithError(err).Error("Error starting container")
+		return err
+	}
+
+	lc.cmd = cmd
+	lc.done = make(chan struct{})
+	go func() {
+		defer close(lc.done)
+		err := cmd.Wait()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			lc.exitCode = exitErr.ExitCode()
+		} else if err != nil {
+			lc.GetLogger().WithError(err).Error("Error waiting container")
+			lc.exitCode = -1
+		}
+	}()
+
+	return nil
+}
+
+func (lc *LocalContainer) signal(sig syscall.Signal) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	err := syscall.Kill(-lc.cmd.Process.Pid, sig)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+func (lc *LocalContainer) Stop(ctx context.Context, timeout time.Duration) error {
+	running, _ := lc.IsRunning(ctx)
+	if !running {
+		return nil
+	}
+
+	if err := lc.signal(syscall.SIGTERM); err != nil {
+		lc.GetLogger().WithError(err).Error("Error stopping container")
+		return err
+	}
+
+	select {
+	case <-lc.done:
+		return nil
+	case <-time.After(timeout):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return lc.Kill(ctx)
+}
+
+func (lc *LocalContainer) Kill(ctx context.Context) error {
+	running, _ := lc.IsRunning(ctx)
+	if !running {
+		return nil
+	}
+
+	if err := lc.signal(syscall.SIGKILL); err != nil {
+		lc.GetLogger().WithError(err).Error("Error killing container")
+		return err
+	}
+	<-lc.done
+	return nil
+}
+
+func (lc *LocalContainer) Remove(ctx context.Context) error {
+	if running, _ := lc.IsRunning(ctx); running {
+		return fmt.Errorf("container %s is running", lc.id)
+	}
+
+	// Symlinks of mounts are removed without touching their sources
+	err := os.RemoveAll(lc.root)
+	if err != nil {
+		lc.GetLogger().WithError(err).Errorf("Error removing container")
+		return err
+	}
+	lc.release()
+	lc.release = func() {}
+	return nil
+}
+
+func (lc *LocalContainer) IsRunning(ctx context.Context) (bool, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.done == nil {
+		return false, nil
+	}
+
+	select {
+	case <-lc.done:
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+func (lc *LocalContainer) Wait(ctx context.Context, stdout, stderr io.Writer) (int, error) {
+	lc.mu.Lock()
+	done := lc.done
+	lc.mu.Unlock()
+	if done == nil {
+		return 0, fmt.Errorf("container %s is not started", lc.id)
+	}
+
+	lc.stdout.Attach(stdout)
+	lc.stderr.Attach(stderr)
+
+	select {
+	case <-done:
+		return lc.exitCode, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (lc *LocalContainer) Exec(ctx context.Context, config contman.ExecConfig) (int, error) {
+	l := lc.GetLogger().WithField("cmd", config.Cmd)
+
+	wd := config.WorkingDir
+	if wd == "" {
+		wd = lc.config.WorkingDir
+	}
+	cmd, err := lc.command(ctx, []string{"sh", "-c", config.Cmd}, config.Env, wd)
+	if err != nil {
+		l.WithError(err).Error("Error creating working directory")
+		return 0, err
+	}
+	cmd.Stdout = orDiscard(config.Stdout)
+	cmd.Stderr = orDiscard(config.Stderr)
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		l.WithError(err).Error("Error executing command")
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (lc *LocalContainer) CopyFrom(ctx context.Context, src, dest string) error {
+	l := lc.GetLogger().WithFields(log.Fields{
+		"src":  src,
+		"dest": dest,
+	})
+
+	target := rootPath(lc.root, src)
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", src, contman.ErrNotFound)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(archive.CreateTarToWriter(target, path.Base(src), writer))
+	}()
+	defer reader.Close()
+
+	err := archive.ExtractTarFromReader(reader, lc.hostPath(dest))
+	if err != nil {
+		l.WithError(err).Error("Error copying from container")
+	}
+	return err
+}
+
+func (lc *LocalContainer) CopyTo(ctx context.Context, src, dest string) error {
+	l := lc.GetLogger().WithFields(log.Fields{
+		"src":  src,
+		"dest": dest,
+	})
+
+	target := rootPath(lc.root, dest)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(archive.CreateTarToWriter(lc.hostPath(src), src, writer))
+	}()
+	defer reader.Close()
+
+	err := archive.ExtractTarFromReader(reader, target)
+	if err != nil {
+		l.WithError(err).Error("Error copying to container")
+	}
+	return err
+}
+
+func (lc *LocalContainer) GetLogger() *log.Entry {
+	return log.WithField("containerID", lc.id)
+}
+
+func (lc *LocalContainer) hostPath(path string) string {
+	if lc.hostDir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(lc.hostDir, path)
+}
+
+func orDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return ioutil.Discard
+	}
+	return w
+}
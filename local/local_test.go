@@ -0,0 +1,264 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/elemir/contman"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "contman-local-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestToolchain(t *testing.T) {
+	lm, err := NewLocalManager(WithToolchain("golang:alpine", "sh", "contman-missing-binary"))
+	if err != nil {
+		t.Fatal("Cannot create manager: ", err)
+	}
+
+	if ok, _ := lm.HasImage(context.Background(), "alpine:latest"); !ok {
+		t.Error("Image without toolchain is not available")
+	}
+	if ok, _ := lm.HasImage(context.Background(), "golang:alpine"); ok {
+		t.Error("Image with missing toolchain is available")
+	}
+	if err := lm.PullImage(context.Background(), "golang:alpine"); !errors.Is(err, contman.ErrNotFound) {
+		t.Error("Expected not found error, got: ", err)
+	}
+}
+
+func TestRunReceipt(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.txt"), []byte("input\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lm, err := NewLocalManager(WithRoot(filepath.Join(dir, "root")))
+	if err != nil {
+		t.Fatal("Cannot create manager: ", err)
+	}
+
+	result, err := contman.RunReceipt(lm, contman.Receipt{
+		Image:              "alpine:latest",
+		Cmd:                "mkdir -p work/out && echo $GREETING > work/out/greeting && cat work/in/input.txt",
+		Env:                map[string]string{"GREETING": "Hello"},
+		InputCopy:          map[string]string{"input.txt": "/work/in"},
+		OutputCopy:         map[string]string{"/work/out": "."},
+		HostDir:            dir,
+		Network:            contman.NetworkHost,
+		UseImageWorkingDir: true,
+	})
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if string(result.Stdout) != "input\n" {
+		t.Errorf("Unexpected output: %q", result.Stdout)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "out", "greeting")); err != nil || string(data) != "Hello\n" {
+		t.Error("Output was not copied from container: ", err)
+	}
+
+	result, err = contman.RunReceipt(lm, contman.Receipt{
+		Steps: []contman.Step{
+			{Cmd: "test \"$STEP\" = 1", Env: map[string]string{"STEP": "1"}},
+			{Cmd: "test \"$(pwd)\" = \"$(cd .. && pwd)/work\"", WorkingDir: "/work"},
+			{Cmd: "exit 3"},
+		},
+		Network: contman.NetworkHost,
+	})
+	if stepErr, ok := err.(*contman.StepError); !ok || stepErr.Index != 2 || stepErr.ExitCode != 3 {
+		t.Fatalf("Expected failure of last step, got: %v, %+v", err, result)
+	}
+
+	if entries, _ := ioutil.ReadDir(filepath.Join(dir, "root")); len(entries) != 0 {
+		t.Error("Container roots were not removed")
+	}
+}
+
+func TestProcess(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	lm, err := NewLocalManager(WithRoot(dir))
+	if err != nil {
+		t.Fatal("Cannot create manager: ", err)
+	}
+
+	cntr, err := lm.ContainerCreate(context.Background(), contman.Config{
+		Entrypoint: []string{"echo"},
+		Args:       []string{"$HOME", "exec"},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	defer cntr.Remove(context.Background())
+	if err := cntr.Start(context.Background()); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+	var stdout bytes.Buffer
+	if code, err := cntr.Wait(context.Background(), &stdout, ioutil.Discard); err != nil || code != 0 {
+		t.Fatal("Container failed: ", code, err)
+	}
+	if stdout.String() != "$HOME exec\n" {
+		t.Errorf("Unexpected output: %q", stdout.String())
+	}
+
+	for _, config := range []contman.Config{
+		{},
+		{Cmd: "true", User: "nobody"},
+		{Cmd: "true", Hostname: "builder"},
+		{Cmd: "true", Network: contman.NetworkNone},
+		{Cmd: "true", Network: contman.NetworkBridge},
+		{Cmd: "true", Security: contman.Security{ReadOnlyRootfs: true}},
+		{Cmd: "true", Security: contman.StrictSecurity()},
+	} {
+		if _, err := lm.ContainerCreate(context.Background(), config); err == nil {
+			t.Errorf("Config %+v was accepted", config)
+		}
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	lm, err := NewLocalManager(WithRoot(dir))
+	if err != nil {
+		t.Fatal("Cannot create manager: ", err)
+	}
+
+	os.Setenv("CONTMAN_TEST_TOKEN", "secret")
+	defer os.Unsetenv("CONTMAN_TEST_TOKEN")
+
+	_, err = contman.RunReceipt(lm, contman.Receipt{
+		Cmd:     "cat /run/secrets/token",
+		Secrets: map[string]contman.Secret{"token": {Env: "CONTMAN_TEST_TOKEN"}},
+		Network: contman.NetworkHost,
+	})
+	if err == nil {
+		t.Fatal("Secrets were accepted")
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Error("Container roots were not removed")
+	}
+}
+
+func TestMounts(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"rw", "ro"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name, "file"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lm, err := NewLocalManager(WithRoot(filepath.Join(dir, "root")))
+	if err != nil {
+		t.Fatal("Cannot create manager: ", err)
+	}
+	cntr, err := lm.ContainerCreate(context.Background(), contman.Config{
+		Cmd: "echo changed > data/rw/file && echo changed > data/ro/file",
+		Mounts: []contman.Mount{
+			{Source: filepath.Join(dir, "rw"), Target: "/data/rw"},
+			{Source: filepath.Join(dir, "ro"), Target: "/data/ro", ReadOnly: true},
+		},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	if err := cntr.Start(context.Background()); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+	if exitCode, err := cntr.Wait(context.Background(), nil, nil); err != nil || exitCode != 0 {
+		t.Fatal("Command failed: ", exitCode, err)
+	}
+	if err := cntr.Remove(context.Background()); err != nil {
+		t.Fatal("Cannot remove container: ", err)
+	}
+
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "rw", "file")); string(data) != "changed\n" {
+		t.Errorf("Writable mount was not changed: %q", data)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "ro", "file")); string(data) != "ro" {
+		t.Errorf("Read-only mount was changed: %q", data)
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	lm, err := NewLocalManager(WithRoot(dir))
+	if err != nil {
+		t.Fatal("Cannot create manager: ", err)
+	}
+	ctx := context.Background()
+
+	cacheLabels := map[string]string{contman.CacheLabel: "true"}
+	for _, name := range []string{"go-mod", "npm"} {
+		if _, err := lm.VolumeCreate(ctx, name, cacheLabels); err != nil {
+			t.Fatal("Cannot create volume: ", err)
+		}
+	}
+	if _, err := lm.ContainerCreate(ctx, contman.Config{
+		Cmd:    "true",
+		Mounts: []contman.Mount{{Type: contman.MountVolume, Source: "..", Target: "/cache"}},
+	}); err == nil {
+		t.Error("Invalid volume name is accepted")
+	}
+	cntr, err := lm.ContainerCreate(ctx, contman.Config{
+		Cmd:    "true",
+		Mounts: []contman.Mount{{Type: contman.MountVolume, Source: "go-mod", Target: "/go/pkg/mod"}},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+
+	if volumes, err := lm.VolumeList(ctx, cacheLabels); err != nil || len(volumes) != 2 {
+		t.Errorf("Unexpected volumes: %+v, %v", volumes, err)
+	}
+	if pruned, err := lm.VolumePrune(ctx, cacheLabels); err != nil || !reflect.DeepEqual(pruned, []string{"npm"}) {
+		t.Errorf("Used volume is pruned: %v, %v", pruned, err)
+	}
+	cntr.Remove(ctx)
+	if pruned, err := lm.VolumePrune(ctx, cacheLabels); err != nil || !reflect.DeepEqual(pruned, []string{"go-mod"}) {
+		t.Errorf("Unused volume is not pruned: %v, %v", pruned, err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	lm, err := NewLocalManager()
+	if err != nil {
+		t.Fatal("Cannot create manager: ", err)
+	}
+	cntr, err := lm.ContainerCreate(context.Background(), contman.Config{Cmd: "sleep 60"})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	defer cntr.Remove(context.Background())
+	if err := cntr.Start(context.Background()); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+
+	if err := cntr.Stop(context.Background(), 5*time.Second); err != nil {
+		t.Fatal("Cannot stop container: ", err)
+	}
+	if running, _ := cntr.IsRunning(context.Background()); running {
+		t.Error("Container is still running")
+	}
+}
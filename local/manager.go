@@ -0,0 +1,212 @@
+// Package local implements contman.Manager running commands as plain host
+// processes, which allows iterating on receipts without pulling images.
+//
+// Every container gets its own temporary root directory, absolute container
+// paths of working directories, mounts and copies are resolved inside it.
+// Commands are run by host sh, or exec form Entrypoint and Args directly,
+// with host environment extended by Config.Env. Labels are ignored, secrets
+// are refused as commands see /run/secrets of the host.
+// Volumes are directories under the root of the manager.
+// Commands always run as the current user on the host network, unconfined
+// and limited only by the host, so other networks and security settings are
+// refused while resource limits are ignored.
+package local
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+)
+
+type LocalManager struct {
+	root       string
+	toolchains map[string][]string
+
+	mu sync.Mutex
+	// used counts containers of this manager using volume directories
+	used map[string]int
+}
+
+type Option func(*LocalManager)
+
+// WithRoot sets directory for container roots, system temporary directory
+// is used by default
+func WithRoot(root string) Option {
+	return func(lm *LocalManager) {
+		lm.root = root
+	}
+}
+
+// WithToolchain makes image available only when all of binaries are found
+// in PATH, images without toolchain are always available
+func WithToolchain(image string, binaries ...string) Option {
+	return func(lm *LocalManager) {
+		lm.toolchains[image] = binaries
+	}
+}
+
+func NewLocalManager(opts ...Option) (*LocalManager, error) {
+	lm := &LocalManager{
+		root:       os.TempDir(),
+		toolchains: map[string][]string{},
+		used:       map[string]int{},
+	}
+	for _, opt := range opts {
+		opt(lm)
+	}
+
+	if err := os.MkdirAll(lm.root, 0700); err != nil {
+		return nil, err
+	}
+	return lm, nil
+}
+
+// checkToolchain looks up binaries configured for image
+func (lm *LocalManager) checkToolchain(image string) error {
+	for _, binary := range lm.toolchains[image] {
+		if _, err := exec.LookPath(binary); err != nil {
+			return fmt.Errorf("toolchain of image %s: %w: %w", image, contman.ErrNotFound, err)
+		}
+	}
+	return nil
+}
+
+// PullImage only checks toolchain of image, nothing is downloaded
+func (lm *LocalManager) PullImage(ctx context.Context, image string) error {
+	err := lm.checkToolchain(image)
+	if err != nil {
+		log.WithError(err).Error("Error checking toolchain")
+	}
+	return err
+}
+
+func (lm *LocalManager) HasImage(ctx context.Context, image string) (bool, error) {
+	return lm.checkToolchain(image) == nil, nil
+}
+
+// ContainerCreate fails for settings of the process which cannot be honored
+// on the host: users other than the current one, hostnames, secrets,
+// networks other than the host one and security settings
+func (lm *LocalManager) ContainerCreate(ctx context.Context, config contman.Config) (contman.Container, error) {
+	if len(processArgs(config)) == 0 {
+		return nil, errors.New("local manager requires a command, there is no image entrypoint")
+	}
+	if user := config.ProcessUser(); user != "" && user != fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()) {
+		return nil, fmt.Errorf("user %s is not supported by local manager, commands run as the current user", user)
+	}
+	if config.Hostname != "" {
+		return nil, errors.New("hostname is not supported by local manager")
+	}
+	if len(config.Secrets) > 0 {
+		return nil, errors.New("secrets are not supported by local manager, there is no /run/secrets on the host")
+	}
+	if config.Network != "" && config.Network != contman.NetworkHost {
+		return nil, fmt.Errorf("network %s is not supported by local manager, commands run on the host network", config.Network)
+	}
+	if !reflect.DeepEqual(config.Security, contman.Security{}) {
+		return nil, errors.New("security settings are not supported by local manager, commands run unconfined")
+	}
+	if err := lm.checkToolchain(config.Image); err != nil {
+		log.WithError(err).Error("Error checking toolchain")
+		return nil, err
+	}
+
+	root, err := ioutil.TempDir(lm.root, "contman-local-")
+	if err != nil {
+		log.WithError(err).Error("Error creating container root")
+		return nil, err
+	}
+
+	lc := &LocalContainer{
+		id:      newID(),
+		root:    root,
+		config:  config,
+		hostDir: config.HostDir,
+		release: func() {},
+	}
+	for _, m := range config.Mounts {
+		if m.Type == contman.MountVolume {
+			if m.Source, err = lm.volume(m.Source, lc); err != nil {
+				lc.release()
+				os.RemoveAll(root)
+				return nil, err
+			}
+		}
+		if err := lc.mount(m); err != nil {
+			lc.GetLogger().WithError(err).WithField("target", m.Target).Error("Error mounting path")
+			lc.release()
+			os.RemoveAll(root)
+			return nil, err
+		}
+	}
+
+	return lc, nil
+}
+
+// processArgs returns command line of container process, images have no
+// entrypoint of their own
+func processArgs(config contman.Config) []string {
+	entrypoint, args := config.Process()
+	return append(append([]string(nil), entrypoint...), args...)
+}
+
+// GetSystemMounts returns nothing, commands already run on the host
+func (lm *LocalManager) GetSystemMounts() []contman.Mount {
+	return nil
+}
+
+// volume returns directory of named volume, which outlives containers, and
+// marks it used until release of the container is called
+func (lm *LocalManager) volume(name string, lc *LocalContainer) (string, error) {
+	dir, err := lm.volumes().Path(name)
+	if err != nil {
+		return "", err
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.used[dir]++
+	release := lc.release
+	lc.release = func() {
+		release()
+		lm.mu.Lock()
+		defer lm.mu.Unlock()
+		if lm.used[dir]--; lm.used[dir] == 0 {
+			delete(lm.used, dir)
+		}
+	}
+	return dir, nil
+}
+
+// rootPath resolves container path inside root, never leaving it
+func rootPath(root, path string) string {
+	return filepath.Join(root, filepath.Clean("/"+path))
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func formatEnv(vars map[string]string) []string {
+	env := make([]string, 0, len(vars))
+	for key, value := range vars {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	return env
+}
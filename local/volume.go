@@ -0,0 +1,48 @@
+package local
+
+import (
+	"context"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/volumes"
+)
+
+// volumes keeps volumes as directories under the manager root
+func (lm *LocalManager) volumes() volumes.Store {
+	return volumes.Store{Dir: filepath.Join(lm.root, "contman-volumes")}
+}
+
+func (lm *LocalManager) VolumeCreate(ctx context.Context, name string, labels map[string]string) (contman.Volume, error) {
+	v, err := lm.volumes().Create(name, labels)
+	if err != nil {
+		log.WithError(err).WithField("volume", name).Error("Error creating volume")
+	}
+	return v, err
+}
+
+func (lm *LocalManager) VolumeList(ctx context.Context, labels map[string]string) ([]contman.Volume, error) {
+	list, err := lm.volumes().List(labels)
+	if err != nil {
+		log.WithError(err).Error("Error listing volumes")
+	}
+	return list, err
+}
+
+// VolumePrune keeps volumes used by containers of this manager, containers
+// of other processes are not known
+func (lm *LocalManager) VolumePrune(ctx context.Context, labels map[string]string) ([]string, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	used := map[string]bool{}
+	for dir := range lm.used {
+		used[dir] = true
+	}
+	removed, err := lm.volumes().Prune(labels, used)
+	if err != nil {
+		log.WithError(err).Error("Error pruning volumes")
+	}
+	return removed, err
+}
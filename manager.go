@@ -1,43 +1,225 @@
 package contman
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"os"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	MountBind   = "bind"
+	MountVolume = "volume"
+	MountTmpfs  = "tmpfs"
+)
+
 type Mount struct {
+	// Type is MountBind when empty
+	Type string
+	// Source is host path of bind mount or name of volume, which is created
+	// when it does not exist, tmpfs has no source
 	Source   string
 	Target   string
 	ReadOnly bool
 }
 
+// Volume is named storage living independently of containers
+type Volume struct {
+	Name   string
+	Labels map[string]string
+}
+
+const (
+	NetworkNone   = "none"
+	NetworkBridge = "bridge"
+	NetworkHost   = "host"
+)
+
+// Port publishes ContainerPort on HostPort of the host, zero HostPort means a
+// random one
+type Port struct {
+	HostIP        string
+	HostPort      int
+	ContainerPort int
+	// Protocol is tcp when empty
+	Protocol string
+}
+
+// Ulimit sets soft and hard limits of a resource named as in ulimit, e.g.
+// nofile or nproc
+type Ulimit struct {
+	Name string `receipt:"name"`
+	Soft int64  `receipt:"soft"`
+	Hard int64  `receipt:"hard"`
+}
+
+// Resources limit what a container may consume, zero values mean no limit
+type Resources struct {
+	// CPUQuota is CPU time in microseconds the container may use every
+	// CPUPeriod, which is 100ms when zero
+	CPUQuota  int64 `receipt:"cpu_quota"`
+	CPUPeriod int64 `receipt:"cpu_period"`
+	// CPUShares is weight of the container relative to others, 1024 is the
+	// default one
+	CPUShares int64 `receipt:"cpu_shares"`
+	// Memory is limit in bytes, MemorySwap is limit of memory and swap
+	// together, -1 means unlimited swap
+	Memory     int64    `receipt:"memory"`
+	MemorySwap int64    `receipt:"memory_swap"`
+	PidsLimit  int64    `receipt:"pids_limit"`
+	Ulimits    []Ulimit `receipt:"ulimits"`
+	// ShmSize is size of /dev/shm in bytes
+	ShmSize int64 `receipt:"shm_size"`
+	// Tmpfs maps container paths to options of tmpfs mounted there, e.g.
+	// "size=64m"
+	Tmpfs map[string]string `receipt:"tmpfs"`
+}
+
+// Security constrains what the container process may do, zero value keeps
+// defaults of the backend
+type Security struct {
+	ReadOnlyRootfs bool `receipt:"read_only_rootfs"`
+	// CapDrop and CapAdd are capability names without CAP_ prefix, "ALL"
+	// drops every capability
+	CapDrop         []string `receipt:"cap_drop"`
+	CapAdd          []string `receipt:"cap_add"`
+	NoNewPrivileges bool     `receipt:"no_new_privileges"`
+	// SeccompProfile is path to a seccomp profile in docker format or
+	// "unconfined"
+	SeccompProfile string `receipt:"seccomp_profile"`
+	// AppArmorProfile is name of a profile loaded on the host
+	AppArmorProfile string `receipt:"apparmor_profile"`
+	// UsernsMode is user namespace mode, "host" opts out of remapping done
+	// by the daemon
+	UsernsMode string `receipt:"userns_mode"`
+	// RunAsHostUser runs the process as UID and GID of current process
+	// instead of Config.User
+	RunAsHostUser bool `receipt:"run_as_host_user"`
+}
+
+// StrictSecurity is a preset for untrusted receipts: the process runs as
+// the invoking host user without any capability or a way to gain
+// privileges, and only mounts and tmpfs are writable
+func StrictSecurity() Security {
+	return Security{
+		ReadOnlyRootfs:  true,
+		CapDrop:         []string{"ALL"},
+		NoNewPrivileges: true,
+		RunAsHostUser:   true,
+	}
+}
+
 type Config struct {
-	Image      string
-	Cmd        string
+	Image string
+	// Cmd is run by shell, which is Entrypoint when it is set or sh
+	Cmd string
+	// Entrypoint overrides entrypoint of the image
+	Entrypoint []string
+	// Args are arguments of Entrypoint in exec form, no shell is involved
+	// and Cmd is ignored when they are set
+	Args       []string
 	Env        map[string]string
 	Mounts     []Mount
 	WorkingDir string
+	// User is user[:group] the process runs as, user of the image is used
+	// when empty
+	User     string
+	Labels   map[string]string
+	Hostname string
+	// Network is none, bridge, host, name of a network or "container:<id>"
+	// sharing network namespace of another container, default network of
+	// the backend is used when empty
+	Network string
+	Ports   []Port
+	// ExtraHosts are "host:ip" entries added to /etc/hosts
+	ExtraHosts []string
+	DNS        []string
+	Resources  Resources
+	Security   Security
+	// Secrets are values provided read-only at SecretsDir/<name> without
+	// leaving them on disk, backends unable to do so refuse them
+	Secrets map[string][]byte
+	// Tty allocates terminal, so all output of the process goes to stdout
+	Tty       bool
+	StdinOpen bool
+	// HostDir is used to resolve relative host paths of CopyTo and
+	// CopyFrom, current working directory is used when empty
+	HostDir string
+}
+
+// Process returns entrypoint and arguments of container process, nil
+// entrypoint means the one of the image
+func (c Config) Process() (entrypoint, args []string) {
+	switch {
+	case len(c.Args) > 0:
+		return c.Entrypoint, c.Args
+	case c.Cmd == "":
+		return c.Entrypoint, nil
+	case len(c.Entrypoint) > 0:
+		return c.Entrypoint, []string{"-c", c.Cmd}
+	}
+	return []string{"sh"}, []string{"-c", c.Cmd}
+}
+
+// ProcessUser returns user the container process runs as, it is
+// "uid:gid" of current process when Security.RunAsHostUser is set
+func (c Config) ProcessUser() string {
+	if c.Security.RunAsHostUser {
+		return fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	}
+	return c.User
+}
+
+type ExecConfig struct {
+	Cmd        string
+	Env        map[string]string
+	WorkingDir string
+	Stdout     io.Writer
+	Stderr     io.Writer
 }
 
 type Container interface {
-	Start() error
-	Stop(timeout time.Duration) error
-	Remove() error
+	ID() string
+	ImageDigest(ctx context.Context) (string, error)
 
-	IsRunning() (bool, error)
-	Wait(dumpLog bool) (int, error)
+	Start(ctx context.Context) error
+	Stop(ctx context.Context, timeout time.Duration) error
+	Kill(ctx context.Context) error
+	Remove(ctx context.Context) error
 
-	CopyFrom(src, dest string) error
-	CopyTo(src, dest string) error
+	IsRunning(ctx context.Context) (bool, error)
+	// Wait blocks until container exits, following its output into stdout
+	// and stderr unless both of them are nil. Exit caused by running out of
+	// memory is reported as *ExitError with OOMKilled set, by Exec as well.
+	Wait(ctx context.Context, stdout, stderr io.Writer) (int, error)
+	Exec(ctx context.Context, config ExecConfig) (int, error)
+
+	CopyFrom(ctx context.Context, src, dest string) error
+	CopyTo(ctx context.Context, src, dest string) error
 
 	GetLogger() *log.Entry
 }
 
+// VolumeManager is implemented by managers able to manage volumes lifecycle
+type VolumeManager interface {
+	VolumeCreate(ctx context.Context, name string, labels map[string]string) (Volume, error)
+	// VolumeList returns volumes having all of labels
+	VolumeList(ctx context.Context, labels map[string]string) ([]Volume, error)
+	// VolumePrune removes volumes having all of labels which are not used by
+	// any container and returns their names
+	VolumePrune(ctx context.Context, labels map[string]string) ([]string, error)
+}
+
 type Manager interface {
-	PullImage(string) error
-	HasImage(string) bool
+	PullImage(ctx context.Context, image string) error
+	// HasImage tells whether image is in the store of the manager, image
+	// may be referenced by a short name, a registry qualified one or a
+	// digest
+	HasImage(ctx context.Context, image string) (bool, error)
 
-	ContainerCreate(Config) (Container, error)
+	ContainerCreate(ctx context.Context, config Config) (Container, error)
 	GetSystemMounts() []Mount
 }
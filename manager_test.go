@@ -0,0 +1,41 @@
+package contman_test
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/elemir/contman"
+)
+
+func TestConfigProcess(t *testing.T) {
+	for _, tc := range []struct {
+		config     contman.Config
+		entrypoint []string
+		args       []string
+	}{
+		{contman.Config{Cmd: "make"}, []string{"sh"}, []string{"-c", "make"}},
+		{contman.Config{Cmd: "make", Entrypoint: []string{"bash"}}, []string{"bash"}, []string{"-c", "make"}},
+		{contman.Config{Cmd: "make", Args: []string{"--serve"}}, nil, []string{"--serve"}},
+		{contman.Config{Entrypoint: []string{"/app"}, Args: []string{"--serve"}}, []string{"/app"}, []string{"--serve"}},
+		{contman.Config{}, nil, nil},
+	} {
+		entrypoint, args := tc.config.Process()
+		if !reflect.DeepEqual(entrypoint, tc.entrypoint) || !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("Unexpected process of %+v: %v %v", tc.config, entrypoint, args)
+		}
+	}
+}
+
+func TestConfigProcessUser(t *testing.T) {
+	config := contman.Config{User: "nobody"}
+	if user := config.ProcessUser(); user != "nobody" {
+		t.Errorf("Unexpected user: %s", user)
+	}
+
+	config.Security = contman.StrictSecurity()
+	if user := config.ProcessUser(); user != fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()) {
+		t.Errorf("Unexpected user of strict config: %s", user)
+	}
+}
@@ -0,0 +1,363 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/archive"
+	"github.com/elemir/contman/internal/cgroups"
+	"github.com/elemir/contman/internal/stream"
+)
+
+const (
+	// killedExitCode is exit code of processes killed by SIGKILL
+	killedExitCode = 128 + 9
+	// oomEventTimeout limits waiting for OOM event of a killed process, the
+	// runtime reports it independently of the exit status
+	oomEventTimeout = 500 * time.Millisecond
+)
+
+type OCIContainer struct {
+	manager *OCIManager
+	id      string
+	bundle  string
+	digest  string
+	hostDir string
+	// secretsDir keeps secret files mounted into the container
+	secretsDir string
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	done     chan struct{}
+	exitCode int
+	stdout   stream.DeferredWriter
+	stderr   stream.DeferredWriter
+	// oom is notified by events of the runtime until stopWatch is called
+	oom       *cgroups.OOMNotifier
+	stopWatch context.CancelFunc
+}
+
+func (oc *OCIContainer) ID() string {
+	return oc.id
+}
+
+func (oc *OCIContainer) ImageDigest(ctx context.Context) (string, error) {
+	return oc.digest, nil
+}
+
+func (oc *OCIContainer) rootfs() string {
+	return filepath.Join(oc.bundle, "rootfs")
+}
+
+// runtime runs OCI runtime command and returns its error together with
+// stderr
+func (oc *OCIContainer) runtime(ctx context.Context, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := oc.manager.runtimeCmd(ctx, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", oc.manager.runtime, args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+func (oc *OCIContainer) Start(ctx context.Context) error {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if oc.cmd != nil {
+		return fmt.Errorf("container %s is already started", oc.id)
+	}
+
+	// Runtime runs in foreground, so its exit status is the container one
+	cmd := oc.manager.runtimeCmd(context.Background(), "run", "--bundle", oc.bundle, oc.id)
+	cmd.Stdout = &oc.stdout
+	cmd.Stderr = &oc.stderr
+	if err := cmd.Start(); err != nil {
+		oc.GetLogger().WithError(err).Error("Error starting container")
+		return err
+	}
+
+	oc.cmd = cmd
+	oc.done = make(chan struct{})
+	oc.oom = cgroups.NewOOMNotifier()
+	go func() {
+		defer close(oc.done)
+		err := cmd.Wait()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			oc.exitCode = exitErr.ExitCode()
+		} else if err != nil {
+			oc.GetLogger().WithError(err).Error("Error waiting container")
+			oc.exitCode = -1
+		}
+	}()
+
+	// Foreground runtime creates container asynchronously, while execs
+	// require it to exist already
+	for {
+		var status struct {
+			Status string `json:"status"`
+		}
+		out, err := oc.manager.runtimeCmd(ctx, "state", oc.id).Output()
+		if err == nil && json.Unmarshal(out, &status) == nil && status.Status == "running" {
+			var watchCtx context.Context
+			watchCtx, oc.stopWatch = context.WithCancel(context.Background())
+			go oc.watchOOM(watchCtx)
+			return nil
+		}
+
+		select {
+		case <-oc.done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// watchOOM notifies oc.oom about OOM events reported by the runtime, e.g.
+// runc reads them from cgroup of the container. Runtimes without events
+// leave OOM kills undetected.
+func (oc *OCIContainer) watchOOM(ctx context.Context) {
+	cmd := oc.manager.runtimeCmd(ctx, "events", oc.id)
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		oc.GetLogger().WithError(err).Debug("Cannot watch runtime events")
+		return
+	}
+
+	decoder := json.NewDecoder(out)
+	for {
+		var event struct {
+			Type string `json:"type"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			break
+		}
+		if event.Type == "oom" {
+			oc.oom.Notify()
+		}
+	}
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		oc.GetLogger().WithError(err).Debug("Runtime events are not available")
+	}
+}
+
+// exitError returns *contman.ExitError for processes killed by OOM killer
+func (oc *OCIContainer) exitError(code int) (int, error) {
+	if code == killedExitCode && oc.oom != nil && oc.oom.Killed(oomEventTimeout) {
+		return code, &contman.ExitError{ContainerID: oc.id, Code: code, OOMKilled: true}
+	}
+	return code, nil
+}
+
+func (oc *OCIContainer) Stop(ctx context.Context, timeout time.Duration) error {
+	running, _ := oc.IsRunning(ctx)
+	if !running {
+		return nil
+	}
+
+	if err := oc.runtime(ctx, "kill", oc.id, "TERM"); err != nil {
+		oc.GetLogger().WithError(err).Error("Error stopping container")
+		return err
+	}
+
+	select {
+	case <-oc.done:
+		return nil
+	case <-time.After(timeout):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return oc.Kill(ctx)
+}
+
+func (oc *OCIContainer) Kill(ctx context.Context) error {
+	running, _ := oc.IsRunning(ctx)
+	if !running {
+		return nil
+	}
+
+	err := oc.runtime(ctx, "kill", oc.id, "KILL")
+	if err != nil {
+		oc.GetLogger().WithError(err).Error("Error killing container")
+	}
+	return err
+}
+
+func (oc *OCIContainer) Remove(ctx context.Context) error {
+	if running, _ := oc.IsRunning(ctx); running {
+		return fmt.Errorf("container %s is running", oc.id)
+	}
+
+	oc.mu.Lock()
+	started := oc.cmd != nil
+	if oc.stopWatch != nil {
+		oc.stopWatch()
+	}
+	oc.mu.Unlock()
+	if started {
+		if err := oc.runtime(ctx, "delete", "--force", oc.id); err != nil {
+			oc.GetLogger().WithError(err).Debug("Error deleting runtime state")
+		}
+	}
+
+	err := os.RemoveAll(oc.bundle)
+	if err != nil {
+		oc.GetLogger().WithError(err).Errorf("Error removing container")
+		return err
+	}
+	return os.RemoveAll(oc.secretsDir)
+}
+
+func (oc *OCIContainer) IsRunning(ctx context.Context) (bool, error) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if oc.done == nil {
+		return false, nil
+	}
+
+	select {
+	case <-oc.done:
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+func (oc *OCIContainer) Wait(ctx context.Context, stdout, stderr io.Writer) (int, error) {
+	oc.mu.Lock()
+	done := oc.done
+	oc.mu.Unlock()
+	if done == nil {
+		return 0, fmt.Errorf("container %s is not started", oc.id)
+	}
+
+	oc.stdout.Attach(stdout)
+	oc.stderr.Attach(stderr)
+
+	select {
+	case <-done:
+		return oc.exitError(oc.exitCode)
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (oc *OCIContainer) Exec(ctx context.Context, config contman.ExecConfig) (int, error) {
+	l := oc.GetLogger().WithField("cmd", config.Cmd)
+
+	args := []string{"exec"}
+	if config.WorkingDir != "" {
+		args = append(args, "--cwd", config.WorkingDir)
+	}
+	for _, env := range formatEnv(config.Env) {
+		args = append(args, "--env", env)
+	}
+	args = append(args, oc.id, "sh", "-c", config.Cmd)
+
+	cmd := oc.manager.runtimeCmd(ctx, args...)
+	cmd.Stdout = orDiscard(config.Stdout)
+	cmd.Stderr = orDiscard(config.Stderr)
+
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return oc.exitError(exitErr.ExitCode())
+	}
+	if err != nil {
+		l.WithError(err).Error("Error executing command")
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (oc *OCIContainer) CopyFrom(ctx context.Context, src, dest string) error {
+	l := oc.GetLogger().WithFields(log.Fields{
+		"src":  src,
+		"dest": dest,
+	})
+
+	target, err := rootPath(oc.rootfs(), src)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", src, contman.ErrNotFound)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(archive.CreateTarToWriter(target, path.Base(src), writer))
+	}()
+	defer reader.Close()
+
+	err = archive.ExtractTarFromReader(reader, oc.hostPath(dest))
+	if err != nil {
+		l.WithError(err).Error("Error copying from container")
+	}
+	return err
+}
+
+func (oc *OCIContainer) CopyTo(ctx context.Context, src, dest string) error {
+	l := oc.GetLogger().WithFields(log.Fields{
+		"src":  src,
+		"dest": dest,
+	})
+
+	// Destination is a directory, so symlinks are resolved up to its end
+	target, err := securejoin.SecureJoin(oc.rootfs(), dest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(archive.CreateTarToWriter(oc.hostPath(src), src, writer))
+	}()
+	defer reader.Close()
+
+	err = archive.ExtractTarFromReader(reader, target)
+	if err != nil {
+		l.WithError(err).Error("Error copying to container")
+	}
+	return err
+}
+
+func (oc *OCIContainer) GetLogger() *log.Entry {
+	return log.WithField("containerID", oc.id)
+}
+
+func (oc *OCIContainer) hostPath(path string) string {
+	if oc.hostDir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(oc.hostDir, path)
+}
+
+func orDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return ioutil.Discard
+	}
+	return w
+}
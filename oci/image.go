@@ -0,0 +1,303 @@
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/elemir/contman"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// image is a manifest of an OCI image layout together with its config
+type image struct {
+	layout   string
+	digest   digest.Digest
+	manifest v1.Manifest
+	config   v1.Image
+}
+
+// splitImage splits image reference "path[:tag]" into OCI layout path and
+// tag, which is matched against ref name annotations of the index
+func splitImage(ref string) (string, string) {
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return ref, ""
+	}
+	return ref[:i], ref[i+1:]
+}
+
+func readJSON(layout string, d digest.Digest, v interface{}) error {
+	blob, err := openBlob(layout, d)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	if err := json.NewDecoder(blob).Decode(v); err != nil {
+		return err
+	}
+	return blob.verify()
+}
+
+// blob reads a blob of the layout computing its digest
+type blob struct {
+	*os.File
+	r        io.Reader
+	digest   digest.Digest
+	verifier digest.Verifier
+}
+
+func openBlob(layout string, d digest.Digest) (*blob, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(blobPath(layout, d))
+	if err != nil {
+		return nil, err
+	}
+	verifier := d.Verifier()
+	return &blob{File: f, r: io.TeeReader(f, verifier), digest: d, verifier: verifier}, nil
+}
+
+func (b *blob) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// verify reads the rest of the blob, which its consumer has not needed, and
+// checks its digest
+func (b *blob) verify() error {
+	if _, err := io.Copy(ioutil.Discard, b.r); err != nil {
+		return err
+	}
+	if !b.verifier.Verified() {
+		return fmt.Errorf("blob %s does not match its digest", b.digest)
+	}
+	return nil
+}
+
+func blobPath(layout string, d digest.Digest) string {
+	return filepath.Join(layout, "blobs", d.Algorithm().String(), d.Hex())
+}
+
+// loadImage finds manifest tagged tag in OCI layout, the first one is used
+// when tag is empty
+func loadImage(layout, tag string) (*image, error) {
+	var index v1.Index
+	f, err := os.Open(filepath.Join(layout, "index.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("oci layout %s: %w", layout, contman.ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&index); err != nil {
+		return nil, err
+	}
+
+	for _, desc := range index.Manifests {
+		if tag != "" && desc.Annotations[v1.AnnotationRefName] != tag {
+			continue
+		}
+
+		img := &image{layout: layout, digest: desc.Digest}
+		if err := readJSON(layout, desc.Digest, &img.manifest); err != nil {
+			return nil, err
+		}
+		if err := readJSON(layout, img.manifest.Config.Digest, &img.config); err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+
+	return nil, fmt.Errorf("image %s:%s: %w", layout, tag, contman.ErrNotFound)
+}
+
+// unpack applies image layers on top of each other into rootfs
+func (img *image) unpack(rootfs string) error {
+	for _, layer := range img.manifest.Layers {
+		if err := img.applyLayer(layer.Digest, rootfs); err != nil {
+			return fmt.Errorf("layer %s: %w", layer.Digest, err)
+		}
+	}
+	return nil
+}
+
+// applyLayer verifies the layer while applying it, so a corrupted one fails
+// however much of it is applied
+func (img *image) applyLayer(d digest.Digest, rootfs string) error {
+	blob, err := openBlob(img.layout, d)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	r, err := decompress(blob)
+	if err != nil {
+		return err
+	}
+	if err := applyTar(tar.NewReader(r), rootfs); err != nil {
+		return err
+	}
+	return blob.verify()
+}
+
+// decompress recognizes gzip by its magic, so layer media types and tarball
+// extensions do not matter
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// rootPath resolves path inside root the way the container sees it, so it
+// cannot point outside of it: symlinks of its directories, absolute ones
+// included, are resolved relative to root. The last element is kept as is.
+func rootPath(root, path string) (string, error) {
+	path = filepath.Clean("/" + path)
+	if path == "/" {
+		return root, nil
+	}
+	dir, err := securejoin.SecureJoin(root, filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+func applyTar(tr *tar.Reader, rootfs string) error {
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(rootfs)
+	if err != nil {
+		return err
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := rootPath(root, header.Name)
+		if err != nil {
+			return err
+		}
+		if target == root {
+			continue
+		}
+		dir, base := filepath.Split(target)
+
+		if base == whiteoutOpaque {
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, entry := range entries {
+				if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			if err := os.RemoveAll(filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		// Entry replaces whatever lower layers have at its path, except of
+		// directories which are merged
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && header.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		mode := header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := rootPath(root, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		default:
+			// Device nodes cannot be created without privileges, runtime
+			// provides the standard ones
+			continue
+		}
+		// Owners are kept only with privileges, chown resets setuid and
+		// setgid bits, so it goes first
+		if os.Geteuid() == 0 {
+			if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+				return err
+			}
+		}
+		if header.Typeflag != tar.TypeSymlink {
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// extractLayout unpacks tarball of OCI layout into dir
+func extractLayout(tarball, dir string) error {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	return applyTar(tar.NewReader(r), dir)
+}
@@ -0,0 +1,270 @@
+// Package oci implements daemonless contman.Manager, which unpacks OCI image
+// layouts into bundles and runs them with runc or crun.
+//
+// Images are referred by path to an OCI image layout directory or to its
+// tarball, optionally followed by ":tag" selecting a manifest by
+// "org.opencontainers.image.ref.name" annotation.
+package oci
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/secrets"
+)
+
+// ErrNoRegistry is returned when an image is not available locally, the
+// backend does not talk to registries
+var ErrNoRegistry = errors.New("oci backend cannot pull images from registries")
+
+type OCIManager struct {
+	root     string
+	runtime  string
+	rootless bool
+}
+
+type Option func(*OCIManager)
+
+// WithRoot sets directory for bundles, runtime state and unpacked tarballs
+func WithRoot(root string) Option {
+	return func(om *OCIManager) {
+		om.root = root
+	}
+}
+
+// WithRuntime sets OCI runtime binary, runc or crun from PATH is used by
+// default
+func WithRuntime(runtime string) Option {
+	return func(om *OCIManager) {
+		om.runtime = runtime
+	}
+}
+
+func NewOCIManager(opts ...Option) (*OCIManager, error) {
+	om := &OCIManager{
+		rootless: os.Geteuid() != 0,
+	}
+	for _, opt := range opts {
+		opt(om)
+	}
+
+	if om.root == "" {
+		om.root = filepath.Join(os.TempDir(), fmt.Sprintf("contman-oci-%d", os.Geteuid()))
+	}
+	if err := os.MkdirAll(om.root, 0700); err != nil {
+		return nil, err
+	}
+
+	if om.runtime == "" {
+		for _, runtime := range []string{"runc", "crun"} {
+			if path, err := exec.LookPath(runtime); err == nil {
+				om.runtime = path
+				break
+			}
+		}
+		if om.runtime == "" {
+			return nil, errors.New("neither runc nor crun is found in PATH")
+		}
+	}
+
+	return om, nil
+}
+
+// layoutPath returns OCI layout directory of image, tarballs are extracted
+// into the manager root once
+func (om *OCIManager) layoutPath(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("image %s: %w: %w", path, contman.ErrNotFound, ErrNoRegistry)
+	}
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return path, nil
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", abs, fi.Size(), fi.ModTime().UnixNano())))
+	layout := filepath.Join(om.root, "images", hex.EncodeToString(sum[:]))
+	if _, err := os.Stat(filepath.Join(layout, "index.json")); err == nil {
+		return layout, nil
+	}
+
+	tmp, err := ioutil.TempDir(om.root, "image-")
+	if err != nil {
+		return "", err
+	}
+	if err := extractLayout(path, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(layout), 0700); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, layout); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return layout, nil
+}
+
+func (om *OCIManager) loadImage(ref string) (*image, error) {
+	path, tag := splitImage(ref)
+	layout, err := om.layoutPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return loadImage(layout, tag)
+}
+
+// PullImage only checks that image is available locally
+func (om *OCIManager) PullImage(ctx context.Context, image string) error {
+	_, err := om.loadImage(image)
+	if err != nil {
+		log.WithError(err).Error("Error loading image")
+	}
+	return err
+}
+
+func (om *OCIManager) HasImage(ctx context.Context, image string) (bool, error) {
+	if image == "" {
+		return false, nil
+	}
+	_, err := om.loadImage(image)
+	if errors.Is(err, contman.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (om *OCIManager) ContainerCreate(ctx context.Context, config contman.Config) (contman.Container, error) {
+	switch config.Network {
+	case "", contman.NetworkNone, contman.NetworkHost:
+	default:
+		return nil, fmt.Errorf("network %s is not supported without CNI", config.Network)
+	}
+
+	mounts, err := om.volumeMounts(config.Mounts)
+	if err != nil {
+		return nil, err
+	}
+	secretsDir, secretMounts, err := secrets.Mounts(config.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	created := false
+	defer func() {
+		if !created {
+			os.RemoveAll(secretsDir)
+		}
+	}()
+	config.Mounts = append(mounts, secretMounts...)
+
+	img, err := om.loadImage(config.Image)
+	if err != nil {
+		log.WithError(err).Error("Error loading image")
+		return nil, err
+	}
+
+	id := newID()
+	bundle := filepath.Join(om.root, "bundles", id)
+	if err := img.unpack(filepath.Join(bundle, "rootfs")); err != nil {
+		log.WithError(err).Error("Error unpacking image")
+		os.RemoveAll(bundle)
+		return nil, err
+	}
+
+	spec, err := generateSpec(img, config, bundle, om.rootless)
+	if err != nil {
+		log.WithError(err).Error("Error generating runtime spec")
+		os.RemoveAll(bundle)
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(spec, "", "\t")
+	if err != nil {
+		os.RemoveAll(bundle)
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, "config.json"), data, 0600); err != nil {
+		os.RemoveAll(bundle)
+		return nil, err
+	}
+	created = true
+
+	return &OCIContainer{
+		manager:    om,
+		id:         id,
+		bundle:     bundle,
+		digest:     img.digest.String(),
+		hostDir:    config.HostDir,
+		secretsDir: secretsDir,
+	}, nil
+}
+
+// GetSystemMounts returns nothing, there is no daemon to share
+func (om *OCIManager) GetSystemMounts() []contman.Mount {
+	return nil
+}
+
+// volumeMounts turns volumes into bind mounts of directories under the
+// manager root, which are created on first use
+func (om *OCIManager) volumeMounts(mounts []contman.Mount) ([]contman.Mount, error) {
+	result := make([]contman.Mount, len(mounts))
+	for i, m := range mounts {
+		result[i] = m
+		switch m.Type {
+		case "", contman.MountBind, contman.MountTmpfs:
+			continue
+		case contman.MountVolume:
+		default:
+			return nil, fmt.Errorf("unknown type %s of mount %s", m.Type, m.Target)
+		}
+		dir, err := om.volumes().Path(m.Source)
+		if err != nil {
+			return nil, err
+		}
+		result[i].Type = contman.MountBind
+		result[i].Source = dir
+	}
+	return result, nil
+}
+
+// runtimeCmd prepares invocation of OCI runtime with the manager state root
+func (om *OCIManager) runtimeCmd(ctx context.Context, args ...string) *exec.Cmd {
+	args = append([]string{"--root", filepath.Join(om.root, "state")}, args...)
+	return exec.CommandContext(ctx, om.runtime, args...)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func formatEnv(vars map[string]string) []string {
+	env := make([]string, 0, len(vars))
+	for key, value := range vars {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	return env
+}
@@ -0,0 +1,515 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	specsv "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/elemir/contman"
+)
+
+// TestMain turns the test binary into a fake OCI runtime, which runs bundle
+// processes right on the host inside the rootfs directory
+func TestMain(m *testing.M) {
+	if os.Getenv("CONTMAN_FAKE_RUNTIME") == "1" {
+		os.Exit(fakeRuntime(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+func fakeRuntime(args []string) int {
+	state, cmd, args := args[1], args[2], args[3:]
+	bundleFile := func(id string) string { return filepath.Join(state, id) }
+
+	run := func(bundle string, process *specs.Process, extraEnv []string, pidFile string) int {
+		c := exec.Command(process.Args[0], process.Args[1:]...)
+		// runc creates missing working directory as well
+		c.Dir = filepath.Join(bundle, "rootfs", process.Cwd)
+		os.MkdirAll(c.Dir, 0755)
+		c.Env = append(process.Env, extraEnv...)
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		if err := c.Start(); err != nil {
+			return 127
+		}
+		if pidFile != "" {
+			ioutil.WriteFile(pidFile, []byte(strconv.Itoa(c.Process.Pid)), 0644)
+		}
+		if err := c.Wait(); err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return exitErr.ExitCode()
+			}
+			return 128
+		}
+		return 0
+	}
+
+	loadSpec := func(bundle string) *specs.Spec {
+		var spec specs.Spec
+		data, _ := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+		json.Unmarshal(data, &spec)
+		return &spec
+	}
+
+	switch cmd {
+	case "run":
+		bundle, id := args[1], args[2]
+		os.MkdirAll(state, 0755)
+		ioutil.WriteFile(bundleFile(id), []byte(bundle), 0644)
+		return run(bundle, loadSpec(bundle).Process, nil, bundleFile(id)+".pid")
+	case "exec":
+		var env []string
+		cwd := ""
+		for len(args) > 0 && (args[0] == "--cwd" || args[0] == "--env") {
+			if args[0] == "--cwd" {
+				cwd = args[1]
+			} else {
+				env = append(env, args[1])
+			}
+			args = args[2:]
+		}
+		bundle, _ := ioutil.ReadFile(bundleFile(args[0]))
+		process := loadSpec(string(bundle)).Process
+		process.Args = args[1:]
+		if cwd != "" {
+			process.Cwd = cwd
+		}
+		return run(string(bundle), process, env, "")
+	case "kill":
+		pid, _ := ioutil.ReadFile(bundleFile(args[0]) + ".pid")
+		p, _ := strconv.Atoi(string(pid))
+		signal := syscall.SIGTERM
+		if args[1] == "KILL" {
+			signal = syscall.SIGKILL
+		}
+		syscall.Kill(p, signal)
+	case "state":
+		if _, err := os.Stat(bundleFile(args[0]) + ".pid"); err != nil {
+			return 1
+		}
+		fmt.Print(`{"status": "running"}`)
+	case "events":
+		// Containers labeled with "oom" report OOM kill right away
+		bundle, _ := ioutil.ReadFile(bundleFile(args[0]))
+		if loadSpec(string(bundle)).Annotations["oom"] != "" {
+			fmt.Printf(`{"type":"oom","id":%q}`+"\n", args[0])
+		}
+	case "delete":
+		os.Remove(bundleFile(args[len(args)-1]))
+	}
+	return 0
+}
+
+func writeBlob(t *testing.T, layout string, data []byte) v1.Descriptor {
+	d := digest.FromBytes(data)
+	dir := filepath.Join(layout, "blobs", "sha256")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, d.Hex()), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return v1.Descriptor{Digest: d, Size: int64(len(data))}
+}
+
+func layer(t *testing.T, compress bool, files map[string]string) []byte {
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	for name, data := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if name[len(name)-1] == '/' {
+			header = &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(data))
+	}
+	tw.Close()
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+// newLayout creates OCI layout of an image with two layers, where the upper
+// one removes a file of the lower one
+func newLayout(t *testing.T, dir string) {
+	config, _ := json.Marshal(v1.Image{
+		Config: v1.ImageConfig{
+			Env:        []string{"PATH=" + os.Getenv("PATH"), "GREETING=Hello"},
+			WorkingDir: "/work",
+		},
+	})
+	manifest, _ := json.Marshal(v1.Manifest{
+		Versioned: specsv.Versioned{SchemaVersion: 2},
+		Config:    writeBlob(t, dir, config),
+		Layers: []v1.Descriptor{
+			writeBlob(t, dir, layer(t, false, map[string]string{"work/": "", "etc/os-release": "fake", "work/old.txt": "old"})),
+			writeBlob(t, dir, layer(t, true, map[string]string{"work/.wh.old.txt": "", "work/new.txt": "new"})),
+		},
+	})
+
+	desc := writeBlob(t, dir, manifest)
+	desc.MediaType = v1.MediaTypeImageManifest
+	desc.Annotations = map[string]string{v1.AnnotationRefName: "v1"}
+	index, _ := json.Marshal(v1.Index{
+		Versioned: specsv.Versioned{SchemaVersion: 2},
+		Manifests: []v1.Descriptor{desc},
+	})
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestManager(t *testing.T, dir string) *OCIManager {
+	os.Setenv("CONTMAN_FAKE_RUNTIME", "1")
+	om, err := NewOCIManager(WithRoot(filepath.Join(dir, "root")), WithRuntime(os.Args[0]))
+	if err != nil {
+		t.Fatal("Cannot create manager: ", err)
+	}
+	return om
+}
+
+func TestContainerCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contman-oci-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layout := filepath.Join(dir, "image")
+	newLayout(t, layout)
+	om := newTestManager(t, dir)
+
+	if ok, err := om.HasImage(context.Background(), layout+":v1"); !ok || err != nil {
+		t.Error("Image is not found by tag: ", err)
+	}
+	if ok, err := om.HasImage(context.Background(), layout+":v2"); ok || err != nil {
+		t.Error("Image is found by missing tag: ", err)
+	}
+
+	cntr, err := om.ContainerCreate(context.Background(), contman.Config{
+		Image:  layout,
+		Cmd:    "true",
+		Env:    map[string]string{"GOOS": "linux"},
+		Mounts: []contman.Mount{{Source: "/data", Target: "/data", ReadOnly: true}},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	defer cntr.Remove(context.Background())
+
+	bundle := cntr.(*OCIContainer).bundle
+	if _, err := os.Stat(filepath.Join(bundle, "rootfs", "work", "old.txt")); !os.IsNotExist(err) {
+		t.Error("Whiteout was not applied")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(bundle, "rootfs", "work", "new.txt")); err != nil || string(data) != "new" {
+		t.Error("Compressed layer was not applied: ", err)
+	}
+
+	var spec specs.Spec
+	data, _ := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal("Cannot read spec: ", err)
+	}
+	env := spec.Process.Env
+	if spec.Process.Cwd != "/work" || env[1] != "GREETING=Hello" || env[2] != "GOOS=linux" {
+		t.Errorf("Unexpected process: %+v", spec.Process)
+	}
+	if m := spec.Mounts[len(spec.Mounts)-1]; m.Destination != "/data" || m.Options[1] != "ro" {
+		t.Errorf("Unexpected mount: %+v", m)
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contman-oci-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layout := filepath.Join(dir, "image")
+	newLayout(t, layout)
+	om := newTestManager(t, dir)
+	ctx := context.Background()
+
+	cacheLabels := map[string]string{contman.CacheLabel: "true"}
+	for _, name := range []string{"go-mod", "npm"} {
+		if _, err := om.VolumeCreate(ctx, name, cacheLabels); err != nil {
+			t.Fatal("Cannot create volume: ", err)
+		}
+	}
+	for _, name := range []string{"..", "."} {
+		if _, err := om.ContainerCreate(ctx, contman.Config{
+			Image:  layout,
+			Cmd:    "true",
+			Mounts: []contman.Mount{{Type: contman.MountVolume, Source: name, Target: "/cache"}},
+		}); err == nil {
+			t.Errorf("Invalid volume name %q is accepted", name)
+		}
+	}
+	cntr, err := om.ContainerCreate(ctx, contman.Config{
+		Image:  layout,
+		Cmd:    "true",
+		Mounts: []contman.Mount{{Type: contman.MountVolume, Source: "go-mod", Target: "/go/pkg/mod"}},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+
+	if volumes, err := om.VolumeList(ctx, cacheLabels); err != nil || len(volumes) != 2 {
+		t.Errorf("Unexpected volumes: %+v, %v", volumes, err)
+	}
+	if pruned, err := om.VolumePrune(ctx, cacheLabels); err != nil || !reflect.DeepEqual(pruned, []string{"npm"}) {
+		t.Errorf("Used volume is pruned: %v, %v", pruned, err)
+	}
+	cntr.Remove(ctx)
+	if pruned, err := om.VolumePrune(ctx, cacheLabels); err != nil || !reflect.DeepEqual(pruned, []string{"go-mod"}) {
+		t.Errorf("Unused volume is not pruned: %v, %v", pruned, err)
+	}
+}
+
+func TestGenerateSpec(t *testing.T) {
+	img := &image{}
+	img.config.Config.Entrypoint = []string{"/bin/echo"}
+	img.config.Config.Cmd = []string{"default"}
+
+	spec, err := generateSpec(img, contman.Config{
+		Args:     []string{"hello"},
+		User:     "1000:100",
+		Hostname: "builder",
+		Labels:   map[string]string{"receipt": "test"},
+	}, "/bundle", false)
+	if err != nil {
+		t.Fatal("Cannot generate spec: ", err)
+	}
+	if !reflect.DeepEqual(spec.Process.Args, []string{"/bin/echo", "hello"}) {
+		t.Errorf("Unexpected args: %v", spec.Process.Args)
+	}
+	if spec.Process.User.UID != 1000 || spec.Process.User.GID != 100 {
+		t.Errorf("Unexpected user: %+v", spec.Process.User)
+	}
+	if spec.Hostname != "builder" || spec.Annotations["receipt"] != "test" {
+		t.Errorf("Unexpected spec: %+v", spec)
+	}
+
+	spec, err = generateSpec(img, contman.Config{}, "/bundle", false)
+	if err != nil || !reflect.DeepEqual(spec.Process.Args, []string{"/bin/echo", "default"}) {
+		t.Errorf("Image command is not used: %v", err)
+	}
+
+	if _, err := generateSpec(img, contman.Config{User: "1000:100"}, "/bundle", true); err == nil {
+		t.Error("Rootless spec dropped user")
+	}
+	img.config.Config.User = "1000"
+	if _, err := generateSpec(img, contman.Config{}, "/bundle", true); err == nil {
+		t.Error("Rootless spec dropped user of the image")
+	}
+	for _, config := range []contman.Config{{User: "0:0"}, {Security: contman.Security{RunAsHostUser: true}}} {
+		spec, err = generateSpec(img, config, "/bundle", true)
+		if err != nil || spec.Process.User.UID != 0 || spec.Linux.UIDMappings[0].HostID != uint32(os.Geteuid()) {
+			t.Errorf("Unexpected rootless spec for %+v: %v", config, err)
+		}
+	}
+}
+
+func TestOOMKilled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contman-oci-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layout := filepath.Join(dir, "image")
+	newLayout(t, layout)
+	om := newTestManager(t, dir)
+	ctx := context.Background()
+
+	cntr, err := om.ContainerCreate(ctx, contman.Config{Image: layout, Cmd: "sleep 0.5; exit 137", Labels: map[string]string{"oom": "true"}})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	defer cntr.Remove(ctx)
+	if err := cntr.Start(ctx); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+
+	_, err = cntr.Exec(ctx, contman.ExecConfig{Cmd: "exit 137"})
+	if exitErr, ok := err.(*contman.ExitError); !ok || !exitErr.OOMKilled {
+		t.Error("Expected OOM error, got: ", err)
+	}
+	if code, err := cntr.Exec(ctx, contman.ExecConfig{Cmd: "exit 3"}); code != 3 || err != nil {
+		t.Error("Plain exit is reported as OOM: ", code, err)
+	}
+	if _, err := cntr.Wait(ctx, nil, nil); err == nil {
+		t.Error("Expected OOM error of the container")
+	}
+}
+
+func TestRunReceipt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contman-oci-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newLayout(t, filepath.Join(dir, "image"))
+	tarball := filepath.Join(dir, "image.tar")
+	if err := exec.Command("tar", "-C", filepath.Join(dir, "image"), "-cf", tarball, ".").Run(); err != nil {
+		t.Skip("Cannot pack layout: ", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.txt"), []byte("input\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	om := newTestManager(t, dir)
+	result, err := contman.RunReceipt(om, contman.Receipt{
+		Image:              tarball + ":v1",
+		Cmd:                "mkdir out && echo $GREETING > out/greeting && cat in/input.txt",
+		InputCopy:          map[string]string{"input.txt": "/work/in"},
+		OutputCopy:         map[string]string{"/work/out": "."},
+		HostDir:            dir,
+		UseImageWorkingDir: true,
+	})
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if string(result.Stdout) != "input\n" {
+		t.Errorf("Unexpected output: %q", result.Stdout)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "out", "greeting")); err != nil || string(data) != "Hello\n" {
+		t.Error("Output was not copied from container: ", err)
+	}
+
+	result, err = contman.RunReceipt(om, contman.Receipt{
+		Image: tarball + ":v1",
+		Steps: []contman.Step{
+			{Cmd: "test \"$STEP\" = 1", Env: map[string]string{"STEP": "1"}},
+			{Cmd: "test -f new.txt", WorkingDir: "/work"},
+			{Cmd: "exit 3"},
+		},
+	})
+	if stepErr, ok := err.(*contman.StepError); !ok || stepErr.Index != 2 || stepErr.ExitCode != 3 {
+		t.Fatalf("Expected failure of last step, got: %v, %+v", err, result)
+	}
+}
+
+func TestApplyTar(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "contman-oci-rootfs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range []*tar.Header{
+		{Name: "lib/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "lib64", Linkname: "/lib", Typeflag: tar.TypeSymlink},
+		{Name: "lib64/ld.so", Mode: 0755, Typeflag: tar.TypeReg},
+		{Name: "bin/su", Mode: 04755, Uid: 1000, Gid: 1000, Typeflag: tar.TypeReg},
+		{Name: "tmp/", Mode: 01777, Typeflag: tar.TypeDir},
+	} {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	if err := applyTar(tar.NewReader(&buf), rootfs); err != nil {
+		t.Fatal("Cannot apply tar: ", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(rootfs, "lib", "ld.so")); err != nil {
+		t.Error("Absolute symlink is not resolved inside rootfs: ", err)
+	}
+	fi, err := os.Stat(filepath.Join(rootfs, "bin", "su"))
+	if err != nil || fi.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("Setuid bit is lost: %v, %v", fi, err)
+	}
+	if os.Geteuid() == 0 && fi.Sys().(*syscall.Stat_t).Uid != 1000 {
+		t.Errorf("Owner is not applied: %+v", fi.Sys())
+	}
+	if fi, err := os.Stat(filepath.Join(rootfs, "tmp")); err != nil || fi.Mode()&os.ModeSticky == 0 {
+		t.Errorf("Sticky bit is lost: %v, %v", fi, err)
+	}
+}
+
+func TestUnpackCorruptedLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contman-oci-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	desc := writeBlob(t, dir, layer(t, true, map[string]string{"etc/os-release": "fake"}))
+	corrupted := layer(t, true, map[string]string{"etc/os-release": "evil"})
+	if err := ioutil.WriteFile(blobPath(dir, desc.Digest), corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	img := &image{layout: dir, manifest: v1.Manifest{Layers: []v1.Descriptor{desc}}}
+	if err := img.unpack(filepath.Join(dir, "rootfs")); err == nil {
+		t.Error("Corrupted layer is unpacked")
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "contman-oci-rootfs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	passwd := "root:x:0:0:root:/root:/bin/sh\nnobody:x:65534:65534:nobody:/:/sbin/nologin\napp:x:1000:1001::/app:/bin/sh\n"
+	group := "root:x:0:\nnogroup:x:65534:\napp:x:1001:\nstaff:x:50:app\n"
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte(group), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for user, expected := range map[string]specs.User{
+		"":          {},
+		"nobody":    {UID: 65534, GID: 65534},
+		"app:staff": {UID: 1000, GID: 50},
+		"1000":      {UID: 1000, GID: 1001},
+		"1234:5678": {UID: 1234, GID: 5678},
+		"app:50":    {UID: 1000, GID: 50},
+	} {
+		if resolved, err := resolveUser(rootfs, user); err != nil || !reflect.DeepEqual(resolved, expected) {
+			t.Errorf("Unexpected user for %q: %+v, %v", user, resolved, err)
+		}
+	}
+	for _, user := range []string{"missing", "app:missing"} {
+		if resolved, err := resolveUser(rootfs, user); err == nil {
+			t.Errorf("User %q is resolved to %+v", user, resolved)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package oci
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/runtimespec"
+)
+
+var defaultMounts = []specs.Mount{
+	{Destination: "/proc", Type: "proc", Source: "proc", Options: []string{"nosuid", "noexec", "nodev"}},
+	{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+	{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}},
+	{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+	{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+	{Destination: "/sys", Type: "none", Source: "/sys", Options: []string{"rbind", "nosuid", "noexec", "nodev", "ro"}},
+	{Destination: "/etc/resolv.conf", Type: "bind", Source: "/etc/resolv.conf", Options: []string{"rbind", "ro"}},
+	{Destination: "/etc/hosts", Type: "bind", Source: "/etc/hosts", Options: []string{"rbind", "ro"}},
+}
+
+var defaultCapabilities = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_FSETID", "CAP_FOWNER", "CAP_MKNOD",
+	"CAP_NET_RAW", "CAP_SETGID", "CAP_SETUID", "CAP_SETFCAP", "CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE", "CAP_SYS_CHROOT", "CAP_KILL", "CAP_AUDIT_WRITE",
+}
+
+// generateSpec makes runtime spec of a container running process of config
+// in environment described by the image config, bundle has the image
+// unpacked. Network namespace is shared with host for host network,
+// otherwise it has loopback only. Labels become annotations.
+func generateSpec(img *image, config contman.Config, bundle string, rootless bool) (*specs.Spec, error) {
+	entrypoint, args := config.Process()
+	if entrypoint == nil {
+		entrypoint = img.config.Config.Entrypoint
+		if args == nil {
+			args = img.config.Config.Cmd
+		}
+	}
+	argv := append(append([]string(nil), entrypoint...), args...)
+	if len(argv) == 0 {
+		return nil, errors.New("neither config nor image has a command")
+	}
+
+	userName := config.ProcessUser()
+	if userName == "" {
+		userName = img.config.Config.User
+	}
+	user, err := resolveUser(filepath.Join(bundle, "rootfs"), userName)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname := config.Hostname
+	if hostname == "" {
+		hostname = "contman"
+	}
+
+	env := append([]string(nil), img.config.Config.Env...)
+	env = append(env, formatEnv(config.Env)...)
+
+	cwd := config.WorkingDir
+	if cwd == "" {
+		cwd = img.config.Config.WorkingDir
+	}
+	if cwd == "" {
+		cwd = "/"
+	}
+
+	caps := append([]string(nil), defaultCapabilities...)
+	spec := &specs.Spec{
+		Version: specs.Version,
+		Root:    &specs.Root{Path: "rootfs"},
+		Process: &specs.Process{
+			Args: argv,
+			Env:  env,
+			Cwd:  cwd,
+			User: user,
+			Capabilities: &specs.LinuxCapabilities{
+				Bounding:  caps,
+				Effective: caps,
+				Permitted: caps,
+			},
+			NoNewPrivileges: true,
+		},
+		Hostname:    hostname,
+		Annotations: config.Labels,
+		Mounts:      append([]specs.Mount(nil), defaultMounts...),
+		Linux: &specs.Linux{
+			Namespaces: []specs.LinuxNamespace{
+				{Type: specs.PIDNamespace},
+				{Type: specs.IPCNamespace},
+				{Type: specs.UTSNamespace},
+				{Type: specs.MountNamespace},
+			},
+			MaskedPaths:   []string{"/proc/kcore", "/proc/keys", "/proc/timer_list", "/sys/firmware"},
+			ReadonlyPaths: []string{"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger"},
+		},
+	}
+
+	if config.Network != contman.NetworkHost {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.NetworkNamespace})
+	}
+
+	if err := runtimespec.SetSecurity(spec, config.Security); err != nil {
+		return nil, err
+	}
+
+	if rootless {
+		// Without privileges only a user namespace mapping current user to
+		// root is available, runtimes need root of the container mapped, so
+		// there is no id left for other users
+		if (user.UID != 0 || user.GID != 0) && !config.Security.RunAsHostUser {
+			return nil, fmt.Errorf("user %s is not supported by rootless oci manager, only root of the container is mapped to the current user", userName)
+		}
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.UserNamespace})
+		spec.Linux.UIDMappings = []specs.LinuxIDMapping{{ContainerID: 0, HostID: uint32(os.Geteuid()), Size: 1}}
+		spec.Linux.GIDMappings = []specs.LinuxIDMapping{{ContainerID: 0, HostID: uint32(os.Getegid()), Size: 1}}
+		spec.Process.User = specs.User{}
+	}
+
+	for _, m := range config.Mounts {
+		options := []string{"rbind", "rw"}
+		if m.ReadOnly {
+			options = []string{"rbind", "ro"}
+		}
+		mount := specs.Mount{
+			Destination: m.Target,
+			Type:        "bind",
+			Source:      m.Source,
+			Options:     options,
+		}
+		if m.Type == contman.MountTmpfs {
+			mount.Type, mount.Source = "tmpfs", "tmpfs"
+			mount.Options = []string{"nosuid", "nodev", options[1]}
+		}
+		spec.Mounts = append(spec.Mounts, mount)
+	}
+	runtimespec.SetResources(spec, config.Resources)
+
+	return spec, nil
+}
@@ -0,0 +1,94 @@
+package oci
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// resolveUser turns "user[:group]" of an image into IDs, names are looked up
+// in /etc/passwd and /etc/group of rootfs. Users which cannot be resolved are
+// errors, so the process never falls back to root.
+func resolveUser(rootfs, user string) (specs.User, error) {
+	if user == "" {
+		return specs.User{}, nil
+	}
+	parts := strings.SplitN(user, ":", 2)
+
+	// passwd entries are name:password:uid:gid:...
+	entry, err := lookupEntry(rootfs, "/etc/passwd", parts[0], 4)
+	if err != nil {
+		return specs.User{}, err
+	}
+	uid, err := parseID(parts[0], entry, 2)
+	if err != nil {
+		return specs.User{}, fmt.Errorf("user %s: %w", parts[0], err)
+	}
+	gid := uint32(0)
+	if entry != nil {
+		gid, _ = parseID("", entry, 3)
+	}
+
+	if len(parts) == 2 {
+		entry, err := lookupEntry(rootfs, "/etc/group", parts[1], 3)
+		if err != nil {
+			return specs.User{}, err
+		}
+		gid, err = parseID(parts[1], entry, 2)
+		if err != nil {
+			return specs.User{}, fmt.Errorf("group %s: %w", parts[1], err)
+		}
+	}
+	return specs.User{UID: uid, GID: gid}, nil
+}
+
+// parseID returns numeric name or field of its entry
+func parseID(name string, entry []string, field int) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	if entry == nil {
+		return 0, fmt.Errorf("not found in image")
+	}
+	id, err := strconv.ParseUint(entry[field], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", entry[field])
+	}
+	return uint32(id), nil
+}
+
+// lookupEntry finds entry of colon separated database file of rootfs by its
+// name or, for numeric names, by ID in the third field. Missing file means
+// no entries.
+func lookupEntry(rootfs, file, name string, fields int) ([]string, error) {
+	path := filepath.Join(rootfs, file)
+	// The file belongs to the image, a symlink could point out of rootfs
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return nil, fmt.Errorf("%s of image is a symlink", file)
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := strings.Split(scanner.Text(), ":")
+		if len(entry) < fields {
+			continue
+		}
+		if entry[0] == name || entry[2] == name {
+			return entry, nil
+		}
+	}
+	return nil, scanner.Err()
+}
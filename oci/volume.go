@@ -0,0 +1,63 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/volumes"
+)
+
+// volumes keeps volumes as directories under the manager root
+func (om *OCIManager) volumes() volumes.Store {
+	return volumes.Store{Dir: filepath.Join(om.root, "volumes")}
+}
+
+func (om *OCIManager) VolumeCreate(ctx context.Context, name string, labels map[string]string) (contman.Volume, error) {
+	v, err := om.volumes().Create(name, labels)
+	if err != nil {
+		log.WithError(err).WithField("volume", name).Error("Error creating volume")
+	}
+	return v, err
+}
+
+func (om *OCIManager) VolumeList(ctx context.Context, labels map[string]string) ([]contman.Volume, error) {
+	list, err := om.volumes().List(labels)
+	if err != nil {
+		log.WithError(err).Error("Error listing volumes")
+	}
+	return list, err
+}
+
+// VolumePrune keeps volumes mounted by bundles of existing containers
+func (om *OCIManager) VolumePrune(ctx context.Context, labels map[string]string) ([]string, error) {
+	bundles, err := filepath.Glob(filepath.Join(om.root, "bundles", "*", "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, config := range bundles {
+		var spec specs.Spec
+		data, err := ioutil.ReadFile(config)
+		if err != nil {
+			continue
+		}
+		if err := json.Unmarshal(data, &spec); err != nil {
+			continue
+		}
+		for _, m := range spec.Mounts {
+			used[m.Source] = true
+		}
+	}
+
+	removed, err := om.volumes().Prune(labels, used)
+	if err != nil {
+		log.WithError(err).Error("Error pruning volumes")
+	}
+	return removed, err
+}
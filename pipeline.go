@@ -0,0 +1,189 @@
+package contman
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Stage is a named receipt of a pipeline. Relative InputCopy sources and
+// OutputCopy destinations of the receipt are resolved against the pipeline
+// workspace, so outputs of a stage are visible to stages depending on it.
+type Stage struct {
+	Name      string
+	Receipt   Receipt
+	DependsOn []string
+}
+
+type Pipeline struct {
+	Stages []Stage
+	// Workspace is a host directory shared by all stages. When empty, a
+	// temporary directory is created and removed after the run.
+	Workspace string
+}
+
+// PipelineError maps names of failed stages to their errors. Stages which
+// were not run because of a failed dependency are included as well.
+type PipelineError map[string]error
+
+func (e PipelineError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("stage %s: %v", name, e[name])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type stageSkippedError struct {
+	dependency string
+}
+
+func (e *stageSkippedError) Error() string {
+	return fmt.Sprintf("skipped because dependency %s failed", e.dependency)
+}
+
+func ValidatePipeline(pipeline Pipeline) error {
+	stages := map[string]Stage{}
+	for _, stage := range pipeline.Stages {
+		if stage.Name == "" {
+			return fmt.Errorf("stage name cannot be empty")
+		}
+		if _, ok := stages[stage.Name]; ok {
+			return fmt.Errorf("duplicate stage %s", stage.Name)
+		}
+		stages[stage.Name] = stage
+	}
+
+	for _, stage := range pipeline.Stages {
+		for _, dep := range stage.DependsOn {
+			if _, ok := stages[dep]; !ok {
+				return fmt.Errorf("stage %s depends on unknown stage %s", stage.Name, dep)
+			}
+		}
+	}
+
+	// Depth-first search for cycles, 1 marks stages on the current path
+	// and 2 marks stages which are already checked
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, dep := range stages[name].DependsOn {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		return nil
+	}
+	for _, stage := range pipeline.Stages {
+		if err := visit(stage.Name, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func RunPipeline(cm Manager, pipeline Pipeline) (map[string]*ReceiptResult, error) {
+	return RunPipelineContext(context.Background(), cm, pipeline)
+}
+
+func RunPipelineContext(ctx context.Context, cm Manager, pipeline Pipeline) (map[string]*ReceiptResult, error) {
+	if err := ValidatePipeline(pipeline); err != nil {
+		return nil, err
+	}
+
+	workspace := pipeline.Workspace
+	if workspace == "" {
+		dir, err := ioutil.TempDir("", "contman-pipeline-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		workspace = dir
+	}
+
+	var mu sync.Mutex
+	errs := PipelineError{}
+	results := map[string]*ReceiptResult{}
+	done := map[string]chan struct{}{}
+	for _, stage := range pipeline.Stages {
+		done[stage.Name] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	for _, stage := range pipeline.Stages {
+		wg.Add(1)
+		go func(stage Stage) {
+			defer wg.Done()
+			defer close(done[stage.Name])
+
+			for _, dep := range stage.DependsOn {
+				<-done[dep]
+			}
+
+			if err := ctx.Err(); err != nil {
+				mu.Lock()
+				errs[stage.Name] = err
+				mu.Unlock()
+				return
+			}
+
+			mu.Lock()
+			for _, dep := range stage.DependsOn {
+				if _, failed := errs[dep]; failed {
+					errs[stage.Name] = &stageSkippedError{dependency: dep}
+					mu.Unlock()
+					return
+				}
+			}
+			mu.Unlock()
+
+			l := log.WithField("stage", stage.Name)
+			l.Info("Running stage")
+
+			receipt := stage.Receipt
+			receipt.HostDir = workspace
+			result, err := RunReceiptContext(ctx, cm, receipt)
+
+			mu.Lock()
+			results[stage.Name] = result
+			if err != nil {
+				errs[stage.Name] = err
+			}
+			mu.Unlock()
+
+			if err != nil {
+				l.WithError(err).Error("Stage failed")
+				return
+			}
+
+			l.Info("Stage finished")
+		}(stage)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
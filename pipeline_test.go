@@ -0,0 +1,223 @@
+package contman_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/contmantest"
+)
+
+func TestValidatePipeline(t *testing.T) {
+	tests := []struct {
+		stages []contman.Stage
+		err    string
+	}{
+		{
+			[]contman.Stage{{Name: "build"}, {Name: "test", DependsOn: []string{"build"}}},
+			"",
+		},
+		{
+			[]contman.Stage{{Name: "build"}, {Name: "build"}},
+			"duplicate stage build",
+		},
+		{
+			[]contman.Stage{{Name: "test", DependsOn: []string{"build"}}},
+			"unknown stage build",
+		},
+		{
+			[]contman.Stage{
+				{Name: "a", DependsOn: []string{"c"}},
+				{Name: "b", DependsOn: []string{"a"}},
+				{Name: "c", DependsOn: []string{"b"}},
+			},
+			"dependency cycle: a -> c -> b -> a",
+		},
+	}
+
+	for _, test := range tests {
+		err := contman.ValidatePipeline(contman.Pipeline{Stages: test.stages})
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("Unexpected error: %v", err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("Expected error %q, got %v", test.err, err)
+		}
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	cm := newTestManager()
+	cm.OnCmd("build", contmantest.Behavior{Files: map[string]string{"/out/app": "binary"}})
+	cm.OnCmd("package", contmantest.Behavior{Run: func(c *contmantest.Container) int {
+		if _, ok := c.ReadFile("/pkg/out/app"); !ok {
+			return 1
+		}
+		return 0
+	}})
+	cm.OnCmd("fail", contmantest.Behavior{ExitCode: 1})
+
+	results, err := contman.RunPipeline(cm, contman.Pipeline{
+		Stages: []contman.Stage{
+			{
+				Name:    "build",
+				Receipt: contman.Receipt{Image: "alpine:latest", Cmd: "build", OutputCopy: map[string]string{"/out": "."}},
+			},
+			{
+				Name:      "package",
+				Receipt:   contman.Receipt{Image: "alpine:latest", Cmd: "package", InputCopy: map[string]string{"out": "/pkg"}},
+				DependsOn: []string{"build"},
+			},
+			{
+				Name:    "lint",
+				Receipt: contman.Receipt{Image: "alpine:latest", Cmd: "fail"},
+			},
+			{
+				Name:      "release",
+				Receipt:   contman.Receipt{Image: "alpine:latest", Cmd: "release"},
+				DependsOn: []string{"package", "lint"},
+			},
+		},
+	})
+
+	errs, ok := err.(contman.PipelineError)
+	if !ok || len(errs) != 2 || errs["lint"] == nil || errs["release"] == nil {
+		t.Fatal("Expected lint and release to fail, got: ", err)
+	}
+	if results["package"] == nil || results["package"].ExitCode != 0 {
+		t.Errorf("Package stage did not receive build artifacts: %+v", results["package"])
+	}
+	if _, ran := results["release"]; ran {
+		t.Error("Release stage ran despite failed dependency")
+	}
+}
+
+func TestRunPipelineParallel(t *testing.T) {
+	cm := newTestManager()
+
+	// Independent stages wait for each other, so they pass only when run
+	// at the same time
+	var started sync.WaitGroup
+	started.Add(2)
+	meet := func(c *contmantest.Container) int {
+		started.Done()
+		done := make(chan struct{})
+		go func() {
+			started.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return 0
+		case <-time.After(5 * time.Second):
+			return 1
+		}
+	}
+	cm.OnCmd("lint", contmantest.Behavior{Run: meet})
+	cm.OnCmd("vet", contmantest.Behavior{Run: meet})
+
+	results, err := contman.RunPipeline(cm, contman.Pipeline{Stages: []contman.Stage{
+		{Name: "lint", Receipt: contman.Receipt{Image: "alpine:latest", Cmd: "lint"}},
+		{Name: "vet", Receipt: contman.Receipt{Image: "alpine:latest", Cmd: "vet"}},
+	}})
+	if err != nil {
+		t.Fatal("Stages were not run in parallel: ", err)
+	}
+	if len(results) != 2 {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+}
+
+func TestRunPipelineWorkspace(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	cm := newTestManager()
+	cm.OnCmd("build", contmantest.Behavior{
+		Duration: 50 * time.Millisecond,
+		Files:    map[string]string{"/out/app": "binary"},
+	})
+	cm.OnCmd("test", contmantest.Behavior{Run: func(c *contmantest.Container) int {
+		if data, ok := c.ReadFile("/in/out/app"); !ok || string(data) != "binary" {
+			return 1
+		}
+		return 0
+	}})
+
+	_, err := contman.RunPipeline(cm, contman.Pipeline{
+		Workspace: dir,
+		Stages: []contman.Stage{
+			{
+				Name:      "test",
+				Receipt:   contman.Receipt{Image: "alpine:latest", Cmd: "test", InputCopy: map[string]string{"out": "/in"}},
+				DependsOn: []string{"build"},
+			},
+			{Name: "build", Receipt: contman.Receipt{Image: "alpine:latest", Cmd: "build", OutputCopy: map[string]string{"/out": "."}}},
+		},
+	})
+	if err != nil {
+		t.Fatal("Cannot run pipeline: ", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "out", "app")); err != nil || string(data) != "binary" {
+		t.Errorf("Output is not kept in workspace: %q, %v", data, err)
+	}
+}
+
+func TestRunPipelineFailure(t *testing.T) {
+	cm := newTestManager()
+	cm.OnCmd("build", contmantest.Behavior{ExitCode: 2})
+
+	results, err := contman.RunPipeline(cm, contman.Pipeline{Stages: []contman.Stage{
+		{Name: "build", Receipt: contman.Receipt{Image: "alpine:latest", Cmd: "build"}},
+		{Name: "test", Receipt: contman.Receipt{Image: "alpine:latest", Cmd: "test"}, DependsOn: []string{"build"}},
+		{Name: "deploy", Receipt: contman.Receipt{Image: "alpine:latest", Cmd: "deploy"}, DependsOn: []string{"test"}},
+		{Name: "lint", Receipt: contman.Receipt{Image: "alpine:latest", Cmd: "lint"}},
+	}})
+	errs, ok := err.(contman.PipelineError)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("Expected errors of build and its dependents, got: %v", err)
+	}
+	var exitErr *contman.ExitError
+	if !errors.As(errs["build"], &exitErr) || exitErr.Code != 2 {
+		t.Errorf("Unexpected error of build: %v", errs["build"])
+	}
+	if !strings.Contains(errs["test"].Error(), "dependency build failed") || !strings.Contains(errs["deploy"].Error(), "dependency test failed") {
+		t.Errorf("Dependents are not skipped: %v", errs)
+	}
+	if results["lint"] == nil || results["test"] != nil {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+	for _, c := range cm.Containers() {
+		if c.Config.Cmd == "test" || c.Config.Cmd == "deploy" {
+			t.Errorf("Skipped stage was run: %s", c.Config.Cmd)
+		}
+	}
+}
+
+func TestRunPipelineCancel(t *testing.T) {
+	cm := newTestManager()
+	cm.OnCmd("build", contmantest.Behavior{Duration: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := contman.RunPipelineContext(ctx, cm, contman.Pipeline{Stages: []contman.Stage{
+		{Name: "build", Receipt: contman.Receipt{Image: "alpine:latest", Cmd: "build"}},
+		{Name: "test", Receipt: contman.Receipt{Image: "alpine:latest", Cmd: "test"}, DependsOn: []string{"build"}},
+	}})
+	errs, ok := err.(contman.PipelineError)
+	if !ok || !errors.Is(errs["test"], context.DeadlineExceeded) {
+		t.Fatalf("Expected cancelled pipeline, got: %v", err)
+	}
+	if timeoutErr, ok := errs["build"].(*contman.TimeoutError); !ok || timeoutErr.Phase != contman.PhaseRun {
+		t.Fatalf("Expected cancelled pipeline, got: %v", err)
+	}
+	if containers := cm.Containers(); len(containers) != 1 {
+		t.Errorf("Stage was run after cancellation: %d containers", len(containers))
+	}
+}
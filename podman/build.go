@@ -0,0 +1,84 @@
+package podman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/buildcontext"
+	"github.com/elemir/contman/internal/jsonstream"
+)
+
+// imageID matches the last line of libpod build stream, which is ID of the
+// built image, compat API reports it in aux message instead
+var imageID = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func (pm *PodmanManager) BuildImage(ctx context.Context, spec contman.BuildSpec) (string, error) {
+	if spec.Dockerfile == "" {
+		spec.Dockerfile = "Dockerfile"
+	}
+	if spec.Ignore == "" {
+		spec.Ignore = ".dockerignore"
+	}
+	args, err := json.Marshal(spec.Args)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"dockerfile": {spec.Dockerfile},
+		"t":          spec.Tags,
+		"buildargs":  {string(args)},
+		"rm":         {"true"},
+	}
+	if spec.Target != "" {
+		query.Set("target", spec.Target)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(buildcontext.Create(spec.Context, spec.Dockerfile, spec.Ignore, writer))
+	}()
+	defer reader.Close()
+
+	resp, err := pm.client.do(ctx, "POST", "/build", query, reader)
+	if err != nil {
+		log.WithError(err).Error("Error building image")
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	id := ""
+	err = jsonstream.Decode(resp.Body, func(msg jsonstream.Message) {
+		event := contman.BuildEvent{Stream: msg.Stream, Status: msg.Status, ID: msg.ID}
+		var result struct{ ID string }
+		switch line := strings.TrimSpace(msg.Stream); {
+		case len(msg.Aux) > 0 && json.Unmarshal(msg.Aux, &result) == nil && result.ID != "":
+			event.ImageID = result.ID
+		case imageID.MatchString(line):
+			event.ImageID = "sha256:" + line
+		}
+		if event.ImageID != "" {
+			id = event.ImageID
+		}
+		if spec.Events != nil {
+			spec.Events(event)
+		} else if line := strings.TrimSpace(msg.Stream); line != "" {
+			log.WithField("context", spec.Context).Debug(line)
+		}
+	})
+	if err != nil {
+		log.WithError(err).Error("Error building image")
+		return "", err
+	}
+	if id == "" {
+		return "", errors.New("builder reported no image ID")
+	}
+	return id, nil
+}
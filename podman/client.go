@@ -0,0 +1,142 @@
+package podman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// APIVersion is the libpod REST API version used by the client
+const APIVersion = "v4.0.0"
+
+// APIError is an error response of the libpod API
+type APIError struct {
+	StatusCode int    `json:"response"`
+	Cause      string `json:"cause"`
+	Message    string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("podman: %s (status %d)", e.Message, e.StatusCode)
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+func isConflict(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusConflict
+}
+
+// SocketPath discovers the Podman API socket: CONTAINER_HOST is used when it
+// points to a unix socket, otherwise the rootless socket of current user or
+// the system one for root.
+func SocketPath() string {
+	if host := os.Getenv("CONTAINER_HOST"); strings.HasPrefix(host, "unix://") {
+		return strings.TrimPrefix(host, "unix://")
+	}
+
+	if os.Geteuid() == 0 {
+		return "/run/podman/podman.sock"
+	}
+
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/run/user/%d", os.Geteuid())
+	}
+	return filepath.Join(runtimeDir, "podman", "podman.sock")
+}
+
+type apiClient struct {
+	http *http.Client
+}
+
+func newAPIClient(socket string) *apiClient {
+	return &apiClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// do sends request to libpod API, body is encoded as JSON unless it is an
+// io.Reader. Responses with error status are converted into APIError.
+func (c *apiClient) do(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	return c.doHeader(ctx, method, path, query, nil, body)
+}
+
+// doHeader sends request like do with additional headers
+func (c *apiClient) doHeader(ctx context.Context, method, path string, query url.Values, header http.Header, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+		contentType = "application/x-tar"
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	u := url.URL{Scheme: "http", Host: "d", Path: "/" + APIVersion + "/libpod" + path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	apiErr := &APIError{}
+	if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	apiErr.StatusCode = resp.StatusCode
+	return nil, apiErr
+}
+
+// call sends request and decodes JSON response into out, if it is not nil
+func (c *apiClient) call(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	resp, err := c.do(ctx, method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,334 @@
+package podman
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/archive"
+	"github.com/elemir/contman/internal/cgroups"
+	"github.com/elemir/contman/internal/references"
+)
+
+// killedExitCode is exit code of processes killed by SIGKILL
+const killedExitCode = 128 + 9
+
+type PodmanContainer struct {
+	id      string
+	manager *PodmanManager
+	hostDir string
+	// secretsDir keeps secret files mounted into the container
+	secretsDir string
+}
+
+type containerInspect struct {
+	ID        string `json:"Id"`
+	Image     string `json:"Image"`
+	ImageName string `json:"ImageName"`
+	State     struct {
+		Status    string `json:"Status"`
+		Running   bool   `json:"Running"`
+		ExitCode  int    `json:"ExitCode"`
+		OOMKilled bool   `json:"OOMKilled"`
+	} `json:"State"`
+}
+
+type imageInspect struct {
+	ID          string   `json:"Id"`
+	Digest      string   `json:"Digest"`
+	RepoDigests []string `json:"RepoDigests"`
+}
+
+type execInspect struct {
+	Running  bool `json:"Running"`
+	ExitCode int  `json:"ExitCode"`
+}
+
+func (pc *PodmanContainer) ID() string {
+	return pc.id
+}
+
+func (pc *PodmanContainer) inspect(ctx context.Context) (*containerInspect, error) {
+	var descr containerInspect
+	err := pc.manager.client.call(ctx, "GET", "/containers/"+pc.id+"/json", nil, nil, &descr)
+	return &descr, err
+}
+
+func (pc *PodmanContainer) ImageDigest(ctx context.Context) (string, error) {
+	descr, err := pc.inspect(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var image imageInspect
+	if err := pc.manager.client.call(ctx, "GET", "/images/"+descr.Image+"/json", nil, nil, &image); err != nil {
+		return "", err
+	}
+	// Image may have digests of other repositories it was pulled from
+	if named, err := reference.ParseNormalizedNamed(descr.ImageName); err == nil {
+		if canonical := references.RepoDigest(image.RepoDigests, named); canonical != nil {
+			return reference.FamiliarString(canonical), nil
+		}
+	}
+	return image.ID, nil
+}
+
+func (pc *PodmanContainer) Start(ctx context.Context) error {
+	err := pc.manager.client.call(ctx, "POST", "/containers/"+pc.id+"/start", nil, nil, nil)
+	if err != nil {
+		pc.GetLogger().WithError(err).Error("Error starting container")
+	}
+	return err
+}
+
+func (pc *PodmanContainer) Stop(ctx context.Context, timeout time.Duration) error {
+	query := url.Values{"timeout": {strconv.Itoa(int(timeout.Seconds()))}}
+	err := pc.manager.client.call(ctx, "POST", "/containers/"+pc.id+"/stop", query, nil, nil)
+	if err != nil {
+		pc.GetLogger().WithError(err).Error("Error stopping container")
+	}
+	return err
+}
+
+func (pc *PodmanContainer) Kill(ctx context.Context) error {
+	query := url.Values{"signal": {"KILL"}}
+	err := pc.manager.client.call(ctx, "POST", "/containers/"+pc.id+"/kill", query, nil, nil)
+	if err != nil {
+		pc.GetLogger().WithError(err).Error("Error killing container")
+	}
+	return err
+}
+
+func (pc *PodmanContainer) Remove(ctx context.Context) error {
+	err := pc.manager.client.call(ctx, "DELETE", "/containers/"+pc.id, nil, nil, nil)
+	if err != nil {
+		pc.GetLogger().WithError(err).Errorf("Error removing container")
+		return err
+	}
+	if pc.secretsDir != "" {
+		err = os.RemoveAll(pc.secretsDir)
+	}
+	return err
+}
+
+func (pc *PodmanContainer) IsRunning(ctx context.Context) (bool, error) {
+	descr, err := pc.inspect(ctx)
+	if err != nil {
+		pc.GetLogger().WithError(err).Errorf("Error checking container running status")
+		return false, err
+	}
+	return descr.State.Running, nil
+}
+
+func (pc *PodmanContainer) Wait(ctx context.Context, stdout, stderr io.Writer) (int, error) {
+	var logsDone chan struct{}
+	if stdout != nil || stderr != nil {
+		query := url.Values{"follow": {"true"}, "stdout": {"true"}, "stderr": {"true"}}
+		resp, err := pc.manager.client.do(ctx, "GET", "/containers/"+pc.id+"/logs", query, nil)
+		if err != nil {
+			pc.GetLogger().WithError(err).Error("Error getting container logs")
+			return 0, err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		logsDone = make(chan struct{})
+		go func() {
+			defer close(logsDone)
+			_, _ = stdcopy.StdCopy(orDiscard(stdout), orDiscard(stderr), resp.Body)
+		}()
+	}
+
+	// libpod replies with a bare exit code once condition is met
+	var exitCode int
+	query := url.Values{"condition": {"stopped"}}
+	if err := pc.manager.client.call(ctx, "POST", "/containers/"+pc.id+"/wait", query, nil, &exitCode); err != nil {
+		pc.GetLogger().WithError(err).Error("Error waiting container")
+		return 0, err
+	}
+
+	// Log stream ends together with container, wait for its tail
+	if logsDone != nil {
+		select {
+		case <-logsDone:
+		case <-ctx.Done():
+		}
+	}
+
+	if exitCode != 0 {
+		descr, err := pc.inspect(ctx)
+		if err != nil {
+			pc.GetLogger().WithError(err).Warn("Cannot check whether container was killed by OOM killer")
+		} else if descr.State.OOMKilled {
+			return exitCode, &contman.ExitError{ContainerID: pc.id, Code: exitCode, OOMKilled: true}
+		}
+	}
+
+	return exitCode, nil
+}
+
+// Exec tells an OOM kill of the command apart by OOM kill counter of the
+// container cgroup read before and after it, podman marks only containers
+// killed by OOM killer
+func (pc *PodmanContainer) Exec(ctx context.Context, config contman.ExecConfig) (int, error) {
+	before, err := pc.oomKills(ctx)
+	if err != nil {
+		pc.GetLogger().WithError(err).Warn("Cannot read OOM events")
+	}
+	exitCode, execErr := pc.exec(ctx, config)
+	if execErr != nil || exitCode != killedExitCode || err != nil {
+		return exitCode, execErr
+	}
+	after, err := pc.oomKills(ctx)
+	if err != nil {
+		pc.GetLogger().WithError(err).Warn("Cannot read OOM events")
+	} else if after > before {
+		return exitCode, &contman.ExitError{ContainerID: pc.id, Code: exitCode, OOMKilled: true}
+	}
+	return exitCode, nil
+}
+
+// exec runs command in the container returning its exit code
+func (pc *PodmanContainer) exec(ctx context.Context, config contman.ExecConfig) (int, error) {
+	l := pc.GetLogger().WithField("cmd", config.Cmd)
+
+	var resp idResponse
+	err := pc.manager.client.call(ctx, "POST", "/containers/"+pc.id+"/exec", nil, map[string]interface{}{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Env":          formatEnv(config.Env),
+		"WorkingDir":   config.WorkingDir,
+		"Cmd":          []string{"sh", "-c", config.Cmd},
+	}, &resp)
+	if err != nil {
+		l.WithError(err).Error("Error creating exec")
+		return 0, err
+	}
+
+	start, err := pc.manager.client.do(ctx, "POST", "/exec/"+resp.ID+"/start", nil, map[string]bool{
+		"Detach": false,
+		"Tty":    false,
+	})
+	if err != nil {
+		l.WithError(err).Error("Error starting exec")
+		return 0, err
+	}
+	defer func() { _ = start.Body.Close() }()
+
+	if _, err := stdcopy.StdCopy(orDiscard(config.Stdout), orDiscard(config.Stderr), start.Body); err != nil {
+		l.WithError(err).Error("Error reading exec output")
+		return 0, err
+	}
+
+	// Output stream may end before exit code is recorded, so poll for it
+	for {
+		var inspect execInspect
+		if err := pc.manager.client.call(ctx, "GET", "/exec/"+resp.ID+"/json", nil, nil, &inspect); err != nil {
+			l.WithError(err).Error("Error inspecting exec")
+			return 0, err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// oomKills returns number of processes of the running container killed by
+// OOM killer
+func (pc *PodmanContainer) oomKills(ctx context.Context) (int, error) {
+	var out bytes.Buffer
+	if _, err := pc.exec(ctx, contman.ExecConfig{Cmd: cgroups.EventsScript, Stdout: &out}); err != nil {
+		return 0, err
+	}
+	return cgroups.OOMKills(out.Bytes()), nil
+}
+
+func (pc *PodmanContainer) CopyFrom(ctx context.Context, src, dest string) error {
+	l := pc.GetLogger().WithFields(log.Fields{
+		"src":  src,
+		"dest": dest,
+	})
+	resp, err := pc.manager.client.do(ctx, "GET", "/containers/"+pc.id+"/archive", url.Values{"path": {src}}, nil)
+	if isNotFound(err) {
+		return fmt.Errorf("%w: %w", contman.ErrNotFound, err)
+	}
+	if err != nil {
+		l.WithError(err).Error("Error copying from container")
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if err := archive.ExtractTarFromReader(resp.Body, pc.hostPath(dest)); err != nil {
+		l.WithError(err).Error("Error extracting from container")
+		return err
+	}
+
+	return nil
+}
+
+func (pc *PodmanContainer) CopyTo(ctx context.Context, src, dest string) error {
+	l := pc.GetLogger().WithFields(log.Fields{
+		"src":  src,
+		"dest": dest,
+	})
+	reader, writer := io.Pipe()
+	defer reader.Close()
+
+	go func() {
+		err := archive.CreateTarToWriter(pc.hostPath(src), src, writer)
+		if err != nil {
+			l.WithError(err).Error("Failed to create tar archive")
+		}
+		_ = writer.CloseWithError(err)
+	}()
+
+	err := pc.manager.client.call(ctx, "PUT", "/containers/"+pc.id+"/archive", url.Values{"path": {dest}}, reader, nil)
+	if err != nil {
+		l.WithError(err).Error("Error copying to container")
+		return err
+	}
+
+	return nil
+}
+
+func (pc *PodmanContainer) GetLogger() *log.Entry {
+	return log.WithField("containerID", pc.id)
+}
+
+func (pc *PodmanContainer) hostPath(path string) string {
+	if pc.hostDir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(pc.hostDir, path)
+}
+
+func orDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return ioutil.Discard
+	}
+	return w
+}
+
+func formatEnv(vars map[string]string) []string {
+	env := make([]string, 0, len(vars))
+	for key, value := range vars {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	return env
+}
@@ -0,0 +1,147 @@
+package podman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/docker/distribution/reference"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/jsonstream"
+)
+
+// imageSummary is an image of libpod image list
+type imageSummary struct {
+	ID          string            `json:"Id"`
+	RepoTags    []string          `json:"RepoTags"`
+	RepoDigests []string          `json:"RepoDigests"`
+	Labels      map[string]string `json:"Labels"`
+	Size        int64             `json:"Size"`
+	Created     int64             `json:"Created"`
+}
+
+type removeReport struct {
+	Deleted  []string `json:"Deleted"`
+	Untagged []string `json:"Untagged"`
+	Errors   []string `json:"Errors"`
+}
+
+// PushImage pushes image with credentials of Auth, or ones of the podman
+// service user if Auth has none, and logs push progress at debug level
+func (pm *PodmanManager) PushImage(ctx context.Context, image string) error {
+	header, err := pm.registryAuth(ctx, image)
+	if err != nil {
+		return err
+	}
+	resp, err := pm.client.doHeader(ctx, "POST", "/images/"+image+"/push", nil, header, nil)
+	if err != nil {
+		log.WithError(err).Error("Error pushing image")
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// Push errors are reported inside the stream after 200 status
+	logger := log.WithField("image", image)
+	err = jsonstream.Decode(resp.Body, func(msg jsonstream.Message) {
+		if status := strings.TrimSpace(msg.Stream); status != "" {
+			logger.Debug(status)
+		}
+	})
+	if err != nil {
+		log.WithError(err).Error("Error pushing image")
+	}
+	return err
+}
+
+func (pm *PodmanManager) TagImage(ctx context.Context, source, target string) error {
+	named, err := reference.ParseNormalizedNamed(target)
+	if err != nil {
+		return err
+	}
+	named = reference.TagNameOnly(named)
+	query := url.Values{"repo": {named.Name()}, "tag": {named.(reference.Tagged).Tag()}}
+
+	err = pm.client.call(ctx, "POST", "/images/"+source+"/tag", query, nil, nil)
+	if isNotFound(err) {
+		return fmt.Errorf("image %s: %w", source, contman.ErrNotFound)
+	}
+	if err != nil {
+		log.WithError(err).Error("Error tagging image")
+	}
+	return err
+}
+
+func (pm *PodmanManager) RemoveImage(ctx context.Context, image string, force bool) error {
+	var report removeReport
+	err := pm.client.call(ctx, "DELETE", "/images/"+image, url.Values{"force": {fmt.Sprint(force)}}, nil, &report)
+	if isNotFound(err) {
+		return fmt.Errorf("image %s: %w", image, contman.ErrNotFound)
+	}
+	if err == nil && len(report.Errors) > 0 {
+		err = errors.New(report.Errors[0])
+	}
+	if err != nil {
+		log.WithError(err).Error("Error removing image")
+	}
+	return err
+}
+
+func (pm *PodmanManager) ListImages(ctx context.Context, filter contman.ImageFilter) ([]contman.Image, error) {
+	filters := filterLabels(filter.Labels)
+	if filter.Reference != "" {
+		filters["reference"] = []string{filter.Reference}
+	}
+	if filter.Dangling {
+		filters["dangling"] = []string{"true"}
+	}
+
+	var list []imageSummary
+	if err := pm.client.call(ctx, "GET", "/images/json", filtersQuery(filters), nil, &list); err != nil {
+		log.WithError(err).Error("Error listing images")
+		return nil, err
+	}
+
+	images := make([]contman.Image, 0, len(list))
+	for _, s := range list {
+		images = append(images, contman.Image{
+			ID:      "sha256:" + s.ID,
+			Tags:    s.RepoTags,
+			Digests: s.RepoDigests,
+			Labels:  s.Labels,
+			Size:    s.Size,
+			Created: time.Unix(s.Created, 0),
+		})
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images, nil
+}
+
+func (pm *PodmanManager) PruneImages(ctx context.Context, filter contman.ImageFilter) ([]string, error) {
+	if filter.Reference != "" {
+		return nil, errors.New("images cannot be pruned by reference")
+	}
+	query := filtersQuery(filterLabels(filter.Labels))
+	query.Set("all", fmt.Sprint(!filter.Dangling))
+
+	var reports []pruneReport
+	if err := pm.client.call(ctx, "POST", "/images/prune", query, nil, &reports); err != nil {
+		log.WithError(err).Error("Error pruning images")
+		return nil, err
+	}
+
+	pruned := []string{}
+	for _, report := range reports {
+		if report.Err != "" {
+			return pruned, fmt.Errorf("prune image %s: %s", report.ID, report.Err)
+		}
+		pruned = append(pruned, "sha256:"+report.ID)
+	}
+	return pruned, nil
+}
@@ -0,0 +1,401 @@
+// Package podman implements contman.Manager on top of Podman libpod REST
+// API, which is served by "podman system service".
+package podman
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/docker/distribution/reference"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/secrets"
+)
+
+type PodmanManager struct {
+	client *apiClient
+	socket string
+
+	// UserNS is user namespace mode of created containers, it is
+	// "keep-id" for rootless Podman, so files copied from containers are
+	// owned by current user.
+	UserNS string
+	// Auth provides registry credentials for pulls and pushes, credentials
+	// of the podman service user are used for registries it has none for
+	Auth contman.AuthProvider
+}
+
+func NewPodmanManagerWithSocket(ctx context.Context, socket string) (*PodmanManager, error) {
+	pm := &PodmanManager{
+		client: newAPIClient(socket),
+		socket: socket,
+	}
+	if os.Geteuid() != 0 {
+		pm.UserNS = "keep-id"
+	}
+
+	if err := pm.client.call(ctx, "GET", "/_ping", nil, nil, nil); err != nil {
+		log.WithError(err).WithField("socket", socket).Error("Cannot connect to podman")
+		return nil, err
+	}
+
+	return pm, nil
+}
+
+func NewPodmanManagerWithContext(ctx context.Context) (*PodmanManager, error) {
+	return NewPodmanManagerWithSocket(ctx, SocketPath())
+}
+
+func NewPodmanManager() (*PodmanManager, error) {
+	return NewPodmanManagerWithContext(context.Background())
+}
+
+// pullReport is a line of libpod image pull stream
+type pullReport struct {
+	Stream string   `json:"stream"`
+	Error  string   `json:"error"`
+	Images []string `json:"images"`
+	ID     string   `json:"id"`
+}
+
+// PullImage logs pull progress at debug level
+func (pm *PodmanManager) PullImage(ctx context.Context, image string) error {
+	return pm.PullImageProgress(ctx, image, func(e contman.PullEvent) {
+		log.WithField("image", image).Debug(e.Status)
+	})
+}
+
+// PullImageProgress reports lines of libpod pull output as events, libpod
+// does not report progress of layers
+func (pm *PodmanManager) PullImageProgress(ctx context.Context, image string, progress func(contman.PullEvent)) error {
+	header, err := pm.registryAuth(ctx, image)
+	if err != nil {
+		return err
+	}
+	resp, err := pm.client.doHeader(ctx, "POST", "/images/pull", url.Values{"reference": {image}}, header, nil)
+	if err != nil {
+		log.WithError(err).Error("Error pulling image")
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// Pull errors are reported inside the stream after 200 status
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var report pullReport
+		err := dec.Decode(&report)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.WithError(err).Error("Error reading pull progress")
+			return err
+		}
+		if report.Error != "" {
+			err := errors.New(report.Error)
+			log.WithError(err).Error("Error pulling image")
+			return err
+		}
+		if status := strings.TrimSpace(report.Stream); status != "" {
+			progress(contman.PullEvent{Status: status})
+		}
+	}
+}
+
+func (pm *PodmanManager) HasImage(ctx context.Context, image string) (bool, error) {
+	if image == "" {
+		return false, nil
+	}
+
+	err := pm.client.call(ctx, "GET", "/images/"+image+"/exists", nil, nil, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		log.WithError(err).Error("Unable to check image existence")
+		return false, err
+	}
+	return true, nil
+}
+
+// mount is a mount of libpod SpecGenerator
+type mount struct {
+	Destination string   `json:"destination"`
+	Source      string   `json:"source"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// namedVolume is a volume mount of libpod SpecGenerator
+type namedVolume struct {
+	Name    string   `json:"Name"`
+	Dest    string   `json:"Dest"`
+	Options []string `json:"Options,omitempty"`
+}
+
+type namespace struct {
+	NSMode string `json:"nsmode"`
+	Value  string `json:"value,omitempty"`
+}
+
+type portMapping struct {
+	HostIP        string `json:"host_ip,omitempty"`
+	ContainerPort int    `json:"container_port"`
+	HostPort      int    `json:"host_port,omitempty"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+// resources is a subset of runtime spec LinuxResources
+type resources struct {
+	CPU    *cpuResources    `json:"cpu,omitempty"`
+	Memory *memoryResources `json:"memory,omitempty"`
+	Pids   *pidsResources   `json:"pids,omitempty"`
+}
+
+type cpuResources struct {
+	Shares uint64 `json:"shares,omitempty"`
+	Quota  int64  `json:"quota,omitempty"`
+	Period uint64 `json:"period,omitempty"`
+}
+
+type memoryResources struct {
+	Limit int64 `json:"limit,omitempty"`
+	Swap  int64 `json:"swap,omitempty"`
+}
+
+type pidsResources struct {
+	Limit int64 `json:"limit"`
+}
+
+type rlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+// spec is a subset of libpod SpecGenerator used to create containers
+type spec struct {
+	Image      string              `json:"image"`
+	Entrypoint []string            `json:"entrypoint,omitempty"`
+	Command    []string            `json:"command,omitempty"`
+	User       string              `json:"user,omitempty"`
+	Labels     map[string]string   `json:"labels,omitempty"`
+	Hostname   string              `json:"hostname,omitempty"`
+	Env        map[string]string   `json:"env,omitempty"`
+	WorkDir    string              `json:"work_dir,omitempty"`
+	Mounts     []mount             `json:"mounts,omitempty"`
+	Volumes    []namedVolume       `json:"volumes,omitempty"`
+	NetNS      *namespace          `json:"netns,omitempty"`
+	Networks   map[string]struct{} `json:"Networks,omitempty"`
+	Ports      []portMapping       `json:"portmappings,omitempty"`
+	HostAdd    []string            `json:"hostadd,omitempty"`
+	DNS        []string            `json:"dns_server,omitempty"`
+	UserNS     *namespace          `json:"userns,omitempty"`
+	Resources  *resources          `json:"resource_limits,omitempty"`
+	Rlimits    []rlimit            `json:"r_limits,omitempty"`
+	ShmSize    int64               `json:"shm_size,omitempty"`
+
+	ReadOnly        bool     `json:"read_only_filesystem,omitempty"`
+	CapAdd          []string `json:"cap_add,omitempty"`
+	CapDrop         []string `json:"cap_drop,omitempty"`
+	NoNewPrivileges bool     `json:"no_new_privileges,omitempty"`
+	SeccompProfile  string   `json:"seccomp_profile_path,omitempty"`
+	AppArmorProfile string   `json:"apparmor_profile,omitempty"`
+}
+
+type idResponse struct {
+	ID string `json:"Id"`
+}
+
+// ContainerCreate bind mounts secrets from files on the host, the socket
+// of podman is always local
+func (pm *PodmanManager) ContainerCreate(ctx context.Context, config contman.Config) (contman.Container, error) {
+	secretsDir, secretMounts, err := secrets.Mounts(config.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	config.Mounts = append(append([]contman.Mount(nil), config.Mounts...), secretMounts...)
+
+	var mounts []mount
+	var volumes []namedVolume
+	for _, m := range config.Mounts {
+		var options []string
+		if m.ReadOnly {
+			options = []string{"ro"}
+		}
+		switch m.Type {
+		case "", contman.MountBind:
+			mounts = append(mounts, mount{Destination: m.Target, Source: m.Source, Type: "bind", Options: options})
+		case contman.MountTmpfs:
+			mounts = append(mounts, mount{Destination: m.Target, Source: "tmpfs", Type: "tmpfs", Options: options})
+		case contman.MountVolume:
+			volumes = append(volumes, namedVolume{Name: m.Source, Dest: m.Target, Options: options})
+		default:
+			os.RemoveAll(secretsDir)
+			return nil, fmt.Errorf("unknown type %s of mount %s", m.Type, m.Target)
+		}
+	}
+
+	entrypoint, args := config.Process()
+	s := spec{
+		Image:      config.Image,
+		Entrypoint: entrypoint,
+		Command:    args,
+		User:       config.ProcessUser(),
+		Labels:     config.Labels,
+		Hostname:   config.Hostname,
+		Env:        config.Env,
+		WorkDir:    config.WorkingDir,
+		Mounts:     mounts,
+		Volumes:    volumes,
+		HostAdd:    config.ExtraHosts,
+		DNS:        config.DNS,
+	}
+	switch {
+	case config.Network == "":
+	case config.Network == contman.NetworkNone || config.Network == contman.NetworkBridge || config.Network == contman.NetworkHost:
+		s.NetNS = &namespace{NSMode: config.Network}
+	case strings.HasPrefix(config.Network, "container:"):
+		s.NetNS = &namespace{NSMode: "container", Value: strings.TrimPrefix(config.Network, "container:")}
+	default:
+		s.NetNS = &namespace{NSMode: contman.NetworkBridge}
+		s.Networks = map[string]struct{}{config.Network: {}}
+	}
+	for _, p := range config.Ports {
+		s.Ports = append(s.Ports, portMapping{
+			HostIP:        p.HostIP,
+			ContainerPort: p.ContainerPort,
+			HostPort:      p.HostPort,
+			Protocol:      p.Protocol,
+		})
+	}
+	if pm.UserNS != "" {
+		s.UserNS = &namespace{NSMode: pm.UserNS}
+	}
+	if config.Security.UsernsMode != "" {
+		s.UserNS = &namespace{NSMode: config.Security.UsernsMode}
+	}
+	s.ReadOnly = config.Security.ReadOnlyRootfs
+	s.CapAdd = config.Security.CapAdd
+	s.CapDrop = config.Security.CapDrop
+	s.NoNewPrivileges = config.Security.NoNewPrivileges
+	s.SeccompProfile = config.Security.SeccompProfile
+	s.AppArmorProfile = config.Security.AppArmorProfile
+	setResources(&s, config.Resources)
+
+	var resp idResponse
+	if err := pm.client.call(ctx, "POST", "/containers/create", nil, s, &resp); err != nil {
+		log.WithError(err).Error("Error creating container")
+		os.RemoveAll(secretsDir)
+		return nil, err
+	}
+
+	return &PodmanContainer{
+		manager:    pm,
+		id:         resp.ID,
+		hostDir:    config.HostDir,
+		secretsDir: secretsDir,
+	}, nil
+}
+
+func setResources(s *spec, r contman.Resources) {
+	limits := &resources{}
+	if r.CPUQuota != 0 || r.CPUPeriod != 0 || r.CPUShares != 0 {
+		limits.CPU = &cpuResources{Shares: uint64(r.CPUShares), Quota: r.CPUQuota, Period: uint64(r.CPUPeriod)}
+	}
+	if r.Memory != 0 || r.MemorySwap != 0 {
+		limits.Memory = &memoryResources{Limit: r.Memory, Swap: r.MemorySwap}
+	}
+	if r.PidsLimit != 0 {
+		limits.Pids = &pidsResources{Limit: r.PidsLimit}
+	}
+	if *limits != (resources{}) {
+		s.Resources = limits
+	}
+
+	for _, u := range r.Ulimits {
+		s.Rlimits = append(s.Rlimits, rlimit{Type: "RLIMIT_" + strings.ToUpper(u.Name), Hard: uint64(u.Hard), Soft: uint64(u.Soft)})
+	}
+	s.ShmSize = r.ShmSize
+	for target, options := range r.Tmpfs {
+		m := mount{Destination: target, Source: "tmpfs", Type: "tmpfs"}
+		if options != "" {
+			m.Options = strings.Split(options, ",")
+		}
+		s.Mounts = append(s.Mounts, m)
+	}
+}
+
+func (pm *PodmanManager) GetSystemMounts() []contman.Mount {
+	mounts := []contman.Mount{
+		{
+			Source: pm.socket,
+			Target: "/run/podman/podman.sock",
+		},
+	}
+
+	authFile := filepath.Join(filepath.Dir(filepath.Dir(pm.socket)), "containers", "auth.json")
+	if _, err := os.Stat(authFile); err == nil {
+		mounts = append(mounts, contman.Mount{
+			Source:   authFile,
+			Target:   "/run/containers/0/auth.json",
+			ReadOnly: true,
+		})
+	}
+
+	return mounts
+}
+
+// authConfig is registry credentials encoded into X-Registry-Auth header
+type authConfig struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+}
+
+// registryAuth returns X-Registry-Auth header with credentials of Auth for
+// registry of image, no header is returned if Auth has no credentials
+func (pm *PodmanManager) registryAuth(ctx context.Context, image string) (http.Header, error) {
+	if pm.Auth == nil {
+		return nil, nil
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		log.WithError(err).Error("Cannot parse image name")
+		return nil, err
+	}
+	registry := reference.Domain(named)
+	auth, err := pm.Auth.GetAuth(ctx, registry)
+	if err != nil {
+		log.WithError(err).Error("Error getting registry credentials")
+		return nil, err
+	}
+	if auth == (contman.AuthConfig{}) {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(authConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		IdentityToken: auth.IdentityToken,
+		RegistryToken: auth.RegistryToken,
+		ServerAddress: registry,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return http.Header{"X-Registry-Auth": {base64.URLEncoding.EncodeToString(data)}}, nil
+}
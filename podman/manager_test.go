@@ -0,0 +1,712 @@
+package podman
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/internal/cgroups"
+)
+
+type fakeContainer struct {
+	spec     spec
+	running  bool
+	exitCode int
+	stdout   string
+	files    map[string]string
+	// oomKills counts execs killed by OOM killer
+	oomKills int
+}
+
+type fakeExec struct {
+	exitCode int
+}
+
+// fakePodman stands in for the libpod API served on a local socket
+type fakePodman struct {
+	mu sync.Mutex
+
+	server *http.Server
+	socket string
+	images map[string]string
+	// repoDigests are reported by inspect of images with the ID
+	repoDigests map[string][]string
+	containers  map[string]*fakeContainer
+	execs       map[string]*fakeExec
+	outputs     map[string]string
+	exitCodes   map[string]int
+	// oomKilled commands of execs are killed by OOM killer
+	oomKilled map[string]bool
+	volumes   map[string]map[string]string
+	builds    []url.Values
+	pushed    []string
+	pushAuths []string
+}
+
+var fakeImageRoute = regexp.MustCompile(`^/v[0-9.]+/libpod/images/(.+)/(push|tag)$`)
+
+var fakeRoute = regexp.MustCompile(`^/v[0-9.]+/libpod/(containers|images|exec)/(.+?)/?(json|exists|start|stop|kill|wait|logs|exec|archive)?$`)
+
+var fakeVolumeRoute = regexp.MustCompile(`^/v[0-9.]+/libpod/volumes/([^/]+)/json$`)
+
+func newFakePodman(t *testing.T) *fakePodman {
+	dir, err := ioutil.TempDir("", "contman-podman-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp := &fakePodman{
+		socket:      filepath.Join(dir, "podman.sock"),
+		images:      map[string]string{},
+		repoDigests: map[string][]string{},
+		containers:  map[string]*fakeContainer{},
+		execs:       map[string]*fakeExec{},
+		outputs:     map[string]string{},
+		oomKilled:   map[string]bool{},
+		exitCodes:   map[string]int{},
+		volumes:     map[string]map[string]string{},
+	}
+
+	l, err := net.Listen("unix", fp.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.server = &http.Server{Handler: http.HandlerFunc(fp.serveHTTP)}
+	go fp.server.Serve(l)
+
+	return fp
+}
+
+func (fp *fakePodman) Close() {
+	fp.server.Close()
+	os.RemoveAll(filepath.Dir(fp.socket))
+}
+
+func writeFrame(w io.Writer, data string) {
+	if data == "" {
+		return
+	}
+	header := make([]byte, 8)
+	header[0] = 1
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	w.Write(header)
+	io.WriteString(w, data)
+}
+
+func (fp *fakePodman) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(APIError{StatusCode: 404, Message: "no such object"})
+	}
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_ping"):
+		io.WriteString(w, "OK")
+		return
+	case strings.HasSuffix(r.URL.Path, "/images/pull"):
+		ref := r.URL.Query().Get("reference")
+		if ref == "broken:latest" {
+			json.NewEncoder(w).Encode(pullReport{Error: "manifest unknown"})
+			return
+		}
+		fp.images[ref] = "sha256:" + ref
+		json.NewEncoder(w).Encode(pullReport{Stream: "Pulling " + ref + "\n"})
+		return
+	case strings.HasSuffix(r.URL.Path, "/images/json"):
+		var filters map[string][]string
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		ids := map[string][]string{}
+		for ref, id := range fp.images {
+			ids[id] = append(ids[id], ref)
+		}
+		list := []imageSummary{}
+		for id, refs := range ids {
+			matches := len(filters["reference"]) == 0
+			for _, ref := range refs {
+				matches = matches || strings.HasPrefix(ref, strings.TrimSuffix(filters["reference"][0], "*"))
+			}
+			if matches {
+				list = append(list, imageSummary{ID: strings.TrimPrefix(id, "sha256:"), RepoTags: refs})
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+		return
+	case strings.HasSuffix(r.URL.Path, "/images/prune"):
+		used := map[string]bool{}
+		for _, c := range fp.containers {
+			used[fp.images[c.spec.Image]] = true
+		}
+		reports := []pruneReport{}
+		for ref, id := range fp.images {
+			if !used[id] && r.URL.Query().Get("all") == "true" {
+				delete(fp.images, ref)
+				reports = append(reports, pruneReport{ID: strings.TrimPrefix(id, "sha256:")})
+			}
+		}
+		json.NewEncoder(w).Encode(reports)
+		return
+	case fakeImageRoute.MatchString(r.URL.Path):
+		m := fakeImageRoute.FindStringSubmatch(r.URL.Path)
+		id, ok := fp.images[m[1]]
+		if !ok {
+			notFound()
+			return
+		}
+		if m[2] == "tag" {
+			fp.images[r.URL.Query().Get("repo")+":"+r.URL.Query().Get("tag")] = id
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if !strings.HasPrefix(m[1], "registry.example.com/") {
+			json.NewEncoder(w).Encode(map[string]string{"error": "requested access to the resource is denied"})
+			return
+		}
+		fp.pushed = append(fp.pushed, m[1])
+		fp.pushAuths = append(fp.pushAuths, r.Header.Get("X-Registry-Auth"))
+		json.NewEncoder(w).Encode(map[string]string{"stream": "Writing manifest to image destination\n"})
+		return
+	case r.Method == "DELETE" && strings.Contains(r.URL.Path, "/images/"):
+		name := r.URL.Path[strings.Index(r.URL.Path, "/images/")+len("/images/"):]
+		id, ok := fp.images[name]
+		if !ok {
+			notFound()
+			return
+		}
+		for _, c := range fp.containers {
+			if fp.images[c.spec.Image] == id && r.URL.Query().Get("force") != "true" {
+				json.NewEncoder(w).Encode(removeReport{Errors: []string{"image is in use by a container"}})
+				return
+			}
+		}
+		delete(fp.images, name)
+		json.NewEncoder(w).Encode(removeReport{Untagged: []string{name}, Deleted: []string{id}})
+		return
+	case strings.HasSuffix(r.URL.Path, "/build"):
+		query := r.URL.Query()
+		fp.builds = append(fp.builds, query)
+		dockerfile := ""
+		tr := tar.NewReader(r.Body)
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if header.Name == query.Get("dockerfile") {
+				data, _ := ioutil.ReadAll(tr)
+				dockerfile = string(data)
+			}
+		}
+		enc := json.NewEncoder(w)
+		if strings.Contains(dockerfile, "RUNN") {
+			enc.Encode(map[string]string{"error": "unknown instruction: RUNN"})
+			return
+		}
+		id := fmt.Sprintf("%064d", len(fp.builds))
+		for _, tag := range query["t"] {
+			fp.images[tag] = "sha256:" + id
+		}
+		enc.Encode(map[string]string{"stream": "STEP 1/1: " + strings.TrimSpace(dockerfile) + "\n"})
+		enc.Encode(map[string]string{"stream": id + "\n"})
+		return
+	case strings.HasSuffix(r.URL.Path, "/containers/create"):
+		id := fmt.Sprintf("pod%04d", len(fp.containers)+1)
+		c := &fakeContainer{files: map[string]string{}}
+		json.NewDecoder(r.Body).Decode(&c.spec)
+		for _, v := range c.spec.Volumes {
+			if _, ok := fp.volumes[v.Name]; !ok {
+				fp.volumes[v.Name] = nil
+			}
+		}
+		fp.containers[id] = c
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(idResponse{ID: id})
+		return
+	case strings.HasSuffix(r.URL.Path, "/volumes/create"):
+		var body struct {
+			Name  string
+			Label map[string]string
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if _, ok := fp.volumes[body.Name]; ok {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(APIError{StatusCode: 409, Message: "volume already exists"})
+			return
+		}
+		fp.volumes[body.Name] = body.Label
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(volumeConfig{Name: body.Name, Labels: body.Label})
+		return
+	case fakeVolumeRoute.MatchString(r.URL.Path):
+		name := fakeVolumeRoute.FindStringSubmatch(r.URL.Path)[1]
+		labels, ok := fp.volumes[name]
+		if !ok {
+			notFound()
+			return
+		}
+		json.NewEncoder(w).Encode(volumeConfig{Name: name, Labels: labels})
+		return
+	case strings.HasSuffix(r.URL.Path, "/volumes/json"), strings.HasSuffix(r.URL.Path, "/volumes/prune"):
+		var filters map[string][]string
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		used := map[string]bool{}
+		for _, c := range fp.containers {
+			for _, v := range c.spec.Volumes {
+				used[v.Name] = true
+			}
+		}
+		list, reports := []volumeConfig{}, []pruneReport{}
+		for name, labels := range fp.volumes {
+			matches := true
+			for _, label := range filters["label"] {
+				parts := strings.SplitN(label, "=", 2)
+				matches = matches && labels[parts[0]] == parts[1]
+			}
+			if !matches {
+				continue
+			}
+			list = append(list, volumeConfig{Name: name, Labels: labels})
+			if strings.HasSuffix(r.URL.Path, "/prune") && !used[name] {
+				delete(fp.volumes, name)
+				reports = append(reports, pruneReport{ID: name})
+			}
+		}
+		if strings.HasSuffix(r.URL.Path, "/prune") {
+			json.NewEncoder(w).Encode(reports)
+		} else {
+			json.NewEncoder(w).Encode(list)
+		}
+		return
+	}
+
+	m := fakeRoute.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		notFound()
+		return
+	}
+	kind, name, op := m[1], m[2], m[3]
+
+	if kind == "images" {
+		id, ok := fp.images[name]
+		for _, imageID := range fp.images {
+			if imageID == name {
+				id, ok = imageID, true
+			}
+		}
+		if !ok {
+			notFound()
+		} else if op == "json" {
+			json.NewEncoder(w).Encode(imageInspect{ID: id, RepoDigests: fp.repoDigests[id]})
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	if kind == "exec" {
+		e := fp.execs[name]
+		if op == "start" {
+			writeFrame(w, fp.outputs[name])
+		} else {
+			json.NewEncoder(w).Encode(execInspect{ExitCode: e.exitCode})
+		}
+		return
+	}
+
+	c, ok := fp.containers[name]
+	if !ok {
+		notFound()
+		return
+	}
+
+	switch op {
+	case "json":
+		descr := containerInspect{ID: name, Image: fp.images[c.spec.Image], ImageName: c.spec.Image}
+		descr.State.Running = c.running
+		json.NewEncoder(w).Encode(descr)
+	case "start":
+		cmd := c.spec.Command[1]
+		c.stdout = fp.outputs[cmd]
+		c.exitCode = fp.exitCodes[cmd]
+		c.files["/out/result.txt"] = "result"
+		c.running = true
+		w.WriteHeader(http.StatusNoContent)
+	case "stop", "kill":
+		c.running = false
+		w.WriteHeader(http.StatusNoContent)
+	case "wait":
+		c.running = false
+		json.NewEncoder(w).Encode(c.exitCode)
+	case "logs":
+		writeFrame(w, c.stdout)
+	case "exec":
+		var config struct{ Cmd []string }
+		json.NewDecoder(r.Body).Decode(&config)
+		id := fmt.Sprintf("exec%04d", len(fp.execs)+1)
+		fp.execs[id] = &fakeExec{exitCode: fp.exitCodes[config.Cmd[2]]}
+		fp.outputs[id] = fp.outputs[config.Cmd[2]]
+		if fp.oomKilled[config.Cmd[2]] {
+			c.oomKills++
+			fp.execs[id].exitCode = 137
+		}
+		if config.Cmd[2] == cgroups.EventsScript {
+			fp.outputs[id] = fmt.Sprintf("oom 1\noom_kill %d\n", c.oomKills)
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(idResponse{ID: id})
+	case "archive":
+		src := r.URL.Query().Get("path")
+		if r.Method == "PUT" {
+			tr := tar.NewReader(r.Body)
+			for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+				data, _ := ioutil.ReadAll(tr)
+				if header.Typeflag == tar.TypeReg {
+					c.files[path.Join(src, header.Name)] = string(data)
+				}
+			}
+			return
+		}
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: path.Base(src) + "/", Mode: 0755, Typeflag: tar.TypeDir})
+		found := false
+		for name, data := range c.files {
+			if strings.HasPrefix(name, src+"/") {
+				rel := strings.TrimPrefix(name, path.Dir(src))
+				tw.WriteHeader(&tar.Header{Name: rel, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+				io.WriteString(tw, data)
+				found = true
+			}
+		}
+		tw.Close()
+		if !found {
+			notFound()
+			return
+		}
+		w.Write(buf.Bytes())
+	case "":
+		if c.running {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(APIError{StatusCode: 409, Message: "container is running"})
+			return
+		}
+		delete(fp.containers, name)
+	}
+}
+
+func TestSocketPath(t *testing.T) {
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	defer os.Unsetenv("CONTAINER_HOST")
+
+	os.Setenv("CONTAINER_HOST", "unix:///tmp/podman.sock")
+	if socket := SocketPath(); socket != "/tmp/podman.sock" {
+		t.Errorf("Unexpected socket for CONTAINER_HOST: %s", socket)
+	}
+
+	os.Unsetenv("CONTAINER_HOST")
+	os.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if socket := SocketPath(); os.Geteuid() != 0 && socket != "/run/user/1000/podman/podman.sock" {
+		t.Errorf("Unexpected rootless socket: %s", socket)
+	}
+}
+
+func TestPodmanReceipt(t *testing.T) {
+	fp := newFakePodman(t)
+	defer fp.Close()
+	fp.outputs["build"] = "building\n"
+
+	dir := filepath.Dir(fp.socket)
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.txt"), []byte("input"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pm, err := NewPodmanManagerWithSocket(context.Background(), fp.socket)
+	if err != nil {
+		t.Fatal("Cannot create podman manager: ", err)
+	}
+	pm.UserNS = "keep-id"
+
+	result, err := contman.RunReceipt(pm, contman.Receipt{
+		Image:      "alpine:latest",
+		Cmd:        "build",
+		InputCopy:  map[string]string{"input.txt": "/src"},
+		OutputCopy: map[string]string{"/out": "."},
+		HostDir:    dir,
+	})
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if result.ImageDigest != "sha256:alpine:latest" || string(result.Stdout) != "building\n" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if len(fp.containers) != 0 {
+		t.Error("Container was not removed")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "out", "result.txt")); err != nil || string(data) != "result" {
+		t.Error("Output was not copied from container: ", err)
+	}
+}
+
+func TestPodmanContainer(t *testing.T) {
+	fp := newFakePodman(t)
+	defer fp.Close()
+	fp.outputs["echo hi"] = "hi\n"
+	fp.exitCodes["false"] = 1
+	fp.exitCodes["kill -9 $$"] = 137
+	fp.oomKilled["allocate"] = true
+
+	pm, err := NewPodmanManagerWithSocket(context.Background(), fp.socket)
+	if err != nil {
+		t.Fatal("Cannot create podman manager: ", err)
+	}
+	pm.UserNS = "keep-id"
+
+	if err := pm.PullImage(context.Background(), "broken:latest"); err == nil || err.Error() != "manifest unknown" {
+		t.Error("Expected pull error from stream, got: ", err)
+	}
+	if ok, err := pm.HasImage(context.Background(), "alpine:latest"); ok || err != nil {
+		t.Error("Image exists before pull: ", err)
+	}
+	if err := pm.PullImage(context.Background(), "alpine:latest"); err != nil {
+		t.Fatal("Cannot pull image: ", err)
+	}
+
+	cntr, err := pm.ContainerCreate(context.Background(), contman.Config{
+		Image:   "alpine:latest",
+		Cmd:     "sleep 60",
+		Mounts:  []contman.Mount{{Source: "/data", Target: "/data", ReadOnly: true}},
+		Network: "ci",
+		Ports:   []contman.Port{{ContainerPort: 8080, HostPort: 18080}},
+		Resources: contman.Resources{
+			Memory:  64 << 20,
+			Ulimits: []contman.Ulimit{{Name: "nofile", Soft: 1024, Hard: 1024}},
+			Tmpfs:   map[string]string{"/tmp": "size=64m"},
+		},
+		Security: contman.Security{ReadOnlyRootfs: true, CapDrop: []string{"ALL"}},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+
+	spec := fp.containers[cntr.ID()].spec
+	if spec.UserNS == nil || spec.UserNS.NSMode != "keep-id" || spec.Mounts[0].Options[0] != "ro" {
+		t.Errorf("Unexpected container spec: %+v", spec)
+	}
+	if _, ok := spec.Networks["ci"]; !ok || spec.NetNS.NSMode != "bridge" || spec.Ports[0].HostPort != 18080 {
+		t.Errorf("Unexpected network of container: %+v", spec)
+	}
+	if spec.Resources.Memory.Limit != 64<<20 || spec.Rlimits[0].Type != "RLIMIT_NOFILE" || spec.Mounts[1].Type != "tmpfs" {
+		t.Errorf("Unexpected resources of container: %+v", spec)
+	}
+	if !spec.ReadOnly || spec.CapDrop[0] != "ALL" {
+		t.Errorf("Unexpected security of container: %+v", spec)
+	}
+
+	if err := cntr.Start(context.Background()); err != nil {
+		t.Fatal("Cannot start container: ", err)
+	}
+
+	var stdout bytes.Buffer
+	if code, err := cntr.Exec(context.Background(), contman.ExecConfig{Cmd: "echo hi", Stdout: &stdout}); err != nil || code != 0 || stdout.String() != "hi\n" {
+		t.Errorf("Unexpected exec result: %d, %q, %v", code, stdout.String(), err)
+	}
+	if code, err := cntr.Exec(context.Background(), contman.ExecConfig{Cmd: "false"}); err != nil || code != 1 {
+		t.Errorf("Unexpected exec result: %d, %v", code, err)
+	}
+	if _, err := cntr.Exec(context.Background(), contman.ExecConfig{Cmd: "allocate"}); err == nil || !err.(*contman.ExitError).OOMKilled {
+		t.Error("Expected OOM error of exec, got: ", err)
+	}
+	// Container cgroup keeps counting the previous kill
+	if code, err := cntr.Exec(context.Background(), contman.ExecConfig{Cmd: "kill -9 $$"}); err != nil || code != 137 {
+		t.Errorf("Unexpected exec result: %d, %v", code, err)
+	}
+
+	if err := cntr.CopyFrom(context.Background(), "/missing", os.TempDir()); !errors.Is(err, contman.ErrNotFound) {
+		t.Error("Expected not found error, got: ", err)
+	}
+	if err := cntr.Remove(context.Background()); err == nil {
+		t.Error("Running container was removed")
+	}
+}
+
+func TestPodmanImageDigest(t *testing.T) {
+	fp := newFakePodman(t)
+	defer fp.Close()
+	alpine := "sha256:" + strings.Repeat("a", 64)
+	fp.images["alpine:latest"] = "sha256:alpine"
+	fp.repoDigests["sha256:alpine"] = []string{"mirror.local/library/alpine@sha256:" + strings.Repeat("b", 64), "docker.io/library/alpine@" + alpine}
+
+	pm, err := NewPodmanManagerWithSocket(context.Background(), fp.socket)
+	if err != nil {
+		t.Fatal("Cannot create podman manager: ", err)
+	}
+	cntr, err := pm.ContainerCreate(context.Background(), contman.Config{Image: "alpine:latest", Cmd: "true"})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	defer cntr.Remove(context.Background())
+
+	if digest, err := cntr.ImageDigest(context.Background()); err != nil || digest != "alpine@"+alpine {
+		t.Errorf("Unexpected digest: %s, %v", digest, err)
+	}
+}
+
+func TestPodmanVolumes(t *testing.T) {
+	fp := newFakePodman(t)
+	defer fp.Close()
+
+	pm, err := NewPodmanManagerWithSocket(context.Background(), fp.socket)
+	if err != nil {
+		t.Fatal("Cannot create podman manager: ", err)
+	}
+
+	ctx := context.Background()
+	if _, err := pm.VolumeCreate(ctx, "npm", map[string]string{"contman.cache": "npm"}); err != nil {
+		t.Fatal("Cannot create volume: ", err)
+	}
+	if v, err := pm.VolumeCreate(ctx, "npm", nil); err != nil || v.Labels["contman.cache"] != "npm" {
+		t.Errorf("Existing volume is not returned: %+v, %v", v, err)
+	}
+	cntr, err := pm.ContainerCreate(ctx, contman.Config{
+		Image: "alpine:latest",
+		Cmd:   "true",
+		Mounts: []contman.Mount{
+			{Type: contman.MountVolume, Source: "go-mod", Target: "/go/pkg/mod"},
+			{Type: contman.MountTmpfs, Target: "/tmp"},
+		},
+	})
+	if err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	spec := fp.containers[cntr.ID()].spec
+	if spec.Volumes[0].Name != "go-mod" || spec.Mounts[0].Type != "tmpfs" {
+		t.Errorf("Unexpected mounts: %+v", spec)
+	}
+
+	volumes, err := pm.VolumeList(ctx, map[string]string{"contman.cache": "npm"})
+	if err != nil || len(volumes) != 1 || volumes[0].Name != "npm" {
+		t.Errorf("Unexpected volumes: %+v, %v", volumes, err)
+	}
+	if pruned, err := pm.VolumePrune(ctx, nil); err != nil || len(pruned) != 1 || pruned[0] != "npm" {
+		t.Errorf("Unexpected pruned volumes: %v, %v", pruned, err)
+	}
+}
+
+func TestPodmanBuild(t *testing.T) {
+	fp := newFakePodman(t)
+	defer fp.Close()
+
+	pm, err := NewPodmanManagerWithSocket(context.Background(), fp.socket)
+	if err != nil {
+		t.Fatal("Cannot create podman manager: ", err)
+	}
+
+	dir, err := ioutil.TempDir("", "contman-build-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "Containerfile"), []byte("FROM alpine:latest\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []contman.BuildEvent
+	id, err := pm.BuildImage(context.Background(), contman.BuildSpec{
+		Context:    dir,
+		Dockerfile: "Containerfile",
+		Args:       map[string]string{"VERSION": "1.0"},
+		Tags:       []string{"app:latest"},
+		Events:     func(e contman.BuildEvent) { events = append(events, e) },
+	})
+	if err != nil {
+		t.Fatal("Cannot build image: ", err)
+	}
+	if fp.images["app:latest"] != id || len(events) != 2 || events[1].ImageID != id {
+		t.Errorf("Unexpected build result: %s, %+v", id, events)
+	}
+	if query := fp.builds[0]; query.Get("buildargs") != `{"VERSION":"1.0"}` || query.Get("target") != "" {
+		t.Errorf("Unexpected build query: %v", query)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("RUNN true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pm.BuildImage(context.Background(), contman.BuildSpec{Context: dir}); err == nil || err.Error() != "unknown instruction: RUNN" {
+		t.Error("Unexpected build error: ", err)
+	}
+}
+
+func TestPodmanImages(t *testing.T) {
+	fp := newFakePodman(t)
+	defer fp.Close()
+
+	pm, err := NewPodmanManagerWithSocket(context.Background(), fp.socket)
+	if err != nil {
+		t.Fatal("Cannot create podman manager: ", err)
+	}
+
+	ctx := context.Background()
+	if err := pm.PullImage(ctx, "alpine:latest"); err != nil {
+		t.Fatal("Cannot pull image: ", err)
+	}
+	if err := pm.TagImage(ctx, "alpine:latest", "registry.example.com/base"); err != nil {
+		t.Fatal("Cannot tag image: ", err)
+	}
+	if err := pm.TagImage(ctx, "missing:latest", "registry.example.com/missing"); !errors.Is(err, contman.ErrNotFound) {
+		t.Error("Unexpected error tagging missing image: ", err)
+	}
+	pm.Auth = contman.StaticAuth{"registry.example.com": {Username: "ci", Password: "secret"}}
+	if err := pm.PushImage(ctx, "registry.example.com/base:latest"); err != nil || len(fp.pushed) != 1 {
+		t.Fatal("Cannot push image: ", err)
+	}
+	var auth authConfig
+	data, _ := base64.URLEncoding.DecodeString(fp.pushAuths[0])
+	if err := json.Unmarshal(data, &auth); err != nil || auth.Username != "ci" || auth.ServerAddress != "registry.example.com" {
+		t.Errorf("Unexpected push credentials: %+v, %v", auth, err)
+	}
+	if err := pm.PushImage(ctx, "alpine:latest"); err == nil {
+		t.Error("Denied push succeeded")
+	}
+
+	images, err := pm.ListImages(ctx, contman.ImageFilter{Reference: "registry.example.com/*"})
+	if err != nil || len(images) != 1 || images[0].ID != "sha256:alpine:latest" {
+		t.Errorf("Unexpected images: %+v, %v", images, err)
+	}
+
+	if _, err := pm.ContainerCreate(ctx, contman.Config{Image: "alpine:latest", Cmd: "true"}); err != nil {
+		t.Fatal("Cannot create container: ", err)
+	}
+	if err := pm.RemoveImage(ctx, "alpine:latest", false); err == nil {
+		t.Error("Image used by container is removed")
+	}
+	if err := pm.RemoveImage(ctx, "alpine:latest", true); err != nil {
+		t.Error("Cannot remove image: ", err)
+	}
+	if err := pm.RemoveImage(ctx, "alpine:latest", true); !errors.Is(err, contman.ErrNotFound) {
+		t.Error("Unexpected error removing missing image: ", err)
+	}
+	if pruned, err := pm.PruneImages(ctx, contman.ImageFilter{}); err != nil || len(pruned) != 1 {
+		t.Errorf("Unexpected pruned images: %v, %v", pruned, err)
+	}
+}
@@ -0,0 +1,94 @@
+package podman
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman"
+)
+
+type volumeConfig struct {
+	Name   string            `json:"Name"`
+	Labels map[string]string `json:"Labels"`
+}
+
+type pruneReport struct {
+	ID  string `json:"Id"`
+	Err string `json:"Err,omitempty"`
+}
+
+// VolumeCreate returns existing volume of the name as is, like docker does
+func (pm *PodmanManager) VolumeCreate(ctx context.Context, name string, labels map[string]string) (contman.Volume, error) {
+	var v volumeConfig
+	body := map[string]interface{}{"Name": name, "Label": labels}
+	err := pm.client.call(ctx, "POST", "/volumes/create", nil, body, &v)
+	if isConflict(err) {
+		err = pm.client.call(ctx, "GET", "/volumes/"+url.PathEscape(name)+"/json", nil, nil, &v)
+	}
+	if err != nil {
+		log.WithError(err).WithField("volume", name).Error("Error creating volume")
+		return contman.Volume{}, err
+	}
+	return contman.Volume{Name: v.Name, Labels: v.Labels}, nil
+}
+
+func (pm *PodmanManager) VolumeList(ctx context.Context, labels map[string]string) ([]contman.Volume, error) {
+	var list []volumeConfig
+	if err := pm.client.call(ctx, "GET", "/volumes/json", labelFilters(labels), nil, &list); err != nil {
+		log.WithError(err).Error("Error listing volumes")
+		return nil, err
+	}
+
+	volumes := make([]contman.Volume, 0, len(list))
+	for _, v := range list {
+		volumes = append(volumes, contman.Volume{Name: v.Name, Labels: v.Labels})
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+func (pm *PodmanManager) VolumePrune(ctx context.Context, labels map[string]string) ([]string, error) {
+	var reports []pruneReport
+	if err := pm.client.call(ctx, "POST", "/volumes/prune", labelFilters(labels), nil, &reports); err != nil {
+		log.WithError(err).Error("Error pruning volumes")
+		return nil, err
+	}
+
+	var pruned []string
+	for _, report := range reports {
+		if report.Err != "" {
+			return pruned, fmt.Errorf("prune volume %s: %s", report.ID, report.Err)
+		}
+		pruned = append(pruned, report.ID)
+	}
+	return pruned, nil
+}
+
+// labelFilters encodes labels into filters query of libpod
+func labelFilters(labels map[string]string) url.Values {
+	return filtersQuery(filterLabels(labels))
+}
+
+func filterLabels(labels map[string]string) map[string][]string {
+	filters := map[string][]string{}
+	for key, value := range labels {
+		filters["label"] = append(filters["label"], key+"="+value)
+	}
+	sort.Strings(filters["label"])
+	return filters
+}
+
+// filtersQuery encodes filters into query of libpod
+func filtersQuery(filters map[string][]string) url.Values {
+	query := url.Values{}
+	if len(filters) > 0 {
+		data, _ := json.Marshal(filters)
+		query.Set("filters", string(data))
+	}
+	return query
+}
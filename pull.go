@@ -0,0 +1,129 @@
+package contman
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PullPolicy tells when receipt pulls its image, UseLocalImage of receipt
+// overrides it with PullNever
+type PullPolicy int
+
+const (
+	// PullAlways pulls image before every run
+	PullAlways PullPolicy = iota
+	// PullIfNotPresent pulls image missing in the manager image store
+	PullIfNotPresent
+	// PullNever runs image of the store only
+	PullNever
+	// PullIfDigestChanged pulls image when the registry has another digest
+	// for it than the store, managers not implementing DigestManager always
+	// pull
+	PullIfDigestChanged
+)
+
+func (p PullPolicy) String() string {
+	switch p {
+	case PullAlways:
+		return "always"
+	case PullIfNotPresent:
+		return "if-not-present"
+	case PullNever:
+		return "never"
+	case PullIfDigestChanged:
+		return "if-digest-changed"
+	}
+	return fmt.Sprintf("PullPolicy(%d)", int(p))
+}
+
+func (p PullPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *PullPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "always":
+		*p = PullAlways
+	case "if-not-present":
+		*p = PullIfNotPresent
+	case "never":
+		*p = PullNever
+	case "if-digest-changed":
+		*p = PullIfDigestChanged
+	default:
+		return fmt.Errorf("unknown pull policy %q", text)
+	}
+	return nil
+}
+
+// DigestManager is implemented by managers able to compare images of their
+// store with registries
+type DigestManager interface {
+	// LocalDigest returns digest image was pulled with, empty when image
+	// is missing or was not pulled from the registry
+	LocalDigest(ctx context.Context, image string) (string, error)
+	// RemoteDigest returns digest of image in its registry
+	RemoteDigest(ctx context.Context, image string) (string, error)
+}
+
+// PullEvent is a progress message of image pull, events of a layer carry its
+// ID and, while it is downloaded or extracted, Current and Total bytes
+type PullEvent struct {
+	ID      string
+	Status  string
+	Current int64
+	Total   int64
+}
+
+// ProgressPuller is implemented by managers reporting pull progress
+type ProgressPuller interface {
+	// PullImageProgress is PullImage calling progress for every event, errors
+	// reported by the registry in the middle of the pull are returned
+	PullImageProgress(ctx context.Context, image string, progress func(PullEvent)) error
+}
+
+// pullImage pulls image according to policy
+func pullImage(ctx context.Context, cm Manager, image string, policy PullPolicy, progress func(PullEvent)) error {
+	l := log.WithFields(log.Fields{"image": image, "policy": policy})
+
+	switch policy {
+	case PullNever:
+		return nil
+	case PullIfNotPresent:
+		hasImage, err := cm.HasImage(ctx, image)
+		if err != nil || hasImage {
+			return err
+		}
+	case PullIfDigestChanged:
+		changed, err := digestChanged(ctx, cm, image)
+		if err != nil {
+			l.WithError(err).Warn("Cannot compare image digests, pulling")
+		} else if !changed {
+			l.Debug("Image digest is not changed")
+			return nil
+		}
+	}
+
+	if pp, ok := cm.(ProgressPuller); ok && progress != nil {
+		return pp.PullImageProgress(ctx, image, progress)
+	}
+	return cm.PullImage(ctx, image)
+}
+
+func digestChanged(ctx context.Context, cm Manager, image string) (bool, error) {
+	dm, ok := cm.(DigestManager)
+	if !ok {
+		return true, nil
+	}
+	local, err := dm.LocalDigest(ctx, image)
+	if err != nil || local == "" {
+		return true, err
+	}
+	remote, err := dm.RemoteDigest(ctx, image)
+	if err != nil {
+		return true, err
+	}
+	return local != remote, nil
+}
@@ -0,0 +1,89 @@
+package contman
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// NewPullRenderer returns PullProgress callback printing pull events to w,
+// a line per layer. Terminal lines are redrawn in place with progress of
+// the layer, other writers get status changes only.
+func NewPullRenderer(w io.Writer) func(PullEvent) {
+	r := &pullRenderer{
+		w:      w,
+		tty:    isTerminal(w),
+		lines:  map[string]int{},
+		status: map[string]string{},
+	}
+	return r.render
+}
+
+type pullRenderer struct {
+	mu sync.Mutex
+
+	w   io.Writer
+	tty bool
+	// lines are indexes of layer lines, n is the number of printed ones
+	lines  map[string]int
+	status map[string]string
+	n      int
+}
+
+func (r *pullRenderer) render(e PullEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	line := e.Status
+	if e.ID != "" {
+		line = e.ID + ": " + line
+	}
+
+	if !r.tty {
+		if e.ID != "" && r.status[e.ID] == e.Status {
+			return
+		}
+		r.status[e.ID] = e.Status
+		fmt.Fprintln(r.w, line)
+		return
+	}
+
+	if e.Total > 0 {
+		line += fmt.Sprintf(" %s/%s", byteSize(e.Current), byteSize(e.Total))
+	}
+	i, ok := r.lines[e.ID]
+	if e.ID == "" || !ok {
+		if e.ID != "" {
+			r.lines[e.ID] = r.n
+		}
+		r.n++
+		fmt.Fprintf(r.w, "\x1b[2K\r%s\n", line)
+		return
+	}
+	// Move up to the line of the layer, redraw it and return back
+	up := r.n - i
+	fmt.Fprintf(r.w, "\x1b[%dA\x1b[2K\r%s\x1b[%dB\r", up, line, up)
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func byteSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
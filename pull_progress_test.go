@@ -0,0 +1,39 @@
+package contman
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPullRenderer(t *testing.T) {
+	events := []PullEvent{
+		{Status: "Pulling from library/alpine"},
+		{ID: "a1", Status: "Pulling fs layer"},
+		{ID: "b2", Status: "Pulling fs layer"},
+		{ID: "a1", Status: "Downloading", Current: 1500, Total: 3000000},
+		{ID: "a1", Status: "Downloading", Current: 3000000, Total: 3000000},
+		{ID: "a1", Status: "Download complete"},
+	}
+
+	var buf bytes.Buffer
+	render := NewPullRenderer(&buf)
+	for _, e := range events {
+		render(e)
+	}
+	expected := "Pulling from library/alpine\na1: Pulling fs layer\nb2: Pulling fs layer\n" +
+		"a1: Downloading\na1: Download complete\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected output: %q", buf.String())
+	}
+
+	buf.Reset()
+	r := &pullRenderer{w: &buf, tty: true, lines: map[string]int{}, status: map[string]string{}}
+	for _, e := range events[:4] {
+		r.render(e)
+	}
+	expected = "\x1b[2K\rPulling from library/alpine\n\x1b[2K\ra1: Pulling fs layer\n\x1b[2K\rb2: Pulling fs layer\n" +
+		"\x1b[2A\x1b[2K\ra1: Downloading 1.5kB/3.0MB\x1b[2B\r"
+	if buf.String() != expected {
+		t.Errorf("Unexpected terminal output: %q", buf.String())
+	}
+}
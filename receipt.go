@@ -1,28 +1,200 @@
 package contman
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/elemir/contman/internal/stream"
+)
+
+// stepsIdleCmd keeps the container alive while steps are executed in it
+const stepsIdleCmd = "trap 'exit 0' TERM; while :; do sleep 1; done"
+
+const defaultStopTimeout = 10 * time.Second
+
+// CacheLabel marks volumes created for caches of receipts, so they can be
+// found by VolumeList and VolumePrune
+const CacheLabel = "contman.cache"
+
+const (
+	PhasePull    = "pull"
+	PhaseBuild   = "build"
+	PhaseCreate  = "create"
+	PhaseCopyIn  = "copy-in"
+	PhaseStart   = "start"
+	PhaseRun     = "run"
+	PhaseCopyOut = "copy-out"
 )
 
+// TimeoutError is returned when receipt context expires or is cancelled,
+// Phase tells which part of the run was interrupted.
+type TimeoutError struct {
+	Phase string
+	Err   error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("receipt interrupted during %s phase: %v", e.Phase, e.Err)
+}
+
+type Step struct {
+	Name            string            `receipt:"name"`
+	Cmd             string            `receipt:"cmd"`
+	Env             map[string]string `receipt:"env"`
+	WorkingDir      string            `receipt:"working_dir"`
+	ContinueOnError bool              `receipt:"continue_on_error"`
+}
+
+// StepError is returned for a step failing the run, it wraps ExitError of
+// the step, so errors.As finds it
+type StepError struct {
+	Index    int
+	Name     string
+	ExitCode int
+	Err      *ExitError
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("step %d (%s) exited with non-zero code: %d", e.Index, e.Name, e.ExitCode)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+type StepResult struct {
+	Name     string
+	ExitCode int
+}
+
+type ReceiptResult struct {
+	ContainerID string
+	// ImageID is ID of the image built by the receipt
+	ImageID     string
+	ImageDigest string
+	// ExitCode is exit code of the container, or of the step failing the
+	// run when the receipt has steps
+	ExitCode   int
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Stdout     []byte
+	Stderr     []byte
+	Steps      []StepResult
+	// OOMKilled tells that ExitCode is caused by the OOM killer
+	OOMKilled  bool
+	InputCopy  []CopyStatus
+	OutputCopy []CopyStatus
+}
+
+type ExitError struct {
+	ContainerID string
+	Code        int
+	OOMKilled   bool
+}
+
+func (e *ExitError) Error() string {
+	if e.OOMKilled {
+		return fmt.Sprintf("container %s was killed by OOM killer with code: %d", e.ContainerID, e.Code)
+	}
+	return fmt.Sprintf("container %s exited with non-zero code: %d", e.ContainerID, e.Code)
+}
+
 type Receipt struct {
-	Image              string
-	Cmd                string
-	Env                map[string]string
-	InputCopy          map[string]string
-	OutputCopy         map[string]string
-	Timeout            time.Duration
-	UseControlSocket   bool
-	UseLocalImage      bool
-	OnlyCreate         bool
-	UseImageWorkingDir bool
-}
-
-func RunReceipt(cm Manager, receipt Receipt) error {
-	if !receipt.UseLocalImage {
-		err := cm.PullImage(receipt.Image)
-		if err != nil {
+	// Image is run unless Build is set, then it names the built image
+	Image string `receipt:"image"`
+	// Build makes the receipt build image with ImageBuilder of the manager
+	// instead of pulling one
+	Build      *BuildSpec        `receipt:"build"`
+	Cmd        string            `receipt:"cmd"`
+	Steps      []Step            `receipt:"steps"`
+	Env        map[string]string `receipt:"env"`
+	InputCopy  map[string]string `receipt:"input_copy"`
+	OutputCopy map[string]string `receipt:"output_copy"`
+	// InputPolicy and OutputPolicy are keyed by copy sources, CopyRequired
+	// is used for sources without a policy
+	InputPolicy        map[string]CopyPolicy `receipt:"input_policy"`
+	OutputPolicy       map[string]CopyPolicy `receipt:"output_policy"`
+	Timeout            time.Duration         `receipt:"timeout"`
+	StopTimeout        time.Duration         `receipt:"stop_timeout"`
+	UseControlSocket   bool                  `receipt:"use_control_socket"`
+	PullPolicy         PullPolicy            `receipt:"pull_policy"`
+	UseLocalImage      bool                  `receipt:"use_local_image"`
+	OnlyCreate         bool                  `receipt:"only_create"`
+	UseImageWorkingDir bool                  `receipt:"use_image_working_dir"`
+	HostDir            string                `receipt:"host_dir"`
+	// Network is NetworkNone unless set, so receipts are hermetic by
+	// default
+	Network    string   `receipt:"network"`
+	ExtraHosts []string `receipt:"extra_hosts"`
+	DNS        []string `receipt:"dns"`
+	// Resources limit the container, receipts are unlimited by default
+	Resources Resources `receipt:"resources"`
+	// Security hardens the container, see StrictSecurity for a preset
+	Security Security `receipt:"security"`
+	// Secrets are provided read-only at SecretsDir/<name> by the backend,
+	// their values are redacted from output
+	Secrets        map[string]Secret `receipt:"secrets"`
+	SecretProvider SecretProvider
+	// Caches map names of volumes to container paths, volumes outlive the
+	// receipt, so e.g. downloaded dependencies are reused by the next run.
+	// Managers implementing VolumeManager label them by CacheLabel.
+	Caches map[string]string `receipt:"caches"`
+	// PullProgress, if set, receives pull events of managers implementing
+	// ProgressPuller, see NewPullRenderer for a terminal output
+	PullProgress func(PullEvent)
+}
+
+func RunReceipt(cm Manager, receipt Receipt) (*ReceiptResult, error) {
+	return RunReceiptContext(context.Background(), cm, receipt)
+}
+
+// RunReceiptContext runs receipt until it finishes or ctx is done. Timeout
+// of the receipt, if any, limits the whole run including pulling and copying.
+func RunReceiptContext(ctx context.Context, cm Manager, receipt Receipt) (*ReceiptResult, error) {
+	if receipt.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, receipt.Timeout)
+		defer cancel()
+	}
+
+	r := &receiptRunner{
+		receipt: receipt,
+		result:  &ReceiptResult{},
+	}
+	err := r.run(ctx, cm)
+	if err != nil && ctx.Err() != nil {
+		err = &TimeoutError{Phase: r.phase, Err: ctx.Err()}
+	}
+	return r.result, err
+}
+
+type receiptRunner struct {
+	receipt Receipt
+	result  *ReceiptResult
+	// phase is the part of the run in progress, used to report timeouts
+	phase string
+	// secrets are values redacted from output
+	secrets [][]byte
+}
+
+func (r *receiptRunner) run(ctx context.Context, cm Manager) error {
+	receipt := r.receipt
+
+	if receipt.Build == nil {
+		policy := receipt.PullPolicy
+		if receipt.UseLocalImage {
+			policy = PullNever
+		}
+		r.phase = PhasePull
+		if err := pullImage(ctx, cm, receipt.Image, policy, receipt.PullProgress); err != nil {
 			return err
 		}
 	}
@@ -33,68 +205,276 @@ func RunReceipt(cm Manager, receipt Receipt) error {
 		mounts = cm.GetSystemMounts()
 	}
 
-	wd, err := os.Getwd()
-	if err != nil {
-		return err
+	wd := receipt.HostDir
+	if wd == "" {
+		var err error
+		if wd, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	r.receipt.HostDir = wd
+
+	image := receipt.Image
+	if receipt.Build != nil {
+		r.phase = PhaseBuild
+		var err error
+		if image, err = r.build(ctx, cm); err != nil {
+			return err
+		}
+	}
+
+	if len(receipt.Caches) > 0 {
+		r.phase = PhaseCreate
+		if err := createCaches(ctx, cm, receipt.Caches); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(receipt.Caches) {
+		mounts = append(mounts, Mount{Type: MountVolume, Source: name, Target: receipt.Caches[name]})
+	}
+
+	var secrets map[string][]byte
+	if len(receipt.Secrets) > 0 {
+		r.phase = PhaseCreate
+		var err error
+		if secrets, err = readSecrets(ctx, receipt.Secrets, wd, receipt.SecretProvider); err != nil {
+			return err
+		}
+		r.secrets = redactedValues(secrets)
 	}
 
 	config := Config{
-		Image:  receipt.Image,
-		Cmd:    receipt.Cmd,
-		Env:    receipt.Env,
-		Mounts: mounts,
+		Image:      image,
+		Cmd:        receipt.Cmd,
+		Env:        receipt.Env,
+		Mounts:     mounts,
+		HostDir:    wd,
+		Network:    receipt.Network,
+		ExtraHosts: receipt.ExtraHosts,
+		DNS:        receipt.DNS,
+		Resources:  receipt.Resources,
+		Security:   receipt.Security,
+		Secrets:    secrets,
+	}
+	if config.Network == "" {
+		config.Network = NetworkNone
+	}
+
+	if len(receipt.Steps) > 0 {
+		config.Cmd = stepsIdleCmd
 	}
 
 	if !receipt.UseImageWorkingDir {
 		config.WorkingDir = wd
 	}
 
-	cntr, err := cm.ContainerCreate(config)
+	r.phase = PhaseCreate
+	cntr, err := cm.ContainerCreate(ctx, config)
 
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		isRunning, _ := cntr.IsRunning()
-		if isRunning {
-			cntr.Stop(receipt.Timeout)
-		}
-		cntr.Remove()
-	}()
+	r.result.ContainerID = cntr.ID()
+	r.result.ImageDigest, err = cntr.ImageDigest(ctx)
+	if err != nil {
+		cntr.GetLogger().WithError(err).Warn("Cannot get image digest")
+	}
+
+	defer r.cleanup(cntr)
+	if r.result.ImageDigest == "" {
+		// Some backends know the image only once the container is started
+		defer func() {
+			r.result.ImageDigest, _ = cntr.ImageDigest(context.Background())
+		}()
+	}
 
 	if !receipt.OnlyCreate {
-		if err := startReceiptContainer(cntr, receipt); err != nil {
+		if err := r.start(ctx, cntr); err != nil {
 			return err
 		}
 	}
 
-	for src, dest := range receipt.OutputCopy {
-		cntr.CopyFrom(src, dest)
+	r.phase = PhaseCopyOut
+	r.result.OutputCopy = copyOutputs(ctx, cntr, wd, receipt.OutputCopy, receipt.OutputPolicy)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
+	return failedCopies(r.result.OutputCopy)
+}
+
+// createCaches labels cache volumes by CacheLabel with managers managing
+// volumes, so they can be listed and pruned, other managers create volumes
+// on mount
+func createCaches(ctx context.Context, cm Manager, caches map[string]string) error {
+	vm, ok := cm.(VolumeManager)
+	if !ok {
+		return nil
+	}
+	for _, name := range sortedKeys(caches) {
+		if _, err := vm.VolumeCreate(ctx, name, map[string]string{CacheLabel: "true"}); err != nil {
+			log.WithError(err).WithField("volume", name).Error("Error creating cache volume")
+			return err
+		}
+	}
 	return nil
 }
 
-func startReceiptContainer(cntr Container, receipt Receipt) error {
-	for src, dest := range receipt.InputCopy {
-		if _, err := os.Stat(src); err != nil {
-			continue
+// build builds image of the receipt and returns its ID, Image of the receipt
+// is added to tags of the image
+func (r *receiptRunner) build(ctx context.Context, cm Manager) (string, error) {
+	builder, ok := cm.(ImageBuilder)
+	if !ok {
+		return "", fmt.Errorf("manager %T cannot build images", cm)
+	}
+
+	spec := *r.receipt.Build
+	spec.Context = hostPath(r.receipt.HostDir, spec.Context)
+	if r.receipt.Image != "" {
+		spec.Tags = append(append([]string(nil), spec.Tags...), r.receipt.Image)
+	}
+	id, err := builder.BuildImage(ctx, spec)
+	if err != nil {
+		log.WithError(err).WithField("context", spec.Context).Error("Error building image")
+		return "", err
+	}
+	r.result.ImageID = id
+	return id, nil
+}
+
+// cleanup stops container gracefully, kills it if it is still running and
+// removes it. It doesn't use run context, which may be already expired.
+func (r *receiptRunner) cleanup(cntr Container) {
+	ctx := context.Background()
+
+	isRunning, _ := cntr.IsRunning(ctx)
+	if isRunning {
+		stopTimeout := r.receipt.StopTimeout
+		if stopTimeout == 0 {
+			stopTimeout = defaultStopTimeout
+		}
+		if err := cntr.Stop(ctx, stopTimeout); err != nil {
+			cntr.Kill(ctx)
+		} else if isRunning, _ = cntr.IsRunning(ctx); isRunning {
+			cntr.Kill(ctx)
 		}
-		cntr.CopyTo(src, dest)
 	}
+	cntr.Remove(ctx)
+}
 
-	if err := cntr.Start(); err != nil {
+func (r *receiptRunner) start(ctx context.Context, cntr Container) error {
+	receipt, result := r.receipt, r.result
+
+	r.phase = PhaseCopyIn
+	result.InputCopy = copyInputs(ctx, cntr, receipt.HostDir, receipt.InputCopy, receipt.InputPolicy)
+	if err := failedCopies(result.InputCopy); err != nil {
 		return err
 	}
 
-	exitCode, err := cntr.Wait(true)
+	var stdout, stderr bytes.Buffer
+	stdoutW := stream.NewRedactWriter(io.MultiWriter(os.Stdout, &stdout), r.secrets)
+	stderrW := stream.NewRedactWriter(io.MultiWriter(os.Stderr, &stderr), r.secrets)
+	defer func() {
+		_ = stdoutW.Flush()
+		_ = stderrW.Flush()
+		result.Stdout = stdout.Bytes()
+		result.Stderr = stderr.Bytes()
+	}()
+
+	r.phase = PhaseStart
+	result.StartedAt = time.Now()
+	defer func() { result.FinishedAt = time.Now() }()
+
+	if err := cntr.Start(ctx); err != nil {
+		return err
+	}
+
+	r.phase = PhaseRun
+	if len(receipt.Steps) > 0 {
+		return runReceiptSteps(ctx, cntr, receipt.Steps, result, stdoutW, stderrW)
+	}
+
+	exitCode, err := cntr.Wait(ctx, stdoutW, stderrW)
+	if exitErr, ok := err.(*ExitError); ok && exitErr.OOMKilled {
+		result.ExitCode = exitErr.Code
+		result.OOMKilled = true
+		cntr.GetLogger().Errorf("Container was killed by OOM killer with code: %d", exitErr.Code)
+		return err
+	}
 	if err != nil {
 		return err
 	}
+	result.ExitCode = exitCode
 	if exitCode != 0 {
 		cntr.GetLogger().Errorf("Container exited with non-zero code: %d", exitCode)
-		return errors.New("failed to run receipt")
+		return &ExitError{ContainerID: cntr.ID(), Code: exitCode}
+	}
+
+	return nil
+}
+
+func hostPath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func runReceiptSteps(ctx context.Context, cntr Container, steps []Step, result *ReceiptResult, stdout, stderr io.Writer) error {
+	for i, step := range steps {
+		name := step.Name
+		if name == "" {
+			name = step.Cmd
+		}
+		l := cntr.GetLogger().WithFields(log.Fields{
+			"step": i,
+			"name": name,
+		})
+
+		l.Info("Running step")
+		exitCode, err := cntr.Exec(ctx, ExecConfig{
+			Cmd:        step.Cmd,
+			Env:        step.Env,
+			WorkingDir: step.WorkingDir,
+			Stdout:     stdout,
+			Stderr:     stderr,
+		})
+		exitErr, oomKilled := err.(*ExitError)
+		oomKilled = oomKilled && exitErr.OOMKilled
+		if err != nil && !oomKilled {
+			return err
+		}
+
+		result.Steps = append(result.Steps, StepResult{Name: name, ExitCode: exitCode})
+		if oomKilled {
+			result.ExitCode = exitCode
+			result.OOMKilled = true
+			l.Errorf("Step was killed by OOM killer with code: %d", exitCode)
+			return err
+		}
+
+		l = l.WithField("exitCode", exitCode)
+		if exitCode == 0 {
+			l.Info("Step finished")
+			continue
+		}
+		if step.ContinueOnError {
+			l.Warn("Step exited with non-zero code, continuing")
+			continue
+		}
+		l.Error("Step exited with non-zero code")
+		result.ExitCode = exitCode
+		return &StepError{Index: i, Name: name, ExitCode: exitCode, Err: &ExitError{ContainerID: cntr.ID(), Code: exitCode}}
 	}
 
 	return nil
@@ -0,0 +1,655 @@
+package contman
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
+	yaml "gopkg.in/yaml.v3"
+)
+
+type ReceiptFormat int
+
+const (
+	FormatYAML ReceiptFormat = iota
+	FormatJSON
+	FormatTOML
+)
+
+func (f ReceiptFormat) String() string {
+	switch f {
+	case FormatYAML:
+		return "yaml"
+	case FormatJSON:
+		return "json"
+	case FormatTOML:
+		return "toml"
+	}
+	return fmt.Sprintf("ReceiptFormat(%d)", int(f))
+}
+
+// ReceiptError points to a single problem in a receipt file. Line and
+// Column are 1-based and zero when the position is unknown.
+type ReceiptError struct {
+	Field  string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ReceiptError) Error() string {
+	var prefix string
+	if e.Line > 0 {
+		prefix = fmt.Sprintf("line %d, column %d: ", e.Line, e.Column)
+	}
+	if e.Field != "" {
+		prefix += e.Field + ": "
+	}
+	return prefix + e.Msg
+}
+
+type ReceiptErrors []*ReceiptError
+
+func (es ReceiptErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func LoadReceipt(r io.Reader, format ReceiptFormat) (*Receipt, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var root *fileNode
+	switch format {
+	case FormatYAML:
+		root, err = parseYAMLNode(data)
+	case FormatJSON:
+		root, err = parseJSONNode(data)
+	case FormatTOML:
+		root, err = parseTOMLNode(data)
+	default:
+		return nil, fmt.Errorf("unknown receipt format: %v", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &Receipt{}
+	d := receiptDecoder{positions: map[string]*fileNode{"": root}}
+	d.decode(root, reflect.ValueOf(receipt).Elem(), "")
+	if len(d.errs) > 0 {
+		return nil, d.errs
+	}
+
+	if err := ValidateReceipt(*receipt); err != nil {
+		if errs, ok := err.(ReceiptErrors); ok {
+			for _, e := range errs {
+				d.locate(e)
+			}
+		}
+		return nil, err
+	}
+
+	return receipt, nil
+}
+
+func LoadReceiptFile(path string) (*Receipt, error) {
+	var format ReceiptFormat
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = FormatYAML
+	case ".json":
+		format = FormatJSON
+	case ".toml":
+		format = FormatTOML
+	default:
+		return nil, fmt.Errorf("cannot guess receipt format of %s", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return LoadReceipt(f, format)
+}
+
+func ValidateReceipt(receipt Receipt) error {
+	var errs ReceiptErrors
+
+	if receipt.Image == "" && receipt.Build == nil {
+		errs = append(errs, &ReceiptError{Field: "image", Msg: "image or build is required"})
+	}
+	if receipt.Build != nil && receipt.UseLocalImage {
+		errs = append(errs, &ReceiptError{Field: "use_local_image", Msg: "use_local_image and build cannot be used together"})
+	}
+	if receipt.Cmd == "" && len(receipt.Steps) == 0 && !receipt.OnlyCreate {
+		errs = append(errs, &ReceiptError{Field: "cmd", Msg: "cmd or steps are required unless only_create is set"})
+	}
+	if receipt.Cmd != "" && len(receipt.Steps) > 0 {
+		errs = append(errs, &ReceiptError{Field: "steps", Msg: "cmd and steps cannot be used together"})
+	}
+	for i, step := range receipt.Steps {
+		if step.Cmd == "" {
+			errs = append(errs, &ReceiptError{Field: fmt.Sprintf("steps[%d].cmd", i), Msg: "step cmd is required"})
+		}
+	}
+	if receipt.Timeout < 0 {
+		errs = append(errs, &ReceiptError{Field: "timeout", Msg: "timeout cannot be negative"})
+	}
+	if receipt.StopTimeout < 0 {
+		errs = append(errs, &ReceiptError{Field: "stop_timeout", Msg: "stop timeout cannot be negative"})
+	}
+	for src, dest := range receipt.InputCopy {
+		if src == "" || dest == "" {
+			errs = append(errs, &ReceiptError{Field: "input_copy", Msg: "source and destination cannot be empty"})
+		}
+	}
+	for src, dest := range receipt.OutputCopy {
+		if src == "" || dest == "" {
+			errs = append(errs, &ReceiptError{Field: "output_copy", Msg: "source and destination cannot be empty"})
+		}
+	}
+	for src := range receipt.InputPolicy {
+		if _, ok := receipt.InputCopy[src]; !ok {
+			errs = append(errs, &ReceiptError{Field: "input_policy." + src, Msg: "policy for unknown input copy"})
+		}
+	}
+	for src := range receipt.OutputPolicy {
+		if _, ok := receipt.OutputCopy[src]; !ok {
+			errs = append(errs, &ReceiptError{Field: "output_policy." + src, Msg: "policy for unknown output copy"})
+		}
+	}
+	for _, name := range sortedSecrets(receipt.Secrets) {
+		if receipt.Secrets[name].sources() != 1 {
+			errs = append(errs, &ReceiptError{Field: "secrets." + name, Msg: "exactly one of file, env and provider is required"})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+type nodeKind int
+
+const (
+	nullNode nodeKind = iota
+	scalarNode
+	mapNode
+	listNode
+)
+
+type scalarTag int
+
+const (
+	strTag scalarTag = iota
+	boolTag
+	intTag
+	floatTag
+)
+
+// fileNode is a format independent view on a parsed receipt file, which
+// keeps source positions for error reporting.
+type fileNode struct {
+	kind   nodeKind
+	tag    scalarTag
+	value  string
+	keys   []string
+	values []*fileNode
+	line   int
+	column int
+}
+
+func parseYAMLNode(data []byte) (*fileNode, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		e := &ReceiptError{Msg: err.Error()}
+		if _, scanErr := fmt.Sscanf(e.Msg, "yaml: line %d:", &e.Line); scanErr == nil {
+			e.Msg = strings.SplitN(e.Msg, ": ", 3)[2]
+		}
+		return nil, ReceiptErrors{e}
+	}
+	if len(doc.Content) == 0 {
+		return &fileNode{kind: mapNode, line: 1, column: 1}, nil
+	}
+	return convertYAMLNode(doc.Content[0])
+}
+
+func convertYAMLNode(n *yaml.Node) (*fileNode, error) {
+	node := &fileNode{line: n.Line, column: n.Column}
+
+	switch n.Kind {
+	case yaml.AliasNode:
+		return convertYAMLNode(n.Alias)
+	case yaml.ScalarNode:
+		node.kind = scalarNode
+		node.value = n.Value
+		switch n.ShortTag() {
+		case "!!null":
+			node.kind = nullNode
+		case "!!bool":
+			node.tag = boolTag
+		case "!!int":
+			node.tag = intTag
+		case "!!float":
+			node.tag = floatTag
+		}
+	case yaml.MappingNode:
+		node.kind = mapNode
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			value, err := convertYAMLNode(n.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			node.keys = append(node.keys, n.Content[i].Value)
+			node.values = append(node.values, value)
+		}
+	case yaml.SequenceNode:
+		node.kind = listNode
+		for _, item := range n.Content {
+			value, err := convertYAMLNode(item)
+			if err != nil {
+				return nil, err
+			}
+			node.values = append(node.values, value)
+		}
+	default:
+		return nil, ReceiptErrors{{Line: n.Line, Column: n.Column, Msg: "unsupported yaml node"}}
+	}
+
+	return node, nil
+}
+
+type jsonParser struct {
+	data []byte
+	dec  *json.Decoder
+}
+
+func parseJSONNode(data []byte) (*fileNode, error) {
+	p := &jsonParser{data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+	p.dec.UseNumber()
+
+	node, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.dec.Token(); err != io.EOF {
+		return nil, p.errorAt(p.dec.InputOffset(), "unexpected data after top-level value")
+	}
+	return node, nil
+}
+
+func (p *jsonParser) position(offset int64) (line, column int) {
+	line, column = 1, 1
+	if offset > int64(len(p.data)) {
+		offset = int64(len(p.data))
+	}
+	for _, c := range p.data[:offset] {
+		if c == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return
+}
+
+func (p *jsonParser) errorAt(offset int64, msg string) error {
+	line, column := p.position(offset)
+	return ReceiptErrors{{Line: line, Column: column, Msg: msg}}
+}
+
+// tokenStart skips whitespace and separators preceding the next token, so
+// that positions point at the token itself rather than at the previous one.
+func (p *jsonParser) tokenStart() int64 {
+	offset := p.dec.InputOffset()
+	for offset < int64(len(p.data)) && strings.IndexByte(" \t\r\n,:", p.data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func (p *jsonParser) parseValue() (*fileNode, error) {
+	offset := p.tokenStart()
+	tok, err := p.dec.Token()
+	if err != nil {
+		if serr, ok := err.(*json.SyntaxError); ok {
+			return nil, p.errorAt(serr.Offset, serr.Error())
+		}
+		return nil, p.errorAt(offset, err.Error())
+	}
+	return p.parseToken(tok, offset)
+}
+
+func (p *jsonParser) parseToken(tok json.Token, offset int64) (*fileNode, error) {
+	node := &fileNode{}
+	node.line, node.column = p.position(offset)
+
+	switch v := tok.(type) {
+	case nil:
+		node.kind = nullNode
+	case bool:
+		node.kind = scalarNode
+		node.tag = boolTag
+		node.value = strconv.FormatBool(v)
+	case json.Number:
+		node.kind = scalarNode
+		node.tag = floatTag
+		if _, err := v.Int64(); err == nil {
+			node.tag = intTag
+		}
+		node.value = v.String()
+	case string:
+		node.kind = scalarNode
+		node.value = v
+	case json.Delim:
+		switch v {
+		case '{':
+			node.kind = mapNode
+			for p.dec.More() {
+				keyOffset := p.tokenStart()
+				key, err := p.dec.Token()
+				if err != nil {
+					return nil, p.errorAt(keyOffset, err.Error())
+				}
+				value, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				node.keys = append(node.keys, key.(string))
+				node.values = append(node.values, value)
+			}
+		case '[':
+			node.kind = listNode
+			for p.dec.More() {
+				value, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				node.values = append(node.values, value)
+			}
+		}
+		if _, err := p.dec.Token(); err != nil {
+			return nil, p.errorAt(p.dec.InputOffset(), err.Error())
+		}
+	}
+
+	return node, nil
+}
+
+func parseTOMLNode(data []byte) (*fileNode, error) {
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		e := &ReceiptError{Msg: err.Error()}
+		if _, scanErr := fmt.Sscanf(e.Msg, "(%d, %d): ", &e.Line, &e.Column); scanErr == nil {
+			e.Msg = strings.SplitN(e.Msg, ": ", 2)[1]
+		}
+		return nil, ReceiptErrors{e}
+	}
+
+	root := convertTOMLTree(tree)
+	root.line, root.column = 1, 1
+	return root, nil
+}
+
+func convertTOMLTree(tree *toml.Tree) *fileNode {
+	pos := tree.Position()
+	node := &fileNode{kind: mapNode, line: pos.Line, column: pos.Col}
+
+	keys := tree.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		pos := tree.GetPositionPath([]string{key})
+		node.keys = append(node.keys, key)
+		node.values = append(node.values, convertTOMLValue(tree.GetPath([]string{key}), pos))
+	}
+
+	return node
+}
+
+func convertTOMLValue(value interface{}, pos toml.Position) *fileNode {
+	node := &fileNode{kind: scalarNode, line: pos.Line, column: pos.Col}
+
+	switch v := value.(type) {
+	case nil:
+		node.kind = nullNode
+	case *toml.Tree:
+		return convertTOMLTree(v)
+	case []*toml.Tree:
+		node.kind = listNode
+		for _, item := range v {
+			node.values = append(node.values, convertTOMLTree(item))
+		}
+	case []interface{}:
+		node.kind = listNode
+		for _, item := range v {
+			node.values = append(node.values, convertTOMLValue(item, pos))
+		}
+	case string:
+		node.value = v
+	case bool:
+		node.tag = boolTag
+		node.value = strconv.FormatBool(v)
+	case int64:
+		node.tag = intTag
+		node.value = strconv.FormatInt(v, 10)
+	case float64:
+		node.tag = floatTag
+		node.value = strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		node.value = fmt.Sprint(v)
+	}
+
+	return node
+}
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// receiptDecoder fills Go values from a fileNode tree using the `receipt`
+// struct tags. It keeps going after a bad field, so a single pass reports
+// every problem in the file.
+type receiptDecoder struct {
+	errs      ReceiptErrors
+	positions map[string]*fileNode
+}
+
+func (d *receiptDecoder) fail(n *fileNode, path, format string, args ...interface{}) {
+	d.errs = append(d.errs, &ReceiptError{
+		Field:  path,
+		Line:   n.line,
+		Column: n.column,
+		Msg:    fmt.Sprintf(format, args...),
+	})
+}
+
+// locate fills the position of an error produced after decoding, falling
+// back to the closest known parent field.
+func (d *receiptDecoder) locate(e *ReceiptError) {
+	path := e.Field
+	for {
+		if n, ok := d.positions[path]; ok {
+			e.Line, e.Column = n.line, n.column
+			return
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			path = ""
+		} else {
+			path = path[:i]
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func (d *receiptDecoder) decode(n *fileNode, v reflect.Value, path string) {
+	d.positions[path] = n
+
+	if n.kind == nullNode {
+		return
+	}
+
+	if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		if n.kind != scalarNode {
+			d.fail(n, path, "expected scalar value")
+			return
+		}
+		if err := v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(n.value)); err != nil {
+			d.fail(n, path, "%v", err)
+		}
+		return
+	}
+
+	if v.Type() == durationType {
+		d.decodeDuration(n, v, path)
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		d.decode(n, v.Elem(), path)
+	case reflect.String:
+		if n.kind != scalarNode {
+			d.fail(n, path, "expected string")
+			return
+		}
+		v.SetString(n.value)
+	case reflect.Bool:
+		if n.kind != scalarNode || n.tag != boolTag {
+			d.fail(n, path, "expected boolean")
+			return
+		}
+		v.SetBool(n.value == "true")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(n.value, 0, v.Type().Bits())
+		if n.kind != scalarNode || n.tag != intTag || err != nil {
+			d.fail(n, path, "expected integer")
+			return
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(n.value, 0, v.Type().Bits())
+		if n.kind != scalarNode || n.tag != intTag || err != nil {
+			d.fail(n, path, "expected non-negative integer")
+			return
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(n.value, v.Type().Bits())
+		if n.kind != scalarNode || (n.tag != intTag && n.tag != floatTag) || err != nil {
+			d.fail(n, path, "expected number")
+			return
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if n.kind != listNode {
+			d.fail(n, path, "expected list")
+			return
+		}
+		slice := reflect.MakeSlice(v.Type(), len(n.values), len(n.values))
+		for i, item := range n.values {
+			d.decode(item, slice.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+		v.Set(slice)
+	case reflect.Map:
+		if n.kind != mapNode {
+			d.fail(n, path, "expected mapping")
+			return
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			d.fail(n, path, "unsupported map key type %v", v.Type().Key())
+			return
+		}
+		m := reflect.MakeMap(v.Type())
+		for i, key := range n.keys {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			d.decode(n.values[i], elem, joinPath(path, key))
+			m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		if n.kind != mapNode {
+			d.fail(n, path, "expected mapping")
+			return
+		}
+		d.decodeStruct(n, v, path)
+	default:
+		d.fail(n, path, "unsupported field type %v", v.Type())
+	}
+}
+
+func (d *receiptDecoder) decodeStruct(n *fileNode, v reflect.Value, path string) {
+	fields := map[string]int{}
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("receipt")
+		if name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+
+	for i, key := range n.keys {
+		idx, ok := fields[key]
+		if !ok {
+			d.fail(n.values[i], joinPath(path, key), "unknown field")
+			continue
+		}
+		d.decode(n.values[i], v.Field(idx), joinPath(path, key))
+	}
+}
+
+// decodeDuration accepts either a Go duration string such as "1m30s" or a
+// plain number of seconds.
+func (d *receiptDecoder) decodeDuration(n *fileNode, v reflect.Value, path string) {
+	if n.kind != scalarNode {
+		d.fail(n, path, "expected duration")
+		return
+	}
+
+	switch n.tag {
+	case intTag, floatTag:
+		secs, err := strconv.ParseFloat(n.value, 64)
+		if err != nil {
+			d.fail(n, path, "expected duration")
+			return
+		}
+		v.SetInt(int64(secs * float64(time.Second)))
+	default:
+		dur, err := time.ParseDuration(n.value)
+		if err != nil {
+			d.fail(n, path, "invalid duration %q", n.value)
+			return
+		}
+		v.SetInt(int64(dur))
+	}
+}
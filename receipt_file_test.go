@@ -0,0 +1,164 @@
+package contman
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const yamlReceipt = `
+image: alpine:latest
+cmd: sed "s/README.md/$MD/g" -i /README.md
+env:
+  MD: WRITEYOU.md
+input_copy:
+  README.md: /
+output_copy:
+  /README.md: .
+  /tmp/*.log: logs
+output_policy:
+  /tmp/*.log: glob
+timeout: 1m30s
+use_control_socket: false
+use_local_image: true
+`
+
+const jsonReceipt = `{
+  "image": "alpine:latest",
+  "cmd": "echo Hello World!",
+  "env": {"GREETING": "hello"},
+  "timeout": 10,
+  "only_create": false
+}`
+
+const tomlReceipt = `
+image = "alpine:latest"
+cmd = "echo Hello World!"
+timeout = "5s"
+use_image_working_dir = true
+pull_policy = "if-not-present"
+
+[env]
+GREETING = "hello"
+`
+
+const stepsReceipt = `
+image: golang:alpine
+steps:
+  - name: build
+    cmd: go build ./...
+  - cmd: go vet ./...
+    continue_on_error: true
+  - cmd: go test ./...
+    working_dir: /src
+    env:
+      CGO_ENABLED: 0
+`
+
+func TestLoadReceipt(t *testing.T) {
+	receipt, err := LoadReceipt(strings.NewReader(yamlReceipt), FormatYAML)
+	if err != nil {
+		t.Fatal("Cannot load yaml receipt: ", err)
+	}
+	if receipt.Image != "alpine:latest" || receipt.Env["MD"] != "WRITEYOU.md" ||
+		receipt.InputCopy["README.md"] != "/" || receipt.OutputCopy["/README.md"] != "." ||
+		receipt.OutputPolicy["/tmp/*.log"] != CopyGlob ||
+		receipt.Timeout != 90*time.Second || !receipt.UseLocalImage {
+		t.Errorf("Unexpected yaml receipt: %+v", receipt)
+	}
+
+	receipt, err = LoadReceipt(strings.NewReader(jsonReceipt), FormatJSON)
+	if err != nil {
+		t.Fatal("Cannot load json receipt: ", err)
+	}
+	if receipt.Cmd != "echo Hello World!" || receipt.Env["GREETING"] != "hello" || receipt.Timeout != 10*time.Second {
+		t.Errorf("Unexpected json receipt: %+v", receipt)
+	}
+
+	receipt, err = LoadReceipt(strings.NewReader(tomlReceipt), FormatTOML)
+	if err != nil {
+		t.Fatal("Cannot load toml receipt: ", err)
+	}
+	if receipt.Env["GREETING"] != "hello" || receipt.Timeout != 5*time.Second || !receipt.UseImageWorkingDir ||
+		receipt.PullPolicy != PullIfNotPresent {
+		t.Errorf("Unexpected toml receipt: %+v", receipt)
+	}
+
+	receipt, err = LoadReceipt(strings.NewReader(stepsReceipt), FormatYAML)
+	if err != nil {
+		t.Fatal("Cannot load receipt with steps: ", err)
+	}
+	if len(receipt.Steps) != 3 || receipt.Steps[0].Name != "build" || !receipt.Steps[1].ContinueOnError ||
+		receipt.Steps[2].WorkingDir != "/src" || receipt.Steps[2].Env["CGO_ENABLED"] != "0" {
+		t.Errorf("Unexpected receipt steps: %+v", receipt.Steps)
+	}
+}
+
+func TestLoadReceiptErrors(t *testing.T) {
+	tests := []struct {
+		format ReceiptFormat
+		input  string
+		errors []ReceiptError
+	}{
+		{
+			FormatYAML,
+			"image: alpine\ncmd: true\nonly_create: yes please\nbogus: 1\n",
+			[]ReceiptError{
+				{Field: "only_create", Line: 3, Column: 14},
+				{Field: "bogus", Line: 4, Column: 8},
+			},
+		},
+		{
+			FormatYAML,
+			"image: alpine\ncmd: ls\ninput_policy:\n  a.txt: maybe\n",
+			[]ReceiptError{{Field: "input_policy.a.txt", Line: 4, Column: 10}},
+		},
+		{
+			FormatYAML,
+			"cmd: ls\n",
+			[]ReceiptError{{Field: "image", Line: 1, Column: 1}},
+		},
+		{
+			FormatYAML,
+			"cmd: ls\nuse_local_image: true\nbuild:\n  context: .\n",
+			[]ReceiptError{{Field: "use_local_image", Line: 2, Column: 18}},
+		},
+		{
+			FormatJSON,
+			"{\n  \"image\": \"alpine\",\n  \"cmd\": \"ls\",\n  \"env\": [\"A=B\"]\n}",
+			[]ReceiptError{{Field: "env", Line: 4, Column: 10}},
+		},
+		{
+			FormatTOML,
+			"image = \"alpine\"\ncmd = \"ls\"\ntimeout = \"forever\"\n",
+			[]ReceiptError{{Field: "timeout", Line: 3, Column: 1}},
+		},
+		{
+			FormatYAML,
+			"image: alpine\ncmd: ls\nsecrets:\n  both:\n    file: token\n    env: TOKEN\n  none: {}\n",
+			[]ReceiptError{
+				{Field: "secrets.both", Line: 5, Column: 5},
+				{Field: "secrets.none", Line: 7, Column: 9},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		_, err := LoadReceipt(strings.NewReader(test.input), test.format)
+		errs, ok := err.(ReceiptErrors)
+		if !ok {
+			t.Errorf("%v: expected ReceiptErrors, got %v", test.format, err)
+			continue
+		}
+		if len(errs) != len(test.errors) {
+			t.Errorf("%v: expected %d errors, got %v", test.format, len(test.errors), errs)
+			continue
+		}
+		for i, e := range errs {
+			want := test.errors[i]
+			if e.Field != want.Field || e.Line != want.Line || e.Column != want.Column {
+				t.Errorf("%v: expected error at %s %d:%d, got %v", test.format, want.Field, want.Line, want.Column, e)
+			}
+		}
+	}
+}
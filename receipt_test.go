@@ -0,0 +1,474 @@
+package contman_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/elemir/contman"
+	"github.com/elemir/contman/contmantest"
+)
+
+func newTestManager() *contmantest.Manager {
+	cm := contmantest.NewManager()
+	cm.AddRemoteImage("alpine:latest", "sha256:alpine")
+	return cm
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "contman-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRunReceiptResult(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "input.txt"), []byte("input"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := newTestManager()
+	cm.OnCmd("build", contmantest.Behavior{
+		Stdout: "building\n",
+		Files:  map[string]string{"/out/result.txt": "result"},
+	})
+
+	result, err := contman.RunReceipt(cm, contman.Receipt{
+		Image:      "alpine:latest",
+		Cmd:        "build",
+		InputCopy:  map[string]string{"input.txt": "/src"},
+		OutputCopy: map[string]string{"/out": "."},
+		HostDir:    dir,
+	})
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+
+	if result.ExitCode != 0 || result.ImageDigest != "sha256:alpine" || string(result.Stdout) != "building\n" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if pulls := cm.Pulls(); len(pulls) != 1 || pulls[0] != "alpine:latest" {
+		t.Errorf("Unexpected pulls: %v", pulls)
+	}
+
+	cntr := cm.Containers()[0]
+	if cntr.ID() != result.ContainerID || cntr.State() != contmantest.Removed {
+		t.Errorf("Container %s is %v after run", cntr.ID(), cntr.State())
+	}
+	if data, ok := cntr.ReadFile("/src/input.txt"); !ok || string(data) != "input" {
+		t.Error("Input was not copied into container")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "out", "result.txt")); err != nil || string(data) != "result" {
+		t.Error("Output was not copied from container: ", err)
+	}
+}
+
+func TestRunReceiptExitError(t *testing.T) {
+	cm := newTestManager()
+	cm.OnCmd("false", contmantest.Behavior{ExitCode: 2, Stderr: "failed\n"})
+
+	result, err := contman.RunReceipt(cm, contman.Receipt{Image: "alpine:latest", Cmd: "false"})
+	exitErr, ok := err.(*contman.ExitError)
+	if !ok {
+		t.Fatal("Expected exit error, got: ", err)
+	}
+	if exitErr.Code != 2 || result.ExitCode != 2 || string(result.Stderr) != "failed\n" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+}
+
+func TestRunReceiptOOMKilled(t *testing.T) {
+	cm := newTestManager()
+	cm.OnCmd("allocate", contmantest.Behavior{OOMKilled: true})
+
+	result, err := contman.RunReceipt(cm, contman.Receipt{
+		Image:     "alpine:latest",
+		Cmd:       "allocate",
+		Resources: contman.Resources{Memory: 64 << 20, PidsLimit: 100},
+	})
+	exitErr, ok := err.(*contman.ExitError)
+	if !ok || !exitErr.OOMKilled {
+		t.Fatal("Expected OOM error, got: ", err)
+	}
+	if !result.OOMKilled || result.ExitCode != contmantest.KilledExitCode {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if limits := cm.Containers()[0].Config.Resources; limits.Memory != 64<<20 || limits.PidsLimit != 100 {
+		t.Errorf("Unexpected resources: %+v", limits)
+	}
+}
+
+func TestRunReceiptStepOOMKilled(t *testing.T) {
+	cm := newTestManager()
+	cm.OnExec("allocate", contmantest.Behavior{OOMKilled: true})
+
+	result, err := contman.RunReceipt(cm, contman.Receipt{
+		Image: "alpine:latest",
+		Steps: []contman.Step{{Cmd: "allocate", ContinueOnError: true}, {Cmd: "true"}},
+	})
+	if exitErr, ok := err.(*contman.ExitError); !ok || !exitErr.OOMKilled {
+		t.Fatal("Expected OOM error, got: ", err)
+	}
+	if !result.OOMKilled || len(result.Steps) != 1 || result.Steps[0].ExitCode != contmantest.KilledExitCode {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+}
+
+func TestRunReceiptSecrets(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CONTMAN_TEST_PASSWORD", "env-password")
+	defer os.Unsetenv("CONTMAN_TEST_PASSWORD")
+
+	var secretFiles map[string]string
+	cm := newTestManager()
+	cm.OnCmd("deploy", contmantest.Behavior{
+		Stdout: "token=file-token password=env-password key=vault-key\n",
+		Run: func(c *contmantest.Container) int {
+			secretFiles = map[string]string{}
+			for _, name := range c.Files() {
+				data, _ := c.ReadFile(name)
+				secretFiles[name] = string(data)
+			}
+			return 0
+		},
+	})
+
+	result, err := contman.RunReceipt(cm, contman.Receipt{
+		Image:   "alpine:latest",
+		Cmd:     "deploy",
+		HostDir: dir,
+		Secrets: map[string]contman.Secret{
+			"token":    {File: "token"},
+			"password": {Env: "CONTMAN_TEST_PASSWORD"},
+			"key":      {Provider: "ci/key"},
+		},
+		SecretProvider: contman.SecretProviderFunc(func(ctx context.Context, key string) ([]byte, error) {
+			return []byte("vault-" + filepath.Base(key)), nil
+		}),
+	})
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+
+	expected := map[string]string{
+		"/run/secrets/token":    "file-token\n",
+		"/run/secrets/password": "env-password",
+		"/run/secrets/key":      "vault-key",
+	}
+	if !reflect.DeepEqual(secretFiles, expected) {
+		t.Errorf("Unexpected secrets: %v", secretFiles)
+	}
+	if string(result.Stdout) != "token=*** password=*** key=***\n" {
+		t.Errorf("Secrets are not redacted: %q", result.Stdout)
+	}
+	if mounts := cm.Containers()[0].Config.Mounts; len(mounts) != 0 {
+		t.Errorf("Secrets are mounted by receipt: %+v", mounts)
+	}
+
+	_, err = contman.RunReceipt(cm, contman.Receipt{
+		Image:   "alpine:latest",
+		Cmd:     "deploy",
+		Secrets: map[string]contman.Secret{"missing": {Env: "CONTMAN_TEST_MISSING"}},
+	})
+	if !errors.Is(err, contman.ErrNotFound) {
+		t.Error("Expected missing secret error, got: ", err)
+	}
+
+	_, err = contman.RunReceipt(cm, contman.Receipt{
+		Image:   "alpine:latest",
+		Cmd:     "deploy",
+		Secrets: map[string]contman.Secret{"token": {File: "token", Env: "CONTMAN_TEST_TOKEN"}},
+	})
+	if err == nil {
+		t.Error("Secret with two sources was accepted")
+	}
+}
+
+func TestRunReceiptCaches(t *testing.T) {
+	cm := newTestManager()
+	receipt := contman.Receipt{
+		Image:  "golang:alpine",
+		Cmd:    "go build ./...",
+		Caches: map[string]string{"go-mod": "/go/pkg/mod", "go-build": "/root/.cache/go-build"},
+	}
+	cm.AddRemoteImage("golang:alpine", "sha256:golang")
+	for i := 0; i < 2; i++ {
+		if _, err := contman.RunReceipt(cm, receipt); err != nil {
+			t.Fatal("Cannot run receipt: ", err)
+		}
+	}
+
+	mounts := cm.Containers()[1].Config.Mounts
+	if len(mounts) != 2 || mounts[0] != (contman.Mount{Type: contman.MountVolume, Source: "go-build", Target: "/root/.cache/go-build"}) {
+		t.Errorf("Unexpected mounts: %+v", mounts)
+	}
+	cacheLabels := map[string]string{contman.CacheLabel: "true"}
+	if volumes, _ := cm.VolumeList(context.Background(), cacheLabels); len(volumes) != 2 {
+		t.Errorf("Unexpected volumes: %+v", volumes)
+	}
+	if pruned, _ := cm.VolumePrune(context.Background(), cacheLabels); len(pruned) != 2 {
+		t.Errorf("Caches are not pruned: %v", pruned)
+	}
+}
+
+func TestRunReceiptBuild(t *testing.T) {
+	cm := newTestManager()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var events []contman.BuildEvent
+	receipt := contman.Receipt{
+		Image: "app:test",
+		Cmd:   "app",
+		Build: &contman.BuildSpec{
+			Context: "app",
+			Target:  "runtime",
+			Events:  func(e contman.BuildEvent) { events = append(events, e) },
+		},
+		HostDir: dir,
+	}
+	result, err := contman.RunReceipt(cm, receipt)
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if pulls := cm.Pulls(); len(pulls) != 0 {
+		t.Errorf("Built image is pulled: %v", pulls)
+	}
+	spec := cm.Builds[0]
+	if spec.Context != filepath.Join(dir, "app") || !reflect.DeepEqual(spec.Tags, []string{"app:test"}) {
+		t.Errorf("Unexpected build: %+v", spec)
+	}
+	if result.ImageID == "" || cm.Containers()[0].Config.Image != result.ImageID {
+		t.Errorf("Built image is not run: %+v", result)
+	}
+	if len(events) == 0 || events[len(events)-1].ImageID != result.ImageID {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+
+	cm.FailBuild(errors.New("unknown instruction: RUNN"))
+	if _, err := contman.RunReceipt(cm, receipt); err == nil || len(cm.Containers()) != 1 {
+		t.Error("Failed build is run: ", err)
+	}
+}
+
+func TestRunReceiptPullPolicy(t *testing.T) {
+	cm := newTestManager()
+	cm.AddImage("golang:alpine", "sha256:golang")
+	cm.AddRemoteImage("golang:alpine", "sha256:golang")
+
+	for _, tc := range []struct {
+		image  string
+		policy contman.PullPolicy
+		pulled bool
+	}{
+		{"golang:alpine", contman.PullAlways, true},
+		{"golang:alpine", contman.PullIfNotPresent, false},
+		{"golang:alpine", contman.PullIfDigestChanged, false},
+		{"alpine:latest", contman.PullIfNotPresent, true},
+		{"alpine:latest", contman.PullIfNotPresent, false},
+		{"alpine:latest", contman.PullNever, false},
+	} {
+		pulls := len(cm.Pulls())
+		_, err := contman.RunReceipt(cm, contman.Receipt{Image: tc.image, Cmd: "true", PullPolicy: tc.policy})
+		if err != nil {
+			t.Fatalf("Cannot run %s with pull policy %v: %v", tc.image, tc.policy, err)
+		}
+		if pulled := len(cm.Pulls()) != pulls; pulled != tc.pulled {
+			t.Errorf("Image %s with pull policy %v is pulled: %v", tc.image, tc.policy, pulled)
+		}
+	}
+
+	cm.AddRemoteImage("golang:alpine", "sha256:golang-1.12")
+	pulls := len(cm.Pulls())
+	result, err := contman.RunReceipt(cm, contman.Receipt{Image: "golang:alpine", Cmd: "true", PullPolicy: contman.PullIfDigestChanged})
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if len(cm.Pulls()) != pulls+1 || result.ImageDigest != "sha256:golang-1.12" {
+		t.Errorf("Changed image is not pulled: %v %+v", cm.Pulls(), result)
+	}
+	if ok, err := cm.HasImage(context.Background(), "golang:alpine"); !ok || err != nil {
+		t.Error("Image is not found after pull: ", err)
+	}
+}
+
+func TestReleaseImage(t *testing.T) {
+	cm := newTestManager()
+	ctx := context.Background()
+
+	result, err := contman.RunReceipt(cm, contman.Receipt{Image: "app:rc", Cmd: "app --self-test", Build: &contman.BuildSpec{}})
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	var im contman.ImageManager = cm
+	if err := im.TagImage(ctx, "app:rc", "registry.example.com/app:1.0"); err != nil {
+		t.Fatal("Cannot tag image: ", err)
+	}
+	if err := im.PushImage(ctx, "registry.example.com/app:1.0"); err != nil || !reflect.DeepEqual(cm.Pushes, []string{"registry.example.com/app:1.0"}) {
+		t.Fatal("Cannot push image: ", err)
+	}
+
+	images, _ := im.ListImages(ctx, contman.ImageFilter{Reference: "registry.example.com/*"})
+	if len(images) != 1 || images[0].ID != result.ImageID || len(images[0].Tags) != 2 {
+		t.Errorf("Unexpected images: %+v", images)
+	}
+	if err := im.RemoveImage(ctx, "app:rc", false); err != nil {
+		t.Fatal("Cannot untag image: ", err)
+	}
+	pruned, err := im.PruneImages(ctx, contman.ImageFilter{})
+	if err != nil || !reflect.DeepEqual(pruned, []string{result.ImageID}) {
+		t.Errorf("Unexpected pruned images: %v, %v", pruned, err)
+	}
+}
+
+func TestRunReceiptSteps(t *testing.T) {
+	cm := newTestManager()
+	cm.OnExec("lint", contmantest.Behavior{ExitCode: 1})
+	cm.OnExec("test", contmantest.Behavior{ExitCode: 3})
+
+	result, err := contman.RunReceipt(cm, contman.Receipt{
+		Image: "alpine:latest",
+		Steps: []contman.Step{
+			{Name: "build", Cmd: "build", Env: map[string]string{"GOOS": "linux"}},
+			{Name: "lint", Cmd: "lint", ContinueOnError: true},
+			{Name: "test", Cmd: "test"},
+			{Name: "package", Cmd: "package"},
+		},
+	})
+
+	stepErr, ok := err.(*contman.StepError)
+	if !ok {
+		t.Fatal("Expected step error, got: ", err)
+	}
+	if stepErr.Index != 2 || stepErr.ExitCode != 3 {
+		t.Errorf("Unexpected step error: %v", stepErr)
+	}
+	var exitErr *contman.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 3 || result.ExitCode != 3 {
+		t.Errorf("Unexpected exit error: %v, exit code %d", exitErr, result.ExitCode)
+	}
+	if len(result.Steps) != 3 || result.Steps[1].ExitCode != 1 {
+		t.Errorf("Unexpected step results: %+v", result.Steps)
+	}
+
+	execs := cm.Containers()[0].Execs()
+	if len(execs) != 3 || execs[0].Env["GOOS"] != "linux" {
+		t.Errorf("Unexpected execs: %+v", execs)
+	}
+}
+
+func TestRunReceiptStepsContinued(t *testing.T) {
+	cm := newTestManager()
+	cm.OnExec("lint", contmantest.Behavior{ExitCode: 1})
+
+	result, err := contman.RunReceipt(cm, contman.Receipt{
+		Image: "alpine:latest",
+		Steps: []contman.Step{
+			{Name: "lint", Cmd: "lint", ContinueOnError: true},
+			{Name: "test", Cmd: "test"},
+		},
+	})
+	if err != nil || result.ExitCode != 0 {
+		t.Errorf("Continued step failed the run: %v, exit code %d", err, result.ExitCode)
+	}
+}
+
+func TestRunReceiptCopyPolicies(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	cm := newTestManager()
+	cm.OnCmd("", contmantest.Behavior{
+		Files: map[string]string{
+			"/reports/a.xml": "a",
+			"/reports/b.xml": "b",
+			"/reports/c.txt": "c",
+		},
+	})
+
+	receipt := contman.Receipt{
+		Image:      "alpine:latest",
+		Cmd:        "test",
+		InputCopy:  map[string]string{"missing": "/"},
+		OutputCopy: map[string]string{"/reports/*.xml": "reports", "/coverage": "."},
+		HostDir:    dir,
+	}
+
+	_, err := contman.RunReceipt(cm, receipt)
+	if errs, ok := err.(contman.CopyErrors); !ok || len(errs) != 1 || errs[0].Src != "missing" {
+		t.Fatal("Expected error for missing input, got: ", err)
+	}
+
+	receipt.InputPolicy = map[string]contman.CopyPolicy{"missing": contman.CopyOptional}
+	result, err := contman.RunReceipt(cm, receipt)
+	errs, ok := err.(contman.CopyErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatal("Expected errors for required outputs, got: ", err)
+	}
+	if !result.InputCopy[0].Skipped {
+		t.Error("Missing optional input was not skipped")
+	}
+	if !errors.Is(errs[0].Err, contman.ErrNotFound) || !errors.Is(errs[1].Err, contman.ErrNotFound) {
+		t.Error("Unexpected copy errors: ", errs)
+	}
+
+	receipt.OutputPolicy = map[string]contman.CopyPolicy{
+		"/reports/*.xml": contman.CopyGlob,
+		"/coverage":      contman.CopyOptional,
+	}
+	result, err = contman.RunReceipt(cm, receipt)
+	if err != nil {
+		t.Fatal("Cannot run receipt: ", err)
+	}
+	if len(result.OutputCopy) != 3 || !result.OutputCopy[0].Skipped {
+		t.Errorf("Unexpected output statuses: %+v", result.OutputCopy)
+	}
+	for _, name := range []string{"a.xml", "b.xml"} {
+		if _, err := os.Stat(filepath.Join(dir, "reports", name)); err != nil {
+			t.Error("Glob output was not copied: ", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "reports", "c.txt")); !os.IsNotExist(err) {
+		t.Error("Output not matching glob was copied")
+	}
+}
+
+func TestRunReceiptTimeout(t *testing.T) {
+	cm := newTestManager()
+	cm.OnCmd("sleep", contmantest.Behavior{Duration: -1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := contman.RunReceiptContext(ctx, cm, contman.Receipt{Image: "alpine:latest", Cmd: "sleep"})
+	timeoutErr, ok := err.(*contman.TimeoutError)
+	if !ok || timeoutErr.Phase != contman.PhaseRun || timeoutErr.Err != context.Canceled {
+		t.Fatal("Expected cancellation during run, got: ", err)
+	}
+	if cntr := cm.Containers()[0]; cntr.State() != contmantest.Removed || cntr.ExitCode() != contmantest.StoppedExitCode {
+		t.Errorf("Container %s was not stopped and removed", cntr.ID())
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	_, err = contman.RunReceiptContext(ctx, cm, contman.Receipt{Image: "alpine:latest", Cmd: "sleep"})
+	if timeoutErr, ok := err.(*contman.TimeoutError); !ok || timeoutErr.Phase != contman.PhasePull {
+		t.Fatal("Expected timeout during pull, got: ", err)
+	}
+}
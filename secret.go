@@ -0,0 +1,108 @@
+package contman
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/elemir/contman/internal/names"
+)
+
+// SecretsDir is the container directory secrets are mounted into
+const SecretsDir = "/run/secrets"
+
+// Secret is a source of secret value, exactly one of its fields is set
+type Secret struct {
+	// File is a host path, relative one is resolved against HostDir
+	File string `receipt:"file"`
+	Env  string `receipt:"env"`
+	// Provider is a key looked up in SecretProvider of the receipt
+	Provider string `receipt:"provider"`
+}
+
+// SecretProvider fetches secrets from an external store such as a vault
+type SecretProvider interface {
+	GetSecret(ctx context.Context, key string) ([]byte, error)
+}
+
+// SecretProviderFunc is a function implementing SecretProvider
+type SecretProviderFunc func(ctx context.Context, key string) ([]byte, error)
+
+func (f SecretProviderFunc) GetSecret(ctx context.Context, key string) ([]byte, error) {
+	return f(ctx, key)
+}
+
+// sources returns number of fields of the secret which are set
+func (s Secret) sources() int {
+	n := 0
+	for _, source := range []string{s.File, s.Env, s.Provider} {
+		if source != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func readSecret(ctx context.Context, secret Secret, dir string, provider SecretProvider) ([]byte, error) {
+	if secret.sources() > 1 {
+		return nil, fmt.Errorf("secret has more than one source")
+	}
+	switch {
+	case secret.File != "":
+		return ioutil.ReadFile(hostPath(dir, secret.File))
+	case secret.Env != "":
+		value, ok := os.LookupEnv(secret.Env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s: %w", secret.Env, ErrNotFound)
+		}
+		return []byte(value), nil
+	case secret.Provider != "":
+		if provider == nil {
+			return nil, fmt.Errorf("receipt has no secret provider")
+		}
+		return provider.GetSecret(ctx, secret.Provider)
+	}
+	return nil, fmt.Errorf("secret has no source")
+}
+
+// readSecrets reads values of secrets
+func readSecrets(ctx context.Context, secrets map[string]Secret, dir string, provider SecretProvider) (map[string][]byte, error) {
+	values := map[string][]byte{}
+	for _, name := range sortedSecrets(secrets) {
+		if err := names.Check("secret", name); err != nil {
+			return nil, err
+		}
+		value, err := readSecret(ctx, secrets[name], dir, provider)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", name, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// redactedValues returns values of secrets to redact from output. Values
+// are trimmed of trailing whitespace, e.g. newline ending a secret file,
+// which is rarely printed along with them.
+func redactedValues(secrets map[string][]byte) [][]byte {
+	var values [][]byte
+	for _, value := range secrets {
+		if trimmed := bytes.TrimRight(value, " \t\r\n"); len(trimmed) > 0 {
+			value = trimmed
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+func sortedSecrets(secrets map[string]Secret) []string {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}